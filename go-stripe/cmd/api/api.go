@@ -4,8 +4,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"myapp/internal/audit"
+	"myapp/internal/cards"
 	"myapp/internal/driver"
+	"myapp/internal/events"
+	"myapp/internal/lockout"
 	"myapp/internal/models"
+	"myapp/internal/passwords"
+	"myapp/internal/pricing"
+	"myapp/internal/ratelimit"
+	"myapp/internal/twofactor"
 	"net/http"
 	"os"
 	"time"
@@ -19,9 +27,11 @@ type config struct {
 	db   struct {
 		dsn string
 	}
-	stripe struct {
-		secret string
-		key    string
+	gateway string
+	stripe  struct {
+		secret        string
+		key           string
+		webhookSecret string
 	}
 	smtp struct {
 		host     string
@@ -29,16 +39,40 @@ type config struct {
 		username string
 		password string
 	}
-	secretkey string // to sign URLs
-	frontend  string
+	secretkey        string // to sign URLs
+	frontend         string
+	reservationTTL   time.Duration
+	reservationLimit int
+	lockout          string
+	ratelimit        string
+	passwords        struct {
+		minLength int
+		history   int
+		banned    string
+		breached  string
+	}
+	events struct {
+		url    string
+		secret string
+	}
 }
 
 type application struct {
-	config   config
-	infoLog  *log.Logger
-	errorLog *log.Logger
-	version  string
-	DB       models.DBModel
+	config        config
+	infoLog       *log.Logger
+	errorLog      *log.Logger
+	version       string
+	DB            models.Repository
+	Gateway       cards.PaymentGateway
+	Pricing       *pricing.Service
+	Auditor       *audit.Auditor
+	TwoFactor     *twofactor.Service
+	LoginAttempts models.LoginAttemptRepository
+	Lockout       *lockout.Guard
+	RateLimits    models.RateLimitRepository
+	Limiter       *ratelimit.Limiter
+	Passwords     *passwords.Checker
+	Events        *events.Publisher
 }
 
 func (app *application) serve() error {
@@ -68,14 +102,26 @@ func main() {
 	flag.StringVar(&cfg.smtp.username, "smtpusername", "a0e5ee79037570", "Username for smtp server")
 	flag.StringVar(&cfg.smtp.password, "smtppassword", "87d6f0e74a890a", "Password for smtp server")
 
+	flag.StringVar(&cfg.gateway, "gateway", "stripe", "Payment gateway (stripe|fake)")
 	flag.StringVar(&cfg.secretkey, "secret", "x6Z2c9H5F1B8g7L9A3p7D1W8k2E6h3R9", "Secret Key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "URL to frontend")
+	flag.DurationVar(&cfg.reservationTTL, "reservation-ttl", 15*time.Minute, "How long stock is held for an unpaid payment intent")
+	flag.IntVar(&cfg.reservationLimit, "reservation-limit", 2*pricing.MaxQuantity, "Most widgets one client can hold in unpaid payment intents")
+	flag.StringVar(&cfg.lockout, "lockout", "database", "Where failed logins are counted (database|memory)")
+	flag.StringVar(&cfg.ratelimit, "ratelimit", "database", "Where rate limits are counted (database|memory)")
+	flag.IntVar(&cfg.passwords.minLength, "password-min-length", passwords.DefaultPolicy.MinLength, "Fewest characters a password may have")
+	flag.IntVar(&cfg.passwords.history, "password-history", passwords.DefaultPolicy.History, "How many previous passwords users may not use again")
+	flag.StringVar(&cfg.passwords.banned, "banned-passwords", "", "File of banned passwords, one per line")
+	flag.StringVar(&cfg.passwords.breached, "breached-passwords", "", "File of SHA-1 hashes of breached passwords, whole or in k-anonymity ranges")
+	flag.StringVar(&cfg.events.url, "events-url", "http://localhost:4000/internal/events", "URL of the web server to post events to")
+	flag.StringVar(&cfg.events.secret, "internal-secret", "", "Secret shared with the web server for posting events; events are not posted without it")
 
 	flag.Parse()
 
 	// Retrieve stripe key and secret from environment variables
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhookSecret = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	// Set up logging
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
@@ -89,14 +135,102 @@ func main() {
 	// Close connection when main() exits
 	defer conn.Close()
 
+	// Choose payment gateway
+	var gateway cards.PaymentGateway
+	switch cfg.gateway {
+	case "stripe":
+		gateway = cards.NewStripeGateway(cfg.stripe.secret)
+	case "fake":
+		gateway = cards.NewFakeGateway()
+	default:
+		errorLog.Fatalf("unknown payment gateway %q", cfg.gateway)
+	}
+
 	// Initialize a new instance of application containing the config struct
 	app := &application{
 		config:   cfg,
 		infoLog:  infoLog,
 		errorLog: errorLog,
 		version:  version,
-		DB:       models.DBModel{DB: conn},
+		DB:       &models.DBModel{DB: conn},
+		Gateway:  gateway,
+		Auditor:  audit.New(),
+	}
+	app.Pricing = pricing.New(app.DB)
+	app.TwoFactor = twofactor.New(app.DB, []byte(cfg.secretkey))
+
+	// Failed logins are counted in the database so the web server and every api server
+	// see the same counts
+	switch cfg.lockout {
+	case "database":
+		app.LoginAttempts = app.DB
+	case "memory":
+		app.LoginAttempts = lockout.NewMemoryStore()
+	default:
+		errorLog.Fatalf("unknown lockout store %q", cfg.lockout)
+	}
+	app.Lockout = lockout.New(app.LoginAttempts)
+
+	// Rate limits are shared the same way
+	switch cfg.ratelimit {
+	case "database":
+		app.RateLimits = app.DB
+	case "memory":
+		app.RateLimits = ratelimit.NewMemoryStore()
+	default:
+		errorLog.Fatalf("unknown rate limit store %q", cfg.ratelimit)
+	}
+	app.Limiter = ratelimit.New(app.RateLimits, errorLog)
+
+	// Password rules, with the optional lists of banned and breached passwords
+	policy := passwords.DefaultPolicy
+	policy.MinLength = cfg.passwords.minLength
+	policy.History = cfg.passwords.history
+	if cfg.passwords.banned != "" {
+		policy.Banned, err = passwords.LoadBannedList(cfg.passwords.banned)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+	if cfg.passwords.breached != "" {
+		policy.Breaches, err = passwords.LoadBreachList(cfg.passwords.breached)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("Loaded %d breached password hashes", policy.Breaches.Len())
 	}
+	app.Passwords = passwords.New(app.DB, policy)
+
+	// Events for the live admin pages are posted to the web server
+	if cfg.events.secret != "" {
+		app.Events = events.NewPublisher(cfg.events.url, cfg.events.secret)
+	} else {
+		infoLog.Println("No internal secret, so events are not posted to the web server")
+	}
+
+	// Fake subscriptions cost what their widgets do, so plan changes are prorated
+	if fake, ok := gateway.(*cards.FakeGateway); ok {
+		fake.SetPlanPrices(func(plan string) (int64, error) {
+			widget, err := app.DB.GetWidgetByPlanID(plan)
+			return int64(widget.Price), err
+		})
+	}
+
+	// Give back stock held by checkouts that were never paid
+	go app.releaseExpiredReservations(time.Minute)
+
+	// Forget devices whose tokens have expired
+	go app.deleteExpiredTokens(time.Hour)
+
+	// Forget password reset links that can no longer be used
+	go app.deletePasswordResets(time.Hour)
+
+	// Tell users when their account is locked out, and forget old failed logins
+	go app.notifyLockouts(30 * time.Second)
+	go app.deleteStaleLoginAttempts(time.Hour)
+
+	// Forget rate limits of clients that have not been seen for a while
+	go app.deleteIdleRateLimitBuckets(time.Hour)
 
 	err = app.serve()
 	if err != nil {
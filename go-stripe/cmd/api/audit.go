@@ -0,0 +1,62 @@
+package main
+
+import (
+	"myapp/internal/audit"
+	"myapp/internal/models"
+	"net/http"
+)
+
+// recordAudit records an action made by the user of the request. tx should be the
+// transaction making the change, so that one is never kept without the other.
+func (app *application) recordAudit(tx models.Repository, r *http.Request, action string, entity audit.Entity, before, after interface{}) error {
+	var userID int
+	if user := app.userFromContext(r); user != nil {
+		userID = user.ID
+	}
+
+	return app.Auditor.Record(tx, audit.ActorFromRequest(r, userID), action, entity, before, after)
+}
+
+// AuditLog returns a page of the audit log, newest first, narrowed down by the filter sent
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize    int `json:"page_size"`
+		CurrentPage int `json:"current_page"`
+		models.AuditFilter
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.PageSize < 1 || payload.PageSize > 100 {
+		payload.PageSize = 25
+	}
+	if payload.CurrentPage < 1 {
+		payload.CurrentPage = 1
+	}
+
+	events, lastPage, numRecords, err := app.DB.GetAuditEventsPaginated(payload.AuditFilter, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var res struct {
+		CurrentPage  int                  `json:"current_page"`
+		PageSize     int                  `json:"page_size"`
+		LastPage     int                  `json:"last_page"`
+		TotalRecords int                  `json:"total_records"`
+		Events       []*models.AuditEvent `json:"events"`
+	}
+
+	res.CurrentPage = payload.CurrentPage
+	res.PageSize = payload.PageSize
+	res.LastPage = lastPage
+	res.TotalRecords = numRecords
+	res.Events = events
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"myapp/internal/cart"
+	"myapp/internal/models"
+	"myapp/internal/pricing"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// cartResponse is a cart with its total, as sent to clients
+type cartResponse struct {
+	Token    string            `json:"token"`
+	Items    []models.CartItem `json:"items"`
+	Count    int               `json:"count"`
+	Amount   int               `json:"amount"`
+	Currency string            `json:"currency"`
+}
+
+// cartItemPayload is the body of requests that add or update cart items
+type cartItemPayload struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// CreateCart creates an empty cart. The returned token is the only way to reach the cart,
+// so clients keep it and pass it to the other cart endpoints and to /api/payment-intent.
+func (app *application) CreateCart(w http.ResponseWriter, r *http.Request) {
+	c, err := app.DB.CreateCart()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sendCart(w, r, http.StatusCreated, c)
+}
+
+// GetCart returns a cart and its total
+func (app *application) GetCart(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.cartFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	app.sendCart(w, r, http.StatusOK, c)
+}
+
+// AddCartItem adds a widget to a cart, or adds to its quantity when it is already there
+func (app *application) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.cartFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	var payload cartItemPayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if payload.Quantity == 0 {
+		payload.Quantity = 1
+	}
+
+	widget, err := app.DB.GetWidget(payload.WidgetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("no such widget"))
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if widget.IsRecurring {
+		app.badRequest(w, r, pricing.ErrRecurring)
+		return
+	}
+
+	items := c.CartItems()
+	err = items.Add(payload.WidgetID, payload.Quantity)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.saveCart(w, r, c, items)
+}
+
+// UpdateCartItem sets the quantity of a widget in a cart. A quantity of 0 removes it.
+func (app *application) UpdateCartItem(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.cartFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "widgetID"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("invalid widget id"))
+		return
+	}
+
+	var payload cartItemPayload
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	items := c.CartItems()
+	err = items.Update(widgetID, payload.Quantity)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.saveCart(w, r, c, items)
+}
+
+// RemoveCartItem takes a widget out of a cart
+func (app *application) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	c, ok := app.cartFromURL(w, r)
+	if !ok {
+		return
+	}
+
+	widgetID, err := strconv.Atoi(chi.URLParam(r, "widgetID"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("invalid widget id"))
+		return
+	}
+
+	items := c.CartItems()
+	err = items.Remove(widgetID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.saveCart(w, r, c, items)
+}
+
+// cartFromURL loads the cart named by the token URL parameter. It writes the error response
+// and returns false when there is no such cart.
+func (app *application) cartFromURL(w http.ResponseWriter, r *http.Request) (*models.Cart, bool) {
+	c, err := app.DB.GetCartByToken(chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such cart"})
+		return nil, false
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return c, true
+}
+
+// saveCart stores the new items of c and sends the updated cart
+func (app *application) saveCart(w http.ResponseWriter, r *http.Request, c *models.Cart, items cart.Cart) {
+	err := app.DB.SetCartItems(c.ID, items.Items)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	c, err = app.DB.GetCartByToken(c.Token)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.sendCart(w, r, http.StatusOK, c)
+}
+
+// sendCart writes a cart with its total, priced from the current widget prices
+func (app *application) sendCart(w http.ResponseWriter, r *http.Request, status int, c *models.Cart) {
+	resp := cartResponse{
+		Token:    c.Token,
+		Items:    c.Items,
+		Currency: pricing.DefaultCurrency,
+	}
+	if resp.Items == nil {
+		resp.Items = []models.CartItem{}
+	}
+
+	for _, item := range c.Items {
+		resp.Count += item.Quantity
+		resp.Amount += item.Widget.Price * item.Quantity
+	}
+
+	err := app.writeJSON(w, status, resp)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"myapp/internal/events"
+	"myapp/internal/models"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// publish posts an event to the web server in the background, so the request that caused
+// it does not wait. Events that cannot be posted are logged and dropped; the pages that
+// show them are only out of date until they are reloaded.
+func (app *application) publish(eventType string, data interface{}) {
+	if app.Events == nil {
+		return
+	}
+
+	e, err := events.New(eventType, data)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := app.Events.Publish(ctx, e)
+		if err != nil {
+			app.errorLog.Println(err)
+		}
+	}()
+}
+
+// publishSale tells the web server about a sale
+func (app *application) publishSale(checkout models.Checkout, txn models.Transaction) {
+	app.publish(events.SaleCreated, events.Sale{
+		OrderID:       checkout.OrderID,
+		TransactionID: checkout.TransactionID,
+		Amount:        txn.Amount,
+		Currency:      txn.Currency,
+	})
+}
+
+// publishCancellation tells the web server that a subscription was cancelled, now or at
+// the end of its period
+func (app *application) publishCancellation(stripeSubscription *stripe.Subscription) {
+	app.publish(events.SubscriptionCancelled, events.Subscription{
+		StripeSubscriptionID: stripeSubscription.ID,
+		Status:               string(stripeSubscription.Status),
+		CancelAtPeriodEnd:    stripeSubscription.CancelAtPeriodEnd,
+	})
+}
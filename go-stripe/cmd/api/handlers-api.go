@@ -1,36 +1,44 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"myapp/internal/cards"
+	"myapp/internal/audit"
+	"myapp/internal/cart"
+	"myapp/internal/clientip"
 	"myapp/internal/encryption"
+	"myapp/internal/events"
 	"myapp/internal/models"
+	"myapp/internal/pricing"
 	"myapp/internal/urlsigner"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stripe/stripe-go/v72"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email         string `json:"email"`
-	CardBrand     string `json:"card_brand"`
-	ExpiryMonth   int    `json:"expiry_month"`
-	ExpiryYear    int    `json:"expiry_year"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
+	Currency      string      `json:"currency"`
+	Amount        string      `json:"amount"`
+	PaymentMethod string      `json:"payment_method"`
+	Email         string      `json:"email"`
+	CardBrand     string      `json:"card_brand"`
+	ExpiryMonth   int         `json:"expiry_month"`
+	ExpiryYear    int         `json:"expiry_year"`
+	LastFour      string      `json:"last_four"`
+	Plan          string      `json:"plan"`
+	ProductID     string      `json:"product_id"`
+	Quantity      int         `json:"quantity"`
+	Items         []cart.Item `json:"items"`
+	CartToken     string      `json:"cart_token"`
+	FirstName     string      `json:"first_name"`
+	LastName      string      `json:"last_name"`
 }
 
 type jsonResponse struct {
@@ -44,30 +52,172 @@ func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request)
 
 	var payload stripePayload
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	// The order is a stored cart, a list of items, or quantity of a single product
+	var order cart.Cart
+	switch {
+	case payload.CartToken != "":
+		c, err := app.DB.GetCartByToken(payload.CartToken)
+		if errors.Is(err, sql.ErrNoRows) {
+			app.badRequest(w, r, errors.New("no such cart"))
+			return
+		}
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		order = c.CartItems()
+
+	case len(payload.Items) > 0:
+		for _, item := range payload.Items {
+			if err := order.Add(item.WidgetID, item.Quantity); err != nil {
+				app.badRequest(w, r, err)
+				return
+			}
+		}
+
+	default:
+		widgetID, err := strconv.Atoi(payload.ProductID)
+		if err != nil {
+			app.badRequest(w, r, errors.New("invalid product_id"))
+			return
+		}
+
+		quantity := payload.Quantity
+		if quantity == 0 {
+			quantity = 1
+		}
+
+		order.Items = []cart.Item{{WidgetID: widgetID, Quantity: quantity}}
+	}
+
+	// The amount charged always comes from the widget prices
+	quote, err := app.Pricing.QuoteItems(order.Items)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("no such widget"))
+		return
+	}
+	if errors.Is(err, pricing.ErrInvalidQuantity) || errors.Is(err, pricing.ErrRecurring) || errors.Is(err, pricing.ErrEmptyOrder) {
+		app.badRequest(w, r, err)
+		return
+	}
 	if err != nil {
-		app.errorLog.Println(err)
+		app.serverError(w, r, err)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	// An amount sent by the browser must match what we are about to charge
+	if payload.Amount != "" {
+		amount, err := strconv.Atoi(payload.Amount)
+		if err != nil {
+			app.badRequest(w, r, errors.New("invalid amount"))
+			return
+		}
+		if err := quote.Check(amount, payload.Currency); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
 	}
 
-	okay := true
+	// Anyone can hold stock without paying for it, so each client can only hold so much at
+	// a time. Concurrent requests from a client may go a little over, as far as the rate
+	// limit lets them.
+	client := clientip.FromRequest(r)
+	held, err := app.DB.ReservedBy(client)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	for _, line := range quote.Lines {
+		held += line.Quantity
+	}
+	if held > app.config.reservationLimit {
+		msg := "Too many checkouts are in progress. Please finish one or try again later."
+		app.writeJSON(w, http.StatusTooManyRequests, jsonResponse{OK: false, Message: msg})
+		return
+	}
 
-	pi, msg, err := card.Charge(payload.Currency, amount)
+	// Hold the stock until the payment intent is paid or the reservations expire
+	var reservations []int
+	for _, line := range quote.Lines {
+		reservationID, err := app.DB.ReserveWidget(line.Widget.ID, line.Quantity, client, app.config.reservationTTL)
+		if err != nil {
+			app.releaseReservations(reservations)
+			if errors.Is(err, models.ErrOutOfStock) {
+				msg := fmt.Sprintf("Sorry, %s is out of stock.", line.Widget.Name)
+				app.writeJSON(w, http.StatusConflict, jsonResponse{OK: false, Message: msg})
+				return
+			}
+			app.serverError(w, r, err)
+			return
+		}
+		reservations = append(reservations, reservationID)
+	}
+
+	metadata := cart.Metadata(order.Items)
+	if payload.CartToken != "" {
+		metadata["cart_token"] = payload.CartToken
+	}
+
+	pi, msg, err := app.Gateway.CreatePaymentIntent(quote.Currency, quote.Amount, metadata)
 	if err != nil {
-		okay = false
+		app.releaseReservations(reservations)
+	} else {
+		for _, id := range reservations {
+			if err := app.DB.AttachReservation(id, pi.ID); err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 	}
 
-	if okay {
+	app.sendPaymentIntent(w, pi, msg)
+}
+
+// releaseReservations gives back the stock held for a checkout that did not go ahead
+func (app *application) releaseReservations(ids []int) {
+	for _, id := range ids {
+		if err := app.DB.ReleaseReservation(id); err != nil {
+			app.errorLog.Println(err)
+		}
+	}
+}
+
+// VirtualTerminalPaymentIntent creates a payment intent for any amount. Only admins can use
+// it; the storefront goes through GetPaymentIntent, which charges the widget price.
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+
+	var payload stripePayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	amount, err := strconv.Atoi(payload.Amount)
+	if err != nil || amount <= 0 {
+		app.badRequest(w, r, errors.New("invalid amount"))
+		return
+	}
+
+	currency := payload.Currency
+	if currency == "" {
+		currency = pricing.DefaultCurrency
+	}
+
+	pi, msg, err := app.Gateway.CreatePaymentIntent(currency, amount, map[string]string{})
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+
+	app.sendPaymentIntent(w, pi, msg)
+}
+
+// sendPaymentIntent writes a newly created payment intent, or msg when pi is nil
+func (app *application) sendPaymentIntent(w http.ResponseWriter, pi *stripe.PaymentIntent, msg string) {
+	if pi != nil {
 		out, err := json.MarshalIndent(pi, "", "\t")
 		if err != nil {
 			app.errorLog.Println(err)
@@ -117,21 +267,47 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 
 	var data stripePayload
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		app.errorLog.Println(err)
+		app.badRequest(w, r, err)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+	productID, err := strconv.Atoi(data.ProductID)
+	if err != nil {
+		app.badRequest(w, r, errors.New("invalid product_id"))
+		return
+	}
+
+	// The plan and the amount come from the widget, not from the browser
+	quote, err := app.Pricing.Quote(productID, 1)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("no such widget"))
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !quote.Widget.IsRecurring {
+		app.badRequest(w, r, errors.New("this widget is not sold as a subscription"))
+		return
+	}
+	if data.Amount != "" {
+		amount, err := strconv.Atoi(data.Amount)
+		if err != nil {
+			app.badRequest(w, r, errors.New("invalid amount"))
+			return
+		}
+		if err := quote.Check(amount, quote.Currency); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
 	}
 
 	okay := true
 	var subscription *stripe.Subscription
 	txnMsg := "Transaction successful"
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	stripeCustomer, msg, err := app.Gateway.CreateCustomer(data.PaymentMethod, data.Email)
 	if err != nil {
 		app.errorLog.Println(err)
 		okay = false
@@ -139,7 +315,7 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	}
 
 	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
+		subscription, err = app.Gateway.SubscribeToPlan(stripeCustomer, quote.Widget.PlanID, data.Email, data.LastFour, "")
 		if err != nil {
 			app.errorLog.Println(err)
 			okay = false
@@ -148,20 +324,23 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	}
 
 	if okay {
-		productID, _ := strconv.Atoi(data.ProductID) // Not handling error here!
+		// Stripe bills the plan price, which should always be the widget price
+		if subscription.Plan != nil && subscription.Plan.Amount != 0 {
+			if err := quote.Check(int(subscription.Plan.Amount), string(subscription.Plan.Currency)); err != nil {
+				app.errorLog.Printf("plan %s does not match widget %d: %s", quote.Widget.PlanID, quote.Widget.ID, err)
+			}
+		}
 
 		// Assume each new transaction is a new customer
-		customerID, err := app.SaveCustomer(data.FirstName, data.LastName, data.Email)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		customer := models.Customer{
+			FirstName: data.FirstName,
+			LastName:  data.LastName,
+			Email:     data.Email,
 		}
 
-		// Create new transaction
-		amount, _ := strconv.Atoi(data.Amount)
 		txn := models.Transaction{
-			Amount:              amount,
-			Currency:            "cad",
+			Amount:              quote.Amount,
+			Currency:            quote.Currency,
 			LastFour:            data.LastFour,
 			ExpiryMonth:         data.ExpiryMonth,
 			ExpiryYear:          data.ExpiryYear,
@@ -169,30 +348,34 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 			PaymentIntent:       subscription.ID,
 			PaymentMethod:       data.PaymentMethod,
 		}
-
-		txnId, err := app.SaveTransaction(txn)
-		if err != nil {
-			app.errorLog.Println(err)
-			return
+		if subscription.LatestInvoice != nil {
+			txn.StripePaymentID = subscription.LatestInvoice.ID
 		}
 
-		// Create order
 		order := models.Order{
-			WidgetID:      productID,
-			TransactionID: txnId,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
+			WidgetID:  productID,
+			StatusID:  1,
+			Quantity:  quote.Quantity,
+			Amount:    quote.Amount,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
 		}
 
-		_, err = app.SaveOrder(order)
-		if err != nil {
-			app.errorLog.Println(err)
+		// The Stripe webhook may have recorded the first invoice, and the subscription,
+		// already
+		checkout, err := app.DB.CreateCheckout(r.Context(), customer, txn, order)
+		if err != nil && !errors.Is(err, models.ErrPaymentRecorded) {
+			app.serverError(w, r, err)
 			return
 		}
+		if err == nil {
+			app.publishSale(checkout, txn)
+
+			err = app.recordSubscription(app.DB, subscription, quote.Widget.ID, checkout.CustomerID)
+			if err != nil {
+				app.errorLog.Println(err)
+			}
+		}
 	}
 
 	resp := jsonResponse{
@@ -210,48 +393,14 @@ func (app *application) CreateCustomerAndSubscribeToPlan(w http.ResponseWriter,
 	w.Write(out)
 }
 
-// SaveCustomer saves a customer to the database and returns the ID
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// SaveTransaction saves a transaction to the database and returns the ID
-func (app *application) SaveTransaction(transaction models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(transaction)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// SaveOrder saves an order to the database and returns the ID
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 // CreateAuthToken creates a new auth token for a user
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
 
 	var userInput struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
+		Code       string `json:"code"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -260,10 +409,16 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Refuse accounts and addresses with too many failed logins
+	if !app.checkLoginAllowed(w, r, userInput.Email) {
+		return
+	}
+
 	// Get user from database
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 
 	if err != nil {
+		app.loginFailed(r, userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
@@ -271,59 +426,86 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	// Validate password
 	validPassword, err := app.passwordMatches(user.Password, userInput.Password)
 	if err != nil || !validPassword {
+		app.loginFailed(r, userInput.Email)
 		app.invalidCredentials(w)
 		return
 	}
 
-	// Generate token
-	token, err := models.GenerateToken(int64(user.ID), 24*time.Hour, models.ScopeAuthentication)
+	if user.Disabled() {
+		app.accountDisabled(w)
+		return
+	}
+
+	// Users with two-factor authentication also need a code before they get a token
+	if user.TwoFactor {
+		if userInput.Code == "" {
+			app.twoFactorRequired(w)
+			return
+		}
+
+		validCode, err := app.TwoFactor.Verify(user.ID, userInput.Code)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+		if !validCode {
+			app.loginFailed(r, userInput.Email)
+			app.invalidCredentials(w)
+			return
+		}
+	}
+
+	app.loginSucceeded(userInput.Email)
+
+	// Generate tokens
+	token, refreshToken, err := models.GenerateTokenPair(int64(user.ID), deviceName(userInput.DeviceName, r), accessTokenTTL, refreshTokenTTL)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// Save token to database
-	err = app.DB.InsertToken(token, user)
+	// Save tokens to database
+	err = app.DB.InsertTokenPair(token, refreshToken, user)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
 	// Send Response
-
-	var payload struct {
-		Error   bool          `json:"error"`
-		Message string        `json:"message"`
-		Token   *models.Token `json:"authentication_token"`
-	}
-
-	payload.Error = false
-	payload.Message = fmt.Sprintf("Token for user %s created", user.Email)
-	payload.Token = token
-
-	_ = app.writeJSON(w, http.StatusOK, payload)
+	app.writeTokens(w, fmt.Sprintf("Token for user %s created", user.Email), token, refreshToken)
 }
 
-// authenticateToken authenticates a token and returns the user
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+// bearerToken returns the token in the Authorization header of a request
+func (app *application) bearerToken(r *http.Request) (string, error) {
 
 	authorizationHeader := r.Header.Get("Authorization")
 	if authorizationHeader == "" {
-		return nil, errors.New("no authorization header")
+		return "", errors.New("no authorization header")
 	}
 
 	headerParts := strings.Split(authorizationHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header")
+		return "", errors.New("no authorization header")
 	}
 
 	token := headerParts[1]
 	if len(token) != 26 {
-		return nil, errors.New("invalid token")
+		return "", errors.New("invalid token")
+	}
+
+	return token, nil
+}
+
+// authenticateToken authenticates a token and returns the user. Only unexpired tokens
+// with the authentication scope are accepted.
+func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+	token, err := app.bearerToken(r)
+	if err != nil {
+		return nil, err
 	}
 
 	// Get user from tokens table
-	user, err := app.DB.GetUserForToken(token)
+	user, err := app.DB.GetUserForToken(token, models.ScopeAuthentication)
 	if err != nil {
 		return nil, errors.New("no user found")
 	}
@@ -341,13 +523,23 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	permissions, err := app.DB.GetUserPermissions(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
 	// Valid User
 	var payload struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+		Error       bool     `json:"error"`
+		Message     string   `json:"message"`
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
 	}
 	payload.Error = false
 	payload.Message = fmt.Sprintf("User %s is authenticated", user.Email)
+	payload.Role = user.Role
+	payload.Permissions = permissions
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
@@ -375,27 +567,32 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		app.badRequest(w, r, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status))
+		return
+	}
+
+	// Record what was actually charged, not what the browser says
+	txnData.PaymentAmount = int(pi.Amount)
+	txnData.PaymentCurrency = pi.Currency
 	txnData.LastFour = pm.Card.Last4
 	txnData.ExpiryMonth = int(pm.Card.ExpMonth)
 	txnData.ExpiryYear = int(pm.Card.ExpYear)
-	txnData.BankReturnCode = pi.Charges.Data[0].ID
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		txnData.BankReturnCode = pi.Charges.Data[0].ID
+	}
 
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
@@ -407,9 +604,25 @@ func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r
 		TransactionStatusID: 2,
 		PaymentIntent:       txnData.PaymentIntent,
 		PaymentMethod:       txnData.PaymentMethod,
+		StripePaymentID:     pi.ID,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		var err error
+		txn.ID, err = tx.InsertTransaction(txn)
+		if errors.Is(err, models.ErrPaymentRecorded) {
+			// The Stripe webhook recorded the payment first; the charge is still audited
+			recorded, err := tx.GetTransactionByPaymentIntent(pi.ID)
+			if err != nil {
+				return err
+			}
+			txn.ID = recorded.ID
+		} else if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionVirtualTerminalCharge, audit.NewEntity(audit.EntityTransaction, txn.ID), nil, txn)
+	})
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -436,7 +649,7 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 	}
 
 	// Get user from database
-	_, err = app.DB.GetUserByEmail(payload.Email)
+	user, err := app.DB.GetUserByEmail(payload.Email)
 	if err != nil {
 		res.Error = true
 		res.Message = "No matching user found in our system"
@@ -444,9 +657,17 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
+	// Record the link, so that it only works once
+	nonce, err := app.DB.InsertPasswordReset(user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/reset-password?email=%s&nonce=%s", app.config.frontend, url.QueryEscape(payload.Email), nonce)
 	sign := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposePasswordReset,
 	}
 
 	// Sign the link
@@ -477,6 +698,7 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Email    string `json:"email"`
+		Nonce    string `json:"nonce"`
 		Password string `json:"password"`
 	}
 
@@ -508,15 +730,34 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check the new password against the password policy
+	err = app.Passwords.Check(user, payload.Password)
+	if err != nil {
+		app.invalidFields(w, r, err)
+		return
+	}
+
 	// Hash New Password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(payload.Password), 12)
+	hashedPassword, err := app.Passwords.Hash(payload.Password)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// Update password
-	err = app.DB.UpdatePasswordForUser(user, string(hashedPassword))
+	// Use up the link and update the password, remembering it so it cannot be used again
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		err := tx.ConsumePasswordReset(user.ID, payload.Nonce)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdatePasswordForUser(user, hashedPassword)
+		if err != nil {
+			return err
+		}
+
+		return tx.AddPasswordHistory(user.ID, hashedPassword, app.Passwords.Keep())
+	})
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -602,6 +843,8 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		PaymentIntent string `json:"pi"`
 		Amount        int    `json:"amount"`
 		Currency      string `json:"currency"`
+		Reason        string `json:"reason"`
+		Restock       bool   `json:"restock"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -610,41 +853,128 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: Validate amount and currency and other checks
-	// TODO: Assume user is admin
-
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	order, err := app.DB.GetOrderById(chargeToRefund.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such order"})
+		return
 	}
-
-	// Refund charge
-	err = card.RefundPayment(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.serverError(w, r, err)
 		return
 	}
 
-	// Update status database
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, 2)
+	// Auth put the user in the context, so the refund records who made it
+	user := app.userFromContext(r)
+
+	// The order's transaction stays locked from the checks until the refund is recorded, so
+	// concurrent refunds of it wait for each other and never refund more than was paid.
+	// Refused says why a refund was not made; refund is set once the gateway has made it.
+	var refused error
+	var refund *stripe.Refund
+	var remaining int
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		err := tx.LockTransaction(r.Context(), order.TransactionID)
+		if err != nil {
+			return err
+		}
+
+		before := order
+		order, err = tx.GetOrderById(order.ID)
+		if err != nil {
+			return err
+		}
+
+		// The order says what was paid; the client only says how much of it to refund
+		switch {
+		case chargeToRefund.PaymentIntent != "" && chargeToRefund.PaymentIntent != order.Transaction.PaymentIntent:
+			refused = errors.New("payment intent does not match the order")
+		case chargeToRefund.Currency != "" && !strings.EqualFold(chargeToRefund.Currency, order.Transaction.Currency):
+			refused = errors.New("currency does not match the order")
+		case chargeToRefund.Amount <= 0 || chargeToRefund.Amount > order.RefundableAmount:
+			refused = fmt.Errorf("amount must be between 0.01 and %.2f", float64(order.RefundableAmount)/100.0)
+		}
+		if refused != nil {
+			return refused
+		}
+
+		refund, err = app.Gateway.RefundPayment(order.Transaction.PaymentIntent, chargeToRefund.Amount, chargeToRefund.Reason)
+		if err != nil {
+			refused = err
+			return err
+		}
+
+		// Record the refund and update the status of the transaction and order
+		remaining, err = tx.RecordRefund(r.Context(), models.Refund{
+			TransactionID:  order.TransactionID,
+			StripeRefundID: refund.ID,
+			Amount:         chargeToRefund.Amount,
+			Reason:         chargeToRefund.Reason,
+			UserID:         user.ID,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Widgets are put back into stock if asked to, once the whole order is refunded. A
+		// partial refund says how much money goes back but not which widgets, so restocking
+		// part of the order would only be a guess.
+		if chargeToRefund.Restock && remaining == 0 {
+			for _, item := range order.Items {
+				err = tx.RestockWidget(item.WidgetID, item.Quantity)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		refunded, err := tx.GetOrderById(order.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionRefund, audit.NewEntity(audit.EntityOrder, order.ID), before, refunded)
+	})
+	if refused != nil {
+		app.badRequest(w, r, refused)
+		return
+	}
+	if err != nil && refund != nil {
+		// The customer has their money back, so the refund must be recorded by hand, or by
+		// the charge.refunded webhook if Stripe sends one
+		chargeID := order.Transaction.BankReturnCode
+		if refund.Charge != nil {
+			chargeID = refund.Charge.ID
+		}
+		app.serverError(w, r, fmt.Errorf("refund %s of charge %s (order %d) made but not recorded: %w", refund.ID, chargeID, order.ID, err))
+		return
+	}
 	if err != nil {
-		app.badRequest(w, r, errors.New("charge refunded but database not updated"))
+		app.serverError(w, r, err)
 		return
 	}
 
 	var res struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+		Error     bool   `json:"error"`
+		Message   string `json:"message"`
+		Remaining int    `json:"remaining"`
 	}
 
+	app.publish(events.RefundIssued, events.Refund{
+		OrderID:       order.ID,
+		TransactionID: order.TransactionID,
+		Amount:        chargeToRefund.Amount,
+		Remaining:     remaining,
+		Reason:        chargeToRefund.Reason,
+	})
+
 	res.Error = false
 	res.Message = "Charge refunded successfully"
+	res.Remaining = remaining
 
 	_ = app.writeJSON(w, http.StatusOK, res)
 }
 
-// CancelSubscription cancels a subscription
+// CancelSubscription cancels a subscription at the end of the current period
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 
 	var subToCancel struct {
@@ -659,25 +989,20 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
-	}
-
-	// Cancel subscription
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
+	// The customer keeps what they paid for; the order is marked cancelled when Stripe
+	// ends the subscription and sends customer.subscription.deleted
+	subscription, err := app.Gateway.CancelSubscriptionAtPeriodEnd(subToCancel.PaymentIntent)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// Update status database
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, 3)
+	_, err = app.auditedSync(r, audit.ActionSubscriptionCancelAtPeriod, subscription)
 	if err != nil {
 		app.badRequest(w, r, errors.New("subscription cancelled but database not updated"))
 		return
 	}
+	app.publishCancellation(subscription)
 
 	var res struct {
 		Error   bool   `json:"error"`
@@ -685,7 +1010,7 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 	}
 
 	res.Error = false
-	res.Message = "Subscription cancelled successfully"
+	res.Message = "Subscription will be cancelled at the end of the current period"
 
 	_ = app.writeJSON(w, http.StatusOK, res)
 }
@@ -738,35 +1063,104 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 
 	if userID > 0 {
 		// Editing existing user
-		err = app.DB.EditUser(user)
+		existing, err := app.DB.GetOneUser(userID)
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
+		user.ID = userID
 
+		// Keep the role unless a new one was chosen, and never let users change their own,
+		// so the last owner cannot lock everyone out of managing users
+		if user.RoleID == 0 {
+			user.RoleID = existing.RoleID
+		}
+		if user.RoleID != existing.RoleID && userID == app.userFromContext(r).ID {
+			app.badRequest(w, r, errors.New("you cannot change your own role"))
+			return
+		}
+
+		var newHash string
 		if user.Password != "" {
 			// Password changed
-			newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+			err = app.Passwords.Check(user, user.Password)
 			if err != nil {
-				app.badRequest(w, r, err)
+				app.invalidFields(w, r, err)
 				return
 			}
 
-			err = app.DB.UpdatePasswordForUser(user, string(newHash))
+			newHash, err = app.Passwords.Hash(user.Password)
 			if err != nil {
 				app.badRequest(w, r, err)
 				return
 			}
 		}
+
+		err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+			err := tx.EditUser(user)
+			if err != nil {
+				return err
+			}
+
+			if newHash != "" {
+				err = tx.UpdatePasswordForUser(user, newHash)
+				if err != nil {
+					return err
+				}
+
+				err = tx.AddPasswordHistory(userID, newHash, app.Passwords.Keep())
+				if err != nil {
+					return err
+				}
+			}
+
+			edited, err := tx.GetOneUser(userID)
+			if err != nil {
+				return err
+			}
+
+			after := struct {
+				*models.User
+				PasswordChanged bool `json:"password_changed"`
+			}{edited, newHash != ""}
+			return app.recordAudit(tx, r, audit.ActionUserUpdate, audit.NewEntity(audit.EntityUser, userID), existing, after)
+		})
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
 	} else {
 		// Adding new user
-		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+		err = app.Passwords.Check(user, user.Password)
+		if err != nil {
+			app.invalidFields(w, r, err)
+			return
+		}
+
+		newHash, err := app.Passwords.Hash(user.Password)
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
 		}
 
-		err = app.DB.AddUser(user, string(newHash))
+		err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+			id, err := tx.AddUser(user, newHash)
+			if err != nil {
+				return err
+			}
+
+			err = tx.AddPasswordHistory(id, newHash, app.Passwords.Keep())
+			if err != nil {
+				return err
+			}
+
+			added, err := tx.GetOneUser(id)
+			if err != nil {
+				return err
+			}
+
+			return app.recordAudit(tx, r, audit.ActionUserCreate, audit.NewEntity(audit.EntityUser, id), nil, added)
+		})
 		if err != nil {
 			app.badRequest(w, r, err)
 			return
@@ -778,6 +1172,10 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		Message string `json:"message"`
 	}
 
+	if userID > 0 {
+		app.publish(events.UserUpdated, events.User{ID: userID})
+	}
+
 	res.Error = false
 	res.Message = "User updated successfully"
 
@@ -793,7 +1191,24 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteUser(userID)
+	if userID == app.userFromContext(r).ID {
+		app.badRequest(w, r, errors.New("you cannot delete yourself"))
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		deleted, err := tx.GetOneUser(userID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteUser(userID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionUserDelete, audit.NewEntity(audit.EntityUser, userID), deleted, nil)
+	})
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -808,4 +1223,104 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	res.Message = "User deleted successfully"
 
 	_ = app.writeJSON(w, http.StatusOK, res)
-}
\ No newline at end of file
+}
+
+// DisableUser stops a user from logging in, and logs them out of every device and web
+// server session they have
+func (app *application) DisableUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if userID == app.userFromContext(r).ID {
+		app.badRequest(w, r, errors.New("you cannot disable yourself"))
+		return
+	}
+
+	var tokens, sessions int64
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		before, err := tx.GetOneUser(userID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DisableUser(userID)
+		if err != nil {
+			return err
+		}
+
+		tokens, err = tx.DeleteTokensForUser(userID)
+		if err != nil {
+			return err
+		}
+
+		sessions, err = tx.DeleteSessionsForUser(userID)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.GetOneUser(userID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionUserDisable, audit.NewEntity(audit.EntityUser, userID), before, after)
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.publish(events.UserUpdated, events.User{ID: userID})
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: fmt.Sprintf("User disabled and logged out of %d devices and %d sessions", tokens, sessions)})
+}
+
+// EnableUser lets a disabled user log in again
+func (app *application) EnableUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		before, err := tx.GetOneUser(userID)
+		if err != nil {
+			return err
+		}
+
+		err = tx.EnableUser(userID)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.GetOneUser(userID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionUserEnable, audit.NewEntity(audit.EntityUser, userID), before, after)
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.publish(events.UserUpdated, events.User{ID: userID})
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "User enabled"})
+}
+
+// AllRoles returns the roles users can have, with their permissions
+func (app *application) AllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, roles)
+}
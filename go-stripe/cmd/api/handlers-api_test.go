@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/cards"
+	"myapp/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// seedSales adds two widgets sold once and one sold as a subscription, and records a sale
+// of each through CreateCheckout. It returns the IDs of the orders, oldest first.
+func seedSales(t *testing.T, app *application, db *sql.DB) []int {
+	t.Helper()
+
+	seed(t, db,
+		`INSERT INTO statuses (id, name) VALUES (1, 'Cleared'), (2, 'Refunded'), (3, 'Cancelled')`,
+		`INSERT INTO transaction_statuses (id, name) VALUES (1, 'Pending'), (2, 'Cleared')`,
+		`INSERT INTO widgets (id, name, inventory_level, price, slug) VALUES (1, 'Widget', 10, 1000, 'widget')`,
+		`INSERT INTO widgets (id, name, inventory_level, price, slug) VALUES (2, 'Gadget', 10, 2500, 'gadget')`,
+		`INSERT INTO widgets (id, name, inventory_level, price, slug, is_recurring, plan_id) VALUES (3, 'Plan', 0, 2000, 'plan', 1, 'price_1')`,
+	)
+
+	sales := []struct {
+		email string
+		order models.Order
+	}{
+		{"one@example.com", models.Order{StatusID: 1, Amount: 1000, Items: []models.OrderItem{{WidgetID: 1, Quantity: 1, UnitPrice: 1000}}}},
+		{"two@example.com", models.Order{StatusID: 1, Amount: 7000, Items: []models.OrderItem{
+			{WidgetID: 1, Quantity: 2, UnitPrice: 1000},
+			{WidgetID: 2, Quantity: 2, UnitPrice: 2500},
+		}}},
+		{"three@example.com", models.Order{WidgetID: 3, StatusID: 1, Quantity: 1, Amount: 2000}},
+	}
+
+	var ids []int
+	for i, sale := range sales {
+		txn := models.Transaction{
+			Amount:              sale.order.Amount,
+			Currency:            "cad",
+			LastFour:            "4242",
+			PaymentIntent:       fmt.Sprintf("pi_%d", i+1),
+			TransactionStatusID: 2,
+			StripePaymentID:     fmt.Sprintf("pi_%d", i+1),
+		}
+
+		checkout, err := app.DB.CreateCheckout(context.Background(), models.Customer{FirstName: "Pat", LastName: "Buyer", Email: sale.email}, txn, sale.order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, checkout.OrderID)
+
+		// Orders are listed newest first, so they must not share a second
+		seed(t, db, fmt.Sprintf(`UPDATE orders SET created_at = datetime('now', '-%d minutes') WHERE id = %d`, len(sales)-i, checkout.OrderID))
+	}
+
+	return ids
+}
+
+func TestAllSales(t *testing.T) {
+	app, db := newTestApp(t)
+	ids := seedSales(t, app, db)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionViewSales))
+
+	w := request(t, app, http.MethodPost, "/api/admin/all-sales", token, map[string]int{"page_size": 1, "current_page": 1})
+
+	var res struct {
+		CurrentPage  int             `json:"current_page"`
+		LastPage     int             `json:"last_page"`
+		TotalRecords int             `json:"total_records"`
+		Orders       []*models.Order `json:"orders"`
+	}
+	decode(t, w, &res)
+
+	// The subscription is not a sale
+	if res.TotalRecords != 2 || res.LastPage != 2 {
+		t.Errorf("got %d sales on %d pages, want 2 on 2", res.TotalRecords, res.LastPage)
+	}
+	if len(res.Orders) != 1 {
+		t.Fatalf("got %d sales on the page, want 1", len(res.Orders))
+	}
+
+	sale := res.Orders[0]
+	if sale.ID != ids[1] {
+		t.Errorf("first sale is order %d, want the newest, %d", sale.ID, ids[1])
+	}
+	if sale.Customer.Email != "two@example.com" || sale.Transaction.LastFour != "4242" {
+		t.Errorf("sale has customer %q and card %q", sale.Customer.Email, sale.Transaction.LastFour)
+	}
+	if len(sale.Items) != 2 || sale.Items[1].Widget.Name != "Gadget" {
+		t.Errorf("sale has items %+v, want a Widget and a Gadget", sale.Items)
+	}
+
+	w = request(t, app, http.MethodPost, "/api/admin/all-sales", token, map[string]int{"page_size": 1, "current_page": 2})
+	decode(t, w, &res)
+	if len(res.Orders) != 1 || res.Orders[0].ID != ids[0] {
+		t.Errorf("second page has %+v, want order %d", res.Orders, ids[0])
+	}
+}
+
+func TestAllSalesNeedsPermission(t *testing.T) {
+	app, db := newTestApp(t)
+	seedSales(t, app, db)
+	token := loginToken(t, app, seedUser(t, db, "clerk@example.com", models.PermissionViewUsers))
+
+	w := request(t, app, http.MethodPost, "/api/admin/all-sales", token, map[string]int{"page_size": 10, "current_page": 1})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = request(t, app, http.MethodPost, "/api/admin/all-sales", "", map[string]int{"page_size": 10, "current_page": 1})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestGetSale(t *testing.T) {
+	app, db := newTestApp(t)
+	ids := seedSales(t, app, db)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionViewSales))
+
+	w := request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/get-sale/%d", ids[1]), token, nil)
+
+	var sale models.Order
+	decode(t, w, &sale)
+
+	if sale.ID != ids[1] || sale.Amount != 7000 || sale.Quantity != 4 {
+		t.Errorf("got order %d of %d for %d widgets, want order %d of 7000 for 4", sale.ID, sale.Amount, sale.Quantity, ids[1])
+	}
+	if sale.Transaction.PaymentIntent != "pi_2" {
+		t.Errorf("got payment intent %q, want pi_2", sale.Transaction.PaymentIntent)
+	}
+	if len(sale.History) != 1 || sale.History[0].StatusID != 1 {
+		t.Errorf("got history %+v, want the order cleared", sale.History)
+	}
+	if sale.RefundableAmount != 7000 {
+		t.Errorf("got refundable amount %d, want 7000", sale.RefundableAmount)
+	}
+
+	w = request(t, app, http.MethodPost, "/api/admin/get-sale/999", token, nil)
+
+	var res struct {
+		Error bool `json:"error"`
+	}
+	decode(t, w, &res)
+	if !res.Error {
+		t.Error("got no error for an order that does not exist")
+	}
+}
+
+func TestEditUser(t *testing.T) {
+	app, db := newTestApp(t)
+	adminID := seedUser(t, db, "admin@example.com", models.PermissionManageUsers)
+	userID := seedUser(t, db, "user@example.com")
+	token := loginToken(t, app, adminID)
+
+	var res struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	w := request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/all-users/edit/%d", userID), token, models.User{
+		FirstName: "Renamed",
+		LastName:  "User",
+		Email:     "renamed@example.com",
+	})
+	decode(t, w, &res)
+	if res.Error {
+		t.Fatalf("editing user: %s", res.Message)
+	}
+
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.FirstName != "Renamed" || user.Email != "renamed@example.com" {
+		t.Errorf("user is %s <%s>, want Renamed <renamed@example.com>", user.FirstName, user.Email)
+	}
+
+	var roleID int
+	db.QueryRow(`SELECT role_id FROM users WHERE id = ?`, userID).Scan(&roleID)
+	if roleID == 0 || user.RoleID != roleID {
+		t.Errorf("role changed to %d when none was sent", user.RoleID)
+	}
+
+	// The change is in the audit log, by the admin who made it
+	var actorID int
+	var action string
+	err = db.QueryRow(`SELECT user_id, action FROM audit_events WHERE entity_id = ?`, fmt.Sprint(userID)).Scan(&actorID, &action)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actorID != adminID || action != audit.ActionUserUpdate {
+		t.Errorf("audit event %q by user %d, want %q by %d", action, actorID, audit.ActionUserUpdate, adminID)
+	}
+
+	// A weak password is refused, and the old one still works
+	w = request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/all-users/edit/%d", userID), token, models.User{
+		FirstName: "Renamed",
+		LastName:  "User",
+		Email:     "renamed@example.com",
+		Password:  "short",
+	})
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("weak password got status %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+	if _, err := app.DB.Authenticate("renamed@example.com", testPassword); err != nil {
+		t.Errorf("old password no longer works: %s", err)
+	}
+
+	// Admins cannot change their own role
+	w = request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/all-users/edit/%d", adminID), token, models.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     "admin@example.com",
+		RoleID:    roleID,
+	})
+	decode(t, w, &res)
+	if !res.Error {
+		t.Error("admin changed their own role")
+	}
+}
+
+func TestEditUserAddsUser(t *testing.T) {
+	app, db := newTestApp(t)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionManageUsers))
+
+	w := request(t, app, http.MethodPost, "/api/admin/all-users/edit/0", token, models.User{
+		FirstName: "New",
+		LastName:  "User",
+		Email:     "new@example.com",
+		Password:  "a much longer passphrase",
+	})
+
+	var res struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	decode(t, w, &res)
+	if res.Error {
+		t.Fatalf("adding user: %s", res.Message)
+	}
+
+	if _, err := app.DB.Authenticate("new@example.com", "a much longer passphrase"); err != nil {
+		t.Errorf("new user cannot log in: %s", err)
+	}
+}
+
+// tokenResponse is what the api sends with new tokens
+type tokenResponse struct {
+	Error        bool         `json:"error"`
+	Message      string       `json:"message"`
+	Token        models.Token `json:"authentication_token"`
+	RefreshToken models.Token `json:"refresh_token"`
+}
+
+func TestTokenFlow(t *testing.T) {
+	app, db := newTestApp(t)
+	seedUser(t, db, "admin@example.com")
+
+	// Log in straight after failing, rather than after the backoff
+	app.Lockout.Account.BaseDelay = 0
+	app.Lockout.IP.BaseDelay = 0
+
+	// Logging in with the wrong password gets no tokens
+	w := requestWithCSRF(t, app, http.MethodPost, "/api/authenticate", map[string]string{
+		"email":    "admin@example.com",
+		"password": "wrong password",
+	})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = requestWithCSRF(t, app, http.MethodPost, "/api/authenticate", map[string]string{
+		"email":       "admin@example.com",
+		"password":    testPassword,
+		"device_name": "Test browser",
+	})
+	var login tokenResponse
+	decode(t, w, &login)
+	if login.Error || login.Token.PlainText == "" || login.RefreshToken.PlainText == "" {
+		t.Fatalf("logging in: %s", w.Body.String())
+	}
+
+	w = request(t, app, http.MethodPost, "/api/is-authenticated", login.Token.PlainText, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("token is not authenticated: %s", w.Body.String())
+	}
+
+	// The refresh token gets a new pair, once
+	w = request(t, app, http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": login.RefreshToken.PlainText})
+	var refreshed tokenResponse
+	decode(t, w, &refreshed)
+	if refreshed.Error || refreshed.Token.PlainText == "" || refreshed.Token.PlainText == login.Token.PlainText {
+		t.Fatalf("refreshing: %s", w.Body.String())
+	}
+
+	w = request(t, app, http.MethodPost, "/api/is-authenticated", refreshed.Token.PlainText, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("refreshed token is not authenticated: %s", w.Body.String())
+	}
+
+	// The authentication token it replaced no longer works
+	w = request(t, app, http.MethodPost, "/api/is-authenticated", login.Token.PlainText, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("replaced token got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Using a refresh token again logs its device out
+	w = request(t, app, http.MethodPost, "/api/token/refresh", "", map[string]string{"refresh_token": login.RefreshToken.PlainText})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	for _, token := range []string{refreshed.Token.PlainText, refreshed.RefreshToken.PlainText} {
+		w = request(t, app, http.MethodPost, "/api/is-authenticated", token, nil)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("token of a device logged out got status %d, want %d", w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestRevokeCurrentToken(t *testing.T) {
+	app, db := newTestApp(t)
+	userID := seedUser(t, db, "admin@example.com")
+	token := loginToken(t, app, userID)
+	other := loginToken(t, app, userID)
+
+	w := request(t, app, http.MethodPost, "/api/admin/tokens/revoke-current", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoking token: %s", w.Body.String())
+	}
+
+	w = request(t, app, http.MethodPost, "/api/is-authenticated", token, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Other devices stay logged in
+	w = request(t, app, http.MethodPost, "/api/is-authenticated", other, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("token of another device got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+// refundableSale records a sale of five of widget 1, paid through the fake gateway, and
+// returns the ID of its order
+func refundableSale(t *testing.T, app *application, db *sql.DB) int {
+	t.Helper()
+
+	seedSales(t, app, db)
+	pi := virtualTerminalCharge(t, app)
+
+	checkout, err := app.DB.CreateCheckout(context.Background(), models.Customer{FirstName: "Pat", LastName: "Buyer", Email: "buyer@example.com"}, models.Transaction{
+		Amount:              int(pi.Amount),
+		Currency:            pi.Currency,
+		PaymentIntent:       pi.ID,
+		TransactionStatusID: 2,
+		StripePaymentID:     pi.ID,
+	}, models.Order{StatusID: 1, Amount: int(pi.Amount), Items: []models.OrderItem{{WidgetID: 1, Quantity: 5, UnitPrice: 1000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return checkout.OrderID
+}
+
+// inventory returns the inventory level of a widget
+func inventory(t *testing.T, db *sql.DB, widgetID int) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT inventory_level FROM widgets WHERE id = ?`, widgetID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestRefundCharge(t *testing.T) {
+	app, db := newTestApp(t)
+	orderID := refundableSale(t, app, db)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionRefund))
+	stock := inventory(t, db, 1)
+
+	var res struct {
+		Error     bool   `json:"error"`
+		Message   string `json:"message"`
+		Remaining int    `json:"remaining"`
+	}
+
+	// Partial refunds leave the widgets out of stock
+	w := request(t, app, http.MethodPost, "/api/admin/refund", token, map[string]interface{}{"id": orderID, "amount": 2000, "restock": true})
+	decode(t, w, &res)
+	if res.Error || res.Remaining != 3000 {
+		t.Fatalf("partial refund got %+v, want 3000 remaining", res)
+	}
+	if n := inventory(t, db, 1); n != stock {
+		t.Errorf("partial refund changed the inventory to %d, want %d", n, stock)
+	}
+
+	// What is left is checked against the refunds already made
+	w = request(t, app, http.MethodPost, "/api/admin/refund", token, map[string]interface{}{"id": orderID, "amount": 4000})
+	decode(t, w, &res)
+	if !res.Error {
+		t.Error("refund of more than what is left was made")
+	}
+
+	w = request(t, app, http.MethodPost, "/api/admin/refund", token, map[string]interface{}{"id": orderID, "amount": 3000, "restock": true})
+	decode(t, w, &res)
+	if res.Error || res.Remaining != 0 {
+		t.Fatalf("final refund got %+v, want nothing remaining", res)
+	}
+	if n := inventory(t, db, 1); n != stock+5 {
+		t.Errorf("full refund left the inventory at %d, want %d", n, stock+5)
+	}
+	if n := count(t, db, "refunds"); n != 2 {
+		t.Errorf("%d refunds recorded, want 2", n)
+	}
+}
+
+func TestRefundChargeNotRecorded(t *testing.T) {
+	app, db := newTestApp(t)
+	orderID := refundableSale(t, app, db)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionRefund))
+
+	// The refund is made but cannot be recorded with its audit event
+	if _, err := db.Exec(`DROP TABLE audit_events`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(t, app, http.MethodPost, "/api/admin/refund", token, map[string]interface{}{"id": orderID, "amount": 2000})
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	if n := count(t, db, "refunds"); n != 0 {
+		t.Errorf("%d refunds recorded, want the refund rolled back", n)
+	}
+}
+
+func TestPaymentIntentReservationLimit(t *testing.T) {
+	app, db := newWebhookApp(t)
+	app.Gateway = cards.NewFakeGateway()
+	app.config.reservationLimit = 5
+	seed(t, db, `UPDATE widgets SET inventory_level = 100 WHERE id = 1`)
+
+	// checkout asks for a payment intent for quantity of widget 1 from an address
+	checkout := func(quantity int, addr string) int {
+		r := newRequest(t, http.MethodPost, "/api/payment-intent", map[string]interface{}{"product_id": "1", "quantity": quantity})
+		r.RemoteAddr = addr
+		r.Header.Set("X-CSRF-Token", "test-csrf-token")
+		r.AddCookie(&http.Cookie{Name: "csrf_token", Value: "test-csrf-token"})
+
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := checkout(3, "192.0.2.1:1234"); code != http.StatusOK {
+		t.Fatalf("first payment intent got %d", code)
+	}
+	if code := checkout(3, "192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("payment intent over the limit got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := checkout(2, "192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("payment intent up to the limit got %d", code)
+	}
+
+	// Other clients have limits of their own
+	if code := checkout(3, "198.51.100.1:1234"); code != http.StatusOK {
+		t.Errorf("payment intent from another client got %d", code)
+	}
+
+	// Expired reservations no longer count
+	seed(t, db, `UPDATE widget_reservations SET expires_at = datetime('now', '-1 minute')`)
+	if code := checkout(3, "192.0.2.1:1234"); code != http.StatusOK {
+		t.Errorf("payment intent after the reservations expired got %d", code)
+	}
+}
+
+func TestAuthenticateNormalizesEmail(t *testing.T) {
+	app, db := newTestApp(t)
+	seedUser(t, db, "admin@example.com")
+
+	// Addresses are looked up as the lockout and rate limits count them
+	w := requestWithCSRF(t, app, http.MethodPost, "/api/authenticate", map[string]string{
+		"email":    " Admin@Example.com ",
+		"password": testPassword,
+	})
+
+	var login tokenResponse
+	decode(t, w, &login)
+	if login.Error || login.Token.PlainText == "" {
+		t.Errorf("logging in with a padded address: %s", w.Body)
+	}
+}
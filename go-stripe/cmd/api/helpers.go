@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"io"
+	"myapp/internal/passwords"
 	"net/http"
 
 	"golang.org/x/crypto/bcrypt"
@@ -70,6 +71,43 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+// serverError is a helper that logs err and sends an Internal Server Error response to the client.
+func (app *application) serverError(w http.ResponseWriter, r *http.Request, err error) error {
+	app.errorLog.Println(err)
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "internal server error"
+
+	return app.writeJSON(w, http.StatusInternalServerError, payload)
+}
+
+// invalidFields is a helper that sends an Unprocessable Entity response saying what is wrong
+// with each field, for pages to show next to the fields. Errors other than field errors
+// are sent as server errors.
+func (app *application) invalidFields(w http.ResponseWriter, r *http.Request, err error) error {
+	var fields passwords.FieldErrors
+	if !errors.As(err, &fields) {
+		return app.serverError(w, r, err)
+	}
+
+	var payload struct {
+		Error   bool                  `json:"error"`
+		Message string                `json:"message"`
+		Errors  passwords.FieldErrors `json:"errors"`
+	}
+
+	payload.Error = true
+	payload.Message = "Please correct the highlighted fields"
+	payload.Errors = fields
+
+	return app.writeJSON(w, http.StatusUnprocessableEntity, payload)
+}
+
 // invalidCredentials is a helper that sends an Invalid Credentials response to the client.
 func (app *application) invalidCredentials(w http.ResponseWriter) error {
 
@@ -89,6 +127,35 @@ func (app *application) invalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// forbidden is a helper that tells the client the authenticated user is not allowed to do
+// what they asked.
+func (app *application) forbidden(w http.ResponseWriter) error {
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "You do not have permission to do that"
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
+// accountDisabled sends the response for a disabled user who gave the right password
+func (app *application) accountDisabled(w http.ResponseWriter) error {
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "This account has been disabled"
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
 // passwordMatches checks whether a plain-text password matches a hashed password.
 func (app *application) passwordMatches(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// InvoiceJobs returns a page of the invoices queued for the invoice microservice, newest
+// first, with the status sent, or failed ones if none is
+func (app *application) InvoiceJobs(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		PageSize    int    `json:"page_size"`
+		CurrentPage int    `json:"current_page"`
+		Status      string `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if payload.PageSize < 1 || payload.PageSize > 100 {
+		payload.PageSize = 25
+	}
+	if payload.CurrentPage < 1 {
+		payload.CurrentPage = 1
+	}
+
+	switch payload.Status {
+	case "":
+		payload.Status = models.InvoiceJobFailed
+	case "all":
+		payload.Status = ""
+	case models.InvoiceJobPending, models.InvoiceJobDelivered, models.InvoiceJobFailed:
+	default:
+		app.badRequest(w, r, fmt.Errorf("unknown invoice job status %q", payload.Status))
+		return
+	}
+
+	jobs, lastPage, numRecords, err := app.DB.GetInvoiceJobsPaginated(payload.Status, payload.PageSize, payload.CurrentPage)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var res struct {
+		CurrentPage  int                  `json:"current_page"`
+		PageSize     int                  `json:"page_size"`
+		LastPage     int                  `json:"last_page"`
+		TotalRecords int                  `json:"total_records"`
+		Jobs         []*models.InvoiceJob `json:"jobs"`
+	}
+
+	res.CurrentPage = payload.CurrentPage
+	res.PageSize = payload.PageSize
+	res.LastPage = lastPage
+	res.TotalRecords = numRecords
+	res.Jobs = jobs
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// RetryInvoiceJob puts a failed invoice back in the queue, to be sent again straight away
+// with a fresh set of attempts
+func (app *application) RetryInvoiceJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var job models.InvoiceJob
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		job, err = tx.GetInvoiceJob(jobID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("invoice job not found")
+		}
+		if err != nil {
+			return err
+		}
+
+		ok, err := tx.RetryInvoiceJob(jobID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("the invoice for order %d has not failed", job.OrderID)
+		}
+
+		after, err := tx.GetInvoiceJob(jobID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionInvoiceRetry, audit.NewEntity(audit.EntityOrder, job.OrderID), job, after)
+	})
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: fmt.Sprintf("The invoice for order %d will be sent again", job.OrderID)})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// releaseExpiredReservations deletes expired widget reservations every interval, so stock
+// held for abandoned checkouts can be sold again. It runs until the program exits.
+func (app *application) releaseExpiredReservations(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.ReleaseExpiredReservations()
+		if err != nil {
+			app.errorLog.Println("releasing expired reservations:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Released %d expired widget reservations", n)
+		}
+	}
+}
+
+// deleteExpiredTokens deletes expired authentication tokens every interval, so the tokens
+// table only holds devices that are still logged in. It runs until the program exits.
+func (app *application) deleteExpiredTokens(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.DeleteExpiredTokens()
+		if err != nil {
+			app.errorLog.Println("deleting expired tokens:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Deleted %d expired tokens", n)
+		}
+	}
+}
+
+// notifyLockouts emails the users whose account has been locked out by failed logins,
+// every interval. Lockouts of email addresses without a user are not emailed. It runs
+// until the program exits.
+func (app *application) notifyLockouts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lockouts, err := app.LoginAttempts.GetUnnotifiedLockouts()
+		if err != nil {
+			app.errorLog.Println("getting lockouts:", err)
+			continue
+		}
+
+		for _, a := range lockouts {
+			if _, err := app.DB.GetUserByEmail(a.Email); err == nil {
+				data := struct {
+					LockedUntil time.Time
+					Link        string
+				}{
+					LockedUntil: *a.LockedUntil,
+					Link:        fmt.Sprintf("%s/forgot-password", app.config.frontend),
+				}
+
+				err = app.SendMail("gowidgets@matthewgoodman.ca", a.Email, "Your Account Has Been Locked", "account-locked", data)
+				if err != nil {
+					app.errorLog.Println("emailing lockout:", err)
+					continue
+				}
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				app.errorLog.Println("getting locked out user:", err)
+				continue
+			}
+
+			if err := app.LoginAttempts.MarkLockoutNotified(a.Key); err != nil {
+				app.errorLog.Println("marking lockout notified:", err)
+			}
+		}
+	}
+}
+
+// deleteStaleLoginAttempts forgets the failed logins of accounts and IP addresses that
+// have not failed for a day, every interval. It runs until the program exits.
+func (app *application) deleteStaleLoginAttempts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.LoginAttempts.DeleteStaleLoginAttempts(time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			app.errorLog.Println("deleting stale login attempts:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Forgot %d stale failed logins", n)
+		}
+	}
+}
+
+// deleteIdleRateLimitBuckets forgets the rate limits of clients not seen for a day, every
+// interval. Their buckets have long been full again. It runs until the program exits.
+func (app *application) deleteIdleRateLimitBuckets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.RateLimits.DeleteIdleRateLimitBuckets(time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			app.errorLog.Println("deleting idle rate limit buckets:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Forgot %d idle rate limit buckets", n)
+		}
+	}
+}
+
+// deletePasswordResets deletes the password reset links that expired more than a day ago,
+// every interval. It runs until the program exits.
+func (app *application) deletePasswordResets(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.DeletePasswordResetsBefore(time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			app.errorLog.Println("deleting password resets:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Deleted %d expired password reset links", n)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/clientip"
+	"myapp/internal/lockout"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// checkLoginAllowed sends a Too Many Requests response and returns false if the account or
+// the IP address of a login request must wait before trying again
+func (app *application) checkLoginAllowed(w http.ResponseWriter, r *http.Request, email string) bool {
+	err := app.Lockout.Check(email, clientip.FromRequest(r))
+
+	var wait *lockout.WaitError
+	switch {
+	case errors.As(err, &wait):
+		app.tooManyAttempts(w, wait)
+		return false
+	case err != nil:
+		app.serverError(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// loginFailed counts a failed login. Lockouts are emailed to their user by notifyLockouts.
+func (app *application) loginFailed(r *http.Request, email string) {
+	locked, err := app.Lockout.Fail(email, clientip.FromRequest(r))
+	if err != nil {
+		app.errorLog.Println("counting failed login:", err)
+		return
+	}
+	if locked {
+		app.infoLog.Printf("Locked out %s after too many failed logins from %s", email, clientip.FromRequest(r))
+	}
+}
+
+// loginSucceeded forgets the failed logins of an account once its user has logged in
+func (app *application) loginSucceeded(email string) {
+	if err := app.Lockout.Succeed(email); err != nil {
+		app.errorLog.Println("resetting failed logins:", err)
+	}
+}
+
+// tooManyAttempts is a helper that sends a Too Many Requests response, telling the client
+// when to try again.
+func (app *application) tooManyAttempts(w http.ResponseWriter, wait *lockout.WaitError) error {
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	if wait.Locked {
+		payload.Message = "Too many failed login attempts. Try again later, or ask an administrator to unlock your account."
+	} else {
+		payload.Message = "Too many failed login attempts. Wait a moment before trying again."
+	}
+
+	headers := make(http.Header)
+	headers.Set("Retry-After", strconv.Itoa(int(wait.RetryAfter(time.Now())/time.Second)))
+
+	return app.writeJSON(w, http.StatusTooManyRequests, payload, headers)
+}
+
+// UserLockout tells whether a user is locked out by failed logins
+func (app *application) UserLockout(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	attempts, err := app.Lockout.Status(user.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var res struct {
+		OK     bool `json:"ok"`
+		Locked bool `json:"locked"`
+		models.LoginAttempts
+	}
+	res.OK = true
+	res.Locked = attempts.Locked(time.Now())
+	res.LoginAttempts = attempts
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// UnlockUser lets a user locked out by failed logins log in again straight away
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		// Counts kept in the database are unlocked in the transaction of the audit event.
+		// The memory store cannot be, so it is unlocked last.
+		guard := app.Lockout
+		if app.config.lockout == "database" {
+			guard = app.Lockout.WithStore(tx)
+		}
+
+		attempts, err := guard.Status(user.Email)
+		if err != nil {
+			return err
+		}
+
+		err = app.recordAudit(tx, r, audit.ActionUserUnlock, audit.NewEntity(audit.EntityUser, userID), attempts, nil)
+		if err != nil {
+			return err
+		}
+
+		return guard.Unlock(user.Email)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: fmt.Sprintf("%s can log in again", user.Email)})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/lockout"
+	"myapp/internal/models"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newLockoutTestApp returns a test application counting failed logins in the database
+func newLockoutTestApp(t *testing.T) (*application, *sql.DB) {
+	t.Helper()
+
+	app, db := newTestApp(t)
+	app.config.lockout = "database"
+	app.LoginAttempts = app.DB
+	app.Lockout = lockout.New(app.LoginAttempts)
+
+	return app, db
+}
+
+// lockOut fails to log in as the account with an email address until it is locked out
+func lockOut(t *testing.T, app *application, email string) {
+	t.Helper()
+
+	for i := 0; i < app.Lockout.Account.Threshold; i++ {
+		if _, err := app.Lockout.Fail(email, "192.0.2.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// locked tells whether the account with an email address is locked out
+func locked(t *testing.T, app *application, email string) bool {
+	t.Helper()
+
+	attempts, err := app.Lockout.Status(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return attempts.Locked(time.Now())
+}
+
+func TestUnlockUser(t *testing.T) {
+	app, db := newLockoutTestApp(t)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionManageUsers))
+	email := "locked@example.com"
+	userID := seedUser(t, db, email)
+
+	lockOut(t, app, email)
+	if !locked(t, app, email) {
+		t.Fatal("user was not locked out")
+	}
+
+	// SQLite locks the database for the transaction of the audit event, so an unlock made
+	// outside it would wait for it and fail
+	w := request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/all-users/%d/unlock", userID), token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlocking got %d: %s", w.Code, w.Body)
+	}
+
+	if locked(t, app, email) {
+		t.Error("user is still locked out")
+	}
+
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE action = ? AND entity_id = ?`, audit.ActionUserUnlock, fmt.Sprint(userID)).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("%d unlock audit events, want 1", n)
+	}
+}
+
+func TestUnlockUserWithoutAudit(t *testing.T) {
+	app, db := newLockoutTestApp(t)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionManageUsers))
+	email := "locked@example.com"
+	userID := seedUser(t, db, email)
+	lockOut(t, app, email)
+
+	// The audit event cannot be recorded, so the unlock is rolled back with it
+	if _, err := db.Exec(`DROP TABLE audit_events`); err != nil {
+		t.Fatal(err)
+	}
+
+	w := request(t, app, http.MethodPost, fmt.Sprintf("/api/admin/all-users/%d/unlock", userID), token, nil)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unlocking got %d, want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	if !locked(t, app, email) {
+		t.Error("user was unlocked without an audit event")
+	}
+}
@@ -1,14 +1,96 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"myapp/internal/csrf"
+	"myapp/internal/models"
+	"net/http"
+)
 
+// contextKey is the type for keys of values this application stores in a request context
+type contextKey string
+
+const contextKeyUser = contextKey("user")
+
+// Auth authenticates the bearer token and puts the user, with their permissions, in the
+// request context for RequirePermission and the handlers
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, err := app.authenticateToken(r)
 		if err != nil {
 			app.invalidCredentials(w)
 			return
 		}
+
+		user.Permissions, err = app.DB.GetUserPermissions(user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyUser, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CSRF refuses unsafe requests from browsers that do not send the CSRF cookie the web
+// server set and the same token in the X-CSRF-Token header. It is for routes that need no
+// authentication, so an Authorization header does not let a request through: anyone can
+// send one.
+//
+// Requests without any cookies are let through. Cross-site requests are only a danger
+// because the browser adds the cookies of the site to them, and a browser that has been
+// to the site has the CSRF cookie. Other clients, such as scripts logging in at
+// /api/authenticate, send no cookies and need no token.
+func (app *application) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if csrf.Safe(r.Method) || len(r.Cookies()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var cookie string
+		if c, err := r.Cookie(csrf.CookieName); err == nil {
+			cookie = c.Value
+		}
+
+		if !csrf.Matches(r.Header.Get(csrf.HeaderName), cookie) {
+			var payload struct {
+				Error   bool   `json:"error"`
+				Message string `json:"message"`
+			}
+			payload.Error = true
+			payload.Message = "Missing or invalid CSRF token. Please reload the page and try again."
+
+			app.writeJSON(w, http.StatusForbidden, payload)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequirePermission only lets through users whose role has permission. It must come
+// after Auth.
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.userFromContext(r)
+			if user == nil || !user.Can(permission) {
+				app.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userFromContext returns the user Auth put in the request context, or nil outside of
+// authenticated routes
+func (app *application) userFromContext(r *http.Request) *models.User {
+	user, ok := r.Context().Value(contextKeyUser).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
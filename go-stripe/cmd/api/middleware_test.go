@@ -0,0 +1,45 @@
+package main
+
+import (
+	"myapp/internal/csrf"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name    string
+		method  string
+		cookies map[string]string
+		header  string
+		want    int
+	}{
+		{"matching token", http.MethodPost, map[string]string{csrf.CookieName: "token"}, "token", http.StatusOK},
+		{"token not matching the cookie", http.MethodPost, map[string]string{csrf.CookieName: "token"}, "other", http.StatusForbidden},
+		{"no token", http.MethodPost, map[string]string{csrf.CookieName: "token"}, "", http.StatusForbidden},
+		{"no CSRF cookie", http.MethodPost, map[string]string{"session": "abc"}, "token", http.StatusForbidden},
+		{"empty cookie and token", http.MethodPost, map[string]string{csrf.CookieName: ""}, "", http.StatusForbidden},
+		{"safe method", http.MethodGet, map[string]string{csrf.CookieName: "token"}, "", http.StatusOK},
+		{"no cookies at all", http.MethodPost, nil, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/authenticate", nil)
+		for name, value := range tt.cookies {
+			r.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrf.HeaderName, tt.header)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
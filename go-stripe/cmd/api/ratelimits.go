@@ -0,0 +1,27 @@
+package main
+
+import (
+	"myapp/internal/ratelimit"
+	"time"
+)
+
+// Rate limits of the public routes. Routes that charge cards are limited by IP address, to
+// slow down card testing; routes that send email are also limited by the address they send
+// to, so no one can be flooded with email.
+var (
+	paymentIntentLimit = ratelimit.Policy{Name: "payment-intent", Burst: 10, Every: 30 * time.Second, Key: ratelimit.ByIP}
+	subscribeLimit     = ratelimit.Policy{Name: "subscribe", Burst: 5, Every: time.Minute, Key: ratelimit.ByIP}
+	changePlanLimit    = ratelimit.Policy{Name: "change-plan", Burst: 10, Every: time.Minute, Key: ratelimit.ByIP}
+
+	authenticateIPLimit    = ratelimit.Policy{Name: "authenticate-ip", Burst: 20, Every: 10 * time.Second, Key: ratelimit.ByIP}
+	authenticateEmailLimit = ratelimit.Policy{Name: "authenticate-email", Burst: 10, Every: 30 * time.Second, Key: ratelimit.ByEmail}
+	refreshTokenLimit      = ratelimit.Policy{Name: "refresh-token", Burst: 10, Every: time.Minute, Key: ratelimit.ByIP}
+	resetPasswordLimit     = ratelimit.Policy{Name: "reset-password", Burst: 10, Every: time.Minute, Key: ratelimit.ByIP}
+
+	sendEmailIPLimit = ratelimit.Policy{Name: "send-email-ip", Burst: 5, Every: time.Minute, Key: ratelimit.ByIP}
+	sendEmailLimit   = ratelimit.Policy{Name: "send-email", Burst: 3, Every: 20 * time.Minute, Key: ratelimit.ByEmail}
+
+	// Admin users are limited by token, generously, so a leaked token cannot be used to
+	// scrape everything at once
+	adminLimit = ratelimit.Policy{Name: "admin", Burst: 100, Every: 100 * time.Millisecond, Key: ratelimit.ByToken}
+)
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"myapp/internal/models"
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
@@ -10,49 +12,126 @@ import (
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
-	// CORS middleware
+	// CORS middleware. Credentials are allowed so that pages can send the CSRF cookie of the
+	// web server, so only the pages of the frontend may make requests.
 	mux.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"https://*", "http://*"},
+		AllowedOrigins:   []string{strings.TrimSuffix(app.config.frontend, "/")},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		AllowCredentials: false,
+		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
-
 	mux.Get("/api/widget/{id}", app.GetWidgetById)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+	mux.Post("/api/cart", app.CreateCart)
+	mux.Get("/api/cart/{token}", app.GetCart)
+	mux.Post("/api/cart/{token}/items", app.AddCartItem)
+	mux.Put("/api/cart/{token}/items/{widgetID}", app.UpdateCartItem)
+	mux.Delete("/api/cart/{token}/items/{widgetID}", app.RemoveCartItem)
 
-	mux.Post("/api/authenticate", app.CreateAuthToken)
+	mux.With(app.Limiter.Limit(refreshTokenLimit)).Post("/api/token/refresh", app.RefreshAuthToken)
 
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
 
-	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
+	// Routes the pages of the web server post to without a token
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.CSRF)
+
+		mux.With(app.Limiter.Limit(paymentIntentLimit)).Post("/api/payment-intent", app.GetPaymentIntent)
+		mux.With(app.Limiter.Limit(subscribeLimit)).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribeToPlan)
+
+		mux.With(app.Limiter.Limit(authenticateIPLimit, authenticateEmailLimit)).Post("/api/authenticate", app.CreateAuthToken)
 
-	mux.Post("/api/reset-password", app.ResetPassword)
+		mux.With(app.Limiter.Limit(sendEmailIPLimit, sendEmailLimit)).Post("/api/forgot-password", app.SendPasswordResetEmail)
+		mux.With(app.Limiter.Limit(resetPasswordLimit)).Post("/api/reset-password", app.ResetPassword)
+
+		mux.With(app.Limiter.Limit(sendEmailIPLimit, sendEmailLimit)).Post("/api/change-plan-link", app.SendChangePlanEmail)
+		mux.With(app.Limiter.Limit(changePlanLimit)).Post("/api/change-plan/preview", app.PreviewCustomerPlanChange)
+		mux.With(app.Limiter.Limit(changePlanLimit)).Post("/api/change-plan", app.ChangeCustomerPlan)
+	})
+
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
 
 	mux.Route("/api/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
+		mux.Use(app.Limiter.Limit(adminLimit))
 
 		mux.Get("/test", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("Authenticated!"))
 		})
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		// Every user can see and log out the devices they are logged in on
+		mux.Post("/tokens", app.Tokens)
+		mux.Post("/tokens/{tokenID}/revoke", app.RevokeToken)
+		mux.Post("/tokens/revoke-all", app.RevokeAllTokens)
+		mux.Post("/tokens/revoke-current", app.RevokeCurrentToken)
+
+		// Every user can set up two-factor authentication for themselves
+		mux.Post("/two-factor", app.TwoFactorStatus)
+		mux.Post("/two-factor/enroll", app.EnrollTwoFactor)
+		mux.Post("/two-factor/confirm", app.ConfirmTwoFactor)
+		mux.Post("/two-factor/disable", app.DisableTwoFactor)
+		mux.Post("/two-factor/recovery-codes", app.RegenerateRecoveryCodes)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionVirtualTerminal))
+			mux.Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
+			mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSucceeded)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSales))
+			mux.Post("/all-sales", app.AllSales)
+			mux.Post("/get-sale/{id}", app.GetSale)
+		})
+
+		mux.With(app.RequirePermission(models.PermissionRefund)).Post("/refund", app.RefundCharge)
 
-		mux.Post("/get-sale/{id}", app.GetSale)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageInvoices))
+			mux.Post("/invoice-jobs", app.InvoiceJobs)
+			mux.Post("/invoice-jobs/{id}/retry", app.RetryInvoiceJob)
+		})
 
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSubscriptions))
+			mux.Post("/all-subscriptions", app.AllSubscriptions)
+			mux.Post("/subscriptions/{id}", app.GetSubscription)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageSubscriptions))
+			mux.Post("/cancel-subscription", app.CancelSubscription)
+			mux.Post("/subscriptions/{id}/pause", app.PauseSubscription)
+			mux.Post("/subscriptions/{id}/resume", app.ResumeSubscription)
+			mux.Post("/subscriptions/{id}/cancel", app.CancelSubscriptionNow)
+			mux.Post("/subscriptions/{id}/cancel-at-period-end", app.CancelSubscriptionAtPeriodEnd)
+			mux.Post("/subscriptions/{id}/preview-plan-change", app.PreviewPlanChange)
+			mux.Post("/subscriptions/{id}/change-plan", app.ChangePlan)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewUsers))
+			mux.Post("/all-users", app.AllUsers)
+			mux.Post("/all-users/{id}", app.OneUser)
+			mux.Post("/all-users/{id}/tokens", app.Tokens)
+			mux.Post("/all-users/{id}/lockout", app.UserLockout)
+			mux.Post("/roles", app.AllRoles)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionManageUsers))
+			mux.Post("/all-users/edit/{id}", app.EditUser)
+			mux.Post("/all-users/delete/{id}", app.DeleteUser)
+			mux.Post("/all-users/{id}/tokens/{tokenID}/revoke", app.RevokeToken)
+			mux.Post("/all-users/{id}/tokens/revoke-all", app.RevokeAllTokens)
+			mux.Post("/all-users/{id}/unlock", app.UnlockUser)
+			mux.Post("/all-users/{id}/disable", app.DisableUser)
+			mux.Post("/all-users/{id}/enable", app.EnableUser)
+		})
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		mux.With(app.RequirePermission(models.PermissionViewAuditLog)).Post("/audit", app.AuditLog)
 	})
 
 	return mux
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"myapp/internal/audit"
+	"myapp/internal/lockout"
+	"myapp/internal/models"
+	"myapp/internal/passwords"
+	"myapp/internal/pricing"
+	"myapp/internal/ratelimit"
+	"myapp/internal/testdb"
+	"myapp/internal/twofactor"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPassword is the password of the users seedUser adds
+const testPassword = "correct horse battery staple"
+
+// newTestApp returns an application backed by a new SQLite database with the schema of
+// migrations/schema.sql, and the database itself for checking what was written
+func newTestApp(t *testing.T) (*application, *sql.DB) {
+	t.Helper()
+
+	db, err := testdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	var cfg config
+	cfg.frontend = "http://localhost:4000"
+	cfg.secretkey = "x6Z2c9H5F1B8g7L9A3p7D1W8k2E6h3R9"
+	cfg.reservationTTL = 15 * time.Minute
+	cfg.reservationLimit = 2 * pricing.MaxQuantity
+
+	m := testdb.NewModel(db)
+	discard := log.New(io.Discard, "", 0)
+
+	app := &application{
+		config:   cfg,
+		infoLog:  discard,
+		errorLog: discard,
+		version:  version,
+		DB:       &m,
+		Auditor:  audit.New(),
+	}
+	app.Pricing = pricing.New(app.DB)
+	app.TwoFactor = twofactor.New(app.DB, []byte(cfg.secretkey))
+	app.LoginAttempts = lockout.NewMemoryStore()
+	app.Lockout = lockout.New(app.LoginAttempts)
+	app.RateLimits = ratelimit.NewMemoryStore()
+	app.Limiter = ratelimit.New(app.RateLimits, discard)
+	app.Passwords = passwords.New(app.DB, passwords.DefaultPolicy)
+
+	return app, db
+}
+
+// seed runs statements against the test database
+func seed(t *testing.T, db *sql.DB, statements ...string) {
+	t.Helper()
+
+	for _, s := range statements {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatalf("seeding %q: %s", s, err)
+		}
+	}
+}
+
+// seedUser adds a user with testPassword and a role with the given permissions, and
+// returns the user's ID
+func seedUser(t *testing.T, db *sql.DB, email string, permissions ...string) int {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.Exec(`INSERT INTO roles (name) VALUES (?)`, "role of "+email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleID, _ := result.LastInsertId()
+
+	for _, p := range permissions {
+		seed(t, db, `INSERT OR IGNORE INTO permissions (name) VALUES ('`+p+`')`)
+		_, err = db.Exec(`INSERT INTO role_permissions (role_id, permission_id) SELECT ?, id FROM permissions WHERE name = ?`, roleID, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err = db.Exec(`INSERT INTO users (first_name, last_name, email, password, role_id) VALUES ('Test', 'User', ?, ?, ?)`, email, string(hash), roleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+
+	return int(id)
+}
+
+// loginToken returns a new authentication token for a user, as if they had logged in
+func loginToken(t *testing.T, app *application, userID int) string {
+	t.Helper()
+
+	token, err := models.GenerateToken(int64(userID), time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.DB.InsertToken(token, models.User{ID: userID}); err != nil {
+		t.Fatal(err)
+	}
+
+	return token.PlainText
+}
+
+// request sends a request to the application's routes. Bodies are sent as JSON, and a
+// token, if given, as a bearer token.
+func request(t *testing.T, app *application, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := newRequest(t, method, path, body)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	return w
+}
+
+// requestWithCSRF is request for the routes that check the CSRF token the web server
+// gives its pages
+func requestWithCSRF(t *testing.T, app *application, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := newRequest(t, method, path, body)
+	r.Header.Set("X-CSRF-Token", "test-csrf-token")
+	r.AddCookie(&http.Cookie{Name: "csrf_token", Value: "test-csrf-token"})
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	return w
+}
+
+// newRequest returns a request with body, if any, encoded as JSON
+func newRequest(t *testing.T, method, path string, body interface{}) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(method, path, &buf)
+	r.Header.Set("Content-Type", "application/json")
+
+	return r
+}
+
+// decode decodes the JSON body of a response
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %s", w.Body.String(), err)
+	}
+}
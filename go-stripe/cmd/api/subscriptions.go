@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/models"
+	"myapp/internal/pricing"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
+)
+
+// GetSubscription returns the stored state of a subscription
+func (app *application) GetSubscription(w http.ResponseWriter, r *http.Request) {
+	subscription, err := app.DB.GetSubscriptionByStripeID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such subscription"})
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, subscription)
+}
+
+// PauseSubscription stops charging a subscription until it is resumed
+func (app *application) PauseSubscription(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, app.Gateway.PauseSubscription, audit.ActionSubscriptionPause, "Subscription paused")
+}
+
+// ResumeSubscription resumes a paused subscription, or one set to cancel at the end of its period
+func (app *application) ResumeSubscription(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, app.Gateway.ResumeSubscription, audit.ActionSubscriptionResume, "Subscription resumed")
+}
+
+// CancelSubscriptionNow cancels a subscription immediately
+func (app *application) CancelSubscriptionNow(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, app.Gateway.CancelSubscriptionNow, audit.ActionSubscriptionCancel, "Subscription cancelled")
+}
+
+// CancelSubscriptionAtPeriodEnd cancels a subscription at the end of the current period
+func (app *application) CancelSubscriptionAtPeriodEnd(w http.ResponseWriter, r *http.Request) {
+	app.changeSubscription(w, r, app.Gateway.CancelSubscriptionAtPeriodEnd, audit.ActionSubscriptionCancelAtPeriod, "Subscription will be cancelled at the end of the current period")
+}
+
+// changeSubscription applies a gateway action to the subscription named in the URL, stores
+// the result under auditAction and sends the updated subscription
+func (app *application) changeSubscription(w http.ResponseWriter, r *http.Request, action func(string) (*stripe.Subscription, error), auditAction, msg string) {
+	id := chi.URLParam(r, "id")
+
+	_, err := app.DB.GetSubscriptionByStripeID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such subscription"})
+		return
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	stripeSubscription, err := action(id)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	subscription, err := app.auditedSync(r, auditAction, stripeSubscription)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if auditAction == audit.ActionSubscriptionCancel || auditAction == audit.ActionSubscriptionCancelAtPeriod {
+		app.publishCancellation(stripeSubscription)
+	}
+
+	var res struct {
+		OK           bool                 `json:"ok"`
+		Message      string               `json:"message"`
+		Subscription *models.Subscription `json:"subscription"`
+	}
+	res.OK = true
+	res.Message = msg
+	res.Subscription = subscription
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// recordSubscription stores a new subscription for a widget bought by a customer
+func (app *application) recordSubscription(db models.Repository, stripeSubscription *stripe.Subscription, widgetID, customerID int) error {
+	subscription := subscriptionFromStripe(stripeSubscription)
+	subscription.WidgetID = widgetID
+	subscription.CustomerID = customerID
+
+	_, err := db.SaveSubscription(subscription)
+	return err
+}
+
+// syncSubscription stores the latest state of a subscription from Stripe through db. A
+// subscription we have no record of is linked to its widget and customer through the order
+// paid with it; when there is no such order yet, nothing is stored and the order's own
+// checkout records it.
+func (app *application) syncSubscription(db models.Repository, stripeSubscription *stripe.Subscription) error {
+	var widgetID, customerID int
+
+	existing, err := db.GetSubscriptionByStripeID(stripeSubscription.ID)
+	switch {
+	case err == nil:
+		widgetID, customerID = existing.WidgetID, existing.CustomerID
+
+		// A plan changed in the Stripe dashboard still moves the subscription to the plan's widget
+		if planID := subscriptionFromStripe(stripeSubscription).PlanID; planID != existing.PlanID {
+			if widget, err := db.GetWidgetByPlanID(planID); err == nil {
+				widgetID = widget.ID
+			}
+		}
+	case errors.Is(err, sql.ErrNoRows):
+		order, err := db.GetOrderByPaymentIntent(stripeSubscription.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		widgetID, customerID = order.WidgetID, order.CustomerID
+	default:
+		return err
+	}
+
+	err = app.recordSubscription(db, stripeSubscription, widgetID, customerID)
+	if err != nil {
+		return err
+	}
+
+	// An order stays cleared until its subscription has actually ended
+	if stripeSubscription.Status == stripe.SubscriptionStatusCanceled {
+		order, err := db.GetOrderByPaymentIntent(stripeSubscription.ID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return db.UpdateOrderStatus(order.ID, 3)
+	}
+
+	return nil
+}
+
+// auditedSync stores the latest state of a subscription changed by the user of the request,
+// recording the change under action, and returns the stored subscription. The subscription
+// is nil if it is not stored yet.
+func (app *application) auditedSync(r *http.Request, action string, stripeSubscription *stripe.Subscription) (*models.Subscription, error) {
+	var after *models.Subscription
+
+	err := app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		before, err := tx.GetSubscriptionByStripeID(stripeSubscription.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		err = app.syncSubscription(tx, stripeSubscription)
+		if err != nil {
+			return err
+		}
+
+		after, err = tx.GetSubscriptionByStripeID(stripeSubscription.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		entity := audit.Entity{Type: audit.EntitySubscription, ID: stripeSubscription.ID}
+		return app.recordAudit(tx, r, action, entity, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return after, nil
+}
+
+// subscriptionFromStripe returns the state of a Stripe subscription, without its widget and customer
+func subscriptionFromStripe(sub *stripe.Subscription) models.Subscription {
+	s := models.Subscription{
+		StripeSubscriptionID: sub.ID,
+		Status:               string(sub.Status),
+		CurrentPeriodStart:   unixTime(sub.CurrentPeriodStart),
+		CurrentPeriodEnd:     unixTime(sub.CurrentPeriodEnd),
+		TrialEnd:             unixTime(sub.TrialEnd),
+		CancelAt:             unixTime(sub.CancelAt),
+		CancelAtPeriodEnd:    sub.CancelAtPeriodEnd,
+		CanceledAt:           unixTime(sub.CanceledAt),
+	}
+
+	if sub.Plan != nil {
+		s.PlanID = sub.Plan.ID
+	} else if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].Price != nil {
+		s.PlanID = sub.Items.Data[0].Price.ID
+	}
+
+	// Stripe reports a paused subscription as active with its collection paused
+	if sub.PauseCollection.Behavior != "" && sub.Status != stripe.SubscriptionStatusCanceled {
+		s.Status = models.SubscriptionPaused
+	}
+
+	return s
+}
+
+// unixTime converts a Stripe timestamp, returning nil for an unset (zero) one
+func unixTime(sec int64) *time.Time {
+	if sec == 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// planChangePayload is the request to preview or make a plan change. Link is only sent by
+// customers, as the signed link they were emailed; ProrationDate is the one returned by the
+// preview.
+type planChangePayload struct {
+	Link          string `json:"link"`
+	WidgetID      int    `json:"widget_id"`
+	ProrationDate int64  `json:"proration_date"`
+}
+
+// planChangePreview is what a plan change would cost. ProratedAmount is negative when the
+// new plan is cheaper; the credit goes towards the next invoices and nothing is charged now.
+type planChangePreview struct {
+	OK             bool          `json:"ok"`
+	Message        string        `json:"message"`
+	CurrentPlan    models.Widget `json:"current_plan"`
+	NewPlan        models.Widget `json:"new_plan"`
+	ProratedAmount int           `json:"prorated_amount"`
+	AmountDue      int           `json:"amount_due"`
+	Currency       string        `json:"currency"`
+	ProrationDate  int64         `json:"proration_date"`
+	NextPaymentAt  *time.Time    `json:"next_payment_at"`
+}
+
+// PreviewPlanChange returns what moving the subscription in the URL to another widget's plan would cost
+func (app *application) PreviewPlanChange(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.previewPlanChange(w, r, chi.URLParam(r, "id"), payload.WidgetID)
+}
+
+// ChangePlan moves the subscription in the URL to another widget's plan
+func (app *application) ChangePlan(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.changePlan(w, r, chi.URLParam(r, "id"), payload.WidgetID, payload.ProrationDate)
+}
+
+// SendChangePlanEmail emails a customer a signed link to change the plan of each of their
+// subscriptions. The response is the same whether or not the email address is known.
+func (app *application) SendChangePlanEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	var res struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	subscriptions, err := app.DB.GetSubscriptionsByEmail(payload.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	sign := urlsigner.Signer{
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposeChangePlan,
+	}
+
+	type planLink struct {
+		Plan string
+		Link string
+	}
+
+	var data struct {
+		Links []planLink
+	}
+
+	for _, s := range subscriptions {
+		if s.Status == models.SubscriptionCanceled {
+			continue
+		}
+
+		link := fmt.Sprintf("%s/change-plan/confirm?subscription=%s", app.config.frontend, s.StripeSubscriptionID)
+		data.Links = append(data.Links, planLink{Plan: s.Widget.Name, Link: sign.GenerateTokenFromString(link)})
+	}
+
+	if len(data.Links) > 0 {
+		err = app.SendMail("gowidgets@matthewgoodman.ca", payload.Email, "Change Your Plan", "change-plan", data)
+		if err != nil {
+			app.errorLog.Println(err)
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	res.Error = false
+	res.Message = fmt.Sprintf("If %s has a subscription, a link to change its plan has been sent", payload.Email)
+
+	_ = app.writeJSON(w, http.StatusCreated, res)
+}
+
+// PreviewCustomerPlanChange is PreviewPlanChange for a customer, who names their
+// subscription with the signed link they were emailed
+func (app *application) PreviewCustomerPlanChange(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	subscriptionID, err := app.changePlanSubscription(payload.Link)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.previewPlanChange(w, r, subscriptionID, payload.WidgetID)
+}
+
+// ChangeCustomerPlan is ChangePlan for a customer, who names their subscription with the
+// signed link they were emailed
+func (app *application) ChangeCustomerPlan(w http.ResponseWriter, r *http.Request) {
+	var payload planChangePayload
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	subscriptionID, err := app.changePlanSubscription(payload.Link)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.changePlan(w, r, subscriptionID, payload.WidgetID, payload.ProrationDate)
+}
+
+// changePlanSubscription returns the ID of the subscription a change-plan link is for. The
+// link is checked with every request, so it stops working when it expires.
+func (app *application) changePlanSubscription(link string) (string, error) {
+	signer := urlsigner.Signer{
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposeChangePlan,
+	}
+	if err := signer.VerifyToken(link); err != nil {
+		return "", fmt.Errorf("invalid link: %w", err)
+	}
+	if signer.Expired(link, int(urlsigner.ChangePlanTTL/time.Minute)) {
+		return "", errors.New("this link has expired; ask for a new one")
+	}
+
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Query().Get("subscription"), nil
+}
+
+// previewPlanChange sends what moving a subscription to the plan of widgetID would cost now
+func (app *application) previewPlanChange(w http.ResponseWriter, r *http.Request, subscriptionID string, widgetID int) {
+	subscription, widget, ok := app.planChangeTarget(w, r, subscriptionID, widgetID)
+	if !ok {
+		return
+	}
+
+	invoice, err := app.Gateway.PreviewPlanChange(subscription.StripeSubscriptionID, widget.PlanID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	res := planChangePreview{
+		OK:            true,
+		CurrentPlan:   subscription.Widget,
+		NewPlan:       widget,
+		Currency:      string(invoice.Currency),
+		ProrationDate: invoice.SubscriptionProrationDate,
+		NextPaymentAt: unixTime(invoice.NextPaymentAttempt),
+	}
+	if res.Currency == "" {
+		res.Currency = pricing.DefaultCurrency
+	}
+
+	// Only the prorated lines are invoiced at the time of the change
+	if invoice.Lines != nil {
+		for _, line := range invoice.Lines.Data {
+			if line.Proration {
+				res.ProratedAmount += int(line.Amount)
+			}
+		}
+	}
+	if res.ProratedAmount > 0 {
+		res.AmountDue = res.ProratedAmount
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// changePlan moves a subscription to the plan of widgetID and records the change as a new
+// transaction and order for the new widget. The order is for the full price of the plan;
+// the transaction is the prorated amount charged for the rest of the current period.
+func (app *application) changePlan(w http.ResponseWriter, r *http.Request, subscriptionID string, widgetID int, prorationDate int64) {
+	subscription, widget, ok := app.planChangeTarget(w, r, subscriptionID, widgetID)
+	if !ok {
+		return
+	}
+
+	previous, err := app.DB.GetOrderByPaymentIntent(subscription.StripeSubscriptionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.serverError(w, r, err)
+		return
+	}
+
+	stripeSubscription, err := app.Gateway.ChangePlan(subscription.StripeSubscriptionID, widget.PlanID, prorationDate)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	txn := models.Transaction{
+		Currency:            pricing.DefaultCurrency,
+		TransactionStatusID: 2,
+	}
+	if inv := stripeSubscription.LatestInvoice; inv != nil {
+		txn.Amount = int(inv.AmountPaid)
+		if inv.Currency != "" {
+			txn.Currency = string(inv.Currency)
+		}
+		if inv.Charge != nil {
+			txn.BankReturnCode = inv.Charge.ID
+		}
+	}
+	if previous != nil {
+		// The customer's card is charged again
+		txn.LastFour = previous.Transaction.LastFour
+		txn.ExpiryMonth = previous.Transaction.ExpiryMonth
+		txn.ExpiryYear = previous.Transaction.ExpiryYear
+	}
+
+	changed := subscriptionFromStripe(stripeSubscription)
+	changed.WidgetID = widget.ID
+	changed.CustomerID = subscription.CustomerID
+
+	note := fmt.Sprintf("Plan changed from %s to %s", subscription.Widget.Name, widget.Name)
+	before := subscription
+
+	var checkout models.Checkout
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		checkout, err = tx.ChangeSubscriptionPlan(r.Context(), changed, txn, models.Order{
+			StatusID: 1,
+			Quantity: 1,
+			Amount:   widget.Price,
+		}, note)
+		if err != nil {
+			return err
+		}
+
+		subscription, err = tx.GetSubscriptionByStripeID(subscription.StripeSubscriptionID)
+		if err != nil {
+			return err
+		}
+
+		entity := audit.Entity{Type: audit.EntitySubscription, ID: subscription.StripeSubscriptionID}
+		return app.recordAudit(tx, r, audit.ActionSubscriptionChangePlan, entity, before, subscription)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var res struct {
+		OK           bool                 `json:"ok"`
+		Message      string               `json:"message"`
+		OrderID      int                  `json:"order_id"`
+		Subscription *models.Subscription `json:"subscription"`
+	}
+	res.OK = true
+	res.Message = note
+	res.OrderID = checkout.OrderID
+	res.Subscription = subscription
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// planChangeTarget returns a subscription and the widget it is being moved to, after
+// checking that the move makes sense. Otherwise it sends an error and returns false.
+func (app *application) planChangeTarget(w http.ResponseWriter, r *http.Request, subscriptionID string, widgetID int) (*models.Subscription, models.Widget, bool) {
+	subscription, err := app.DB.GetSubscriptionByStripeID(subscriptionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such subscription"})
+		return nil, models.Widget{}, false
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, models.Widget{}, false
+	}
+
+	if subscription.Status == models.SubscriptionCanceled {
+		app.badRequest(w, r, errors.New("this subscription has been cancelled"))
+		return nil, models.Widget{}, false
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such plan"})
+		return nil, models.Widget{}, false
+	}
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, models.Widget{}, false
+	}
+
+	if !widget.IsRecurring || widget.PlanID == "" {
+		app.badRequest(w, r, fmt.Errorf("%s is not a plan", widget.Name))
+		return nil, models.Widget{}, false
+	}
+	if widget.ID == subscription.WidgetID {
+		app.badRequest(w, r, fmt.Errorf("this subscription is already on %s", widget.Name))
+		return nil, models.Widget{}, false
+	}
+
+	return subscription, widget, true
+}
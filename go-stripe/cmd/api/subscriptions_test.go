@@ -0,0 +1,88 @@
+package main
+
+import (
+	"myapp/internal/ratelimit"
+	"myapp/internal/urlsigner"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	goalone "github.com/bwmarrin/go-alone"
+)
+
+// changePlanLink returns a link to change the plan of a subscription, signed as
+// SendChangePlanEmail signs them
+func changePlanLink(app *application, subscriptionID string) string {
+	signer := urlsigner.Signer{
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposeChangePlan,
+	}
+	return signer.GenerateTokenFromString(app.config.frontend + "/change-plan/confirm?subscription=" + subscriptionID)
+}
+
+func TestChangeCustomerPlanLink(t *testing.T) {
+	app, _ := newTestApp(t)
+	link := changePlanLink(app, "sub_test")
+
+	// signedAgo returns a link signed age ago, by moving the clock back while signing it
+	signedAgo := func(age time.Duration) string {
+		crypt := goalone.New([]byte(app.config.secretkey), goalone.Timestamp, goalone.Epoch(int64(age/time.Second)))
+		data := app.config.frontend + "/change-plan/confirm?subscription=sub_test&purpose=" + urlsigner.PurposeChangePlan + "&hash="
+		return string(crypt.Sign([]byte(data)))
+	}
+
+	reset := urlsigner.Signer{Secret: []byte(app.config.secretkey), Purpose: urlsigner.PurposePasswordReset}
+
+	tests := []struct {
+		name     string
+		link     string
+		accepted bool
+	}{
+		{"signed link", link, true},
+		{"link about to expire", signedAgo(urlsigner.ChangePlanTTL - time.Minute), true},
+		{"expired link", signedAgo(urlsigner.ChangePlanTTL + time.Minute), false},
+		{"tampered link", strings.Replace(link, "sub_test", "sub_other", 1), false},
+		{"password reset link", reset.GenerateTokenFromString(app.config.frontend + "/reset-password?subscription=sub_test"), false},
+		{"no link", "", false},
+	}
+
+	for _, path := range []string{"/api/change-plan/preview", "/api/change-plan"} {
+		// Each path starts with a new rate limit
+		app.Limiter = ratelimit.New(ratelimit.NewMemoryStore(), app.errorLog)
+
+		for _, tt := range tests {
+			w := requestWithCSRF(t, app, http.MethodPost, path, map[string]interface{}{"link": tt.link, "widget_id": 1})
+
+			var res struct {
+				Error   bool   `json:"error"`
+				Message string `json:"message"`
+			}
+			decode(t, w, &res)
+
+			// Accepted links get as far as looking up the subscription, which is not there
+			accepted := w.Code == http.StatusNotFound && res.Message == "no such subscription"
+			if accepted != tt.accepted {
+				t.Errorf("%s to %s got %d: %s", tt.name, path, w.Code, w.Body)
+			}
+		}
+	}
+}
+
+func TestChangeCustomerPlanRateLimit(t *testing.T) {
+	app, _ := newTestApp(t)
+	link := changePlanLink(app, "sub_test")
+
+	for i := 0; i < changePlanLimit.Burst; i++ {
+		w := requestWithCSRF(t, app, http.MethodPost, "/api/change-plan/preview", map[string]interface{}{"link": link, "widget_id": 1})
+		if w.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d was limited", i+1)
+		}
+	}
+
+	// Previews and changes share the limit
+	w := requestWithCSRF(t, app, http.MethodPost, "/api/change-plan", map[string]interface{}{"link": link, "widget_id": 1})
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the limit got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
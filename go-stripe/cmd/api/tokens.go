@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxDeviceName is the longest device name stored with a token
+const maxDeviceName = 255
+
+// accessTokenTTL is how long an authentication token lasts. Clients get a new one before
+// then with their refresh token, which lasts refreshTokenTTL from the last refresh, so a
+// device stays logged in for as long as it is used at least that often.
+const (
+	accessTokenTTL  = 24 * time.Hour
+	refreshTokenTTL = 14 * 24 * time.Hour
+)
+
+// deviceName returns the name of the device a token is for: the name the client gave, or
+// its user agent
+func deviceName(name string, r *http.Request) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = r.UserAgent()
+	}
+	if name == "" {
+		name = "Unknown device"
+	}
+	if len(name) > maxDeviceName {
+		name = name[:maxDeviceName]
+	}
+	return name
+}
+
+// writeTokens sends a new authentication token and refresh token to the client
+func (app *application) writeTokens(w http.ResponseWriter, msg string, token, refreshToken *models.Token) {
+	var payload struct {
+		Error        bool          `json:"error"`
+		Message      string        `json:"message"`
+		Token        *models.Token `json:"authentication_token"`
+		RefreshToken *models.Token `json:"refresh_token"`
+	}
+
+	payload.Error = false
+	payload.Message = msg
+	payload.Token = token
+	payload.RefreshToken = refreshToken
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// RefreshAuthToken exchanges a refresh token for a new authentication token and refresh
+// token. A refresh token can only be used once; using it again logs its device out.
+func (app *application) RefreshAuthToken(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, token, refreshToken, err := app.DB.RefreshTokens(r.Context(), payload.RefreshToken, accessTokenTTL, refreshTokenTTL)
+	switch {
+	case errors.Is(err, models.ErrTokenReused):
+		app.errorLog.Printf("refresh token reused from %s; its device has been logged out", r.RemoteAddr)
+		app.invalidCredentials(w)
+		return
+	case errors.Is(err, models.ErrInvalidToken), errors.Is(err, sql.ErrNoRows):
+		app.invalidCredentials(w)
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeTokens(w, fmt.Sprintf("Token for user %s refreshed", user.Email), token, refreshToken)
+}
+
+// tokenOwner returns the ID of the user whose tokens a request is about: the user in the
+// URL on the user management routes, and the authenticated user otherwise
+func (app *application) tokenOwner(r *http.Request) (int, error) {
+	if id := chi.URLParam(r, "id"); id != "" {
+		return strconv.Atoi(id)
+	}
+	return app.userFromContext(r).ID, nil
+}
+
+// Tokens returns the devices a user is logged in on. The token of the request, if it is
+// one of them, is marked as current.
+func (app *application) Tokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.tokenOwner(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tokens, err := app.DB.GetTokensForUser(userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var currentHash []byte
+	if plainText, err := app.bearerToken(r); err == nil {
+		hash := sha256.Sum256([]byte(plainText))
+		currentHash = hash[:]
+	}
+
+	type device struct {
+		models.Token
+		Current bool `json:"current"`
+	}
+
+	var res struct {
+		OK     bool     `json:"ok"`
+		Tokens []device `json:"tokens"`
+	}
+	res.OK = true
+	res.Tokens = make([]device, 0, len(tokens))
+	for _, t := range tokens {
+		res.Tokens = append(res.Tokens, device{Token: t, Current: bytes.Equal(t.Hash, currentHash)})
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// RevokeToken logs a user out of one device
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.tokenOwner(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var found bool
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		found, err = tx.DeleteTokenForUser(tokenID, userID)
+		if err != nil || !found {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionTokenRevoke, audit.NewEntity(audit.EntityUser, userID), map[string]int{"token_id": tokenID}, nil)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+	if !found {
+		app.writeJSON(w, http.StatusNotFound, jsonResponse{OK: false, Message: "no such token"})
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Device logged out"})
+}
+
+// RevokeAllTokens logs a user out of every device, including the one making the request if
+// it is theirs
+func (app *application) RevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	userID, err := app.tokenOwner(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var n int64
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		n, err = tx.DeleteTokensForUser(userID)
+		if err != nil {
+			return err
+		}
+
+		return app.recordAudit(tx, r, audit.ActionTokenRevokeAll, audit.NewEntity(audit.EntityUser, userID), map[string]int64{"tokens": n}, nil)
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: fmt.Sprintf("Logged out of %d devices", n)})
+}
+
+// RevokeCurrentToken logs out the device making the request
+func (app *application) RevokeCurrentToken(w http.ResponseWriter, r *http.Request) {
+	plainText, err := app.bearerToken(r)
+	if err != nil {
+		app.invalidCredentials(w)
+		return
+	}
+
+	err = app.DB.DeleteToken(plainText)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Logged out"})
+}
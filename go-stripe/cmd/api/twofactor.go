@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/twofactor"
+	"net/http"
+)
+
+// twoFactorRequired tells the client the user's password was right, and that they must
+// send it again with a code from their authenticator app
+func (app *application) twoFactorRequired(w http.ResponseWriter) error {
+
+	var payload struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+	}
+
+	payload.Error = true
+	payload.Message = "Enter the code from your authenticator app"
+	payload.TwoFactorRequired = true
+
+	return app.writeJSON(w, http.StatusUnauthorized, payload)
+}
+
+// twoFactorError sends the response for an error from the two-factor service
+func (app *application) twoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, twofactor.ErrInvalidCode),
+		errors.Is(err, twofactor.ErrAlreadyEnabled),
+		errors.Is(err, twofactor.ErrNotEnabled),
+		errors.Is(err, models.ErrTwoFactorNotEnrolled):
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: err.Error()})
+	default:
+		app.serverError(w, r, err)
+	}
+}
+
+// TwoFactorStatus tells the authenticated user whether they have two-factor authentication
+// and how many recovery codes they have left
+func (app *application) TwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	state, err := app.DB.GetTwoFactor(app.userFromContext(r).ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	var res struct {
+		OK                bool `json:"ok"`
+		Enabled           bool `json:"enabled"`
+		RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	}
+	res.OK = true
+	res.Enabled = state.Enabled()
+	res.RecoveryCodesLeft = state.RecoveryCodesLeft
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// EnrollTwoFactor gives the authenticated user a new secret for their authenticator app
+func (app *application) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	enrollment, err := app.TwoFactor.Enroll(*app.userFromContext(r))
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+
+	var res struct {
+		OK bool `json:"ok"`
+		twofactor.Enrollment
+	}
+	res.OK = true
+	res.Enrollment = enrollment
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
+
+// ConfirmTwoFactor turns on two-factor authentication for the authenticated user once they
+// send a code for their new secret, and returns their recovery codes
+func (app *application) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	codes, err := app.TwoFactor.Confirm(r.Context(), app.userFromContext(r).ID, payload.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, "Two-factor authentication enabled", codes)
+}
+
+// DisableTwoFactor turns off two-factor authentication for the authenticated user, who
+// must send a code
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.TwoFactor.Disable(r.Context(), app.userFromContext(r).ID, payload.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes gives the authenticated user new recovery codes in place of
+// their old ones. They must send a code.
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	codes, err := app.TwoFactor.RegenerateRecoveryCodes(r.Context(), app.userFromContext(r).ID, payload.Code)
+	if err != nil {
+		app.twoFactorError(w, r, err)
+		return
+	}
+
+	app.writeRecoveryCodes(w, "New recovery codes generated", codes)
+}
+
+// writeRecoveryCodes sends recovery codes to the client, the only time they are shown
+func (app *application) writeRecoveryCodes(w http.ResponseWriter, msg string, codes []string) {
+	var res struct {
+		OK            bool     `json:"ok"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	res.OK = true
+	res.Message = msg
+	res.RecoveryCodes = codes
+
+	_ = app.writeJSON(w, http.StatusOK, res)
+}
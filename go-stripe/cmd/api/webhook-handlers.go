@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"myapp/internal/cart"
+	"myapp/internal/events"
+	"myapp/internal/models"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// StripeWebhook receives events from Stripe, verifies the Stripe-Signature header and
+// records the sale in the database. Events are handled once per Stripe event ID: an event
+// is recorded in the transaction that handles it, so it is either handled and recorded,
+// or neither, and handled again when Stripe retries.
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	maxBytes := 65536
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		app.errorLog.Println(err)
+		app.writeJSON(w, http.StatusServiceUnavailable, jsonResponse{OK: false, Message: "error reading request body"})
+		return
+	}
+
+	event, err := webhook.ConstructEvent(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhookSecret)
+	if err != nil {
+		app.errorLog.Println("invalid webhook signature:", err)
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{OK: false, Message: "invalid signature"})
+		return
+	}
+
+	// Stripe retries deliveries, and may deliver an event again while it is still being
+	// handled, so the event is claimed in the transaction that handles it
+	var processed bool
+	var publish func()
+	err = app.DB.WithTx(r.Context(), func(tx models.Repository) error {
+		claimed, err := tx.ClaimStripeEvent(models.StripeEvent{StripeEventID: event.ID, EventType: event.Type})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			processed = true
+			return nil
+		}
+
+		publish, err = app.handleStripeEvent(r.Context(), tx, event)
+		return err
+	})
+	if err != nil {
+		// A non-2xx status makes Stripe deliver the event again later
+		app.errorLog.Printf("error handling stripe event %s (%s): %s", event.ID, event.Type, err)
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{OK: false, Message: "error handling event"})
+		return
+	}
+	if processed {
+		app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "event already processed"})
+		return
+	}
+
+	// Changes are only published once they are committed
+	if publish != nil {
+		publish()
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true})
+}
+
+// handleStripeEvent dispatches a verified event to its handler, which makes its changes
+// through db. It returns a function publishing the changes, to be called once they are
+// committed, or nil if there is nothing to publish. Unknown event types are ignored.
+func (app *application) handleStripeEvent(ctx context.Context, db models.Repository, event stripe.Event) (func(), error) {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return nil, err
+		}
+		return app.paymentIntentSucceeded(ctx, db, &pi)
+
+	case "charge.refunded":
+		var ch stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &ch); err != nil {
+			return nil, err
+		}
+		return app.chargeRefunded(ctx, db, &ch)
+
+	case "invoice.paid":
+		var inv stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+			return nil, err
+		}
+		return app.invoicePaid(ctx, db, &inv)
+
+	case "invoice.payment_failed":
+		var inv stripe.Invoice
+		if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+			return nil, err
+		}
+		return nil, app.invoicePaymentFailed(db, &inv)
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted",
+		"customer.subscription.paused", "customer.subscription.resumed":
+		var subscription stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &subscription); err != nil {
+			return nil, err
+		}
+		err := app.syncSubscription(db, &subscription)
+		if err != nil {
+			return nil, err
+		}
+
+		if event.Type == "customer.subscription.deleted" {
+			return func() { app.publishCancellation(&subscription) }, nil
+		}
+		return nil, nil
+
+	default:
+		return nil, nil
+	}
+}
+
+// paymentIntentSucceeded records the sale for a one-time payment, unless the browser already
+// did, and empties the cart that was paid for
+func (app *application) paymentIntentSucceeded(ctx context.Context, db models.Repository, pi *stripe.PaymentIntent) (func(), error) {
+	if token := pi.Metadata["cart_token"]; token != "" {
+		err := db.ClearCart(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	txn := models.Transaction{
+		Amount:              int(pi.Amount),
+		Currency:            pi.Currency,
+		TransactionStatusID: 2,
+		PaymentIntent:       pi.ID,
+		StripePaymentID:     pi.ID,
+	}
+	if pi.PaymentMethod != nil {
+		txn.PaymentMethod = pi.PaymentMethod.ID
+	}
+
+	var billing *stripe.BillingDetails
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		ch := pi.Charges.Data[0]
+		txn.BankReturnCode = ch.ID
+		billing = ch.BillingDetails
+		if ch.PaymentMethodDetails != nil && ch.PaymentMethodDetails.Card != nil {
+			txn.LastFour = ch.PaymentMethodDetails.Card.Last4
+			txn.ExpiryMonth = int(ch.PaymentMethodDetails.Card.ExpMonth)
+			txn.ExpiryYear = int(ch.PaymentMethodDetails.Card.ExpYear)
+		}
+	}
+
+	// Payments without widgets (such as the virtual terminal) have no order
+	items, err := cart.FromMetadata(pi.Metadata)
+	if err != nil || len(items) == 0 {
+		return nil, app.recordPayment(db, txn)
+	}
+
+	// Only record an order when the payment matches the price of what was bought
+	quote, err := app.Pricing.QuoteItems(items)
+	if err == nil {
+		err = quote.Check(int(pi.Amount), pi.Currency)
+	}
+	if err != nil {
+		app.errorLog.Printf("payment intent %s does not match items %q: %s", pi.ID, cart.Encode(items), err)
+		return nil, app.recordPayment(db, txn)
+	}
+
+	var customer models.Customer
+	if billing != nil {
+		customer.FirstName, customer.LastName = splitName(billing.Name)
+		customer.Email = billing.Email
+	}
+	if customer.Email == "" {
+		customer.Email = pi.ReceiptEmail
+	}
+
+	checkout, err := db.CreateCheckout(ctx, customer, txn, models.Order{
+		StatusID: 1,
+		Amount:   txn.Amount,
+		Items:    quote.OrderItems(),
+	})
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { app.publishSale(checkout, txn) }, nil
+}
+
+// chargeRefunded records the refunds of a charge that are not in the refunds ledger yet,
+// such as those made in the Stripe dashboard. Recording them updates the status of the
+// transaction and its order.
+func (app *application) chargeRefunded(ctx context.Context, db models.Repository, ch *stripe.Charge) (func(), error) {
+	if ch.PaymentIntent == nil {
+		return nil, nil
+	}
+
+	txn, err := db.GetTransactionByPaymentIntent(ch.PaymentIntent.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ch.Refunds == nil {
+		return nil, nil
+	}
+
+	var recorded []events.Refund
+	var orderID int
+	order, err := db.GetOrderByPaymentIntent(ch.PaymentIntent.ID)
+	if err == nil {
+		orderID = order.ID
+	}
+
+	for _, refund := range ch.Refunds.Data {
+		if refund.Status == stripe.RefundStatusFailed || refund.Status == stripe.RefundStatusCanceled {
+			continue
+		}
+
+		reason := refund.Metadata["reason"]
+		if reason == "" {
+			reason = string(refund.Reason)
+		}
+
+		remaining, err := db.RecordRefund(ctx, models.Refund{
+			TransactionID:  txn.ID,
+			StripeRefundID: refund.ID,
+			Amount:         int(refund.Amount),
+			Reason:         reason,
+		})
+		if errors.Is(err, models.ErrRefundTooLarge) {
+			// Refunds recorded before the ledger had Stripe refund IDs cannot be matched
+			app.errorLog.Printf("refund %s of %s not recorded: %s", refund.ID, ch.PaymentIntent.ID, err)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		recorded = append(recorded, events.Refund{
+			OrderID:       orderID,
+			TransactionID: txn.ID,
+			Amount:        int(refund.Amount),
+			Remaining:     remaining,
+			Reason:        reason,
+		})
+	}
+
+	// Refunds made here were published when they were made, and are published again;
+	// the pages just load the sale once more
+	return func() {
+		for _, refund := range recorded {
+			app.publish(events.RefundIssued, refund)
+		}
+	}, nil
+}
+
+// invoicePaid records subscription payments. The first invoice is normally recorded by
+// CreateCustomerAndSubscribeToPlan; renewals are recorded as a new transaction and order.
+func (app *application) invoicePaid(ctx context.Context, db models.Repository, inv *stripe.Invoice) (func(), error) {
+	if inv.Subscription == nil {
+		return nil, nil
+	}
+
+	order, err := db.GetOrderByPaymentIntent(inv.Subscription.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if inv.BillingReason == stripe.InvoiceBillingReasonSubscriptionCreate && order != nil {
+		return nil, nil
+	}
+
+	var widgetID int
+	var customer models.Customer
+	if order != nil {
+		widgetID = order.WidgetID
+		customer.ID = order.CustomerID
+	} else {
+		// The browser never reached us, so build the order from the invoice
+		widget, err := db.GetWidgetByPlanID(invoicePlanID(inv))
+		if err != nil {
+			return nil, fmt.Errorf("no widget for subscription %s: %w", inv.Subscription.ID, err)
+		}
+		widgetID = widget.ID
+
+		var name string
+		if inv.CustomerName != nil {
+			name = *inv.CustomerName
+		}
+		customer.FirstName, customer.LastName = splitName(name)
+		customer.Email = inv.CustomerEmail
+	}
+
+	txn := models.Transaction{
+		Amount:              int(inv.AmountPaid),
+		Currency:            string(inv.Currency),
+		TransactionStatusID: 2,
+		PaymentIntent:       inv.Subscription.ID,
+		StripePaymentID:     inv.ID,
+	}
+	if inv.Charge != nil {
+		txn.BankReturnCode = inv.Charge.ID
+	}
+
+	checkout, err := db.CreateCheckout(ctx, customer, txn, models.Order{
+		WidgetID: widgetID,
+		StatusID: 1,
+		Quantity: 1,
+		Amount:   txn.Amount,
+	})
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	publish := func() { app.publishSale(checkout, txn) }
+
+	if order != nil {
+		// Renewals of a known subscription are tracked by customer.subscription.updated
+		return publish, nil
+	}
+
+	subscription := &stripe.Subscription{
+		ID:     inv.Subscription.ID,
+		Status: stripe.SubscriptionStatusActive,
+		Plan:   &stripe.Plan{ID: invoicePlanID(inv)},
+	}
+	if inv.Lines != nil && len(inv.Lines.Data) > 0 && inv.Lines.Data[0].Period != nil {
+		subscription.CurrentPeriodStart = inv.Lines.Data[0].Period.Start
+		subscription.CurrentPeriodEnd = inv.Lines.Data[0].Period.End
+	}
+
+	err = app.recordSubscription(db, subscription, widgetID, checkout.CustomerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return publish, nil
+}
+
+// invoicePaymentFailed records a declined transaction for a failed subscription payment
+func (app *application) invoicePaymentFailed(db models.Repository, inv *stripe.Invoice) error {
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	txn := models.Transaction{
+		Amount:              int(inv.AmountDue),
+		Currency:            string(inv.Currency),
+		TransactionStatusID: 3,
+		PaymentIntent:       inv.Subscription.ID,
+	}
+	if inv.Charge != nil {
+		txn.BankReturnCode = inv.Charge.ID
+	}
+
+	_, err := db.InsertTransaction(txn)
+	return err
+}
+
+// recordPayment records a payment that has no order, unless it was recorded already
+func (app *application) recordPayment(db models.Repository, txn models.Transaction) error {
+	_, err := db.InsertTransaction(txn)
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		return nil
+	}
+	return err
+}
+
+// invoicePlanID returns the plan (price) ID of the first line of an invoice
+func invoicePlanID(inv *stripe.Invoice) string {
+	if inv.Lines == nil || len(inv.Lines.Data) == 0 {
+		return ""
+	}
+
+	line := inv.Lines.Data[0]
+	if line.Price != nil {
+		return line.Price.ID
+	}
+	if line.Plan != nil {
+		return line.Plan.ID
+	}
+	return ""
+}
+
+// splitName splits a cardholder name into first and last names
+func splitName(name string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(name), " ", 2)
+	if len(parts) == 2 {
+		return parts[0], strings.TrimSpace(parts[1])
+	}
+	return parts[0], ""
+}
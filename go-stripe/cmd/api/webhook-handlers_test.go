@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"myapp/internal/audit"
+	"myapp/internal/cards"
+	"myapp/internal/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+	"github.com/stripe/stripe-go/v72/webhook"
+)
+
+// testWebhookSecret is the signing secret of the test application's webhook endpoint
+const testWebhookSecret = "whsec_test_secret"
+
+// stripeEvent returns the JSON of a Stripe event with an object as its data
+func stripeEvent(t *testing.T, id, eventType string, object interface{}) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"id":          id,
+		"object":      "event",
+		"type":        eventType,
+		"api_version": "2020-08-27",
+		"data":        map[string]json.RawMessage{"object": data},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return payload
+}
+
+// deliver posts an event to the webhook with a Stripe-Signature header for secret, as
+// webhook.GenerateTestSignedPayload does in later versions of stripe-go
+func deliver(t *testing.T, app *application, payload []byte, secret string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, secret))
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", bytes.NewReader(payload))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	return w
+}
+
+// newWebhookApp returns a test application that accepts events signed with
+// testWebhookSecret, with a widget to buy
+func newWebhookApp(t *testing.T) (*application, *sql.DB) {
+	t.Helper()
+
+	app, db := newTestApp(t)
+	app.config.stripe.webhookSecret = testWebhookSecret
+
+	seed(t, db,
+		`INSERT INTO statuses (id, name) VALUES (1, 'Cleared')`,
+		`INSERT INTO transaction_statuses (id, name) VALUES (1, 'Pending'), (2, 'Cleared')`,
+		`INSERT INTO widgets (id, name, inventory_level, price, slug) VALUES (1, 'Widget', 10, 1000, 'widget')`,
+	)
+
+	return app, db
+}
+
+// paymentIntent is the data of a payment_intent.succeeded event for two of widget 1
+var paymentIntent = map[string]interface{}{
+	"id":            "pi_test",
+	"object":        "payment_intent",
+	"amount":        2000,
+	"currency":      "cad",
+	"status":        "succeeded",
+	"receipt_email": "buyer@example.com",
+	"metadata":      map[string]string{"items": "1:2"},
+}
+
+// count returns the number of rows of a table
+func count(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestStripeWebhookBadSignature(t *testing.T) {
+	app, db := newWebhookApp(t)
+
+	payload := stripeEvent(t, "evt_1", "payment_intent.succeeded", paymentIntent)
+
+	w := deliver(t, app, payload, "whsec_wrong_secret")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// A payload changed after signing is rejected too
+	now := time.Now()
+	signature := hex.EncodeToString(webhook.ComputeSignature(now, payload, testWebhookSecret))
+	tampered := bytes.Replace(payload, []byte(`"amount":2000`), []byte(`"amount":1`), 1)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/webhooks/stripe", bytes.NewReader(tampered))
+	r.Header.Set("Stripe-Signature", fmt.Sprintf("t=%d,v1=%s", now.Unix(), signature))
+	w = httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("tampered payload got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if n := count(t, db, "stripe_events"); n != 0 {
+		t.Errorf("%d events recorded, want 0", n)
+	}
+	if n := count(t, db, "orders"); n != 0 {
+		t.Errorf("%d orders recorded, want 0", n)
+	}
+}
+
+func TestStripeWebhookRedelivery(t *testing.T) {
+	app, db := newWebhookApp(t)
+
+	payload := stripeEvent(t, "evt_1", "payment_intent.succeeded", paymentIntent)
+
+	var res jsonResponse
+	w := deliver(t, app, payload, testWebhookSecret)
+	decode(t, w, &res)
+	if w.Code != http.StatusOK || !res.OK {
+		t.Fatalf("first delivery got %d: %s", w.Code, w.Body)
+	}
+
+	w = deliver(t, app, payload, testWebhookSecret)
+	decode(t, w, &res)
+	if w.Code != http.StatusOK || res.Message != "event already processed" {
+		t.Errorf("second delivery got %d: %s", w.Code, w.Body)
+	}
+
+	// A different event for the same payment does not record it again either
+	w = deliver(t, app, stripeEvent(t, "evt_2", "payment_intent.succeeded", paymentIntent), testWebhookSecret)
+	if w.Code != http.StatusOK {
+		t.Errorf("event for the same payment got %d: %s", w.Code, w.Body)
+	}
+
+	if n := count(t, db, "orders"); n != 1 {
+		t.Errorf("%d orders recorded, want 1", n)
+	}
+	if n := count(t, db, "transactions"); n != 1 {
+		t.Errorf("%d transactions recorded, want 1", n)
+	}
+
+	var inventory int
+	if err := db.QueryRow(`SELECT inventory_level FROM widgets WHERE id = 1`).Scan(&inventory); err != nil {
+		t.Fatal(err)
+	}
+	if inventory != 8 {
+		t.Errorf("inventory is %d, want 8", inventory)
+	}
+}
+
+func TestStripeWebhookUnknownEvent(t *testing.T) {
+	app, db := newWebhookApp(t)
+
+	payload := stripeEvent(t, "evt_1", "customer.created", map[string]string{"id": "cus_test", "object": "customer"})
+
+	w := deliver(t, app, payload, testWebhookSecret)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// The event is claimed, so it is not looked at again
+	if n := count(t, db, "stripe_events"); n != 1 {
+		t.Errorf("%d events recorded, want 1", n)
+	}
+}
+
+// virtualTerminalCharge makes a charge through the fake gateway as the virtual terminal
+// page does, and returns the payment intent
+func virtualTerminalCharge(t *testing.T, app *application) *stripe.PaymentIntent {
+	t.Helper()
+
+	gateway := cards.NewFakeGateway()
+	app.Gateway = gateway
+
+	pi, _, err := gateway.CreatePaymentIntent("cad", 5000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err = gateway.ConfirmPaymentIntent(pi.ID, "pm_card_visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pi
+}
+
+// virtualTerminalSucceeded posts a virtual terminal charge as the page does once it has
+// been confirmed
+func virtualTerminalSucceeded(t *testing.T, app *application, token string, pi *stripe.PaymentIntent) {
+	t.Helper()
+
+	w := request(t, app, http.MethodPost, "/api/admin/virtual-terminal-succeeded", token, map[string]interface{}{
+		"amount":         pi.Amount,
+		"currency":       pi.Currency,
+		"email":          "customer@example.com",
+		"payment_intent": pi.ID,
+		"payment_method": pi.PaymentMethod.ID,
+	})
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), `"error": true`) {
+		t.Fatalf("virtual terminal charge got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestVirtualTerminalRecordedOnce(t *testing.T) {
+	for _, webhookFirst := range []bool{false, true} {
+		app, db := newWebhookApp(t)
+		token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionVirtualTerminal))
+		pi := virtualTerminalCharge(t, app)
+
+		webhook := func() {
+			w := deliver(t, app, stripeEvent(t, "evt_1", "payment_intent.succeeded", pi), testWebhookSecret)
+			if w.Code != http.StatusOK {
+				t.Fatalf("webhook got %d: %s", w.Code, w.Body)
+			}
+		}
+
+		if webhookFirst {
+			webhook()
+			virtualTerminalSucceeded(t, app, token, pi)
+		} else {
+			virtualTerminalSucceeded(t, app, token, pi)
+			webhook()
+		}
+
+		if n := count(t, db, "transactions"); n != 1 {
+			t.Errorf("webhook first %v: %d transactions recorded, want 1", webhookFirst, n)
+		}
+
+		// The charge is audited whichever recorded it
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM audit_events WHERE action = ?`, audit.ActionVirtualTerminalCharge).Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 1 {
+			t.Errorf("webhook first %v: %d audit events, want 1", webhookFirst, n)
+		}
+	}
+}
+
+// chargelessGateway returns payment intents without their charges, as Stripe does when
+// they are not expanded
+type chargelessGateway struct {
+	cards.PaymentGateway
+}
+
+func (g chargelessGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	pi, err := g.PaymentGateway.RetrievePaymentIntent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	out := *pi
+	out.Charges = nil
+	return &out, nil
+}
+
+func TestVirtualTerminalWithoutCharges(t *testing.T) {
+	app, db := newWebhookApp(t)
+	token := loginToken(t, app, seedUser(t, db, "admin@example.com", models.PermissionVirtualTerminal))
+	pi := virtualTerminalCharge(t, app)
+	app.Gateway = chargelessGateway{app.Gateway}
+
+	virtualTerminalSucceeded(t, app, token, pi)
+
+	if n := count(t, db, "transactions"); n != 1 {
+		t.Errorf("%d transactions recorded, want 1", n)
+	}
+}
@@ -10,14 +10,24 @@ import (
 )
 
 type Order struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	CreatedAt time.Time `json:"created_at"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
+	ID        int         `json:"id"`
+	Quantity  int         `json:"quantity"`
+	Amount    int         `json:"amount"`
+	Product   string      `json:"product"`
+	Items     []OrderItem `json:"items"`
+	CreatedAt time.Time   `json:"created_at"`
+	FirstName string      `json:"first_name"`
+	LastName  string      `json:"last_name"`
+	Email     string      `json:"email"`
+}
+
+// OrderItem is one line of an order. Orders sent without items are a single line made
+// of Product, Quantity and Amount.
+type OrderItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
 }
 
 // CreateAndSendInvoice creates and sends an email with an invoice
@@ -89,14 +99,23 @@ func (app *application) createInvoicePDF(order Order) error {
 	pdf.Ln(5)
 	pdf.CellFormat(97, 8, order.CreatedAt.Format("2006-01-02"), "", 0, "L", false, 0, "")
 
-	// Add Products to Invoice Table
-	pdf.SetX(58)
-	pdf.SetY(93)
-	pdf.CellFormat(155, 8, order.Product, "", 0, "L", false, 0, "")
-	pdf.SetX(166)
-	pdf.CellFormat(20, 8, fmt.Sprintf("%d", order.Quantity), "", 0, "C", false, 0, "")
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(order.Amount/100.0)), "", 0, "R", false, 0, "")
+	// Add Products to Invoice Table, one row per item
+	items := order.Items
+	if len(items) == 0 {
+		items = []OrderItem{{Product: order.Product, Quantity: order.Quantity, Amount: order.Amount}}
+	}
+
+	y := 93.0
+	for _, item := range items {
+		pdf.SetX(58)
+		pdf.SetY(y)
+		pdf.CellFormat(155, 8, item.Product, "", 0, "L", false, 0, "")
+		pdf.SetX(166)
+		pdf.CellFormat(20, 8, fmt.Sprintf("%d", item.Quantity), "", 0, "C", false, 0, "")
+		pdf.SetX(185)
+		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float64(item.Amount)/100.0), "", 0, "R", false, 0, "")
+		y += 8
+	}
 
 	// Save PDF
 	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"myapp/internal/eventbus"
+	"myapp/internal/events"
+	"myapp/internal/hub"
+	"time"
+)
+
+// Topics of the messages the web servers send each other on the event bus
+const (
+	// busTopicEvent is for events.Event, sent to the users allowed to see them
+	busTopicEvent = "ws.event"
+	// busTopicLogout is for WsJsonResponse, sent to the user it logs out
+	busTopicLogout = "ws.logout"
+)
+
+// publishToBus publishes v as JSON on a topic of the event bus
+func (app *application) publishToBus(ctx context.Context, topic string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return app.Bus.Publish(ctx, topic, payload)
+}
+
+// listenToBus hands the messages of the event bus to the WebSocket hub, so that what
+// happens on any instance reaches the browsers connected to this one. It runs until the
+// program exits.
+func (app *application) listenToBus() {
+	for {
+		err := app.Bus.Subscribe(context.Background(), app.handleBusMessage)
+		app.errorLog.Println("subscribing to event bus:", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// handleBusMessage sends a message of the event bus to the connections it is for. Sending
+// a message twice only makes pages load what changed twice.
+func (app *application) handleBusMessage(msg eventbus.Message) {
+	switch msg.Topic {
+	case busTopicEvent:
+		var e events.Event
+		err := json.Unmarshal(msg.Payload, &e)
+		if err == nil && e.Type == events.UserUpdated {
+			// The user's role may have changed, and with it what they may be sent
+			err = app.refreshRole(e)
+		}
+		if err == nil {
+			err = app.broadcast(e)
+		}
+		if err != nil {
+			app.errorLog.Printf("event bus message %d: %s", msg.ID, err)
+		}
+
+	case busTopicLogout:
+		var response WsJsonResponse
+		err := json.Unmarshal(msg.Payload, &response)
+		if err == nil {
+			err = app.Hub.Send(hub.User(response.UserID), response)
+		}
+		if err != nil {
+			app.errorLog.Printf("event bus message %d: %s", msg.ID, err)
+		}
+
+	default:
+		app.errorLog.Printf("event bus message %d has unknown topic %q", msg.ID, msg.Topic)
+	}
+}
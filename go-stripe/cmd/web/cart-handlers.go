@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"myapp/internal/cart"
+	"myapp/internal/pricing"
+	"net/http"
+	"strconv"
+)
+
+// cartLine is one line of the cart page
+type cartLine struct {
+	WidgetID int
+	Name     string
+	Price    int
+	Quantity int
+	Amount   int
+}
+
+// getCart returns the cart kept in the user's session
+func (app *application) getCart(r *http.Request) cart.Cart {
+	c, ok := app.Session.Get(r.Context(), "cart").(cart.Cart)
+	if !ok {
+		return cart.Cart{}
+	}
+	return c
+}
+
+// putCart stores the cart in the user's session
+func (app *application) putCart(r *http.Request, c cart.Cart) {
+	if c.Empty() {
+		app.Session.Remove(r.Context(), "cart")
+		return
+	}
+	app.Session.Put(r.Context(), "cart", c)
+}
+
+// ShowCart displays the cart, with a checkout form when it is not empty
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	c := app.getCart(r)
+
+	data := make(map[string]interface{})
+	intMap := make(map[string]int)
+	stringMap := make(map[string]string)
+
+	if !c.Empty() {
+		quote, err := app.Pricing.QuoteItems(c.Items)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		var lines []cartLine
+		for _, line := range quote.Lines {
+			lines = append(lines, cartLine{
+				WidgetID: line.Widget.ID,
+				Name:     line.Widget.Name,
+				Price:    line.Widget.Price,
+				Quantity: line.Quantity,
+				Amount:   line.Amount,
+			})
+		}
+		data["lines"] = lines
+		intMap["total"] = quote.Amount
+
+		// Sent to the api by stripe-js to create the payment intent
+		items, err := json.Marshal(c.Items)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		stringMap["cart_items"] = string(items)
+	}
+
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data:      data,
+		IntMap:    intMap,
+		StringMap: stringMap,
+	}, "stripe-js"); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// AddToCart adds the posted widget and quantity to the cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := app.cartForm(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+	if quantity == 0 {
+		quantity = 1
+	}
+
+	widget, err := app.DB.GetWidget(widgetID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.clientError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if widget.IsRecurring {
+		app.clientError(w, http.StatusBadRequest, pricing.ErrRecurring)
+		return
+	}
+
+	c := app.getCart(r)
+	if err := c.Add(widgetID, quantity); err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+	app.putCart(r, c)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// UpdateCart sets the quantity of a widget in the cart. A quantity of 0 removes it.
+func (app *application) UpdateCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, quantity, err := app.cartForm(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c := app.getCart(r)
+	if err := c.Update(widgetID, quantity); err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+	app.putCart(r, c)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// RemoveFromCart takes a widget out of the cart
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	widgetID, _, err := app.cartForm(r)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c := app.getCart(r)
+	if err := c.Remove(widgetID); err != nil && !errors.Is(err, cart.ErrNotInCart) {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+	app.putCart(r, c)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// cartForm reads the widget_id and optional quantity fields posted by the cart forms
+func (app *application) cartForm(r *http.Request) (int, int, error) {
+	if err := r.ParseForm(); err != nil {
+		return 0, 0, err
+	}
+
+	widgetID, err := strconv.Atoi(r.Form.Get("widget_id"))
+	if err != nil {
+		return 0, 0, errors.New("invalid widget_id")
+	}
+
+	var quantity int
+	if q := r.Form.Get("quantity"); q != "" {
+		quantity, err = strconv.Atoi(q)
+		if err != nil {
+			return 0, 0, errors.New("invalid quantity")
+		}
+	}
+
+	return widgetID, quantity, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myapp/internal/events"
+	"myapp/internal/hub"
+	"myapp/internal/models"
+	"net/http"
+)
+
+// eventPermissions is the permission users need to be sent each type of event
+var eventPermissions = map[string]string{
+	events.SaleCreated:           models.PermissionViewSales,
+	events.RefundIssued:          models.PermissionViewSales,
+	events.SubscriptionCancelled: models.PermissionViewSubscriptions,
+	events.UserUpdated:           models.PermissionViewUsers,
+}
+
+// ReceiveEvent takes an event posted by the api with the internal secret and publishes it
+// on the event bus, for every web server to send to the pages of the users allowed to see it
+func (app *application) ReceiveEvent(w http.ResponseWriter, r *http.Request) {
+	if !events.Authorized(r, app.config.internalSecret) {
+		app.clientError(w, http.StatusForbidden, errors.New("event posted without the internal secret"))
+		return
+	}
+
+	var e events.Event
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&e)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, ok := eventPermissions[e.Type]; !ok {
+		app.clientError(w, http.StatusBadRequest, fmt.Errorf("unknown event type %q", e.Type))
+		return
+	}
+
+	err = app.publishToBus(r.Context(), busTopicEvent, e)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// broadcast sends an event to the WebSocket connections of the users whose role has the
+// permission its type needs
+func (app *application) broadcast(e events.Event) error {
+	permission, ok := eventPermissions[e.Type]
+	if !ok {
+		return fmt.Errorf("unknown event type %q", e.Type)
+	}
+
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		return err
+	}
+
+	for _, role := range roles {
+		for _, p := range role.Permissions {
+			if p != permission {
+				continue
+			}
+			err = app.Hub.Send(hub.Role(role.ID), e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// refreshRole gives the connections of the user of a UserUpdated event the role the user
+// has now. Deleted users are logged out instead.
+func (app *application) refreshRole(e events.Event) error {
+	var data events.User
+	err := json.Unmarshal(e.Data, &data)
+	if err != nil {
+		return err
+	}
+
+	user, err := app.DB.GetOneUser(data.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return app.Hub.SetRole(user.ID, user.RoleID)
+}
+
+// publish sends an event that happened in the web server to the pages that show it, on
+// every instance
+func (app *application) publish(eventType string, data interface{}) {
+	e, err := events.New(eventType, data)
+	if err == nil {
+		err = app.publishToBus(context.Background(), busTopicEvent, e)
+	}
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+}
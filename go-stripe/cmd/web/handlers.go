@@ -1,12 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
-	"myapp/internal/cards"
+	"myapp/internal/audit"
+	"myapp/internal/cart"
+	"myapp/internal/clientip"
 	"myapp/internal/encryption"
+	"myapp/internal/events"
 	"myapp/internal/models"
 	"myapp/internal/urlsigner"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v72"
 )
 
 // Displays the home page
@@ -43,6 +46,7 @@ type TransactionData struct {
 	ExpiryMonth     int
 	ExpiryYear      int
 	BankReturnCode  string
+	Items           []cart.Item
 }
 
 // GetTransactionData reads the posted data and stripe
@@ -61,26 +65,19 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	email := r.Form.Get("cardholder_email")
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
-	amount, err := strconv.Atoi(paymentAmount)
+
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+	// Amount and currency come from the payment intent, never from the form
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return txnData, fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status)
 	}
 
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
-	if err != nil {
-		app.errorLog.Println(err)
-		return txnData, err
-	}
-
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.errorLog.Println(err)
 		return txnData, err
@@ -99,82 +96,60 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: pi.Currency,
 		LastFour:        lastfour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
-		BankReturnCode:  pi.Charges.Data[0].ID,
 	}
-
-	return txnData, nil
-}
-
-// VirtualTerminalPaymentSucceeded displays receipt page for virtual terminal transactions
-func (app *application) VirtualTerminalPaymentSucceeded(w http.ResponseWriter, r *http.Request) {
-	txnData, err := app.GetTransactionData(r)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+	if pi.Charges != nil && len(pi.Charges.Data) > 0 {
+		txnData.BankReturnCode = pi.Charges.Data[0].ID
 	}
 
-	// Create New Transaction
-	transaction := models.Transaction{
-		Amount:              txnData.PaymentAmount,
-		Currency:            txnData.PaymentCurrency,
-		LastFour:            txnData.LastFour,
-		ExpiryMonth:         txnData.ExpiryMonth,
-		ExpiryYear:          txnData.ExpiryYear,
-		BankReturnCode:      txnData.BankReturnCode,
-		PaymentIntent:       txnData.PaymentIntentID,
-		PaymentMethod:       txnData.PaymentMethodID,
-		TransactionStatusID: 2,
-	}
-	_, err = app.SaveTransaction(transaction)
+	// Set by the api when it created the payment intent
+	txnData.Items, err = cart.FromMetadata(pi.Metadata)
 	if err != nil {
-		app.errorLog.Println(err)
-		return
+		return txnData, err
 	}
 
-	// Write data to session and redirect user to new page
-	app.Session.Put(r.Context(), "receipt", txnData)
-	http.Redirect(w, r, "/virtual-terminal-receipt", http.StatusSeeOther)
-}
-
-type Invoice struct {
-	ID        int       `json:"id"`
-	Quantity  int       `json:"quantity"`
-	Amount    int       `json:"amount"`
-	Product   string    `json:"product"`
-	CreatedAt time.Time `json:"created_at"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
+	return txnData, nil
 }
 
 // PaymentSucceeded displays receipt page for store checkout transactions
 func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
-		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest, err)
 		return
 	}
 
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.serverError(w, err)
 		return
 	}
 
-	widgetID, _ := strconv.Atoi(r.Form.Get("product_id")) // Ignoring error!
+	// The cart has been paid for, whatever happens next
+	if r.Form.Get("cart_items") != "" {
+		app.putCart(r, cart.Cart{})
+	}
 
-	// Create New Customer
-	customerID, err := app.SaveCustomer(txnData.FirstName, txnData.LastName, txnData.Email)
+	// Make sure the customer paid the price of what they are buying
+	quote, err := app.Pricing.QuoteItems(txnData.Items)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.clientError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := quote.Check(txnData.PaymentAmount, txnData.PaymentCurrency); err != nil {
+		app.clientError(w, http.StatusBadRequest, fmt.Errorf("payment intent %s: %w", txnData.PaymentIntentID, err))
 		return
 	}
 
-	// Create New Transaction
+	// Create new customer, transaction and order in one go
+	customer := models.Customer{
+		FirstName: txnData.FirstName,
+		LastName:  txnData.LastName,
+		Email:     txnData.Email,
+	}
 
 	transaction := models.Transaction{
 		Amount:              txnData.PaymentAmount,
@@ -186,95 +161,43 @@ func (app *application) PaymentSucceeded(w http.ResponseWriter, r *http.Request)
 		PaymentIntent:       txnData.PaymentIntentID,
 		PaymentMethod:       txnData.PaymentMethodID,
 		TransactionStatusID: 2,
-	}
-	transactionID, err := app.SaveTransaction(transaction)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
+		StripePaymentID:     txnData.PaymentIntentID,
 	}
 
-	// Create New Order
 	order := models.Order{
-		WidgetID:      widgetID,
-		TransactionID: transactionID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
-	}
-	orderID, err := app.SaveOrder(order)
-	if err != nil {
-		app.errorLog.Println(err)
-		return
-	}
-
-	// Call Invoice Microservice
-	invoice := Invoice{
-		ID:        orderID,
-		Quantity:  order.Amount,
-		Product:   "Widget",
-		Amount:    order.Amount,
-		FirstName: txnData.FirstName,
-		LastName:  txnData.LastName,
-		Email:     txnData.Email,
+		StatusID:  1,
+		Amount:    quote.Amount,
+		Items:     quote.OrderItems(),
 		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
 
-	err = app.callInvoiceMicroservice(invoice)
+	// The order's invoice is queued with it, and sent to the invoice microservice in the
+	// background
+	checkout, err := app.DB.CreateCheckout(r.Context(), customer, transaction, order)
+	if errors.Is(err, models.ErrPaymentRecorded) {
+		// The Stripe webhook recorded this sale already
+		app.Session.Put(r.Context(), "receipt", txnData)
+		http.Redirect(w, r, "/receipt", http.StatusSeeOther)
+		return
+	}
 	if err != nil {
-		app.errorLog.Println(err)
+		app.serverError(w, err)
+		return
 	}
 
+	app.publish(events.SaleCreated, events.Sale{
+		OrderID:       checkout.OrderID,
+		TransactionID: checkout.TransactionID,
+		Amount:        transaction.Amount,
+		Currency:      transaction.Currency,
+	})
+
 	// Write data to session and redirect user to new page
 	app.Session.Put(r.Context(), "receipt", txnData)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 }
 
-// callInvoiceMicroservice calls the invoice microservice
-func (app *application) callInvoiceMicroservice(invoice Invoice) error {
-	// Encode the invoice data as JSON
-	json, err := json.MarshalIndent(invoice, "", "\t")
-	if err != nil {
-		return err
-	}
-
-	// Create a new POST request to the invoice microservice
-	req, err := http.NewRequest("POST", "http://localhost:5000/invoice/create-and-send", bytes.NewBuffer(json))
-	if err != nil {
-		return err
-	}
-
-	// Set Header
-	req.Header.Set("Content-Type", "application/json")
-
-	// Create a new HTTP client and send the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	// Check the response status code
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("invoice microservice returned non-200 status code")
-	}
-
-	return nil
-}
-
-// Displays the receipt page for virtual terminal transactions
-func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Request) {
-	txn := app.Session.Pop(r.Context(), "receipt").(TransactionData)
-	data := make(map[string]interface{})
-	data["txn"] = txn
-	if err := app.renderTemplate(w, r, "virtual-terminal-receipt", &templateData{Data: data}); err != nil {
-		app.errorLog.Println(err)
-	}
-}
-
 // Displays the receipt page for store checkout transactions
 func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	txn := app.Session.Pop(r.Context(), "receipt").(TransactionData)
@@ -285,42 +208,6 @@ func (app *application) Receipt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// SaveCustomer saves a customer to the database and returns the ID
-func (app *application) SaveCustomer(firstName, lastName, email string) (int, error) {
-	customer := models.Customer{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-	}
-
-	id, err := app.DB.InsertCustomer(customer)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// SaveTransaction saves a transaction to the database and returns the ID
-func (app *application) SaveTransaction(transaction models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(transaction)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
-// SaveOrder saves an order to the database and returns the ID
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
-	if err != nil {
-		return 0, err
-	}
-
-	return id, nil
-}
-
 // Displays page to buy one widget
 func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 
@@ -341,30 +228,104 @@ func (app *application) ChargeOnce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Displays page to buy Bronze plan subscription
-func (app *application) BronzePlan(w http.ResponseWriter, r *http.Request) {
-
-	widget, err := app.DB.GetWidget(2)
+// Plans displays every subscription plan
+func (app *application) Plans(w http.ResponseWriter, r *http.Request) {
+	widgets, err := app.DB.GetRecurringWidgets()
 	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["plans"] = widgets
+
+	if err := app.renderTemplate(w, r, "plans", &templateData{Data: data}); err != nil {
 		app.errorLog.Println(err)
+	}
+}
+
+// Plan displays the page to subscribe to the plan with the slug in the URL
+func (app *application) Plan(w http.ResponseWriter, r *http.Request) {
+	slug := chi.URLParam(r, "slug")
+
+	widget, err := app.DB.GetWidgetBySlug(slug)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !widget.IsRecurring) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
 		return
 	}
 
 	data := make(map[string]interface{})
 	data["widget"] = widget
 
-	if err := app.renderTemplate(w, r, "bronze-plan", &templateData{Data: data}, "stripe-js"); err != nil {
+	if err := app.renderTemplate(w, r, "plan", &templateData{Data: data}, "stripe-js"); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
 // Displays the receipt page for subscription transactions
-func (app *application) BronzePlanReceipt(w http.ResponseWriter, r *http.Request) {
+func (app *application) PlanReceipt(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "receipt-plan", &templateData{}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
+// ChangePlanRequest displays the page where customers ask for a link to change their plan
+func (app *application) ChangePlanRequest(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "change-plan-request", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// ShowChangePlan displays the page to move a subscription to another plan. It is only
+// reached through the signed link emailed by the api, until the link expires.
+func (app *application) ShowChangePlan(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("%s%s", app.config.frontend, r.RequestURI)
+
+	signer := urlsigner.Signer{
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposeChangePlan,
+	}
+	if err := signer.VerifyToken(testURL); err != nil {
+		app.clientError(w, http.StatusForbidden, fmt.Errorf("invalid URL - tampering detected: %w", err))
+		return
+	}
+	if signer.Expired(testURL, int(urlsigner.ChangePlanTTL/time.Minute)) {
+		app.clientError(w, http.StatusForbidden, errors.New("URL expired"))
+		return
+	}
+
+	subscription, err := app.DB.GetSubscriptionByStripeID(r.URL.Query().Get("subscription"))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	plans, err := app.DB.GetRecurringWidgets()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// The page names the subscription to the api with the signed link, which the api checks
+	// again, so the page stops working when the link expires
+	data := make(map[string]interface{})
+	data["subscription"] = subscription
+	data["plans"] = plans
+	data["link"] = testURL
+
+	if err := app.renderTemplate(w, r, "change-plan", &templateData{Data: data}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 // Authentication Handlers
 // LoginPage displays the login page
 func (app *application) LoginPage(w http.ResponseWriter, r *http.Request) {
@@ -386,18 +347,103 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
+	// Refuse accounts and addresses with too many failed logins
+	err = app.Lockout.Check(email, clientip.FromRequest(r))
+	if err != nil {
+		app.errorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	id, err := app.DB.Authenticate(email, password)
+	if errors.Is(err, models.ErrUserDisabled) {
+		// The password was right, so this is not a guess to count
+		app.infoLog.Printf("Refused login to disabled account %s", email)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 	if err != nil || id == 0 {
+		app.loginFailed(r, email)
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
 		return
 	}
 
+	// Users with two-factor authentication need a second step before they get a session
+	ok, err := app.twoFactorPassed(r, id)
+	if err != nil {
+		app.errorLog.Println(err)
+	}
+	if !ok {
+		app.loginFailed(r, email)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Lockout.Succeed(email); err != nil {
+		app.errorLog.Println(err)
+	}
+
 	app.Session.Put(r.Context(), "userID", id)
+	// Logging in starts a new CSRF token too
+	app.Session.Remove(r.Context(), csrfSessionKey)
+
+	// Remember the session is the user's, so it can be ended if they are disabled or deleted
+	err = app.DB.AddUserSession(id, app.Session.Token(r.Context()), app.Session.Deadline(r.Context()))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// loginFailed counts a failed login. The api server emails users whose account it locks.
+func (app *application) loginFailed(r *http.Request, email string) {
+	locked, err := app.Lockout.Fail(email, clientip.FromRequest(r))
+	if err != nil {
+		app.errorLog.Println("counting failed login:", err)
+		return
+	}
+	if locked {
+		app.infoLog.Printf("Locked out %s after too many failed logins from %s", email, clientip.FromRequest(r))
+	}
+}
+
+// twoFactorPassed reports whether the user logging in with a login form has passed
+// two-factor authentication, if they have it. The login page sends the authentication
+// token the api only issues once the user has given their code; a code may also be sent
+// in the form instead.
+func (app *application) twoFactorPassed(r *http.Request, userID int) (bool, error) {
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		return false, err
+	}
+	if !user.TwoFactor {
+		return true, nil
+	}
+
+	if token := r.Form.Get("authentication_token"); token != "" {
+		tokenUser, err := app.DB.GetUserForToken(token, models.ScopeAuthentication)
+		if err == nil && tokenUser.ID == userID {
+			return true, nil
+		}
+	}
+
+	return app.TwoFactor.Verify(userID, r.Form.Get("code"))
+}
+
+// TwoFactorSettings displays the page where users set up two-factor authentication
+func (app *application) TwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 // Logout handles the logout request
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := app.DB.DeleteUserSession(app.Session.Token(r.Context())); err != nil {
+		app.errorLog.Println(err)
+	}
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
@@ -418,14 +464,27 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 
 	// Check if the URL is valid and not expired
 	signer := urlsigner.Signer{
-		Secret: []byte(app.config.secretkey),
+		Secret:  []byte(app.config.secretkey),
+		Purpose: urlsigner.PurposePasswordReset,
+	}
+	if err := signer.VerifyToken(testURL); err != nil {
+		app.clientError(w, http.StatusForbidden, fmt.Errorf("invalid URL - tampering detected: %w", err))
+		return
+	}
+	if signer.Expired(testURL, int(models.PasswordResetTTL/time.Minute)) {
+		app.clientError(w, http.StatusForbidden, errors.New("URL expired"))
+		return
 	}
-	if !signer.VerifyToken(testURL) {
-		app.errorLog.Println("Invalid URL - tampering detected")
+
+	// Each link only works once, and not after the password has changed some other way
+	nonce := r.URL.Query().Get("nonce")
+	reset, err := app.DB.GetPasswordReset(nonce)
+	if err != nil && !errors.Is(err, models.ErrPasswordResetInvalid) {
+		app.serverError(w, err)
 		return
 	}
-	if signer.Expired(testURL, 60) {
-		app.errorLog.Println("URL expired")
+	if err != nil || !reset.Usable(time.Now()) {
+		app.clientError(w, http.StatusForbidden, models.ErrPasswordResetInvalid)
 		return
 	}
 
@@ -441,6 +500,7 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 
 	data := make(map[string]interface{})
 	data["email"] = encryptedEmail
+	data["nonce"] = nonce
 
 	if err := app.renderTemplate(w, r, "reset-password", &templateData{Data: data}); err != nil {
 		app.errorLog.Println(err)
@@ -454,6 +514,14 @@ func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// InvoiceJobs displays the invoices queued for the invoice microservice, to retry those
+// that failed
+func (app *application) InvoiceJobs(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "invoice-jobs", &templateData{}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
 // AllSubscriptions displays all subscriptions
 func (app *application) AllSubscriptions(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "all-subscriptions", &templateData{}); err != nil {
@@ -469,22 +537,25 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["refund-url"] = "/api/admin/refund"
 	stringMap["refund-btn"] = "Refund Order"
 	stringMap["refund-success-msg"] = "Transaction refunded successfully"
+	stringMap["restock"] = "true"
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{StringMap: stringMap}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
 
-// ShowSubscription displays a subscription
+// ShowSubscription displays a subscription with the actions to pause, resume or cancel it
 func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request) {
-	stringMap := make(map[string]string)
-	stringMap["title"] = "Subscription"
-	stringMap["return-url"] = "/admin/all-subscriptions"
-	stringMap["refund-url"] = "/api/admin/cancel-subscription"
-	stringMap["refund-btn"] = "Cancel Subscription"
-	stringMap["refund-success-msg"] = "Subscription cancelled successfully"
+	plans, err := app.DB.GetRecurringWidgets()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
-	if err := app.renderTemplate(w, r, "sale", &templateData{StringMap: stringMap}); err != nil {
+	data := make(map[string]interface{})
+	data["plans"] = plans
+
+	if err := app.renderTemplate(w, r, "subscription", &templateData{Data: data}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
@@ -496,9 +567,33 @@ func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// OneUser displays a user
+// AuditLog displays the audit log of administrative actions
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	data := make(map[string]interface{})
+	data["actions"] = audit.Actions
+	data["entity_types"] = audit.EntityTypes
+
+	if err := app.renderTemplate(w, r, "audit", &templateData{Data: data}); err != nil {
+		app.errorLog.Println(err)
+	}
+}
+
+// OneUser displays a user, with the roles they can be given
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "one-user", &templateData{}); err != nil {
+	roles, err := app.DB.GetRoles()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := make(map[string]interface{})
+	data["roles"] = roles
+
+	// New users are read-only unless another role is chosen
+	intMap := make(map[string]int)
+	intMap["read_only"] = models.RoleReadOnly
+
+	if err := app.renderTemplate(w, r, "one-user", &templateData{Data: data, IntMap: intMap}); err != nil {
 		app.errorLog.Println(err)
 	}
 }
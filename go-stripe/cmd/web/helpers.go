@@ -0,0 +1,17 @@
+package main
+
+import (
+	"net/http"
+)
+
+// serverError logs err and sends a generic Internal Server Error page to the client
+func (app *application) serverError(w http.ResponseWriter, err error) {
+	app.errorLog.Println(err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+// clientError logs err and sends the given 4xx status to the client
+func (app *application) clientError(w http.ResponseWriter, status int, err error) {
+	app.errorLog.Println(err)
+	http.Error(w, http.StatusText(status), status)
+}
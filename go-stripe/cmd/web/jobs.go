@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// deleteBusMessages deletes the messages of the event bus older than retention every
+// interval. Subscribers only look back a few seconds, so older messages are of no use. It
+// runs until the program exits.
+func (app *application) deleteBusMessages(interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.DeleteBusMessagesBefore(time.Now().Add(-retention))
+		if err != nil {
+			app.errorLog.Println("deleting event bus messages:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Deleted %d event bus messages", n)
+		}
+	}
+}
+
+// deleteExpiredUserSessions forgets which user the expired sessions belonged to every
+// interval. It runs until the program exits.
+func (app *application) deleteExpiredUserSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		n, err := app.DB.DeleteExpiredUserSessions()
+		if err != nil {
+			app.errorLog.Println("deleting expired user sessions:", err)
+			continue
+		}
+		if n > 0 {
+			app.infoLog.Printf("Deleted %d expired user sessions", n)
+		}
+	}
+}
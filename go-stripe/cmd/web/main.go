@@ -1,15 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"myapp/internal/cards"
+	"myapp/internal/cart"
 	"myapp/internal/driver"
+	"myapp/internal/eventbus"
+	"myapp/internal/hub"
+	"myapp/internal/invoices"
+	"myapp/internal/lockout"
 	"myapp/internal/models"
+	"myapp/internal/pricing"
+	"myapp/internal/ratelimit"
+	"myapp/internal/twofactor"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/alexedwards/scs/mysqlstore"
@@ -28,12 +39,27 @@ type config struct {
 	db   struct {
 		dsn string
 	}
-	stripe struct {
+	gateway string
+	stripe  struct {
 		secret string
 		key    string
 	}
 	secretkey string
 	frontend  string
+	lockout   string
+	ratelimit string
+	eventbus  string
+	// cookieDomain is the domain of the CSRF cookie, when the api is on another subdomain
+	cookieDomain string
+	// allowedOrigins are the origins of pages that may open WebSocket connections
+	allowedOrigins []string
+	// internalSecret is shared with the api, which sends it when posting events
+	internalSecret string
+	// invoice is where the invoices of orders are posted
+	invoice struct {
+		url     string
+		timeout time.Duration
+	}
 }
 
 type application struct {
@@ -42,8 +68,15 @@ type application struct {
 	errorLog      *log.Logger
 	templateCache map[string]*template.Template
 	version       string
-	DB            models.DBModel
+	DB            models.Repository
 	Session       *scs.SessionManager
+	Gateway       cards.PaymentGateway
+	Pricing       *pricing.Service
+	TwoFactor     *twofactor.Service
+	Lockout       *lockout.Guard
+	Limiter       *ratelimit.Limiter
+	Hub           *hub.Hub
+	Bus           eventbus.Bus
 }
 
 func (app *application) serve() error {
@@ -62,6 +95,7 @@ func (app *application) serve() error {
 
 func main() {
 	gob.Register(TransactionData{}) // Register map for session data
+	gob.Register(cart.Cart{})
 
 	var cfg config
 
@@ -71,11 +105,27 @@ func main() {
 	flag.StringVar(&cfg.db.dsn, "dsn", "matthewgoodman13:matthew@tcp(localhost:3306)/widgets?parseTime=true&tls=false", "DSN for database connection")
 	flag.StringVar(&cfg.api, "api", "http://localhost:4001", "URL to api")
 
+	flag.StringVar(&cfg.gateway, "gateway", "stripe", "Payment gateway (stripe|fake)")
 	flag.StringVar(&cfg.secretkey, "secret", "x6Z2c9H5F1B8g7L9A3p7D1W8k2E6h3R9", "Secret Key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "URL to frontend")
+	flag.StringVar(&cfg.lockout, "lockout", "database", "Where failed logins are counted (database|memory)")
+	flag.StringVar(&cfg.ratelimit, "ratelimit", "database", "Where rate limits are counted (database|memory)")
+	flag.StringVar(&cfg.eventbus, "eventbus", "database", "How WebSocket messages reach every web server (database|memory)")
+	flag.StringVar(&cfg.cookieDomain, "cookie-domain", "", "Domain of the CSRF cookie, to share it with an api on another subdomain")
+	origins := flag.String("allowed-origins", "", "Comma-separated origins of pages that may open WebSocket connections (default the frontend)")
+	flag.StringVar(&cfg.internalSecret, "internal-secret", "", "Secret the api sends when posting events; events are refused without it")
+	flag.StringVar(&cfg.invoice.url, "invoice-url", "http://localhost:5000/invoice/create-and-send", "URL of the invoice microservice endpoint that creates and sends invoices")
+	flag.DurationVar(&cfg.invoice.timeout, "invoice-timeout", 10*time.Second, "How long to wait for the invoice microservice before trying again later")
 
 	flag.Parse()
 
+	if *origins == "" {
+		*origins = cfg.frontend
+	}
+	for _, origin := range strings.Split(*origins, ",") {
+		cfg.allowedOrigins = append(cfg.allowedOrigins, strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+	}
+
 	// Retrieve stripe key and secret from environment variables
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
@@ -100,6 +150,17 @@ func main() {
 	// Create map for template cache
 	tc := make(map[string]*template.Template)
 
+	// Choose payment gateway
+	var gateway cards.PaymentGateway
+	switch cfg.gateway {
+	case "stripe":
+		gateway = cards.NewStripeGateway(cfg.stripe.secret)
+	case "fake":
+		gateway = cards.NewFakeGateway()
+	default:
+		errorLog.Fatalf("unknown payment gateway %q", cfg.gateway)
+	}
+
 	// Initialize a new instance of application containing the config struct
 	app := &application{
 		config:        cfg,
@@ -107,16 +168,64 @@ func main() {
 		errorLog:      errorLog,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            &models.DBModel{DB: conn},
 		Session:       session,
+		Gateway:       gateway,
+	}
+	app.Pricing = pricing.New(app.DB)
+	app.TwoFactor = twofactor.New(app.DB, []byte(cfg.secretkey))
+
+	// Failed logins are counted in the database so the api servers see them too
+	switch cfg.lockout {
+	case "database":
+		app.Lockout = lockout.New(app.DB)
+	case "memory":
+		app.Lockout = lockout.New(lockout.NewMemoryStore())
+	default:
+		errorLog.Fatalf("unknown lockout store %q", cfg.lockout)
 	}
 
+	// Rate limits are shared the same way
+	switch cfg.ratelimit {
+	case "database":
+		app.Limiter = ratelimit.New(app.DB, errorLog)
+	case "memory":
+		app.Limiter = ratelimit.New(ratelimit.NewMemoryStore(), errorLog)
+	default:
+		errorLog.Fatalf("unknown rate limit store %q", cfg.ratelimit)
+	}
+	app.Limiter.Denied = ratelimit.DeniedText
+
+	// Sessions are indexed by user, so they can be ended when the user is disabled or deleted
+	go app.deleteExpiredUserSessions(time.Hour)
+
+	// Invoices queued with orders are sent in the background, and retried while the
+	// invoice microservice is down
+	worker := invoices.NewWorker(app.DB, invoices.NewClient(cfg.invoice.url, cfg.invoice.timeout), infoLog, errorLog)
+	go worker.Run(context.Background())
+
+	// Start Websocket hub
+	app.Hub = hub.New()
+	app.Hub.Upgrader.CheckOrigin = app.checkOrigin
+	app.Hub.OnMessage = app.handleWsMessage
+	go app.Hub.Run()
+
+	// Messages for the hub go through the event bus, so they reach the browsers connected
+	// to every web server
+	switch cfg.eventbus {
+	case "database":
+		app.Bus = eventbus.NewDatabase(app.DB, errorLog)
+		go app.deleteBusMessages(time.Hour, time.Hour)
+	case "memory":
+		app.Bus = eventbus.NewMemory()
+	default:
+		errorLog.Fatalf("unknown event bus %q", cfg.eventbus)
+	}
+	go app.listenToBus()
+
 	err = app.serve()
 	if err != nil {
 		app.errorLog.Println(err)
 		log.Fatal(err)
 	}
-
-	// Start Websocket
-	go app.ListenToWsChannel()
 }
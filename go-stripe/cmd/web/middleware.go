@@ -1,13 +1,68 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"myapp/internal/csrf"
+	"myapp/internal/models"
 	"net/http"
 )
 
+// contextKey is the type for keys of values this application stores in a request context
+type contextKey string
+
+const contextKeyUser = contextKey("user")
+
+// csrfSessionKey is the session key of the CSRF token
+const csrfSessionKey = "csrfToken"
+
 func SessionLoad(next http.Handler) http.Handler {
 	return session.LoadAndSave(next)
 }
 
+// CSRF gives every session a token, which addDefaultData puts in the pages, and refuses
+// unsafe requests that do not send it back in their csrf_token field or X-CSRF-Token
+// header. It must come after SessionLoad.
+func (app *application) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := app.Session.GetString(r.Context(), csrfSessionKey)
+		if token == "" {
+			var err error
+			token, err = csrf.NewToken()
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			app.Session.Put(r.Context(), csrfSessionKey, token)
+		}
+
+		// Pages send the token to the api in a header, and the api compares it with this
+		// cookie
+		if c, err := r.Cookie(csrf.CookieName); err != nil || c.Value != token {
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrf.CookieName,
+				Value:    token,
+				Path:     "/",
+				Domain:   app.config.cookieDomain,
+				HttpOnly: true,
+				Secure:   app.config.env == "production",
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if !csrf.Safe(r.Method) && !csrf.Matches(csrf.RequestToken(r), token) {
+			app.clientError(w, http.StatusForbidden, fmt.Errorf("missing or wrong CSRF token for %s %s", r.Method, r.URL.Path))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Auth sends visitors who are not logged in to the login page, and puts the logged in
+// user, with their permissions, in the request context
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -16,6 +71,57 @@ func (app *application) Auth(next http.Handler) http.Handler {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		// The user may have been deleted or disabled since logging in, on a server whose
+		// sessions this one does not share
+		user, err := app.DB.GetOneUser(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			// A database error says nothing about the user, so they stay logged in
+			app.serverError(w, err)
+			return
+		}
+		if err != nil || user.Disabled() {
+			if err := app.DB.DeleteUserSession(app.Session.Token(r.Context())); err != nil {
+				app.errorLog.Println(err)
+			}
+			if err := app.Session.Destroy(r.Context()); err != nil {
+				app.errorLog.Println(err)
+			}
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+
+		user.Permissions, err = app.DB.GetUserPermissions(user.ID)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), contextKeyUser, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// RequirePermission only lets through users whose role has permission. It must come
+// after Auth.
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.userFromContext(r)
+			if user == nil || !user.Can(permission) {
+				app.clientError(w, http.StatusForbidden, fmt.Errorf("user does not have permission %q for %s", permission, r.URL.Path))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// userFromContext returns the user Auth put in the request context, or nil outside of
+// authenticated routes
+func (app *application) userFromContext(r *http.Request) *models.User {
+	user, ok := r.Context().Value(contextKeyUser).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"myapp/internal/ratelimit"
+	"time"
+)
+
+// Rate limits of the login form. They share their buckets with the api's /api/authenticate,
+// which the login page calls first, so a login uses a token of each.
+var (
+	loginIPLimit    = ratelimit.Policy{Name: "authenticate-ip", Burst: 20, Every: 10 * time.Second, Key: ratelimit.ByIP}
+	loginEmailLimit = ratelimit.Policy{Name: "authenticate-email", Burst: 10, Every: 30 * time.Second, Key: ratelimit.ByEmail}
+)
@@ -19,10 +19,12 @@ type templateData struct {
 	Error                string
 	IsAuthenticated      int
 	UserID               int
+	Permissions          map[string]bool
 	API                  string
 	CSSVersion           string
 	StripeSecretKey      string
 	StripePublishableKey string
+	CartCount            int
 }
 
 var functions = template.FuncMap{
@@ -40,15 +42,31 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.API = app.config.api
 	td.StripeSecretKey = app.config.stripe.secret
 	td.StripePublishableKey = app.config.stripe.key
+	td.CSRFToken = app.Session.GetString(r.Context(), csrfSessionKey)
 
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+
+		// Outside of admin routes Auth has not loaded the user, so look the permissions up
+		var permissions []string
+		if user := app.userFromContext(r); user != nil {
+			permissions = user.Permissions
+		} else {
+			permissions, _ = app.DB.GetUserPermissions(td.UserID)
+		}
+		td.Permissions = make(map[string]bool)
+		for _, p := range permissions {
+			td.Permissions[p] = true
+		}
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
 	}
 
+	c := app.getCart(r)
+	td.CartCount = c.Count()
+
 	return td
 }
 
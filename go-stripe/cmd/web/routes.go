@@ -1,6 +1,7 @@
 package main
 
 import (
+	"myapp/internal/models"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -9,21 +10,36 @@ import (
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(SessionLoad)
+	mux.Use(app.CSRF)
 
 	mux.Get("/", app.Home)
 	mux.Get("/ws", app.WsEndPoint)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
+		mux.Get("/two-factor", app.TwoFactorSettings)
+		mux.With(app.RequirePermission(models.PermissionVirtualTerminal)).Get("/virtual-terminal", app.VirtualTerminal)
 
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSales))
+			mux.Get("/all-sales", app.AllSales)
+			mux.Get("/sales/{id}", app.ShowSale)
+		})
 
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewSubscriptions))
+			mux.Get("/all-subscriptions", app.AllSubscriptions)
+			mux.Get("/subscriptions/{id}", app.ShowSubscription)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(models.PermissionViewUsers))
+			mux.Get("/all-users", app.AllUsers)
+			mux.Get("/all-users/{id}", app.OneUser)
+		})
+
+		mux.With(app.RequirePermission(models.PermissionManageInvoices)).Get("/invoice-jobs", app.InvoiceJobs)
+		mux.With(app.RequirePermission(models.PermissionViewAuditLog)).Get("/audit", app.AuditLog)
 	})
 
 	mux.Post("/payment-succeeded", app.PaymentSucceeded)
@@ -31,12 +47,20 @@ func (app *application) routes() http.Handler {
 
 	mux.Get("/widget/{id}", app.ChargeOnce)
 
-	mux.Get("/plans/bronze", app.BronzePlan)
-	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/update", app.UpdateCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
+
+	mux.Get("/plans", app.Plans)
+	mux.Get("/plans/{slug}", app.Plan)
+	mux.Get("/receipt/plan", app.PlanReceipt)
+	mux.Get("/change-plan", app.ChangePlanRequest)
+	mux.Get("/change-plan/confirm", app.ShowChangePlan)
 
 	// Authentication Routes
 	mux.Get("/login", app.LoginPage)
-	mux.Post("/login", app.PostLoginPage)
+	mux.With(app.Limiter.Limit(loginIPLimit, loginEmailLimit)).Post("/login", app.PostLoginPage)
 	mux.Get("/logout", app.Logout)
 	mux.Get("/forgot-password", app.ForgotPassword)
 	mux.Get("/reset-password", app.ShowResetPassword)
@@ -44,5 +68,11 @@ func (app *application) routes() http.Handler {
 	fileServer := http.FileServer(http.Dir("./static"))
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
-	return mux
+	// The api posts events here with the internal secret rather than a session, so they
+	// skip SessionLoad and CSRF
+	root := chi.NewRouter()
+	root.Post("/internal/events", app.ReceiveEvent)
+	root.Mount("/", mux)
+
+	return root
 }
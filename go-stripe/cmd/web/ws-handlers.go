@@ -3,22 +3,22 @@ package main
 // Websocket used for when deleting a user, they get logged out automatically
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"myapp/internal/hub"
+	"myapp/internal/models"
 	"net/http"
-
-	"github.com/gorilla/websocket"
+	"strings"
 )
 
-type WebSocketConnection struct {
-	*websocket.Conn
-}
-
 type WsPayload struct {
-	Action      string              `json:"action"`
-	Message     string              `json:"message"`
-	UserName    string              `json:"username"`
-	MessageType string              `json:"message_type"`
-	UserID      int                 `json:"user_id"`
-	Conn        WebSocketConnection `json:"-"`
+	Action      string `json:"action"`
+	Message     string `json:"message"`
+	UserName    string `json:"username"`
+	MessageType string `json:"message_type"`
+	UserID      int    `json:"user_id"`
 }
 
 type WsJsonResponse struct {
@@ -27,85 +27,109 @@ type WsJsonResponse struct {
 	UserID  int    `json:"user_id"`
 }
 
-var upgradeConnection = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-var clients = make(map[WebSocketConnection]string)
-
-var wsChan = make(chan WsPayload)
-
+// WsEndPoint upgrades the request to a WebSocket connection bound to the user logged in
+// to the session, or to the owner of the bearer token, so that messages can be sent to
+// them or their role. Anyone else is refused.
 func (app *application) WsEndPoint(w http.ResponseWriter, r *http.Request) {
-	ws, err := upgradeConnection.Upgrade(w, r, nil)
+	user, err := app.wsUser(r)
+	if err != nil {
+		app.clientError(w, http.StatusUnauthorized, fmt.Errorf("websocket from %s: %w", r.RemoteAddr, err))
+		return
+	}
+
+	client, err := app.Hub.Serve(w, r, user.ID, user.RoleID)
 	if err != nil {
 		app.errorLog.Println(err)
 		return
 	}
 
-	app.infoLog.Printf("Client %s connected", ws.RemoteAddr().String())
+	app.infoLog.Printf("Client %s of user %d connected", client.RemoteAddr(), user.ID)
 
 	var response WsJsonResponse
 	response.Message = "Connected to server"
 
-	err = ws.WriteJSON(response)
+	err = client.Send(response)
 	if err != nil {
 		app.errorLog.Println(err)
-		return
+	}
+}
+
+// wsUser returns the user logged in to the session of a request, or else the user of the
+// api token in its Authorization header, for clients other than the pages
+func (app *application) wsUser(r *http.Request) (*models.User, error) {
+	if app.Session.Exists(r.Context(), "userID") {
+		user, err := app.DB.GetOneUser(app.Session.GetInt(r.Context(), "userID"))
+		if err != nil {
+			return nil, err
+		}
+		if user.Disabled() {
+			return nil, models.ErrUserDisabled
+		}
+		return user, nil
 	}
 
-	conn := WebSocketConnection{Conn: ws}
-	clients[conn] = ""
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, errors.New("not logged in")
+	}
 
-	go app.ListenForWS(&conn)
+	return app.DB.GetUserForToken(token, models.ScopeAuthentication)
 }
 
-func (app *application) ListenForWS(conn *WebSocketConnection) {
-	defer func() {
-		if r := recover(); r != nil {
-			app.errorLog.Println("ERROR: ", r)
+// checkOrigin only lets pages from the allowed origins open WebSocket connections. Clients
+// other than browsers send no Origin header, and are let through.
+func (app *application) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	for _, allowed := range app.config.allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
 		}
-	}()
+	}
 
+	app.errorLog.Printf("websocket from %s refused for origin %s", r.RemoteAddr, origin)
+	return false
+}
+
+// handleWsMessage handles a message a page sent over its WebSocket connection
+func (app *application) handleWsMessage(client *hub.Client, message []byte) {
 	var payload WsPayload
-	for {
-		err := conn.ReadJSON(&payload)
+	err := json.Unmarshal(message, &payload)
+	if err != nil {
+		app.errorLog.Println(err)
+		return
+	}
+
+	switch payload.Action {
+	case "deleteUser", "disableUser":
+		// Only users who can delete or disable users may log them out
+		permissions, err := app.DB.GetUserPermissions(client.UserID)
 		if err != nil {
 			app.errorLog.Println(err)
 			return
 		}
+		user := models.User{ID: client.UserID, Permissions: permissions}
+		if !user.Can(models.PermissionManageUsers) {
+			app.errorLog.Printf("Websocket client %s of user %d may not delete or disable users", client.RemoteAddr(), client.UserID)
+			return
+		}
 
-		payload.Conn = *conn
-		wsChan <- payload
-	}
-}
-
-func (app *application) ListenToWsChannel() {
-	var response WsJsonResponse
-	for {
-		e := <-wsChan
-		switch e.Action {
-		case "deleteUser":
-			response.Action = "logout"
-			response.Message = "Your account has been deleted"
-			response.UserID = e.UserID
-			app.broadcastToAll(response)
-		default:
+		var response WsJsonResponse
+		response.Action = "logout"
+		response.Message = "Your account has been deleted"
+		if payload.Action == "disableUser" {
+			response.Message = "Your account has been disabled"
 		}
-	}
-}
+		response.UserID = payload.UserID
 
-func (app *application) broadcastToAll(response WsJsonResponse) {
-	for client := range clients { // Loop through all clients and broadcast message
-		err := client.WriteJSON(response)
-		if err != nil { // If there is an error, remove the client from the map (such as if they disconnect)
-			app.errorLog.Printf("Websocket error on client %s: %s", response.Action, err)
-			_ = client.Close()
-			delete(clients, client)
-			return
+		// The user may be connected to another instance
+		err = app.publishToBus(context.Background(), busTopicLogout, response)
+		if err != nil {
+			app.errorLog.Println(err)
 		}
+	default:
 	}
 }
@@ -0,0 +1,173 @@
+// Package audit records who did what in the admin. Handlers record an event through the
+// database transaction that makes the change, so a change is never kept without its event.
+package audit
+
+import (
+	"encoding/json"
+	"myapp/internal/clientip"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionRefund                     = "order.refund"
+	ActionVirtualTerminalCharge      = "transaction.virtual-terminal"
+	ActionSubscriptionPause          = "subscription.pause"
+	ActionSubscriptionResume         = "subscription.resume"
+	ActionSubscriptionCancel         = "subscription.cancel"
+	ActionSubscriptionCancelAtPeriod = "subscription.cancel-at-period-end"
+	ActionSubscriptionChangePlan     = "subscription.change-plan"
+	ActionUserCreate                 = "user.create"
+	ActionUserUpdate                 = "user.update"
+	ActionUserDelete                 = "user.delete"
+	ActionTokenRevoke                = "user.revoke-token"
+	ActionTokenRevokeAll             = "user.revoke-all-tokens"
+	ActionUserUnlock                 = "user.unlock"
+	ActionUserDisable                = "user.disable"
+	ActionUserEnable                 = "user.enable"
+	ActionInvoiceRetry               = "order.retry-invoice"
+)
+
+// Entity types an action can be about
+const (
+	EntityOrder        = "order"
+	EntityTransaction  = "transaction"
+	EntitySubscription = "subscription"
+	EntityUser         = "user"
+)
+
+// Actions is every action, in the order they are listed when browsing the log
+var Actions = []string{
+	ActionRefund,
+	ActionVirtualTerminalCharge,
+	ActionSubscriptionPause,
+	ActionSubscriptionResume,
+	ActionSubscriptionCancel,
+	ActionSubscriptionCancelAtPeriod,
+	ActionSubscriptionChangePlan,
+	ActionUserCreate,
+	ActionUserUpdate,
+	ActionUserDelete,
+	ActionTokenRevoke,
+	ActionTokenRevokeAll,
+	ActionUserUnlock,
+	ActionUserDisable,
+	ActionUserEnable,
+	ActionInvoiceRetry,
+}
+
+// EntityTypes is every entity type
+var EntityTypes = []string{EntityOrder, EntityTransaction, EntitySubscription, EntityUser}
+
+// DefaultRedacted are the JSON fields never written to the audit log
+var DefaultRedacted = []string{"password", "token", "token_hash", "secret"}
+
+// Actor is who made a change. UserID is 0 for customers changing their own subscriptions.
+type Actor struct {
+	UserID    int
+	IPAddress string
+	UserAgent string
+}
+
+// ActorFromRequest returns the actor of a request made by the user with the given ID
+func ActorFromRequest(r *http.Request, userID int) Actor {
+	return Actor{
+		UserID:    userID,
+		IPAddress: clientip.FromRequest(r),
+		UserAgent: r.UserAgent(),
+	}
+}
+
+// Entity is what an action was done to
+type Entity struct {
+	Type string
+	ID   string
+}
+
+// NewEntity returns the entity of the given type with a numeric ID
+func NewEntity(entityType string, id int) Entity {
+	return Entity{Type: entityType, ID: strconv.Itoa(id)}
+}
+
+// Auditor writes audit events
+type Auditor struct {
+	redacted map[string]bool
+}
+
+// New returns an Auditor that leaves the DefaultRedacted fields out of the state it records
+func New() *Auditor {
+	a := &Auditor{redacted: make(map[string]bool)}
+	for _, field := range DefaultRedacted {
+		a.redacted[field] = true
+	}
+	return a
+}
+
+// Record writes an event through store, which should be the transaction making the change.
+// before and after are marshalled to JSON; pass nil for state that does not exist.
+func (a *Auditor) Record(store models.AuditRepository, actor Actor, action string, entity Entity, before, after interface{}) error {
+	beforeJSON, err := a.marshal(before)
+	if err != nil {
+		return err
+	}
+
+	afterJSON, err := a.marshal(after)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.InsertAuditEvent(models.AuditEvent{
+		UserID:     actor.UserID,
+		Action:     action,
+		EntityType: entity.Type,
+		EntityID:   entity.ID,
+		Before:     beforeJSON,
+		After:      afterJSON,
+		IPAddress:  actor.IPAddress,
+		UserAgent:  actor.UserAgent,
+	})
+	return err
+}
+
+// marshal returns the JSON of state without the redacted fields
+func (a *Auditor) marshal(state interface{}) (json.RawMessage, error) {
+	if state == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+
+	return json.Marshal(a.redact(v))
+}
+
+// redact removes the redacted fields from v, at any depth
+func (a *Auditor) redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if a.redacted[k] {
+				delete(v, k)
+				continue
+			}
+			v[k] = a.redact(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = a.redact(item)
+		}
+	}
+	return v
+}
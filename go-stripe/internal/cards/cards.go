@@ -1,18 +1,28 @@
 package cards
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/stripe/stripe-go/v72"
-	"github.com/stripe/stripe-go/v72/customer"
-	"github.com/stripe/stripe-go/v72/paymentintent"
-	"github.com/stripe/stripe-go/v72/paymentmethod"
-	"github.com/stripe/stripe-go/v72/refund"
-	"github.com/stripe/stripe-go/v72/sub"
+	"github.com/stripe/stripe-go/v72/client"
 )
 
-type Card struct {
-	Secret   string
-	Key      string
-	Currency string
+// PaymentGateway is the interface for charging cards and managing subscriptions.
+// StripeGateway talks to Stripe; FakeGateway keeps everything in memory.
+type PaymentGateway interface {
+	CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error)
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(id string) (*stripe.PaymentMethod, error)
+	CreateCustomer(pm string, email string) (*stripe.Customer, string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error)
+	RefundPayment(pi string, amount int, reason string) (*stripe.Refund, error)
+	CancelSubscriptionAtPeriodEnd(subscriptionID string) (*stripe.Subscription, error)
+	CancelSubscriptionNow(subscriptionID string) (*stripe.Subscription, error)
+	PauseSubscription(subscriptionID string) (*stripe.Subscription, error)
+	ResumeSubscription(subscriptionID string) (*stripe.Subscription, error)
+	PreviewPlanChange(subscriptionID, plan string) (*stripe.Invoice, error)
+	ChangePlan(subscriptionID, plan string, prorationDate int64) (*stripe.Subscription, error)
 }
 
 type Transaction struct {
@@ -23,23 +33,33 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
-func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+// StripeGateway is the PaymentGateway backed by the Stripe API
+type StripeGateway struct {
+	sc *client.API
 }
 
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	stripe.Key = c.Secret
+// NewStripeGateway returns a StripeGateway with its own Stripe client, so the
+// global stripe.Key is never touched
+func NewStripeGateway(secret string) *StripeGateway {
+	return &StripeGateway{
+		sc: client.New(secret, nil),
+	}
+}
 
+// CreatePaymentIntent creates a payment intent for amount in currency
+func (c *StripeGateway) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
 	// Create a Payment Intent
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
 
-	// Can Add Own Key Value Pairs
-	// params.AddMetadata("key", "value")
+	// Metadata is echoed back in webhook events
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
 
-	pi, err := paymentintent.New(params)
+	pi, err := c.sc.PaymentIntents.New(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -52,10 +72,8 @@ func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.Payment
 }
 
 // GetPaymentMethod gets a payment method by payment intent id
-func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
-	stripe.Key = c.Secret
-
-	pm, err := paymentmethod.Get(s, nil)
+func (c *StripeGateway) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
+	pm, err := c.sc.PaymentMethods.Get(s, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -64,10 +82,8 @@ func (c *Card) GetPaymentMethod(s string) (*stripe.PaymentMethod, error) {
 }
 
 // RetrievePaymentIntent gets an existing payment intent by payment intent id
-func (c *Card) RetrievePaymentIntent(s string) (*stripe.PaymentIntent, error) {
-	stripe.Key = c.Secret
-
-	pi, err := paymentintent.Get(s, nil)
+func (c *StripeGateway) RetrievePaymentIntent(s string) (*stripe.PaymentIntent, error) {
+	pi, err := c.sc.PaymentIntents.Get(s, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +92,7 @@ func (c *Card) RetrievePaymentIntent(s string) (*stripe.PaymentIntent, error) {
 }
 
 // Subscribe to Plan
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+func (c *StripeGateway) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
 	stripeCustomerID := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -92,7 +108,7 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	params.AddMetadata("card_type", cardType)
 	params.AddExpand("latest_invoice.payment_intent") // To get PaymentIntent of subscription
 
-	subscription, err := sub.New(params)
+	subscription, err := c.sc.Subscriptions.New(params)
 	if err != nil {
 		return nil, err
 	}
@@ -101,9 +117,7 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 }
 
 // Create a customer
-func (c *Card) CreateCustomer(pm string, email string) (*stripe.Customer, string, error) {
-	stripe.Key = c.Secret
-
+func (c *StripeGateway) CreateCustomer(pm string, email string) (*stripe.Customer, string, error) {
 	params := &stripe.CustomerParams{
 		PaymentMethod: stripe.String(pm),
 		Email:         stripe.String(email),
@@ -112,7 +126,7 @@ func (c *Card) CreateCustomer(pm string, email string) (*stripe.Customer, string
 		},
 	}
 
-	cust, err := customer.New(params)
+	cust, err := c.sc.Customers.New(params)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
@@ -124,37 +138,120 @@ func (c *Card) CreateCustomer(pm string, email string) (*stripe.Customer, string
 	return cust, "", nil
 }
 
-// Refund a payment
-func (c *Card) RefundPayment(pi string, amount int) error {
-	stripe.Key = c.Secret
-
+// RefundPayment refunds amount of a payment. Stripe only takes a few fixed reasons, so
+// reason is kept in the refund's metadata.
+func (c *StripeGateway) RefundPayment(pi string, amount int, reason string) (*stripe.Refund, error) {
 	params := &stripe.RefundParams{
 		PaymentIntent: stripe.String(pi),
 		Amount:        stripe.Int64(int64(amount)),
 	}
+	if reason != "" {
+		params.AddMetadata("reason", reason)
+	}
 
-	_, err := refund.New(params)
+	refund, err := c.sc.Refunds.New(params)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return refund, nil
 }
 
-// CancelSubscription cancels a subscription
-func (c *Card) CancelSubscription(subscriptionID string) error {
-	stripe.Key = c.Secret
-
+// CancelSubscriptionAtPeriodEnd cancels a subscription once the current period, already
+// paid for, is over
+func (c *StripeGateway) CancelSubscriptionAtPeriodEnd(subscriptionID string) (*stripe.Subscription, error) {
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(true),
 	}
 
-	_, err := sub.Update(subscriptionID, params)
+	return c.sc.Subscriptions.Update(subscriptionID, params)
+}
+
+// CancelSubscriptionNow cancels a subscription immediately
+func (c *StripeGateway) CancelSubscriptionNow(subscriptionID string) (*stripe.Subscription, error) {
+	return c.sc.Subscriptions.Cancel(subscriptionID, &stripe.SubscriptionCancelParams{})
+}
+
+// PauseSubscription stops collecting payments for a subscription. Invoices created while
+// it is paused are voided.
+func (c *StripeGateway) PauseSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		PauseCollection: &stripe.SubscriptionPauseCollectionParams{
+			Behavior: stripe.String(string(stripe.SubscriptionPauseCollectionBehaviorVoid)),
+		},
+	}
+
+	return c.sc.Subscriptions.Update(subscriptionID, params)
+}
+
+// ResumeSubscription undoes PauseSubscription and CancelSubscriptionAtPeriodEnd, so the
+// subscription renews and is charged as usual
+func (c *StripeGateway) ResumeSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	params := &stripe.SubscriptionParams{
+		CancelAtPeriodEnd: stripe.Bool(false),
+	}
+	// An empty value unsets pause_collection
+	params.AddExtra("pause_collection", "")
+
+	return c.sc.Subscriptions.Update(subscriptionID, params)
+}
+
+// PreviewPlanChange returns the upcoming invoice of a subscription as if it were moved to
+// plan now. The prorated lines are what ChangePlan charges when given the invoice's
+// SubscriptionProrationDate.
+func (c *StripeGateway) PreviewPlanChange(subscriptionID, plan string) (*stripe.Invoice, error) {
+	itemID, err := c.subscriptionItemID(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.InvoiceParams{
+		Subscription: stripe.String(subscriptionID),
+		SubscriptionItems: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(itemID), Price: stripe.String(plan)},
+		},
+		SubscriptionProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorCreateProrations)),
+		SubscriptionProrationDate:     stripe.Int64(time.Now().Unix()),
+	}
+
+	return c.sc.Invoices.GetNext(params)
+}
+
+// ChangePlan moves a subscription to plan and invoices the prorated difference straight
+// away. prorationDate should be the one used for the preview the customer agreed to, or 0
+// to prorate from now.
+func (c *StripeGateway) ChangePlan(subscriptionID, plan string, prorationDate int64) (*stripe.Subscription, error) {
+	itemID, err := c.subscriptionItemID(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(itemID), Price: stripe.String(plan)},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorAlwaysInvoice)),
+	}
+	if prorationDate > 0 {
+		params.ProrationDate = stripe.Int64(prorationDate)
+	}
+	params.AddExpand("latest_invoice.charge")
+
+	return c.sc.Subscriptions.Update(subscriptionID, params)
+}
+
+// subscriptionItemID returns the ID of the only item of a subscription
+func (c *StripeGateway) subscriptionItemID(subscriptionID string) (string, error) {
+	subscription, err := c.sc.Subscriptions.Get(subscriptionID, nil)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if subscription.Items == nil || len(subscription.Items.Data) == 0 {
+		return "", fmt.Errorf("subscription %s has no items", subscriptionID)
 	}
 
-	return nil
+	return subscription.Items.Data[0].ID, nil
 }
 
 // cardErrorMessage returns a user-friendly error message for a given Stripe error code.
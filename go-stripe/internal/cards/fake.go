@@ -0,0 +1,546 @@
+package cards
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// fakeCards are the payment methods FakeGateway understands, named after Stripe's test
+// payment methods. Any other payment method ID behaves like pm_card_visa.
+var fakeCards = map[string]stripe.ErrorCode{
+	"pm_card_visa":                      "",
+	"pm_card_chargeDeclined":            stripe.ErrorCodeCardDeclined,
+	"pm_card_chargeDeclinedExpiredCard": stripe.ErrorCodeExpiredCard,
+	"pm_card_incorrectNumber":           stripe.ErrorCodeIncorrectNumber,
+	"pm_card_incorrectZip":              stripe.ErrorCodeIncorrectZip,
+	"pm_card_invalidExpiryMonth":        stripe.ErrorCodeInvalidExpiryMonth,
+	"pm_card_invalidExpiryYear":         stripe.ErrorCodeInvalidExpiryYear,
+	"pm_card_invalidNumber":             stripe.ErrorCodeInvalidNumber,
+}
+
+// FakeGateway is an in-memory PaymentGateway for development and tests. IDs are
+// generated from a counter and times read from a clock that tests can set, so the same
+// sequence of calls always gives the same results.
+type FakeGateway struct {
+	mu             sync.Mutex
+	seq            int
+	declineNext    stripe.ErrorCode
+	paymentIntents map[string]*stripe.PaymentIntent
+	refunded       map[string]int
+	customers      map[string]*stripe.Customer
+	subscriptions  map[string]*stripe.Subscription
+	planPrice      func(plan string) (int64, error)
+	now            func() time.Time
+}
+
+// NewFakeGateway returns an empty FakeGateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		paymentIntents: make(map[string]*stripe.PaymentIntent),
+		refunded:       make(map[string]int),
+		customers:      make(map[string]*stripe.Customer),
+		subscriptions:  make(map[string]*stripe.Subscription),
+		now:            time.Now,
+	}
+}
+
+// DeclineNext makes the next CreatePaymentIntent or CreateCustomer call fail with code
+func (g *FakeGateway) DeclineNext(code stripe.ErrorCode) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.declineNext = code
+}
+
+// SetPlanPrices sets the function used to look up the amount charged for a plan. Without
+// it every plan is free, which is enough unless plans are changed.
+func (g *FakeGateway) SetPlanPrices(lookup func(plan string) (int64, error)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.planPrice = lookup
+}
+
+// SetClock sets the function the gateway reads the time from, instead of time.Now
+func (g *FakeGateway) SetClock(now func() time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.now = now
+}
+
+// CreatePaymentIntent creates a payment intent waiting for a payment method
+func (g *FakeGateway) CreatePaymentIntent(currency string, amount int, metadata map[string]string) (*stripe.PaymentIntent, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.takeDecline(); err != nil {
+		return nil, cardErrorMessage(err.Code), err
+	}
+
+	id := g.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(amount),
+		Currency:     currency,
+		ClientSecret: id + "_secret_fake",
+		Metadata:     metadata,
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Created:      g.now().Unix(),
+	}
+	g.paymentIntents[id] = pi
+
+	out := *pi
+	return &out, "", nil
+}
+
+// ConfirmPaymentIntent does what Stripe.js does in the browser: it charges the payment
+// method and marks the payment intent as succeeded, or fails with the card's error code.
+func (g *FakeGateway) ConfirmPaymentIntent(id, pm string) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pi, ok := g.paymentIntents[id]
+	if !ok {
+		return nil, missing("payment_intent", id)
+	}
+
+	if err := cardError(pm); err != nil {
+		pi.LastPaymentError = err
+		return nil, err
+	}
+
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+	pi.PaymentMethod = fakePaymentMethod(pm)
+	pi.Charges = &stripe.ChargeList{
+		Data: []*stripe.Charge{
+			{
+				ID:            g.nextID("ch"),
+				Amount:        pi.Amount,
+				Currency:      stripe.Currency(pi.Currency),
+				Paid:          true,
+				PaymentIntent: &stripe.PaymentIntent{ID: pi.ID},
+			},
+		},
+	}
+
+	out := *pi
+	return &out, nil
+}
+
+// RetrievePaymentIntent gets a payment intent created by this gateway
+func (g *FakeGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pi, ok := g.paymentIntents[id]
+	if !ok {
+		return nil, missing("payment_intent", id)
+	}
+
+	out := *pi
+	return &out, nil
+}
+
+// GetPaymentMethod returns a visa card for any payment method ID
+func (g *FakeGateway) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	return fakePaymentMethod(id), nil
+}
+
+// CreateCustomer creates a customer, failing with the card's error code for declining payment methods
+func (g *FakeGateway) CreateCustomer(pm string, email string) (*stripe.Customer, string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	err := g.takeDecline()
+	if err == nil {
+		err = cardError(pm)
+	}
+	if err != nil {
+		return nil, cardErrorMessage(err.Code), err
+	}
+
+	cust := &stripe.Customer{
+		ID:    g.nextID("cus"),
+		Email: email,
+	}
+	g.customers[cust.ID] = cust
+
+	return cust, "", nil
+}
+
+// SubscribeToPlan creates an active subscription for a customer created by this gateway
+func (g *FakeGateway) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.customers[cust.ID]; !ok {
+		return nil, missing("customer", cust.ID)
+	}
+
+	p, err := g.plan(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	now := g.now()
+	subscription := &stripe.Subscription{
+		ID:                 g.nextID("sub"),
+		Customer:           cust,
+		Plan:               p,
+		Items:              &stripe.SubscriptionItemList{Data: []*stripe.SubscriptionItem{{ID: g.nextID("si"), Plan: p}}},
+		Status:             stripe.SubscriptionStatusActive,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.AddDate(0, 1, 0).Unix(),
+		Metadata: map[string]string{
+			"email":     email,
+			"last_four": last4,
+			"card_type": cardType,
+		},
+	}
+	g.subscriptions[subscription.ID] = subscription
+
+	out := *subscription
+	return &out, nil
+}
+
+// RefundPayment refunds part or all of a succeeded payment intent. Refunding more than
+// what is left on the charge fails the way Stripe does.
+func (g *FakeGateway) RefundPayment(pi string, amount int, reason string) (*stripe.Refund, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	intent, ok := g.paymentIntents[pi]
+	if !ok {
+		return nil, missing("payment_intent", pi)
+	}
+
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, &stripe.Error{
+			Type: stripe.ErrorTypeInvalidRequest,
+			Msg:  fmt.Sprintf("payment intent %s has not been charged", pi),
+		}
+	}
+
+	remaining := int(intent.Amount) - g.refunded[pi]
+	if remaining == 0 {
+		return nil, &stripe.Error{
+			Type: stripe.ErrorTypeInvalidRequest,
+			Code: stripe.ErrorCodeChargeAlreadyRefunded,
+			Msg:  fmt.Sprintf("charge for %s has already been refunded", pi),
+		}
+	}
+	if amount <= 0 || amount > remaining {
+		return nil, &stripe.Error{
+			Type: stripe.ErrorTypeInvalidRequest,
+			Code: stripe.ErrorCodeAmountTooLarge,
+			Msg:  fmt.Sprintf("refund amount %d is invalid, %d remaining", amount, remaining),
+		}
+	}
+
+	charge := intent.Charges.Data[0]
+	refund := &stripe.Refund{
+		ID:            g.nextID("re"),
+		Amount:        int64(amount),
+		Currency:      stripe.Currency(intent.Currency),
+		Charge:        &stripe.Charge{ID: charge.ID},
+		PaymentIntent: &stripe.PaymentIntent{ID: pi},
+		Status:        stripe.RefundStatusSucceeded,
+		Created:       g.now().Unix(),
+	}
+	if reason != "" {
+		refund.Metadata = map[string]string{"reason": reason}
+	}
+
+	g.refunded[pi] += amount
+	charge.AmountRefunded = int64(g.refunded[pi])
+	charge.Refunded = g.refunded[pi] == int(intent.Amount)
+	if charge.Refunds == nil {
+		charge.Refunds = &stripe.RefundList{}
+	}
+	charge.Refunds.Data = append(charge.Refunds.Data, refund)
+
+	out := *refund
+	return &out, nil
+}
+
+// Refunded returns the total amount refunded for a payment intent
+func (g *FakeGateway) Refunded(pi string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.refunded[pi]
+}
+
+// CancelSubscriptionAtPeriodEnd sets a subscription to cancel at the end of the period
+func (g *FakeGateway) CancelSubscriptionAtPeriodEnd(subscriptionID string) (*stripe.Subscription, error) {
+	return g.updateSubscription(subscriptionID, func(subscription *stripe.Subscription) {
+		subscription.CancelAtPeriodEnd = true
+		subscription.CancelAt = subscription.CurrentPeriodEnd
+	})
+}
+
+// CancelSubscriptionNow cancels a subscription immediately
+func (g *FakeGateway) CancelSubscriptionNow(subscriptionID string) (*stripe.Subscription, error) {
+	return g.updateSubscription(subscriptionID, func(subscription *stripe.Subscription) {
+		now := g.now().Unix()
+		subscription.Status = stripe.SubscriptionStatusCanceled
+		subscription.CanceledAt = now
+		subscription.EndedAt = now
+	})
+}
+
+// PauseSubscription pauses payment collection for a subscription
+func (g *FakeGateway) PauseSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	return g.updateSubscription(subscriptionID, func(subscription *stripe.Subscription) {
+		subscription.PauseCollection.Behavior = stripe.SubscriptionPauseCollectionBehaviorVoid
+	})
+}
+
+// ResumeSubscription clears a pause and a scheduled cancellation
+func (g *FakeGateway) ResumeSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	return g.updateSubscription(subscriptionID, func(subscription *stripe.Subscription) {
+		subscription.PauseCollection = stripe.SubscriptionPauseCollection{}
+		subscription.CancelAtPeriodEnd = false
+		subscription.CancelAt = 0
+	})
+}
+
+// PreviewPlanChange returns the invoice for the next period, with the prorated
+// difference for moving to plan now
+func (g *FakeGateway) PreviewPlanChange(subscriptionID, plan string) (*stripe.Invoice, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	subscription, err := g.activeSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := g.plan(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	now := g.now().Unix()
+	lines := g.prorate(subscription, p, now)
+	lines = append(lines, &stripe.InvoiceLine{
+		Amount: p.Amount,
+		Plan:   p,
+		Period: &stripe.Period{
+			Start: subscription.CurrentPeriodEnd,
+			End:   time.Unix(subscription.CurrentPeriodEnd, 0).AddDate(0, 1, 0).Unix(),
+		},
+	})
+
+	invoice := fakeInvoice(subscription, lines)
+	invoice.SubscriptionProrationDate = now
+	invoice.NextPaymentAttempt = subscription.CurrentPeriodEnd
+
+	return invoice, nil
+}
+
+// ChangePlan moves a subscription to plan and charges the prorated difference, if any,
+// straight away. The charge is the subscription's latest invoice.
+func (g *FakeGateway) ChangePlan(subscriptionID, plan string, prorationDate int64) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	subscription, err := g.activeSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := g.plan(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	if prorationDate == 0 {
+		prorationDate = g.now().Unix()
+	}
+
+	invoice := fakeInvoice(subscription, g.prorate(subscription, p, prorationDate))
+	invoice.ID = g.nextID("in")
+	invoice.BillingReason = stripe.InvoiceBillingReasonSubscriptionUpdate
+	invoice.Status = stripe.InvoiceStatusPaid
+	invoice.Paid = true
+	if invoice.AmountDue > 0 {
+		invoice.AmountPaid = invoice.AmountDue
+		invoice.Charge = &stripe.Charge{ID: g.nextID("ch"), Amount: invoice.AmountDue, Paid: true}
+	}
+
+	subscription.Plan = p
+	subscription.Items.Data[0].Plan = p
+	subscription.LatestInvoice = invoice
+
+	out := *subscription
+	return &out, nil
+}
+
+// prorate returns the invoice lines for moving subscription to plan at the given time: a
+// credit for the unused part of the current plan and a charge for the rest of the period
+// on the new one. The caller must hold g.mu.
+func (g *FakeGateway) prorate(subscription *stripe.Subscription, plan *stripe.Plan, at int64) []*stripe.InvoiceLine {
+	start, end := subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	if at < start {
+		at = start
+	}
+	if at > end {
+		at = end
+	}
+
+	remaining := float64(end-at) / float64(end-start)
+	period := &stripe.Period{Start: at, End: end}
+
+	return []*stripe.InvoiceLine{
+		{
+			Amount:      -int64(math.Round(float64(subscription.Plan.Amount) * remaining)),
+			Description: fmt.Sprintf("Unused time on %s", subscription.Plan.ID),
+			Plan:        subscription.Plan,
+			Period:      period,
+			Proration:   true,
+		},
+		{
+			Amount:      int64(math.Round(float64(plan.Amount) * remaining)),
+			Description: fmt.Sprintf("Remaining time on %s", plan.ID),
+			Plan:        plan,
+			Period:      period,
+			Proration:   true,
+		},
+	}
+}
+
+// plan returns a plan priced by the function given to SetPlanPrices. The caller must hold g.mu.
+func (g *FakeGateway) plan(id string) (*stripe.Plan, error) {
+	p := &stripe.Plan{ID: id}
+	if g.planPrice == nil {
+		return p, nil
+	}
+
+	amount, err := g.planPrice(id)
+	if err != nil {
+		return nil, missing("price", id)
+	}
+	p.Amount = amount
+
+	return p, nil
+}
+
+// activeSubscription returns a subscription that has not been cancelled. The caller must hold g.mu.
+func (g *FakeGateway) activeSubscription(subscriptionID string) (*stripe.Subscription, error) {
+	subscription, ok := g.subscriptions[subscriptionID]
+	if !ok {
+		return nil, missing("subscription", subscriptionID)
+	}
+
+	if subscription.Status == stripe.SubscriptionStatusCanceled {
+		return nil, &stripe.Error{
+			Type: stripe.ErrorTypeInvalidRequest,
+			Msg:  fmt.Sprintf("subscription %s has been canceled", subscriptionID),
+		}
+	}
+
+	return subscription, nil
+}
+
+// updateSubscription applies update to a subscription that has not been cancelled and
+// returns a copy of the result
+func (g *FakeGateway) updateSubscription(subscriptionID string, update func(*stripe.Subscription)) (*stripe.Subscription, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	subscription, err := g.activeSubscription(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	update(subscription)
+
+	out := *subscription
+	return &out, nil
+}
+
+// nextID returns the next deterministic ID with prefix. The caller must hold g.mu.
+func (g *FakeGateway) nextID(prefix string) string {
+	g.seq++
+	return fmt.Sprintf("%s_fake_%06d", prefix, g.seq)
+}
+
+// takeDecline returns and clears the error set by DeclineNext. The caller must hold g.mu.
+func (g *FakeGateway) takeDecline() *stripe.Error {
+	if g.declineNext == "" {
+		return nil
+	}
+
+	code := g.declineNext
+	g.declineNext = ""
+	return &stripe.Error{
+		Type: stripe.ErrorTypeCard,
+		Code: code,
+		Msg:  cardErrorMessage(code),
+	}
+}
+
+// cardError returns the error a fake payment method fails with, or nil
+func cardError(pm string) *stripe.Error {
+	code := fakeCards[pm]
+	if code == "" {
+		return nil
+	}
+
+	return &stripe.Error{
+		Type: stripe.ErrorTypeCard,
+		Code: code,
+		Msg:  cardErrorMessage(code),
+	}
+}
+
+// missing returns the error Stripe gives for an unknown object ID
+func missing(kind, id string) *stripe.Error {
+	return &stripe.Error{
+		Type: stripe.ErrorTypeInvalidRequest,
+		Code: stripe.ErrorCodeResourceMissing,
+		Msg:  fmt.Sprintf("No such %s: '%s'", kind, id),
+	}
+}
+
+// fakeInvoice returns an invoice of lines for subscription
+func fakeInvoice(subscription *stripe.Subscription, lines []*stripe.InvoiceLine) *stripe.Invoice {
+	var total int64
+	for _, line := range lines {
+		total += line.Amount
+	}
+
+	invoice := &stripe.Invoice{
+		Subscription: &stripe.Subscription{ID: subscription.ID},
+		Customer:     subscription.Customer,
+		Lines:        &stripe.InvoiceLineList{Data: lines},
+		Subtotal:     total,
+		Total:        total,
+	}
+	// Credit is kept for later invoices rather than refunded
+	if total > 0 {
+		invoice.AmountDue = total
+	}
+
+	return invoice
+}
+
+// fakePaymentMethod returns a visa card payment method with the given ID
+func fakePaymentMethod(id string) *stripe.PaymentMethod {
+	return &stripe.PaymentMethod{
+		ID:   id,
+		Type: stripe.PaymentMethodTypeCard,
+		Card: &stripe.PaymentMethodCard{
+			Brand:    stripe.PaymentMethodCardBrandVisa,
+			Last4:    "4242",
+			ExpMonth: 12,
+			ExpYear:  2034,
+		},
+	}
+}
@@ -0,0 +1,217 @@
+package cards
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v72"
+)
+
+// clock is when tests say it is
+var clock = time.Date(2023, 2, 15, 12, 0, 0, 0, time.UTC)
+
+// newTestGateway returns a FakeGateway stopped at clock
+func newTestGateway() *FakeGateway {
+	g := NewFakeGateway()
+	g.SetClock(func() time.Time { return clock })
+	return g
+}
+
+// charge creates a payment intent for amount and pays it with pm_card_visa
+func charge(t *testing.T, g *FakeGateway, amount int) *stripe.PaymentIntent {
+	t.Helper()
+
+	pi, _, err := g.CreatePaymentIntent("cad", amount, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pi, err = g.ConfirmPaymentIntent(pi.ID, "pm_card_visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pi
+}
+
+// cardCode returns the code of a card error
+func cardCode(t *testing.T, err error) stripe.ErrorCode {
+	t.Helper()
+
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) || stripeErr.Type != stripe.ErrorTypeCard {
+		t.Fatalf("got %v, want a card error", err)
+	}
+	return stripeErr.Code
+}
+
+func TestFakeDeterministic(t *testing.T) {
+	run := func() []string {
+		g := newTestGateway()
+		pi := charge(t, g, 1000)
+		cust, _, err := g.CreateCustomer("pm_card_visa", "pat@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := g.SubscribeToPlan(cust, "price_1", "pat@example.com", "4242", "visa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		refund, err := g.RefundPayment(pi.ID, 500, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []string{pi.ID, pi.Charges.Data[0].ID, cust.ID, sub.ID, refund.ID}
+	}
+
+	first, second := run(), run()
+	want := []string{"pi_fake_000001", "ch_fake_000002", "cus_fake_000003", "sub_fake_000004", "re_fake_000006"}
+	for i := range want {
+		if first[i] != want[i] || second[i] != want[i] {
+			t.Errorf("ID %d is %s, then %s, want %s both times", i, first[i], second[i], want[i])
+		}
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	g := newTestGateway()
+
+	pi := charge(t, g, 1000)
+	if pi.Created != clock.Unix() {
+		t.Errorf("payment intent created at %d, want %d", pi.Created, clock.Unix())
+	}
+
+	refund, err := g.RefundPayment(pi.ID, 1000, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refund.Created != clock.Unix() {
+		t.Errorf("refund created at %d, want %d", refund.Created, clock.Unix())
+	}
+
+	cust, _, err := g.CreateCustomer("pm_card_visa", "pat@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := g.SubscribeToPlan(cust, "price_1", "pat@example.com", "4242", "visa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.CurrentPeriodStart != clock.Unix() || sub.CurrentPeriodEnd != clock.AddDate(0, 1, 0).Unix() {
+		t.Errorf("subscription runs from %d to %d, want a month from %d", sub.CurrentPeriodStart, sub.CurrentPeriodEnd, clock.Unix())
+	}
+}
+
+func TestFakeDeclines(t *testing.T) {
+	for pm, code := range fakeCards {
+		if code == "" {
+			continue
+		}
+
+		g := newTestGateway()
+		pi, _, err := g.CreatePaymentIntent("cad", 1000, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = g.ConfirmPaymentIntent(pi.ID, pm)
+		if got := cardCode(t, err); got != code {
+			t.Errorf("%s declined with %s, want %s", pm, got, code)
+		}
+
+		// The payment intent is left unpaid, with the error
+		pi, err = g.RetrievePaymentIntent(pi.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pi.Status == stripe.PaymentIntentStatusSucceeded || pi.LastPaymentError == nil {
+			t.Errorf("%s left the payment intent %s with error %v", pm, pi.Status, pi.LastPaymentError)
+		}
+
+		_, msg, err := g.CreateCustomer(pm, "pat@example.com")
+		if got := cardCode(t, err); got != code || msg != cardErrorMessage(code) {
+			t.Errorf("customer with %s declined with %s, %q", pm, got, msg)
+		}
+	}
+}
+
+func TestFakeDeclineNext(t *testing.T) {
+	g := newTestGateway()
+	g.DeclineNext(stripe.ErrorCodeExpiredCard)
+
+	_, msg, err := g.CreatePaymentIntent("cad", 1000, nil)
+	if cardCode(t, err) != stripe.ErrorCodeExpiredCard || msg != "Your card has expired." {
+		t.Errorf("got %v, %q, want an expired card", err, msg)
+	}
+
+	// Only the next call is declined
+	if _, _, err := g.CreatePaymentIntent("cad", 1000, nil); err != nil {
+		t.Errorf("second payment intent got %v", err)
+	}
+}
+
+func TestCardErrorMessage(t *testing.T) {
+	tests := map[stripe.ErrorCode]string{
+		stripe.ErrorCodeCardDeclined:       "Your card was declined.",
+		stripe.ErrorCodeExpiredCard:        "Your card has expired.",
+		stripe.ErrorCodeIncorrectNumber:    "Your card number is incorrect.",
+		stripe.ErrorCodeIncorrectZip:       "Your card's zip code failed validation.",
+		stripe.ErrorCodeInvalidExpiryMonth: "Your card's expiration month is invalid.",
+		stripe.ErrorCodeInvalidExpiryYear:  "Your card's expiration year is invalid.",
+		stripe.ErrorCodeInvalidNumber:      "Your card number is invalid.",
+		stripe.ErrorCodeProcessingError:    "An error occurred while processing your card.",
+	}
+
+	for code, want := range tests {
+		if got := cardErrorMessage(code); got != want {
+			t.Errorf("%s: got %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestFakeRefunds(t *testing.T) {
+	g := newTestGateway()
+	pi := charge(t, g, 1000)
+
+	refundError := func(amount int) stripe.ErrorCode {
+		t.Helper()
+
+		_, err := g.RefundPayment(pi.ID, amount, "")
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) {
+			t.Fatalf("refund of %d got %v, want a Stripe error", amount, err)
+		}
+		return stripeErr.Code
+	}
+
+	if _, err := g.RefundPayment(pi.ID, 600, "requested_by_customer"); err != nil {
+		t.Fatal(err)
+	}
+	if code := refundError(500); code != stripe.ErrorCodeAmountTooLarge {
+		t.Errorf("refund over what is left got %s", code)
+	}
+	if code := refundError(0); code != stripe.ErrorCodeAmountTooLarge {
+		t.Errorf("refund of nothing got %s", code)
+	}
+
+	if _, err := g.RefundPayment(pi.ID, 400, ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := refundError(1); code != stripe.ErrorCodeChargeAlreadyRefunded {
+		t.Errorf("refund of a refunded charge got %s", code)
+	}
+	if got := g.Refunded(pi.ID); got != 1000 {
+		t.Errorf("refunded %d, want 1000", got)
+	}
+
+	// Unpaid and unknown payment intents cannot be refunded
+	unpaid, _, err := g.CreatePaymentIntent("cad", 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.RefundPayment(unpaid.ID, 100, ""); err == nil {
+		t.Error("unpaid payment intent was refunded")
+	}
+	if _, err := g.RefundPayment("pi_missing", 100, ""); err == nil {
+		t.Error("unknown payment intent was refunded")
+	}
+}
@@ -0,0 +1,174 @@
+// Package cart is the shopping cart shared by the web and api servers. The web server keeps
+// a Cart in the user's session; the api server stores carts in the database by token.
+package cart
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxQuantity is the largest quantity of one widget a cart can hold
+const MaxQuantity = 100
+
+var (
+	// ErrInvalidQuantity is returned for a quantity below 1 or above MaxQuantity
+	ErrInvalidQuantity = fmt.Errorf("quantity must be between 1 and %d", MaxQuantity)
+	// ErrNotInCart is returned when updating a widget that is not in the cart
+	ErrNotInCart = errors.New("widget is not in the cart")
+)
+
+// Item is one line of a cart
+type Item struct {
+	WidgetID int `json:"widget_id"`
+	Quantity int `json:"quantity"`
+}
+
+// Cart is a list of widgets and quantities, with at most one line per widget
+type Cart struct {
+	Items []Item `json:"items"`
+}
+
+// Add adds quantity of a widget to the cart, merging with any existing line for the widget
+func (c *Cart) Add(widgetID, quantity int) error {
+	if quantity < 1 {
+		return ErrInvalidQuantity
+	}
+
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			if c.Items[i].Quantity+quantity > MaxQuantity {
+				return ErrInvalidQuantity
+			}
+			c.Items[i].Quantity += quantity
+			return nil
+		}
+	}
+
+	if quantity > MaxQuantity {
+		return ErrInvalidQuantity
+	}
+
+	c.Items = append(c.Items, Item{WidgetID: widgetID, Quantity: quantity})
+	return nil
+}
+
+// Update sets the quantity of a widget already in the cart. A quantity of 0 removes it.
+func (c *Cart) Update(widgetID, quantity int) error {
+	if quantity == 0 {
+		return c.Remove(widgetID)
+	}
+	if quantity < 0 || quantity > MaxQuantity {
+		return ErrInvalidQuantity
+	}
+
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			c.Items[i].Quantity = quantity
+			return nil
+		}
+	}
+
+	return ErrNotInCart
+}
+
+// Remove takes a widget out of the cart
+func (c *Cart) Remove(widgetID int) error {
+	for i := range c.Items {
+		if c.Items[i].WidgetID == widgetID {
+			c.Items = append(c.Items[:i], c.Items[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotInCart
+}
+
+// Count returns the total number of widgets in the cart
+func (c *Cart) Count() int {
+	n := 0
+	for _, item := range c.Items {
+		n += item.Quantity
+	}
+	return n
+}
+
+// Empty reports whether the cart has no items
+func (c *Cart) Empty() bool {
+	return len(c.Items) == 0
+}
+
+// Encode writes items in the compact form stored in payment intent metadata, for
+// example "1:2,3:1" for two of widget 1 and one of widget 3
+func Encode(items []Item) string {
+	parts := make([]string, 0, len(items))
+	for _, item := range items {
+		parts = append(parts, fmt.Sprintf("%d:%d", item.WidgetID, item.Quantity))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Decode reads items written by Encode
+func Decode(s string) ([]Item, error) {
+	var items []Item
+	if s == "" {
+		return items, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		widget, quantity, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid cart item %q", part)
+		}
+
+		var item Item
+		var err error
+		item.WidgetID, err = strconv.Atoi(widget)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cart item %q", part)
+		}
+		item.Quantity, err = strconv.Atoi(quantity)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cart item %q", part)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// Metadata returns the payment intent metadata for an order of items. Single-item orders
+// also get the widget_id and quantity keys used before carts existed.
+func Metadata(items []Item) map[string]string {
+	metadata := map[string]string{
+		"items": Encode(items),
+	}
+	if len(items) == 1 {
+		metadata["widget_id"] = strconv.Itoa(items[0].WidgetID)
+		metadata["quantity"] = strconv.Itoa(items[0].Quantity)
+	}
+	return metadata
+}
+
+// FromMetadata returns the items of an order from payment intent metadata written by
+// Metadata, or by older code that only set widget_id and quantity. It returns no items
+// for a payment that was not for widgets, such as one from the virtual terminal.
+func FromMetadata(metadata map[string]string) ([]Item, error) {
+	if s, ok := metadata["items"]; ok {
+		return Decode(s)
+	}
+
+	widgetID, err := strconv.Atoi(metadata["widget_id"])
+	if err != nil || widgetID == 0 {
+		return nil, nil
+	}
+
+	quantity, err := strconv.Atoi(metadata["quantity"])
+	if err != nil {
+		quantity = 1
+	}
+
+	return []Item{{WidgetID: widgetID, Quantity: quantity}}, nil
+}
@@ -0,0 +1,18 @@
+// Package clientip tells which IP address a request came from, for the packages that
+// limit, count or record what each client does.
+package clientip
+
+import (
+	"net"
+	"net/http"
+)
+
+// FromRequest returns the IP address a request came from. Addresses without a port are
+// returned as they are.
+func FromRequest(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -0,0 +1,27 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		ip         string
+	}{
+		{"192.0.2.1:52100", "192.0.2.1"},
+		{"[2001:db8::1]:52100", "2001:db8::1"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		if ip := FromRequest(r); ip != tt.ip {
+			t.Errorf("%q: got %q, want %q", tt.remoteAddr, ip, tt.ip)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Package csrf has what the web and api servers share to refuse cross-site requests.
+// The web server keeps a token in each session, puts it in its forms and pages, and
+// checks it on every unsafe request. It also sets the token as a cookie, which the pages
+// send back to the api along with the token in a header: a cross-site page can make the
+// browser send the cookie, but cannot read it to copy it into the header.
+package csrf
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// CookieName is the cookie the web server sets the token in for the api
+	CookieName = "csrf_token"
+	// HeaderName is the header pages send the token in
+	HeaderName = "X-CSRF-Token"
+	// FieldName is the form field pages post the token in
+	FieldName = "csrf_token"
+)
+
+// NewToken returns a random token
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Safe reports whether requests with method only read, and so need no token
+func Safe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// RequestToken returns the token sent with a request, in its header or else its form
+func RequestToken(r *http.Request) string {
+	if token := r.Header.Get(HeaderName); token != "" {
+		return token
+	}
+	return r.PostFormValue(FieldName)
+}
+
+// Matches reports whether the token sent with a request is the expected one, taking the
+// same time whatever the tokens are
+func Matches(sent, expected string) bool {
+	if sent == "" || expected == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) == 1
+}
@@ -0,0 +1,77 @@
+package csrf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		sent, expected string
+		want           bool
+	}{
+		{"token", "token", true},
+		{"token", "tokem", false},
+		{"token", "Token", false},
+		{"tok", "token", false},
+		{"token-and-more", "token", false},
+		{"", "token", false},
+		{"token", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		if got := Matches(tt.sent, tt.expected); got != tt.want {
+			t.Errorf("Matches(%q, %q) = %v, want %v", tt.sent, tt.expected, got, tt.want)
+		}
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	a, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a) != 43 || a == b {
+		t.Errorf("got tokens %q and %q, want two different 43 character tokens", a, b)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	form := url.Values{FieldName: {"from-form"}}.Encode()
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got := RequestToken(r); got != "from-form" {
+		t.Errorf("got %q from the form, want from-form", got)
+	}
+
+	// The header wins over the form
+	r = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set(HeaderName, "from-header")
+	if got := RequestToken(r); got != "from-header" {
+		t.Errorf("got %q with a header, want from-header", got)
+	}
+}
+
+func TestSafe(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace} {
+		if !Safe(method) {
+			t.Errorf("%s is not safe", method)
+		}
+	}
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		if Safe(method) {
+			t.Errorf("%s is safe", method)
+		}
+	}
+}
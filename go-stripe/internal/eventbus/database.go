@@ -0,0 +1,138 @@
+package eventbus
+
+import (
+	"context"
+	"log"
+	"myapp/internal/models"
+	"sort"
+	"time"
+)
+
+// Database is a bus shared by every instance using the same database. Messages are
+// inserted in the bus_messages table, and subscribers poll it for messages with IDs above
+// the last they have seen.
+//
+// IDs are handed out when messages are inserted, but become visible when they commit, so
+// a subscriber can see a message before one with a lower ID. Subscribers therefore keep
+// looking below the newest ID they have seen for Lookback, and remember which messages they
+// have given out in that time so they do not give them out twice. A message that takes
+// longer than Lookback to commit after it is inserted can be missed.
+type Database struct {
+	store    models.BusMessageRepository
+	errorLog *log.Logger
+
+	// Interval is how often subscribers poll for messages
+	Interval time.Duration
+	// Lookback is how long subscribers wait for a message with a missing ID to become
+	// visible
+	Lookback time.Duration
+	// BatchSize is how many messages are read at a time
+	BatchSize int
+}
+
+// NewDatabase returns a Database bus keeping messages in store. Errors polling the store
+// are logged to errorLog, and polling carries on.
+func NewDatabase(store models.BusMessageRepository, errorLog *log.Logger) *Database {
+	return &Database{
+		store:     store,
+		errorLog:  errorLog,
+		Interval:  250 * time.Millisecond,
+		Lookback:  10 * time.Second,
+		BatchSize: 100,
+	}
+}
+
+var _ Bus = (*Database)(nil)
+
+// Publish inserts a message for every subscriber to find
+func (b *Database) Publish(ctx context.Context, topic string, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	_, err := b.store.InsertBusMessage(topic, payload)
+	return err
+}
+
+// Subscribe polls for messages published from now on, and calls handler with each of
+// them, until ctx is done
+func (b *Database) Subscribe(ctx context.Context, handler Handler) error {
+	last, err := b.store.GetLastBusMessageID()
+	if err != nil {
+		return err
+	}
+	p := &poller{bus: b, handler: handler, settled: last, seen: make(map[int]time.Time)}
+
+	ticker := time.NewTicker(b.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		err := p.poll(time.Now())
+		if err != nil {
+			b.errorLog.Println("polling event bus:", err)
+		}
+	}
+}
+
+// poller is the state of a subscriber to a Database bus. Every message with an ID up to
+// settled has been given out, or is not waited for any more; seen holds when the messages
+// given out since were first seen.
+type poller struct {
+	bus     *Database
+	handler Handler
+	settled int
+	seen    map[int]time.Time
+}
+
+// poll gives out the messages above settled that have not been given out yet, then moves
+// settled up past the messages that no longer need waiting for
+func (p *poller) poll(now time.Time) error {
+	after := p.settled
+	for {
+		messages, err := p.bus.store.GetBusMessagesAfter(after, p.bus.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range messages {
+			if _, ok := p.seen[m.ID]; ok {
+				continue
+			}
+			p.seen[m.ID] = now
+			p.handler(Message{ID: m.ID, Topic: m.Topic, Payload: m.Payload})
+		}
+
+		if len(messages) < p.bus.BatchSize {
+			break
+		}
+		after = messages[len(messages)-1].ID
+	}
+
+	p.settle(now)
+	return nil
+}
+
+// settle moves settled up over the IDs that have been given out. It only skips a missing
+// ID once the message after it has been seen for Lookback, as the missing one may still
+// become visible until then.
+func (p *poller) settle(now time.Time) {
+	ids := make([]int, 0, len(p.seen))
+	for id := range p.seen {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		if id != p.settled+1 && now.Sub(p.seen[id]) < p.bus.Lookback {
+			return
+		}
+		p.settled = id
+		delete(p.seen, id)
+	}
+}
@@ -0,0 +1,41 @@
+// Package eventbus passes messages between the instances of a server, so that something
+// that happens on one of them can be acted on by all of them. The web servers use it to
+// reach every browser connected over WebSocket, whichever instance it is connected to.
+//
+// Two buses are provided. Memory only reaches subscribers in the same process, so it is
+// for development and a single instance. Database publishes messages by inserting them in
+// the bus_messages table, which every instance polls.
+//
+// Delivery is at least once: every subscriber that is running when a message is published
+// is given it, but a bus may give it more than once, so handlers must not mind seeing a
+// message again. Messages published before a subscriber starts are not given to it. The
+// Database bus can only promise this for messages that commit within its Lookback.
+//
+// Each subscriber is given messages one at a time, in the order of their IDs. Messages
+// published one after another, by any instances, get increasing IDs. Messages published
+// at the same time by different instances may become visible out of order with the
+// Database bus; one that becomes visible after a later one was given out is given out as
+// soon as it is seen, so it arrives late rather than not at all.
+package eventbus
+
+import "context"
+
+// Message is a message published on a topic
+type Message struct {
+	ID      int
+	Topic   string
+	Payload []byte
+}
+
+// Handler handles a message. Handlers are called from one goroutine per subscriber, so a
+// slow handler delays the messages after it.
+type Handler func(Message)
+
+// Bus publishes messages to every subscriber, on every instance
+type Bus interface {
+	// Publish publishes a message on a topic
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe calls handler with every message published from now on, until ctx is
+	// done, and returns the error of ctx
+	Subscribe(ctx context.Context, handler Handler) error
+}
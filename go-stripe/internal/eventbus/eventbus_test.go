@@ -0,0 +1,372 @@
+package eventbus
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"myapp/internal/testdb"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a handler keeping the messages it is given
+type recorder struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (r *recorder) handle(m Message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.messages = append(r.messages, m)
+}
+
+// got returns the messages given so far on a topic
+func (r *recorder) got(topic string) []Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var messages []Message
+	for _, m := range r.messages {
+		if m.Topic == topic {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// wait waits until the recorder has n messages on a topic, and returns them
+func (r *recorder) wait(t *testing.T, topic string, n int) []Message {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		messages := r.got(topic)
+		if len(messages) >= n {
+			return messages
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d messages on %s, want %d", len(messages), topic, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// ids returns the IDs of messages
+func ids(messages []Message) []int {
+	ids := make([]int, 0, len(messages))
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+// publishConcurrently publishes n messages on topic from each of the buses at the same
+// time. Payloads are "<publisher>:<sequence>".
+func publishConcurrently(t *testing.T, buses []Bus, topic string, n int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(buses))
+	for p, b := range buses {
+		wg.Add(1)
+		go func(p int, b Bus) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := b.Publish(context.Background(), topic, []byte(fmt.Sprintf("%d:%d", p, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(p, b)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// checkOrder checks that messages are in ID order, without repeats, and that the messages
+// of each publisher are in the order they were published
+func checkOrder(t *testing.T, messages []Message) {
+	t.Helper()
+
+	next := make(map[string]int)
+	for i, m := range messages {
+		if i > 0 && m.ID <= messages[i-1].ID {
+			t.Fatalf("message %d given after message %d", m.ID, messages[i-1].ID)
+		}
+
+		publisher, seq, _ := strings.Cut(string(m.Payload), ":")
+		n, err := strconv.Atoi(seq)
+		if err != nil {
+			t.Fatalf("message %d has payload %q", m.ID, m.Payload)
+		}
+		if n != next[publisher] {
+			t.Fatalf("got message %d of publisher %s, want %d", n, publisher, next[publisher])
+		}
+		next[publisher]++
+	}
+}
+
+// subscribe runs Subscribe until the test ends
+func subscribe(t *testing.T, b Bus, handler Handler) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.Subscribe(ctx, handler)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitUntilSubscribed publishes on the "ready" topic until r is given a message, as
+// Subscribe only gives out messages published after it has started
+func waitUntilSubscribed(t *testing.T, b Bus, r *recorder) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.got("ready")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("subscriber did not start")
+		}
+		if err := b.Publish(context.Background(), "ready", nil); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemoryOrder(t *testing.T) {
+	b := NewMemory()
+
+	var fast, slow recorder
+	subscribe(t, b, fast.handle)
+	subscribe(t, b, func(m Message) {
+		time.Sleep(100 * time.Microsecond)
+		slow.handle(m)
+	})
+	waitUntilSubscribed(t, b, &fast)
+	waitUntilSubscribed(t, b, &slow)
+
+	publishConcurrently(t, []Bus{b, b, b}, "test", 50)
+
+	for _, r := range []*recorder{&fast, &slow} {
+		messages := r.wait(t, "test", 150)
+		if len(messages) != 150 {
+			t.Fatalf("got %d messages, want 150", len(messages))
+		}
+		checkOrder(t, messages)
+	}
+}
+
+func TestMemoryOnlyNewMessages(t *testing.T) {
+	b := NewMemory()
+
+	if err := b.Publish(context.Background(), "test", []byte("early")); err != nil {
+		t.Fatal(err)
+	}
+
+	var r recorder
+	subscribe(t, b, r.handle)
+	waitUntilSubscribed(t, b, &r)
+
+	if err := b.Publish(context.Background(), "test", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := r.wait(t, "test", 1)
+	if len(messages) != 1 || string(messages[0].Payload) != "late" {
+		t.Errorf("got %q, want only the message published after subscribing", messages)
+	}
+}
+
+// newTestDatabase returns a Database bus on a new SQLite database, polling quickly, and
+// the database for inserting messages directly
+func newTestDatabase(t *testing.T) (*Database, *sql.DB) {
+	t.Helper()
+
+	db, err := testdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m := testdb.NewModel(db)
+	b := NewDatabase(&m, log.New(io.Discard, "", 0))
+	b.Interval = 5 * time.Millisecond
+	b.BatchSize = 7
+
+	return b, db
+}
+
+// insertMessage inserts a message with a given ID, as if the transaction inserting it has
+// just committed
+func insertMessage(t *testing.T, db *sql.DB, id int) {
+	t.Helper()
+
+	_, err := db.Exec(`INSERT INTO bus_messages (id, topic, payload) VALUES (?, 'test', ?)`, id, strconv.Itoa(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// poll polls p at now, and returns the IDs of the messages it gave out
+func poll(t *testing.T, p *poller, r *recorder, now time.Time) []int {
+	t.Helper()
+
+	before := len(r.got("test"))
+	if err := p.poll(now); err != nil {
+		t.Fatal(err)
+	}
+	return ids(r.got("test")[before:])
+}
+
+func TestDatabaseOrder(t *testing.T) {
+	b, _ := newTestDatabase(t)
+
+	// Another instance, using the same table
+	other := NewDatabase(b.store, b.errorLog)
+
+	var r recorder
+	subscribe(t, b, r.handle)
+	waitUntilSubscribed(t, b, &r)
+
+	publishConcurrently(t, []Bus{b, other}, "test", 30)
+
+	messages := r.wait(t, "test", 60)
+	if len(messages) != 60 {
+		t.Fatalf("got %d messages, want 60", len(messages))
+	}
+	checkOrder(t, messages)
+}
+
+func TestDatabaseOnlyNewMessages(t *testing.T) {
+	b, _ := newTestDatabase(t)
+
+	if err := b.Publish(context.Background(), "test", []byte("0:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	var r recorder
+	subscribe(t, b, r.handle)
+	waitUntilSubscribed(t, b, &r)
+
+	if err := b.Publish(context.Background(), "test", []byte("1:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := r.wait(t, "test", 1)
+	if len(messages) != 1 || string(messages[0].Payload) != "1:0" {
+		t.Errorf("got %q, want only the message published after subscribing", messages)
+	}
+}
+
+func TestPollerLateMessage(t *testing.T) {
+	b, db := newTestDatabase(t)
+
+	var r recorder
+	p := &poller{bus: b, handler: r.handle, seen: make(map[int]time.Time)}
+	now := time.Now()
+
+	// Message 3 has its ID, but has not committed yet
+	insertMessage(t, db, 1)
+	insertMessage(t, db, 2)
+	insertMessage(t, db, 4)
+
+	if got := poll(t, p, &r, now); fmt.Sprint(got) != "[1 2 4]" {
+		t.Errorf("first poll gave %v, want [1 2 4]", got)
+	}
+
+	insertMessage(t, db, 3)
+
+	now = now.Add(b.Interval)
+	if got := poll(t, p, &r, now); fmt.Sprint(got) != "[3]" {
+		t.Errorf("poll after message 3 committed gave %v, want [3]", got)
+	}
+
+	// Every message has been given out once, so none are waited for
+	if p.settled != 4 || len(p.seen) != 0 {
+		t.Errorf("poller settled at %d with %d seen, want 4 with none", p.settled, len(p.seen))
+	}
+	if got := poll(t, p, &r, now.Add(b.Interval)); len(got) != 0 {
+		t.Errorf("poll without new messages gave %v", got)
+	}
+}
+
+func TestPollerLookback(t *testing.T) {
+	b, db := newTestDatabase(t)
+
+	var r recorder
+	p := &poller{bus: b, handler: r.handle, seen: make(map[int]time.Time)}
+	now := time.Now()
+
+	insertMessage(t, db, 1)
+	insertMessage(t, db, 3)
+	poll(t, p, &r, now)
+
+	// Message 2 is waited for until message 3 has been seen for Lookback
+	poll(t, p, &r, now.Add(b.Lookback-time.Millisecond))
+	if p.settled != 1 {
+		t.Errorf("poller settled at %d before Lookback, want 1", p.settled)
+	}
+
+	poll(t, p, &r, now.Add(b.Lookback))
+	if p.settled != 3 {
+		t.Errorf("poller settled at %d after Lookback, want 3", p.settled)
+	}
+}
+
+func TestPollerRestart(t *testing.T) {
+	b, db := newTestDatabase(t)
+
+	var r recorder
+	p := &poller{bus: b, handler: r.handle, seen: make(map[int]time.Time)}
+	now := time.Now()
+
+	insertMessage(t, db, 1)
+	insertMessage(t, db, 2)
+	insertMessage(t, db, 4)
+	poll(t, p, &r, now)
+
+	// The poller stops while waiting for message 3, and a new one takes over from the
+	// last ID it had settled. Message 4 is given out again rather than message 3 lost.
+	restarted := &poller{bus: b, handler: r.handle, settled: p.settled, seen: make(map[int]time.Time)}
+	insertMessage(t, db, 3)
+	insertMessage(t, db, 5)
+
+	if got := poll(t, restarted, &r, now.Add(b.Interval)); fmt.Sprint(got) != "[3 4 5]" {
+		t.Errorf("restarted poller gave %v, want [3 4 5]", got)
+	}
+
+	// Restarting once everything is settled gives nothing out again
+	restarted = &poller{bus: b, handler: r.handle, settled: restarted.settled, seen: make(map[int]time.Time)}
+	insertMessage(t, db, 6)
+
+	if got := poll(t, restarted, &r, now.Add(2*b.Interval)); fmt.Sprint(got) != "[6]" {
+		t.Errorf("poller restarted after settling gave %v, want [6]", got)
+	}
+
+	var count int
+	for _, id := range ids(r.got("test")) {
+		if id == 4 {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Errorf("message 4 given out %d times, want 2", count)
+	}
+}
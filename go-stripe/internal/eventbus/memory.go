@@ -0,0 +1,89 @@
+package eventbus
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is a bus for the subscribers of one process. Each subscriber has a queue of its
+// own, so publishing never waits for handlers, and messages are given out exactly once and
+// in the order they were published.
+type Memory struct {
+	mu          sync.Mutex
+	lastID      int
+	subscribers map[*subscriber]bool
+}
+
+// subscriber is the queue of messages waiting for a handler
+type subscriber struct {
+	mu     sync.Mutex
+	queue  []Message
+	notify chan struct{}
+}
+
+// NewMemory returns a Memory bus without subscribers
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[*subscriber]bool)}
+}
+
+var _ Bus = (*Memory)(nil)
+
+// Publish queues a message for every subscriber
+func (b *Memory) Publish(ctx context.Context, topic string, payload []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The lock is held while queueing, so every subscriber sees messages in ID order
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	msg := Message{ID: b.lastID, Topic: topic, Payload: payload}
+
+	for s := range b.subscribers {
+		s.mu.Lock()
+		s.queue = append(s.queue, msg)
+		s.mu.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+			// Already notified
+		}
+	}
+
+	return nil
+}
+
+// Subscribe calls handler with every message published from now on, until ctx is done
+func (b *Memory) Subscribe(ctx context.Context, handler Handler) error {
+	s := &subscriber{notify: make(chan struct{}, 1)}
+
+	b.mu.Lock()
+	b.subscribers[s] = true
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers, s)
+		b.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.notify:
+		}
+
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+
+		for _, msg := range queue {
+			handler(msg)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Package events has the events the api server tells the web server about, so that the
+// web server can push them over WebSocket connections to the pages that show what changed.
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Types of events
+const (
+	SaleCreated           = "sale.created"
+	RefundIssued          = "refund.issued"
+	SubscriptionCancelled = "subscription.cancelled"
+	UserUpdated           = "user.updated"
+)
+
+// SecretHeader is the header the shared secret is sent in
+const SecretHeader = "X-Internal-Secret"
+
+// Event is something that happened, with data that depends on its type
+type Event struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	Time time.Time       `json:"time"`
+}
+
+// New returns an event of a type with data, which is sent as JSON
+func New(eventType string, data interface{}) (Event, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{Type: eventType, Data: raw, Time: time.Now()}, nil
+}
+
+// Sale is the data of a SaleCreated event
+type Sale struct {
+	OrderID       int    `json:"order_id"`
+	TransactionID int    `json:"transaction_id"`
+	Amount        int    `json:"amount"`
+	Currency      string `json:"currency"`
+}
+
+// Refund is the data of a RefundIssued event. Remaining is how much of the order can
+// still be refunded.
+type Refund struct {
+	OrderID       int    `json:"order_id"`
+	TransactionID int    `json:"transaction_id"`
+	Amount        int    `json:"amount"`
+	Remaining     int    `json:"remaining"`
+	Reason        string `json:"reason"`
+}
+
+// Subscription is the data of a SubscriptionCancelled event. Subscriptions are cancelled
+// either now or at the end of their period, in which case CancelAtPeriodEnd is set.
+type Subscription struct {
+	StripeSubscriptionID string `json:"stripe_subscription_id"`
+	Status               string `json:"status"`
+	CancelAtPeriodEnd    bool   `json:"cancel_at_period_end"`
+}
+
+// User is the data of a UserUpdated event
+type User struct {
+	ID int `json:"id"`
+}
+
+// Publisher posts events to the web server with a shared secret
+type Publisher struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// NewPublisher returns a Publisher that posts to url
+func NewPublisher(url, secret string) *Publisher {
+	return &Publisher{
+		URL:    url,
+		Secret: secret,
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Publish posts an event
+func (p *Publisher) Publish(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, p.Secret)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("publishing %s event: %s", e.Type, resp.Status)
+	}
+
+	return nil
+}
+
+// Authorized reports whether a request carries secret. An empty secret authorizes nothing.
+func Authorized(r *http.Request, secret string) bool {
+	given := r.Header.Get(SecretHeader)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
@@ -0,0 +1,89 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is a WebSocket connection of a user
+type Client struct {
+	UserID int
+
+	// roleID is only used by the goroutine running the hub, which changes it in SetRole
+	roleID int
+
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// Send sends v as JSON to this connection only
+func (c *Client) Send(v interface{}) error {
+	return c.hub.Send(Target{client: c}, v)
+}
+
+// RemoteAddr returns the address of the client
+func (c *Client) RemoteAddr() string {
+	return c.conn.RemoteAddr().String()
+}
+
+// readPump reads messages from the connection for OnMessage, and the pongs that keep it
+// alive, until the connection fails or closes. It is the only reader of the connection.
+func (c *Client) readPump() {
+	defer func() {
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.hub.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.hub.PongWait))
+	})
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if c.hub.OnMessage != nil {
+			c.hub.OnMessage(c, message)
+		}
+	}
+}
+
+// writePump writes the messages the hub hands the connection, and pings it, until the hub
+// drops it or a write fails. It is the only writer of the connection.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.hub.PongWait * 9 / 10)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub dropped the connection
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Package hub sends messages to the WebSocket connections of the pages users have open.
+// One goroutine owns the set of connections, and every connection has a goroutine writing
+// to it and one reading from it, so connections can come and go while messages are sent.
+// Messages go to one user, one role or everyone. A user's role is the one they had when
+// they connected, until SetRole changes it.
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is how long a write to a connection may take
+	writeWait = 10 * time.Second
+	// maxMessageSize is the largest message a client may send
+	maxMessageSize = 4096
+	// sendBuffer is how many messages may wait to be written to a connection. Connections
+	// that fall further behind are dropped.
+	sendBuffer = 16
+)
+
+// ErrClosed is returned when using a hub that has been closed
+var ErrClosed = errors.New("hub closed")
+
+// Target is the connections a message is sent to. The zero Target matches none.
+type Target struct {
+	all    bool
+	userID int
+	roleID int
+	client *Client
+}
+
+// Everyone targets every connection
+var Everyone = Target{all: true}
+
+// User targets the connections of a user
+func User(id int) Target {
+	return Target{userID: id}
+}
+
+// Role targets the connections of the users with a role
+func Role(id int) Target {
+	return Target{roleID: id}
+}
+
+// matches reports whether a message for t goes to c
+func (t Target) matches(c *Client) bool {
+	switch {
+	case t.all:
+		return true
+	case t.client != nil:
+		return t.client == c
+	case t.userID != 0:
+		return c.UserID == t.userID
+	case t.roleID != 0:
+		return c.roleID == t.roleID
+	}
+	return false
+}
+
+// envelope is a message on its way to the connections of a target
+type envelope struct {
+	target Target
+	data   []byte
+}
+
+// roleChange moves the connections of a user to another role
+type roleChange struct {
+	userID int
+	roleID int
+}
+
+// Hub keeps track of connections and sends them messages. Run must be running for it to
+// do either.
+type Hub struct {
+	// Upgrader upgrades requests to WebSocket connections
+	Upgrader websocket.Upgrader
+	// OnMessage, if set, is called with every message a client sends, from the goroutine
+	// reading its connection
+	OnMessage func(c *Client, message []byte)
+	// PongWait is how long a connection may go without answering a ping before it is
+	// dropped. Pings are sent a little more often than that.
+	PongWait time.Duration
+
+	clients    map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	outbound   chan envelope
+	roles      chan roleChange
+	count      chan chan int
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// New returns a Hub. Start it with Run.
+func New() *Hub {
+	return &Hub{
+		Upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+		PongWait:   60 * time.Second,
+		clients:    make(map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		outbound:   make(chan envelope),
+		roles:      make(chan roleChange),
+		count:      make(chan chan int),
+		done:       make(chan struct{}),
+	}
+}
+
+// Run registers and unregisters connections and hands messages to them until Close is
+// called, then drops every connection
+func (h *Hub) Run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+
+		case c := <-h.unregister:
+			h.drop(c)
+
+		case e := <-h.outbound:
+			for c := range h.clients {
+				if !e.target.matches(c) {
+					continue
+				}
+				select {
+				case c.send <- e.data:
+				default:
+					// The client is not keeping up
+					h.drop(c)
+				}
+			}
+
+		case rc := <-h.roles:
+			for c := range h.clients {
+				if c.UserID == rc.userID {
+					c.roleID = rc.roleID
+				}
+			}
+
+		case reply := <-h.count:
+			reply <- len(h.clients)
+
+		case <-h.done:
+			for c := range h.clients {
+				h.drop(c)
+			}
+			return
+		}
+	}
+}
+
+// drop forgets a connection, and closes its send channel so its write pump closes it
+func (h *Hub) drop(c *Client) {
+	if h.clients[c] {
+		delete(h.clients, c)
+		close(c.send)
+	}
+}
+
+// Close stops Run and drops every connection
+func (h *Hub) Close() {
+	h.closeOnce.Do(func() {
+		close(h.done)
+	})
+}
+
+// Send sends v as JSON to the connections of target
+func (h *Hub) Send(target Target, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case h.outbound <- envelope{target: target, data: data}:
+		return nil
+	case <-h.done:
+		return ErrClosed
+	}
+}
+
+// SetRole moves the connections of a user to another role, so that they are sent the
+// messages of that role from now on
+func (h *Hub) SetRole(userID, roleID int) error {
+	select {
+	case h.roles <- roleChange{userID: userID, roleID: roleID}:
+		return nil
+	case <-h.done:
+		return ErrClosed
+	}
+}
+
+// Count returns how many connections there are
+func (h *Hub) Count() int {
+	reply := make(chan int)
+	select {
+	case h.count <- reply:
+		return <-reply
+	case <-h.done:
+		return 0
+	}
+}
+
+// Serve upgrades a request to a WebSocket connection of a user with a role, and keeps it
+// until the client goes away. It returns once the connection is registered.
+func (h *Hub) Serve(w http.ResponseWriter, r *http.Request, userID, roleID int) (*Client, error) {
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		UserID: userID,
+		roleID: roleID,
+		hub:    h,
+		conn:   conn,
+		send:   make(chan []byte, sendBuffer),
+	}
+
+	select {
+	case h.register <- c:
+	case <-h.done:
+		conn.Close()
+		return nil, ErrClosed
+	}
+
+	go c.writePump()
+	go c.readPump()
+
+	return c, nil
+}
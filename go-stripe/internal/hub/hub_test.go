@@ -0,0 +1,224 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub runs a hub behind a test server, and returns it with a function that opens
+// a connection for a user with a role
+func newTestHub(t *testing.T) (*Hub, func(userID, roleID int) *websocket.Conn) {
+	t.Helper()
+
+	h := New()
+	go h.Run()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		roleID, _ := strconv.Atoi(r.URL.Query().Get("role"))
+		if _, err := h.Serve(w, r, userID, roleID); err != nil {
+			t.Errorf("serving connection: %s", err)
+		}
+	}))
+	t.Cleanup(func() {
+		h.Close()
+		srv.Close()
+	})
+
+	dial := func(userID, roleID int) *websocket.Conn {
+		t.Helper()
+
+		url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?user=" + strconv.Itoa(userID) + "&role=" + strconv.Itoa(roleID)
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("dialing hub: %s", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	return h, dial
+}
+
+// waitForCount waits until the hub has n connections
+func waitForCount(t *testing.T, h *Hub, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for h.Count() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub has %d connections, want %d", h.Count(), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// receive reads the next message of a connection, decoded as a string. It returns false
+// if none arrives within wait.
+func receive(t *testing.T, conn *websocket.Conn, wait time.Duration) (string, bool) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(wait))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return "", false
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("decoding %q: %s", data, err)
+	}
+	return s, true
+}
+
+func TestRegisterAndUnregister(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	a := dial(1, 1)
+	dial(2, 1)
+	waitForCount(t, h, 2)
+
+	a.Close()
+	waitForCount(t, h, 1)
+}
+
+func TestSendToUser(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	first := dial(1, 1)
+	second := dial(1, 2)
+	other := dial(2, 1)
+	waitForCount(t, h, 3)
+
+	if err := h.Send(User(1), "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range []*websocket.Conn{first, second} {
+		if got, ok := receive(t, conn, time.Second); !ok || got != "hello" {
+			t.Errorf("connection of user 1 got %q, %v; want hello", got, ok)
+		}
+	}
+	if got, ok := receive(t, other, 100*time.Millisecond); ok {
+		t.Errorf("connection of user 2 got %q", got)
+	}
+}
+
+func TestSendToRole(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	admin := dial(1, 1)
+	otherAdmin := dial(2, 1)
+	clerk := dial(3, 2)
+	waitForCount(t, h, 3)
+
+	if err := h.Send(Role(1), "admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(Everyone, "all"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, conn := range []*websocket.Conn{admin, otherAdmin} {
+		for _, want := range []string{"admins", "all"} {
+			if got, ok := receive(t, conn, time.Second); !ok || got != want {
+				t.Errorf("connection with role 1 got %q, %v; want %q", got, ok, want)
+			}
+		}
+	}
+
+	// Messages arrive in order, so the role's message would have come first
+	if got, ok := receive(t, clerk, time.Second); !ok || got != "all" {
+		t.Errorf("connection with role 2 got %q, %v; want all", got, ok)
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	demoted := dial(1, 1)
+	admin := dial(2, 1)
+	waitForCount(t, h, 2)
+
+	if err := h.SetRole(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(Role(1), "admins"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Send(Role(2), "clerks"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := receive(t, admin, time.Second); !ok || got != "admins" {
+		t.Errorf("connection still with role 1 got %q, %v; want admins", got, ok)
+	}
+	if got, ok := receive(t, demoted, time.Second); !ok || got != "clerks" {
+		t.Errorf("connection moved to role 2 got %q, %v; want clerks", got, ok)
+	}
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	// The slow client never reads, so its messages back up until the hub gives up on it
+	dial(1, 1)
+	fast := dial(2, 1)
+	waitForCount(t, h, 2)
+
+	big := strings.Repeat("x", 64<<10)
+	for i := 0; h.Count() == 2; i++ {
+		if i == 1000 {
+			t.Fatal("slow client was not dropped")
+		}
+
+		if err := h.Send(Everyone, big); err != nil {
+			t.Fatal(err)
+		}
+		// Keeping up with every message, the fast client is never behind
+		if _, ok := receive(t, fast, time.Second); !ok {
+			t.Fatal("fast client did not get a message")
+		}
+	}
+
+	if err := h.Send(User(2), "still here"); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := receive(t, fast, time.Second); !ok || got != "still here" {
+		t.Errorf("fast client got %q, %v; want still here", got, ok)
+	}
+	waitForCount(t, h, 1)
+}
+
+func TestClose(t *testing.T) {
+	h, dial := newTestHub(t)
+
+	conn := dial(1, 1)
+	waitForCount(t, h, 1)
+
+	h.Close()
+
+	// The connection is closed once Run has stopped
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Fatalf("reading after Close returned %v, want the connection closed", err)
+	}
+
+	if err := h.Send(Everyone, "late"); err != ErrClosed {
+		t.Errorf("Send after Close returned %v, want ErrClosed", err)
+	}
+	if err := h.SetRole(1, 2); err != ErrClosed {
+		t.Errorf("SetRole after Close returned %v, want ErrClosed", err)
+	}
+	if n := h.Count(); n != 0 {
+		t.Errorf("Count after Close is %d, want 0", n)
+	}
+}
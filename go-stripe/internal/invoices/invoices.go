@@ -0,0 +1,69 @@
+// Package invoices sends the invoices of orders to the invoice microservice, which makes
+// the PDF and emails it to the customer.
+//
+// Invoices are not sent while the customer waits. Every order is recorded with an invoice
+// job, inserted in the same transaction, so an order is never kept without its invoice,
+// and a Worker sends the jobs in the background. A job that fails is tried again with
+// exponential backoff, and after MaxAttempts it is marked failed, where it stays until an
+// admin retries it.
+//
+// Delivery is at least once: a job whose outcome could not be recorded, because the
+// worker stopped or the response was lost, is sent again once its lease runs out.
+package invoices
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Client posts invoices to the invoice microservice
+type Client struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewClient returns a Client that posts to url, giving up on requests after timeout
+func NewClient(url string, timeout time.Duration) *Client {
+	return &Client{
+		URL:    url,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Send posts an invoice, a models.Invoice encoded as JSON. The microservice reports some
+// failures with a 200 and error set in the response, so both are checked.
+func (c *Client) Send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	_ = json.Unmarshal(body, &res)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invoice microservice returned %s: %s", resp.Status, res.Message)
+	}
+	if res.Error {
+		return errors.New("invoice microservice returned an error: " + res.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package invoices
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newInvoiceService returns a Client posting to a test server that answers with status
+// and body, and the last payload the server was sent
+func newInvoiceService(t *testing.T, status int, body string) (*Client, *[]byte) {
+	t.Helper()
+
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return NewClient(srv.URL, time.Second), &got
+}
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		err    string
+	}{
+		{"accepted", http.StatusOK, `{"error": false, "message": "sent"}`, ""},
+		{"accepted without a body", http.StatusOK, ``, ""},
+		{"error in a 200", http.StatusOK, `{"error": true, "message": "no such template"}`, "no such template"},
+		{"server error", http.StatusInternalServerError, `{"error": true, "message": "out of paper"}`, "500 Internal Server Error: out of paper"},
+		{"server error without a body", http.StatusBadGateway, `<html>`, "502 Bad Gateway"},
+	}
+
+	for _, tt := range tests {
+		client, got := newInvoiceService(t, tt.status, tt.body)
+
+		err := client.Send(context.Background(), []byte(`{"id": 1}`))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: got error %q", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got error %v, want one containing %q", tt.name, err, tt.err)
+		}
+
+		if string(*got) != `{"id": 1}` {
+			t.Errorf("%s: service was sent %q", tt.name, *got)
+		}
+	}
+}
+
+func TestSendUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	if err := NewClient(srv.URL, time.Second).Send(context.Background(), []byte(`{}`)); err == nil {
+		t.Error("sending to a closed server did not fail")
+	}
+}
@@ -0,0 +1,124 @@
+package invoices
+
+import (
+	"context"
+	"log"
+	"myapp/internal/models"
+	"time"
+)
+
+// Worker sends the invoice jobs that are due. Any number of workers, on any number of
+// servers, can share the jobs of a database; each job is claimed by one of them at a time.
+type Worker struct {
+	store    models.InvoiceJobRepository
+	client   *Client
+	infoLog  *log.Logger
+	errorLog *log.Logger
+
+	// Interval is how often the worker looks for jobs that are due
+	Interval time.Duration
+	// BatchSize is how many jobs are claimed at a time
+	BatchSize int
+	// Lease is how long a claimed job is left to the worker that claimed it. It must be
+	// longer than sending a whole batch can take, or jobs may be sent twice.
+	Lease time.Duration
+	// MaxAttempts is how many times a job is tried before it is marked failed
+	MaxAttempts int
+	// Backoff is how long to wait after the first failed attempt. The wait doubles after
+	// each attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewWorker returns a Worker sending the jobs in store with client. Deliveries are logged
+// to infoLog, and failures to errorLog.
+func NewWorker(store models.InvoiceJobRepository, client *Client, infoLog, errorLog *log.Logger) *Worker {
+	return &Worker{
+		store:       store,
+		client:      client,
+		infoLog:     infoLog,
+		errorLog:    errorLog,
+		Interval:    5 * time.Second,
+		BatchSize:   10,
+		Lease:       5 * time.Minute,
+		MaxAttempts: 8,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+	}
+}
+
+// Run sends the jobs that are due every Interval, until ctx is done, and returns the error
+// of ctx
+func (w *Worker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		err := w.work(ctx)
+		if err != nil {
+			w.errorLog.Println("sending invoices:", err)
+		}
+	}
+}
+
+// work sends batches of jobs until none are due
+func (w *Worker) work(ctx context.Context) error {
+	for {
+		jobs, err := w.store.ClaimInvoiceJobs(w.BatchSize, w.Lease)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range jobs {
+			if err := ctx.Err(); err != nil {
+				// The lease brings the rest of the batch back
+				return err
+			}
+
+			err = w.deliver(ctx, job)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(jobs) < w.BatchSize {
+			return nil
+		}
+	}
+}
+
+// deliver sends a claimed job and records the outcome
+func (w *Worker) deliver(ctx context.Context, job models.InvoiceJob) error {
+	err := w.client.Send(ctx, job.Payload)
+	if err == nil {
+		w.infoLog.Printf("Sent invoice for order %d", job.OrderID)
+		return w.store.MarkInvoiceJobDelivered(job.ID)
+	}
+
+	if job.Attempts >= w.MaxAttempts {
+		w.errorLog.Printf("invoice for order %d failed after %d attempts: %s", job.OrderID, job.Attempts, err)
+		return w.store.FailInvoiceJob(job.ID, err.Error())
+	}
+
+	next := time.Now().Add(w.backoff(job.Attempts))
+	w.errorLog.Printf("invoice for order %d failed, trying again at %s: %s", job.OrderID, next.Format(time.RFC3339), err)
+	return w.store.RescheduleInvoiceJob(job.ID, next, err.Error())
+}
+
+// backoff returns how long to wait after a job's attempts have all failed
+func (w *Worker) backoff(attempts int) time.Duration {
+	d := w.Backoff
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= w.MaxBackoff {
+			return w.MaxBackoff
+		}
+	}
+	return d
+}
@@ -0,0 +1,169 @@
+package invoices
+
+import (
+	"context"
+	"io"
+	"log"
+	"myapp/internal/models"
+	"myapp/internal/testdb"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestWorker returns a Worker on a new SQLite database, sending to a test server that
+// answers with status, and the model of the database
+func newTestWorker(t *testing.T, status int) (*Worker, *models.DBModel) {
+	t.Helper()
+
+	db, err := testdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m := testdb.NewModel(db)
+	client, _ := newInvoiceService(t, status, `{}`)
+	discard := log.New(io.Discard, "", 0)
+
+	return NewWorker(&m, client, discard, discard), &m
+}
+
+// claim claims the one job that is due, failing the test if there is not exactly one
+func claim(t *testing.T, w *Worker, m *models.DBModel) models.InvoiceJob {
+	t.Helper()
+
+	jobs, err := m.ClaimInvoiceJobs(w.BatchSize, w.Lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("claimed %d jobs, want 1", len(jobs))
+	}
+	return jobs[0]
+}
+
+// job returns a job as it is in the database
+func job(t *testing.T, m *models.DBModel, id int) models.InvoiceJob {
+	t.Helper()
+
+	j, err := m.GetInvoiceJob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestClaimInvoiceJobs(t *testing.T) {
+	w, m := newTestWorker(t, http.StatusOK)
+
+	id, err := m.InsertInvoiceJob(1, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	j := claim(t, w, m)
+	if j.ID != id || j.Attempts != 1 {
+		t.Errorf("claimed job %d with %d attempts, want job %d with 1", j.ID, j.Attempts, id)
+	}
+	if j.NextAttemptAt.Before(before.Add(w.Lease)) {
+		t.Errorf("job leased until %s, want at least %s", j.NextAttemptAt, before.Add(w.Lease))
+	}
+
+	// The lease keeps the job from other workers
+	jobs, err := m.ClaimInvoiceJobs(w.BatchSize, w.Lease)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("claimed %d leased jobs, want none", len(jobs))
+	}
+
+	// Once the lease runs out, the job is claimed again with another attempt counted
+	if err := m.RescheduleInvoiceJob(id, time.Now().Add(-time.Second), "lease ran out"); err != nil {
+		t.Fatal(err)
+	}
+	if j := claim(t, w, m); j.Attempts != 2 {
+		t.Errorf("job claimed again has %d attempts, want 2", j.Attempts)
+	}
+	if j := job(t, m, id); j.Attempts != 2 || j.Status != models.InvoiceJobPending {
+		t.Errorf("job is %s with %d attempts, want pending with 2", j.Status, j.Attempts)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	w, m := newTestWorker(t, http.StatusOK)
+
+	id, err := m.InsertInvoiceJob(1, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.deliver(context.Background(), claim(t, w, m)); err != nil {
+		t.Fatal(err)
+	}
+
+	if j := job(t, m, id); j.Status != models.InvoiceJobDelivered || j.DeliveredAt == nil {
+		t.Errorf("job is %s, delivered at %v, want delivered", j.Status, j.DeliveredAt)
+	}
+}
+
+func TestDeliverFailure(t *testing.T) {
+	w, m := newTestWorker(t, http.StatusInternalServerError)
+	w.MaxAttempts = 2
+
+	id, err := m.InsertInvoiceJob(1, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attempts before the last are tried again after the backoff
+	before := time.Now()
+	if err := w.deliver(context.Background(), claim(t, w, m)); err != nil {
+		t.Fatal(err)
+	}
+
+	j := job(t, m, id)
+	if j.Status != models.InvoiceJobPending || j.LastError == "" {
+		t.Errorf("job is %s with error %q, want pending with the error", j.Status, j.LastError)
+	}
+	if j.NextAttemptAt.Before(before.Add(w.Backoff)) || j.NextAttemptAt.After(time.Now().Add(w.Backoff)) {
+		t.Errorf("job rescheduled for %s, want %s after the attempt", j.NextAttemptAt, w.Backoff)
+	}
+
+	// The last attempt fails the job
+	if err := m.RescheduleInvoiceJob(id, time.Now().Add(-time.Second), j.LastError); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.deliver(context.Background(), claim(t, w, m)); err != nil {
+		t.Fatal(err)
+	}
+
+	if j := job(t, m, id); j.Status != models.InvoiceJobFailed || j.Attempts != 2 {
+		t.Errorf("job is %s after %d attempts, want failed after 2", j.Status, j.Attempts)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	w := &Worker{Backoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := w.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff after %d attempts is %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
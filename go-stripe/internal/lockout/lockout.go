@@ -0,0 +1,217 @@
+// Package lockout slows down and then stops password guessing. Failed logins are counted
+// per account and per IP address: every failure makes the next attempt wait longer, and
+// too many lock the account or address out for a while. The api and web servers share the
+// counts when they both use the database store.
+package lockout
+
+import (
+	"errors"
+	"fmt"
+	"myapp/internal/models"
+	"time"
+)
+
+// ErrLocked is wrapped by the errors Check returns
+var ErrLocked = errors.New("too many failed login attempts")
+
+// WaitError is returned by Check when an account or IP address must wait before trying to
+// log in again
+type WaitError struct {
+	// Until is when the next attempt is allowed
+	Until time.Time
+	// Locked is set when the wait is a lockout, rather than the backoff after a failure
+	Locked bool
+}
+
+func (e *WaitError) Error() string {
+	return fmt.Sprintf("%s; try again after %s", ErrLocked, e.Until.Format(time.Kitchen))
+}
+
+func (e *WaitError) Unwrap() error {
+	return ErrLocked
+}
+
+// RetryAfter returns how long from now the next attempt is allowed, rounded up to a second
+func (e *WaitError) RetryAfter(now time.Time) time.Duration {
+	d := e.Until.Sub(now)
+	if d < time.Second {
+		return time.Second
+	}
+	return d.Round(time.Second)
+}
+
+// Policy is how failures of one kind of key are punished
+type Policy struct {
+	// Threshold is how many failures within Window lock the key out for LockFor
+	Threshold int
+	LockFor   time.Duration
+	Window    time.Duration
+	// BaseDelay is the wait after the first failure. It doubles with each failure up to
+	// MaxDelay. Zero means no wait before the lockout.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// delay returns how long to wait after failures failures
+func (p Policy) delay(failures int) time.Duration {
+	if p.BaseDelay <= 0 || failures < 1 {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+// DefaultAccountPolicy locks an account for 15 minutes after 5 failures
+var DefaultAccountPolicy = Policy{
+	Threshold: 5,
+	LockFor:   15 * time.Minute,
+	Window:    15 * time.Minute,
+	BaseDelay: time.Second,
+	MaxDelay:  30 * time.Second,
+}
+
+// DefaultIPPolicy locks an IP address for 15 minutes after 20 failures, across any number
+// of accounts. Offices share addresses, so it waits less after each failure.
+var DefaultIPPolicy = Policy{
+	Threshold: 20,
+	LockFor:   15 * time.Minute,
+	Window:    15 * time.Minute,
+	BaseDelay: 100 * time.Millisecond,
+	MaxDelay:  5 * time.Second,
+}
+
+// Guard checks and counts login attempts
+type Guard struct {
+	store   models.LoginAttemptRepository
+	Account Policy
+	IP      Policy
+}
+
+// New returns a Guard that keeps counts in store, with the default policies
+func New(store models.LoginAttemptRepository) *Guard {
+	return &Guard{
+		store:   store,
+		Account: DefaultAccountPolicy,
+		IP:      DefaultIPPolicy,
+	}
+}
+
+// WithStore returns a copy of the Guard keeping counts in store, such as a database
+// transaction
+func (g *Guard) WithStore(store models.LoginAttemptRepository) *Guard {
+	c := *g
+	c.store = store
+	return &c
+}
+
+// accountKey returns the key of the account with the given email address
+func accountKey(email string) string {
+	return "account:" + models.NormalizeEmail(email)
+}
+
+// ipKey returns the key of an IP address
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check returns a *WaitError if the account with the given email address, or the IP
+// address, may not try to log in yet. Call it before checking the password.
+func (g *Guard) Check(email, ip string) error {
+	now := time.Now()
+
+	var wait *WaitError
+	for _, k := range []struct {
+		key    string
+		policy Policy
+	}{
+		{accountKey(email), g.Account},
+		{ipKey(ip), g.IP},
+	} {
+		a, err := g.store.GetLoginAttempts(k.key)
+		if err != nil {
+			return err
+		}
+
+		w := k.policy.wait(a, now)
+		if w != nil && (wait == nil || w.Until.After(wait.Until)) {
+			wait = w
+		}
+	}
+
+	if wait != nil {
+		return wait
+	}
+	return nil
+}
+
+// wait returns how long the key with attempts a must wait at now, or nil
+func (p Policy) wait(a models.LoginAttempts, now time.Time) *WaitError {
+	if a.Locked(now) {
+		return &WaitError{Until: *a.LockedUntil, Locked: true}
+	}
+
+	if a.LastFailureAt == nil || now.Sub(*a.LastFailureAt) > p.Window {
+		return nil
+	}
+
+	until := a.LastFailureAt.Add(p.delay(a.Failures))
+	if until.After(now) {
+		return &WaitError{Until: until}
+	}
+	return nil
+}
+
+// Fail counts a failed login for the account with the given email address and the IP
+// address, locking out either once it reaches its threshold. It reports whether the
+// account was locked out by this failure.
+func (g *Guard) Fail(email, ip string) (bool, error) {
+	now := time.Now()
+
+	a, err := g.store.RecordLoginFailure(accountKey(email), models.NormalizeEmail(email), g.Account.Window)
+	if err != nil {
+		return false, err
+	}
+
+	locked := a.Failures >= g.Account.Threshold && !a.Locked(now)
+	if locked {
+		if err := g.store.LockLogin(a.Key, now.Add(g.Account.LockFor)); err != nil {
+			return false, err
+		}
+	}
+
+	a, err = g.store.RecordLoginFailure(ipKey(ip), "", g.IP.Window)
+	if err != nil {
+		return locked, err
+	}
+
+	if a.Failures >= g.IP.Threshold && !a.Locked(now) {
+		if err := g.store.LockLogin(a.Key, now.Add(g.IP.LockFor)); err != nil {
+			return locked, err
+		}
+	}
+
+	return locked, nil
+}
+
+// Succeed forgets the failed logins of an account once its user has logged in. The IP
+// address keeps its count, so that knowing one password does not allow guessing others.
+func (g *Guard) Succeed(email string) error {
+	return g.store.ResetLoginAttempts(accountKey(email))
+}
+
+// Status returns the failed logins of the account with the given email address
+func (g *Guard) Status(email string) (models.LoginAttempts, error) {
+	return g.store.GetLoginAttempts(accountKey(email))
+}
+
+// Unlock forgets the failed logins of an account, so its user can log in straight away
+func (g *Guard) Unlock(email string) error {
+	return g.store.ResetLoginAttempts(accountKey(email))
+}
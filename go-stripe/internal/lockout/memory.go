@@ -0,0 +1,137 @@
+package lockout
+
+import (
+	"myapp/internal/models"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps failed login counts in memory. They are lost on restart and not shared
+// between servers, so it is only meant for development and a single server.
+type MemoryStore struct {
+	mu       sync.Mutex
+	attempts map[string]models.LoginAttempts
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{attempts: make(map[string]models.LoginAttempts)}
+}
+
+var _ models.LoginAttemptRepository = (*MemoryStore)(nil)
+
+// GetLoginAttempts returns the failed logins of a key
+func (s *MemoryStore) GetLoginAttempts(key string) (models.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		return models.LoginAttempts{Key: key}, nil
+	}
+	return a, nil
+}
+
+// RecordLoginFailure counts a failed login for a key, starting again from 1 when the last
+// failure was more than window ago
+func (s *MemoryStore) RecordLoginFailure(key, email string, window time.Duration) (models.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		a = models.LoginAttempts{Key: key, Email: email}
+	}
+	if a.LastFailureAt != nil && now.Sub(*a.LastFailureAt) > window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailureAt = &now
+
+	s.attempts[key] = a
+	return a, nil
+}
+
+// LockLogin locks a key out until until
+func (s *MemoryStore) LockLogin(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+	a.LockedUntil = &until
+	a.NotifiedAt = nil
+
+	s.attempts[key] = a
+	return nil
+}
+
+// ResetLoginAttempts forgets the failed logins of a key
+func (s *MemoryStore) ResetLoginAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+// GetUnnotifiedLockouts returns the accounts locked out whose owner has not been told yet
+func (s *MemoryStore) GetUnnotifiedLockouts() ([]models.LoginAttempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var lockouts []models.LoginAttempts
+	for _, a := range s.attempts {
+		if a.Email != "" && a.Locked(now) && a.NotifiedAt == nil {
+			lockouts = append(lockouts, a)
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].LockedUntil.Before(*lockouts[j].LockedUntil)
+	})
+
+	return lockouts, nil
+}
+
+// MarkLockoutNotified records that the owner of a locked out account has been told
+func (s *MemoryStore) MarkLockoutNotified(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.attempts[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	a.NotifiedAt = &now
+
+	s.attempts[key] = a
+	return nil
+}
+
+// DeleteStaleLoginAttempts forgets the keys that have not failed since before and are not
+// locked out
+func (s *MemoryStore) DeleteStaleLoginAttempts(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var n int64
+	for key, a := range s.attempts {
+		if (a.LastFailureAt == nil || a.LastFailureAt.Before(before)) && !a.Locked(now) {
+			delete(s.attempts, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+)
+
+// AuditEvent is the type for one administrative action. Before and After are the JSON
+// state of the entity around the action; either is empty when there is no such state, as
+// for something created or deleted. UserID is 0 for actions not made by an admin user.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	UserID     int             `json:"user_id"`
+	Action     string          `json:"action"`
+	EntityType string          `json:"entity_type"`
+	EntityID   string          `json:"entity_id"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IPAddress  string          `json:"ip_address"`
+	UserAgent  string          `json:"user_agent"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"-"`
+	User       User            `json:"user"`
+}
+
+// AuditFilter narrows down the audit events returned by GetAuditEventsPaginated. Zero
+// fields match everything.
+type AuditFilter struct {
+	UserID     int        `json:"user_id"`
+	Action     string     `json:"action"`
+	EntityType string     `json:"entity_type"`
+	EntityID   string     `json:"entity_id"`
+	From       *time.Time `json:"from"`
+	To         *time.Time `json:"to"`
+}
+
+// where returns the WHERE clause of the filter and its arguments
+func (f AuditFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.UserID != 0 {
+		conditions = append(conditions, "a.user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "a.action = ?")
+		args = append(args, f.Action)
+	}
+	if f.EntityType != "" {
+		conditions = append(conditions, "a.entity_type = ?")
+		args = append(args, f.EntityType)
+	}
+	if f.EntityID != "" {
+		conditions = append(conditions, "a.entity_id = ?")
+		args = append(args, f.EntityID)
+	}
+	if f.From != nil {
+		conditions = append(conditions, "a.created_at >= ?")
+		args = append(args, *f.From)
+	}
+	if f.To != nil {
+		conditions = append(conditions, "a.created_at < ?")
+		args = append(args, *f.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// InsertAuditEvent records an audit event. Call it on the model of the transaction that
+// makes the change, so the event is only kept if the change is.
+func (m *DBModel) InsertAuditEvent(event AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO audit_events
+				(user_id, action, entity_type, entity_id, before_state, after_state, ip_address, user_agent,
+				created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := m.conn().ExecContext(ctx, query,
+		sql.NullInt64{Int64: int64(event.UserID), Valid: event.UserID != 0},
+		event.Action,
+		event.EntityType,
+		event.EntityID,
+		jsonOrNil(event.Before),
+		jsonOrNil(event.After),
+		event.IPAddress,
+		event.UserAgent,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetAuditEventsPaginated returns a page of the audit events matching filter, newest
+// first, with the number of the last page and the number of matching events
+func (m *DBModel) GetAuditEventsPaginated(filter AuditFilter, pageSize, page int) ([]*AuditEvent, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+	where, args := filter.where()
+
+	var events []*AuditEvent
+
+	query := `
+		SELECT
+			a.id, a.user_id, a.action, a.entity_type, a.entity_id, a.before_state, a.after_state,
+			a.ip_address, a.user_agent, a.created_at, a.updated_at,
+			coalesce(u.first_name, ''), coalesce(u.last_name, ''), coalesce(u.email, '')
+		FROM
+			audit_events a
+			LEFT JOIN users u on (a.user_id = u.id)
+		` + where + `
+		ORDER BY a.id DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e AuditEvent
+		var userID sql.NullInt64
+		var before, after sql.NullString
+
+		err := rows.Scan(
+			&e.ID,
+			&userID,
+			&e.Action,
+			&e.EntityType,
+			&e.EntityID,
+			&before,
+			&after,
+			&e.IPAddress,
+			&e.UserAgent,
+			&e.CreatedAt,
+			&e.UpdatedAt,
+			&e.User.FirstName,
+			&e.User.LastName,
+			&e.User.Email,
+		)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		e.UserID = int(userID.Int64)
+		e.User.ID = e.UserID
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		events = append(events, &e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	query = `SELECT COUNT(a.id) FROM audit_events a ` + where
+
+	var numRecords int
+	err = m.conn().QueryRowContext(ctx, query, args...).Scan(&numRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := int(math.Ceil(float64(numRecords) / float64(pageSize)))
+
+	return events, lastPage, numRecords, nil
+}
+
+// jsonOrNil stores empty JSON as NULL
+func jsonOrNil(data json.RawMessage) sql.NullString {
+	return sql.NullString{String: string(data), Valid: len(data) > 0}
+}
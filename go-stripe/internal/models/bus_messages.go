@@ -0,0 +1,104 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// BusMessage is the type for a message published on the event bus
+type BusMessage struct {
+	ID        int
+	Topic     string
+	Payload   []byte
+	CreatedAt time.Time
+}
+
+// InsertBusMessage publishes a message on a topic and returns its ID
+func (m *DBModel) InsertBusMessage(topic string, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		INSERT INTO bus_messages (topic, payload, created_at, updated_at)
+		VALUES (?, ?, ?, ?)
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, topic, string(payload), now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetLastBusMessageID returns the ID of the latest message, or 0 if there are none
+func (m *DBModel) GetLastBusMessageID() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	err := m.conn().QueryRowContext(ctx, `SELECT coalesce(max(id), 0) FROM bus_messages`).Scan(&id)
+	return id, err
+}
+
+// GetBusMessagesAfter returns up to limit messages with an ID above id, in order of ID
+func (m *DBModel) GetBusMessagesAfter(id, limit int) ([]BusMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var messages []BusMessage
+
+	query := `
+		SELECT id, topic, payload, created_at
+		FROM bus_messages
+		WHERE id > ?
+		ORDER BY id
+		LIMIT ?
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, id, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg BusMessage
+		var payload string
+
+		err := rows.Scan(&msg.ID, &msg.Topic, &payload, &msg.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		msg.Payload = []byte(payload)
+
+		messages = append(messages, msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// DeleteBusMessagesBefore deletes the messages published before before, and returns how
+// many were deleted
+func (m *DBModel) DeleteBusMessagesBefore(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.conn().ExecContext(ctx, `DELETE FROM bus_messages WHERE created_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
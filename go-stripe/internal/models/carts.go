@@ -0,0 +1,179 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"myapp/internal/cart"
+	"time"
+)
+
+// Cart is the type for shopping carts kept by the api for its clients
+type Cart struct {
+	ID        int        `json:"-"`
+	Token     string     `json:"token"`
+	Items     []CartItem `json:"items"`
+	CreatedAt time.Time  `json:"-"`
+	UpdatedAt time.Time  `json:"-"`
+}
+
+// CartItem is the type for one line of a cart
+type CartItem struct {
+	ID       int    `json:"-"`
+	CartID   int    `json:"-"`
+	WidgetID int    `json:"widget_id"`
+	Quantity int    `json:"quantity"`
+	Widget   Widget `json:"widget"`
+}
+
+// CartItems returns the items of c as a cart.Cart, ready to be changed and saved with SetCartItems
+func (c *Cart) CartItems() cart.Cart {
+	var items cart.Cart
+	for _, item := range c.Items {
+		items.Items = append(items.Items, cart.Item{WidgetID: item.WidgetID, Quantity: item.Quantity})
+	}
+	return items
+}
+
+// CreateCart inserts an empty cart with a new random token
+func (m *DBModel) CreateCart() (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Cart{
+		Token:     base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	query := `INSERT INTO carts (token, created_at, updated_at) VALUES (?, ?, ?)`
+
+	result, err := m.conn().ExecContext(ctx, query, c.Token, c.CreatedAt, c.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	c.ID = int(id)
+
+	return &c, nil
+}
+
+// GetCartByToken returns a cart and its items, with the name and price of each widget
+func (m *DBModel) GetCartByToken(token string) (*Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Cart
+
+	query := `SELECT id, token, created_at, updated_at FROM carts WHERE token = ?`
+	err := m.conn().QueryRowContext(ctx, query, token).Scan(
+		&c.ID,
+		&c.Token,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `
+		SELECT
+			ci.id, ci.cart_id, ci.widget_id, ci.quantity,
+			w.id, w.name, w.description, w.price, w.image, w.is_recurring
+		FROM
+			cart_items ci
+			LEFT JOIN widgets w on (ci.widget_id = w.id)
+		WHERE
+			ci.cart_id = ?
+		ORDER BY ci.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item CartItem
+
+		err := rows.Scan(
+			&item.ID,
+			&item.CartID,
+			&item.WidgetID,
+			&item.Quantity,
+			&item.Widget.ID,
+			&item.Widget.Name,
+			&item.Widget.Description,
+			&item.Widget.Price,
+			&item.Widget.Image,
+			&item.Widget.IsRecurring,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Items = append(c.Items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// SetCartItems replaces the items of a cart
+func (m *DBModel) SetCartItems(cartID int, items []cart.Item) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		query := `DELETE FROM cart_items WHERE cart_id = ?`
+		_, err := tx.conn().ExecContext(ctx, query, cartID)
+		if err != nil {
+			return err
+		}
+
+		query = `INSERT INTO cart_items (cart_id, widget_id, quantity, created_at, updated_at) VALUES (?, ?, ?, ?, ?)`
+		for _, item := range items {
+			_, err = tx.conn().ExecContext(ctx, query, cartID, item.WidgetID, item.Quantity, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		query = `UPDATE carts SET updated_at = UTC_TIMESTAMP() WHERE id = ?`
+		_, err = tx.conn().ExecContext(ctx, tx.rebind(query), cartID)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// ClearCart empties the cart with the given token, once its items have been paid for
+func (m *DBModel) ClearCart(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM cart_items WHERE cart_id IN (SELECT id FROM carts WHERE token = ?)`
+
+	_, err := m.conn().ExecContext(ctx, query, token)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// Checkout holds the IDs of the rows written by CreateCheckout
+type Checkout struct {
+	CustomerID    int `json:"customer_id"`
+	TransactionID int `json:"transaction_id"`
+	OrderID       int `json:"order_id"`
+}
+
+// CreateCheckout records a sale: the customer, the transaction, the order, its items and the
+// first entry of its status history are inserted in a single database transaction, together
+// with the stock decrement for each widget, so either all of them are saved or none are.
+// A customer with a non-zero ID already exists and is not inserted again.
+//
+// An order without Items is a single line of order.Quantity of order.WidgetID. For an order
+// with Items, the order's WidgetID is that of the first item and its Quantity is the total
+// of all items.
+//
+// The order's invoice is queued in the same transaction, to be sent in the background.
+//
+// A payment is recorded once: if txn.StripePaymentID already has a transaction, nothing is
+// saved and ErrPaymentRecorded is returned. The unique index on it settles checkouts of
+// the same payment made at the same time.
+func (m *DBModel) CreateCheckout(ctx context.Context, customer Customer, txn Transaction, order Order) (Checkout, error) {
+	var checkout Checkout
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		var err error
+		checkout, err = tx.createCheckout(customer, txn, order, "")
+		return err
+	})
+	if err != nil {
+		return Checkout{}, err
+	}
+
+	return checkout, nil
+}
+
+// createCheckout does the work of CreateCheckout and must be called in a transaction. The
+// order's status history starts with note.
+func (m *DBModel) createCheckout(customer Customer, txn Transaction, order Order, note string) (Checkout, error) {
+	var checkout Checkout
+
+	items := order.Items
+	if len(items) == 0 {
+		unitPrice := order.Amount
+		if order.Quantity > 1 {
+			unitPrice = order.Amount / order.Quantity
+		}
+		items = []OrderItem{{
+			WidgetID:  order.WidgetID,
+			Quantity:  order.Quantity,
+			UnitPrice: unitPrice,
+		}}
+	} else {
+		order.WidgetID = items[0].WidgetID
+		order.Quantity = 0
+		for _, item := range items {
+			order.Quantity += item.Quantity
+		}
+	}
+
+	recorded, err := m.paymentRecorded(txn.StripePaymentID)
+	if err != nil {
+		return Checkout{}, err
+	}
+	if recorded {
+		return Checkout{}, ErrPaymentRecorded
+	}
+
+	// The transaction goes first, so that a payment recorded meanwhile fails the checkout
+	// before anything else is written
+	id, err := m.InsertTransaction(txn)
+	if err != nil {
+		return Checkout{}, err
+	}
+	checkout.TransactionID = id
+
+	checkout.CustomerID = customer.ID
+	if checkout.CustomerID == 0 {
+		id, err := m.InsertCustomer(customer)
+		if err != nil {
+			return Checkout{}, err
+		}
+		checkout.CustomerID = id
+	}
+
+	order.CustomerID = checkout.CustomerID
+	order.TransactionID = checkout.TransactionID
+	id, err = m.InsertOrder(order)
+	if err != nil {
+		return Checkout{}, err
+	}
+	checkout.OrderID = id
+
+	_, err = m.InsertOrderStatusHistory(checkout.OrderID, order.StatusID, note)
+	if err != nil {
+		return Checkout{}, err
+	}
+
+	for _, item := range items {
+		item.OrderID = checkout.OrderID
+		_, err = m.InsertOrderItem(item)
+		if err != nil {
+			return Checkout{}, err
+		}
+
+		err = m.DecrementInventory(item.WidgetID, item.Quantity, txn.PaymentIntent)
+		if err != nil {
+			return Checkout{}, err
+		}
+	}
+
+	// The invoice is sent to the invoice microservice in the background
+	err = m.queueInvoice(checkout.OrderID)
+	if err != nil {
+		return Checkout{}, err
+	}
+
+	return checkout, nil
+}
+
+// paymentRecorded reports whether a Stripe payment already has a transaction. It reports
+// false for an empty ID.
+func (m *DBModel) paymentRecorded(stripePaymentID string) (bool, error) {
+	if stripePaymentID == "" {
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var n int
+	query := `SELECT COUNT(id) FROM transactions WHERE stripe_payment_id = ?`
+	err := m.conn().QueryRowContext(ctx, query, stripePaymentID).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
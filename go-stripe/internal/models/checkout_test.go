@@ -0,0 +1,157 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"myapp/internal/models"
+	"testing"
+)
+
+// seedWidgets adds two widgets with 10 in stock
+func seedWidgets(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	for _, s := range []string{
+		`INSERT INTO widgets (id, name, inventory_level, price, slug) VALUES (1, 'Widget', 10, 1000, 'widget')`,
+		`INSERT INTO widgets (id, name, inventory_level, price, slug) VALUES (2, 'Gadget', 10, 2500, 'gadget')`,
+	} {
+		if _, err := db.Exec(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// inventory returns the stock of a widget
+func inventory(t *testing.T, db *sql.DB, widgetID int) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT inventory_level FROM widgets WHERE id = ?`, widgetID).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// checkout returns the customer, transaction and order of a sale of two widgets and a gadget
+func checkout(paymentID string) (models.Customer, models.Transaction, models.Order) {
+	customer := models.Customer{FirstName: "Pat", LastName: "Buyer", Email: "pat@example.com"}
+	txn := models.Transaction{
+		Amount:              4500,
+		Currency:            "cad",
+		PaymentIntent:       "pi_" + paymentID,
+		TransactionStatusID: 2,
+		StripePaymentID:     paymentID,
+	}
+	order := models.Order{
+		StatusID: 1,
+		Amount:   4500,
+		Items: []models.OrderItem{
+			{WidgetID: 1, Quantity: 2, UnitPrice: 1000},
+			{WidgetID: 2, Quantity: 1, UnitPrice: 2500},
+		},
+	}
+	return customer, txn, order
+}
+
+func TestCreateCheckout(t *testing.T) {
+	m, db := newTestModel(t)
+	seedWidgets(t, db)
+
+	customer, txn, order := checkout("ch_1")
+	c, err := m.CreateCheckout(context.Background(), customer, txn, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := m.GetOrderById(c.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.WidgetID != 1 || saved.Quantity != 3 || saved.CustomerID != c.CustomerID || saved.TransactionID != c.TransactionID {
+		t.Errorf("got order of %d of widget %d for customer %d and transaction %d, want 3 of widget 1 for %d and %d",
+			saved.Quantity, saved.WidgetID, saved.CustomerID, saved.TransactionID, c.CustomerID, c.TransactionID)
+	}
+
+	for table, want := range map[string]int{
+		"customers":            1,
+		"transactions":         1,
+		"orders":               1,
+		"order_items":          2,
+		"order_status_history": 1,
+		"invoice_jobs":         1,
+	} {
+		if n := count(t, db, table); n != want {
+			t.Errorf("%d rows in %s, want %d", n, table, want)
+		}
+	}
+	if got := inventory(t, db, 1); got != 8 {
+		t.Errorf("widget 1 has %d in stock, want 8", got)
+	}
+	if got := inventory(t, db, 2); got != 9 {
+		t.Errorf("widget 2 has %d in stock, want 9", got)
+	}
+}
+
+func TestCreateCheckoutPaymentRecorded(t *testing.T) {
+	m, db := newTestModel(t)
+	seedWidgets(t, db)
+
+	customer, txn, order := checkout("ch_1")
+	if _, err := m.CreateCheckout(context.Background(), customer, txn, order); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same payment again, as a retried webhook would record it
+	_, err := m.CreateCheckout(context.Background(), customer, txn, order)
+	if !errors.Is(err, models.ErrPaymentRecorded) {
+		t.Fatalf("recording the payment twice got %v, want %v", err, models.ErrPaymentRecorded)
+	}
+
+	for _, table := range []string{"customers", "transactions", "orders", "order_status_history", "invoice_jobs"} {
+		if n := count(t, db, table); n != 1 {
+			t.Errorf("%d rows in %s, want 1", n, table)
+		}
+	}
+	if got := inventory(t, db, 1); got != 8 {
+		t.Errorf("widget 1 has %d in stock, want 8", got)
+	}
+
+	// Inside a caller's transaction the error is the same, and rolls back what the caller
+	// wrote before it
+	err = m.WithTx(context.Background(), func(tx models.Repository) error {
+		insertCustomer(t, tx, "other@example.com")
+		_, err := tx.CreateCheckout(context.Background(), customer, txn, order)
+		return err
+	})
+	if !errors.Is(err, models.ErrPaymentRecorded) {
+		t.Errorf("recording the payment in a transaction got %v, want %v", err, models.ErrPaymentRecorded)
+	}
+	if n := count(t, db, "customers"); n != 1 {
+		t.Errorf("%d customers, want 1", n)
+	}
+}
+
+func TestCreateCheckoutRollback(t *testing.T) {
+	m, db := newTestModel(t)
+	seedWidgets(t, db)
+
+	// Queuing the invoice is the last step of a checkout
+	if _, err := db.Exec(`DROP TABLE invoice_jobs`); err != nil {
+		t.Fatal(err)
+	}
+
+	customer, txn, order := checkout("ch_1")
+	if _, err := m.CreateCheckout(context.Background(), customer, txn, order); err == nil {
+		t.Fatal("checkout without an invoice queue succeeded")
+	}
+
+	for _, table := range []string{"customers", "transactions", "orders", "order_items", "order_status_history"} {
+		if n := count(t, db, table); n != 0 {
+			t.Errorf("%d rows in %s after a failed checkout, want 0", n, table)
+		}
+	}
+	if got := inventory(t, db, 1); got != 10 {
+		t.Errorf("widget 1 has %d in stock after a failed checkout, want 10", got)
+	}
+}
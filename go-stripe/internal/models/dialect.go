@@ -0,0 +1,53 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Dialect is the SQL dialect of the database behind a DBModel
+type Dialect int
+
+const (
+	// MySQL is the production database, and the zero value
+	MySQL Dialect = iota
+	// SQLite is the embedded database used in tests
+	SQLite
+)
+
+// String returns the name of the dialect
+func (d Dialect) String() string {
+	switch d {
+	case SQLite:
+		return "sqlite"
+	default:
+		return "mysql"
+	}
+}
+
+// rebind rewrites a query written for MySQL into the model's dialect. Queries use
+// ? placeholders, which both dialects understand; only MySQL functions, locking clauses
+// and INSERT IGNORE need rewriting.
+func (m *DBModel) rebind(query string) string {
+	if m.Dialect == SQLite {
+		// SQLite locks the whole database for writes, so row locks are not needed
+		query = strings.ReplaceAll(query, " FOR UPDATE", "")
+		query = strings.ReplaceAll(query, "INSERT IGNORE", "INSERT OR IGNORE")
+		return strings.ReplaceAll(query, "UTC_TIMESTAMP()", "CURRENT_TIMESTAMP")
+	}
+
+	return query
+}
+
+// isDuplicateKey reports whether err is a violation of a unique index, in either dialect
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+
+	// The SQLite driver is only linked into tests, so its error is matched by message
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
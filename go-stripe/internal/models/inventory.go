@@ -0,0 +1,198 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrOutOfStock is returned when a widget does not have enough stock left for a reservation
+var ErrOutOfStock = errors.New("widget is out of stock")
+
+// WidgetReservation is the type for stock held for a checkout in progress
+type WidgetReservation struct {
+	ID            int       `json:"id"`
+	WidgetID      int       `json:"widget_id"`
+	Quantity      int       `json:"quantity"`
+	PaymentIntent string    `json:"payment_intent"`
+	Client        string    `json:"client"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// ReserveWidget holds quantity widgets for ttl and returns the reservation ID. Stock held by
+// reservations that have not expired counts as sold, so ErrOutOfStock is returned when
+// inventory_level minus those reservations is less than quantity. The reservation is made
+// for client, so that ReservedBy can tell how much stock a client holds.
+func (m *DBModel) ReserveWidget(widgetID, quantity int, client string, ttl time.Duration) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		now := time.Now().UTC()
+
+		// Lock the widget row so concurrent reservations are counted one at a time
+		var inventoryLevel int
+		query := `SELECT inventory_level FROM widgets WHERE id = ? FOR UPDATE`
+		err := tx.conn().QueryRowContext(ctx, tx.rebind(query), widgetID).Scan(&inventoryLevel)
+		if err != nil {
+			return err
+		}
+
+		var reserved int
+		query = `SELECT coalesce(sum(quantity), 0) FROM widget_reservations WHERE widget_id = ? AND expires_at > ?`
+		err = tx.conn().QueryRowContext(ctx, query, widgetID, now).Scan(&reserved)
+		if err != nil {
+			return err
+		}
+
+		if inventoryLevel-reserved < quantity {
+			return ErrOutOfStock
+		}
+
+		query = `INSERT INTO widget_reservations
+					(widget_id, quantity, payment_intent, client, expires_at, created_at, updated_at)
+				  VALUES (?, ?, '', ?, ?, ?, ?)`
+		result, err := tx.conn().ExecContext(ctx, query, widgetID, quantity, client, now.Add(ttl), now, now)
+		if err != nil {
+			return err
+		}
+
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ReservedBy returns how many widgets the reservations of client that have not expired hold
+func (m *DBModel) ReservedBy(client string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var reserved int
+	query := `SELECT coalesce(sum(quantity), 0) FROM widget_reservations WHERE client = ? AND expires_at > ?`
+	err := m.conn().QueryRowContext(ctx, query, client, time.Now().UTC()).Scan(&reserved)
+	if err != nil {
+		return 0, err
+	}
+
+	return reserved, nil
+}
+
+// AttachReservation links a reservation to the payment intent created for it
+func (m *DBModel) AttachReservation(id int, paymentIntent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE widget_reservations SET payment_intent = ?, updated_at = UTC_TIMESTAMP() WHERE id = ?`
+
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), paymentIntent, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseReservation deletes a reservation, giving its stock back
+func (m *DBModel) ReleaseReservation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM widget_reservations WHERE id = ?`
+
+	_, err := m.conn().ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseExpiredReservations deletes every expired reservation and returns how many were deleted
+func (m *DBModel) ReleaseExpiredReservations() (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM widget_reservations WHERE expires_at <= ?`
+
+	result, err := m.conn().ExecContext(ctx, query, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// DecrementInventory takes quantity widgets out of stock for a paid order and deletes the
+// reservation made for its payment intent. Recurring widgets are not stocked and are left
+// alone. The sale has already been paid for, so inventory_level may go below zero when a
+// reservation expired before the customer finished paying.
+func (m *DBModel) DecrementInventory(widgetID, quantity int, paymentIntent string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var isRecurring bool
+	query := `SELECT is_recurring FROM widgets WHERE id = ?`
+	err := m.conn().QueryRowContext(ctx, query, widgetID).Scan(&isRecurring)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isRecurring {
+		return nil
+	}
+
+	query = `UPDATE widgets SET inventory_level = inventory_level - ?, updated_at = UTC_TIMESTAMP() WHERE id = ?`
+	_, err = m.conn().ExecContext(ctx, m.rebind(query), quantity, widgetID)
+	if err != nil {
+		return err
+	}
+
+	if paymentIntent == "" {
+		return nil
+	}
+
+	query = `DELETE FROM widget_reservations WHERE payment_intent = ?`
+	_, err = m.conn().ExecContext(ctx, query, paymentIntent)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestockWidget puts quantity widgets back into stock
+func (m *DBModel) RestockWidget(widgetID, quantity int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `UPDATE widgets SET inventory_level = inventory_level + ?, updated_at = UTC_TIMESTAMP() WHERE id = ?`
+
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), quantity, widgetID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,365 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"time"
+)
+
+// Statuses of an invoice job
+const (
+	// InvoiceJobPending jobs are waiting to be sent to the invoice microservice
+	InvoiceJobPending = "pending"
+	// InvoiceJobDelivered jobs have been accepted by the invoice microservice
+	InvoiceJobDelivered = "delivered"
+	// InvoiceJobFailed jobs ran out of attempts, and wait for an admin to retry them
+	InvoiceJobFailed = "failed"
+)
+
+// InvoiceJob is the type for an invoice waiting to be sent to the invoice microservice.
+// Jobs are inserted by createCheckout, in the transaction that records their order.
+type InvoiceJob struct {
+	ID            int             `json:"id"`
+	OrderID       int             `json:"order_id"`
+	Payload       json.RawMessage `json:"-"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+	Email         string          `json:"email"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"-"`
+}
+
+// Invoice is what the invoice microservice is sent for an order, as the payload of its job
+type Invoice struct {
+	ID        int           `json:"id"`
+	Quantity  int           `json:"quantity"`
+	Amount    int           `json:"amount"`
+	Product   string        `json:"product"`
+	Items     []InvoiceItem `json:"items"`
+	CreatedAt time.Time     `json:"created_at"`
+	FirstName string        `json:"first_name"`
+	LastName  string        `json:"last_name"`
+	Email     string        `json:"email"`
+}
+
+// InvoiceItem is one line of an invoice
+type InvoiceItem struct {
+	Product   string `json:"product"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice int    `json:"unit_price"`
+	Amount    int    `json:"amount"`
+}
+
+// invoiceJobColumns are the columns scanned by scanInvoiceJob
+const invoiceJobColumns = `
+	j.id, j.order_id, j.payload, j.status, j.attempts, j.next_attempt_at, j.last_error,
+	j.delivered_at, coalesce(c.email, ''), j.created_at, j.updated_at
+`
+
+// invoiceJobTables joins the customer of each job's order, for their email
+const invoiceJobTables = `
+	invoice_jobs j
+	LEFT JOIN orders o ON (o.id = j.order_id)
+	LEFT JOIN customers c ON (c.id = o.customer_id)
+`
+
+// scanInvoiceJob scans a row of invoiceJobColumns
+func scanInvoiceJob(row rowScanner) (InvoiceJob, error) {
+	var j InvoiceJob
+	var payload string
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+
+	err := row.Scan(
+		&j.ID,
+		&j.OrderID,
+		&payload,
+		&j.Status,
+		&j.Attempts,
+		&j.NextAttemptAt,
+		&lastError,
+		&deliveredAt,
+		&j.Email,
+		&j.CreatedAt,
+		&j.UpdatedAt,
+	)
+	if err != nil {
+		return j, err
+	}
+
+	j.Payload = json.RawMessage(payload)
+	j.LastError = lastError.String
+	j.DeliveredAt = timeOrNil(deliveredAt)
+
+	return j, nil
+}
+
+// InsertInvoiceJob queues the invoice of an order, to be sent straight away, and returns
+// the ID of the job. Call it in the transaction that records the order; createCheckout
+// does for every order it records.
+func (m *DBModel) InsertInvoiceJob(orderID int, payload []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		INSERT INTO invoice_jobs (order_id, payload, status, attempts, next_attempt_at, created_at, updated_at)
+		VALUES (?, ?, ?, 0, ?, ?, ?)
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, orderID, string(payload), InvoiceJobPending, now, now, now)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// queueInvoice queues the invoice of an order, built from the order as it is in the
+// database. createCheckout calls it, so that every order is recorded with its invoice.
+func (m *DBModel) queueInvoice(orderID int) error {
+	order, err := m.GetOrderById(orderID)
+	if err != nil {
+		return err
+	}
+
+	invoice := Invoice{
+		ID:        order.ID,
+		Quantity:  order.Quantity,
+		Amount:    order.Amount,
+		Product:   order.Widget.Name,
+		CreatedAt: order.CreatedAt,
+		FirstName: order.Customer.FirstName,
+		LastName:  order.Customer.LastName,
+		Email:     order.Customer.Email,
+	}
+	for _, item := range order.Items {
+		invoice.Items = append(invoice.Items, InvoiceItem{
+			Product:   item.Widget.Name,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Amount:    item.UnitPrice * item.Quantity,
+		})
+	}
+
+	payload, err := json.Marshal(invoice)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.InsertInvoiceJob(orderID, payload)
+	return err
+}
+
+// ClaimInvoiceJobs returns up to limit pending jobs that are due, oldest first, counting an
+// attempt for each of them. They are not due again until lease has passed, so other
+// workers leave them alone while they are sent, and they are sent again if the worker
+// stops before recording the outcome.
+func (m *DBModel) ClaimInvoiceJobs(limit int, lease time.Duration) ([]InvoiceJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var jobs []InvoiceJob
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		now := time.Now()
+
+		query := `
+			SELECT ` + invoiceJobColumns + `
+			FROM ` + invoiceJobTables + `
+			WHERE j.status = ? AND j.next_attempt_at <= ?
+			ORDER BY j.next_attempt_at, j.id LIMIT ? FOR UPDATE
+		`
+
+		rows, err := tx.conn().QueryContext(ctx, tx.rebind(query), InvoiceJobPending, now, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			j, err := scanInvoiceJob(rows)
+			if err != nil {
+				return err
+			}
+			jobs = append(jobs, j)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		query = `
+			UPDATE invoice_jobs
+			SET attempts = attempts + 1, next_attempt_at = ?, updated_at = ?
+			WHERE id = ?
+		`
+		for i := range jobs {
+			_, err = tx.conn().ExecContext(ctx, query, now.Add(lease), now, jobs[i].ID)
+			if err != nil {
+				return err
+			}
+			jobs[i].Attempts++
+			jobs[i].NextAttemptAt = now.Add(lease)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// MarkInvoiceJobDelivered records that the invoice microservice accepted a job
+func (m *DBModel) MarkInvoiceJobDelivered(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		UPDATE invoice_jobs
+		SET status = ?, delivered_at = ?, last_error = NULL, updated_at = ?
+		WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, InvoiceJobDelivered, now, now, id)
+	return err
+}
+
+// RescheduleInvoiceJob records why an attempt at a job failed, and when to try again
+func (m *DBModel) RescheduleInvoiceJob(id int, next time.Time, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE invoice_jobs
+		SET next_attempt_at = ?, last_error = ?, updated_at = ?
+		WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, next, lastError, time.Now(), id)
+	return err
+}
+
+// FailInvoiceJob gives up on a job after its last attempt failed. It is not tried again
+// until an admin retries it.
+func (m *DBModel) FailInvoiceJob(id int, lastError string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE invoice_jobs
+		SET status = ?, last_error = ?, updated_at = ?
+		WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, InvoiceJobFailed, lastError, time.Now(), id)
+	return err
+}
+
+// RetryInvoiceJob puts a failed job back in the queue with its attempts reset, to be sent
+// straight away. It reports false if there is no failed job with the ID.
+func (m *DBModel) RetryInvoiceJob(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		UPDATE invoice_jobs
+		SET status = ?, attempts = 0, next_attempt_at = ?, updated_at = ?
+		WHERE id = ? AND status = ?
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, InvoiceJobPending, now, now, id, InvoiceJobFailed)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// GetInvoiceJob returns an invoice job by ID
+func (m *DBModel) GetInvoiceJob(id int) (InvoiceJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `SELECT ` + invoiceJobColumns + ` FROM ` + invoiceJobTables + ` WHERE j.id = ?`
+
+	return scanInvoiceJob(m.conn().QueryRowContext(ctx, query, id))
+}
+
+// GetInvoiceJobsPaginated returns a page of invoice jobs with the given status, or of every
+// job if status is empty, newest first, with the last page number and the number of jobs
+func (m *DBModel) GetInvoiceJobsPaginated(status string, pageSize, page int) ([]*InvoiceJob, int, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	offset := (page - 1) * pageSize
+
+	var where string
+	var args []interface{}
+	if status != "" {
+		where = `WHERE j.status = ?`
+		args = append(args, status)
+	}
+
+	var jobs []*InvoiceJob
+
+	query := `
+		SELECT ` + invoiceJobColumns + `
+		FROM ` + invoiceJobTables + `
+		` + where + `
+		ORDER BY j.id DESC
+		LIMIT ? OFFSET ?
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, append(args, pageSize, offset)...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		j, err := scanInvoiceJob(rows)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		jobs = append(jobs, &j)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, 0, err
+	}
+
+	query = `SELECT COUNT(j.id) FROM invoice_jobs j ` + where
+
+	var numRecords int
+	err = m.conn().QueryRowContext(ctx, query, args...).Scan(&numRecords)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	lastPage := int(math.Ceil(float64(numRecords) / float64(pageSize)))
+
+	return jobs, lastPage, numRecords, nil
+}
@@ -0,0 +1,221 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginAttempts is the type for the failed logins of one key: an account or an IP address.
+// Email is set for accounts, so their owner can be told when they are locked out.
+type LoginAttempts struct {
+	Key           string     `json:"-"`
+	Email         string     `json:"email"`
+	Failures      int        `json:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+	NotifiedAt    *time.Time `json:"-"`
+}
+
+// Locked reports whether the key is locked out at now
+func (a LoginAttempts) Locked(now time.Time) bool {
+	return a.LockedUntil != nil && a.LockedUntil.After(now)
+}
+
+// GetLoginAttempts returns the failed logins of a key. A key without any has no row, and
+// gets the zero LoginAttempts.
+func (m *DBModel) GetLoginAttempts(key string) (LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a, err := m.getLoginAttempts(ctx, key, false)
+	if errors.Is(err, sql.ErrNoRows) {
+		return LoginAttempts{Key: key}, nil
+	}
+	return a, err
+}
+
+// loginAttemptsColumns are the columns scanned by scanLoginAttempts
+const loginAttemptsColumns = `attempt_key, email, failures, last_failure_at, locked_until, notified_at`
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanLoginAttempts reads the loginAttemptsColumns of a row
+func scanLoginAttempts(row rowScanner) (LoginAttempts, error) {
+	var a LoginAttempts
+	var lastFailureAt, lockedUntil, notifiedAt sql.NullTime
+
+	err := row.Scan(
+		&a.Key,
+		&a.Email,
+		&a.Failures,
+		&lastFailureAt,
+		&lockedUntil,
+		&notifiedAt,
+	)
+	if err != nil {
+		return a, err
+	}
+
+	a.LastFailureAt = timeOrNil(lastFailureAt)
+	a.LockedUntil = timeOrNil(lockedUntil)
+	a.NotifiedAt = timeOrNil(notifiedAt)
+
+	return a, nil
+}
+
+// getLoginAttempts reads the row of a key, locking it when forUpdate is set
+func (m *DBModel) getLoginAttempts(ctx context.Context, key string, forUpdate bool) (LoginAttempts, error) {
+	query := `SELECT ` + loginAttemptsColumns + ` FROM login_attempts WHERE attempt_key = ?`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	return scanLoginAttempts(m.conn().QueryRowContext(ctx, m.rebind(query), key))
+}
+
+// RecordLoginFailure counts a failed login for a key and returns its failures so far.
+// Failures more than window apart are not counted together: the count starts again from 1.
+func (m *DBModel) RecordLoginFailure(key, email string, window time.Duration) (LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var a LoginAttempts
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		now := time.Now()
+
+		// Make sure the row exists, so that concurrent failures all lock the same row
+		query := `
+			INSERT IGNORE INTO login_attempts (attempt_key, email, failures, created_at, updated_at)
+			VALUES (?, ?, 0, ?, ?)
+		`
+		_, err := tx.conn().ExecContext(ctx, tx.rebind(query), key, email, now, now)
+		if err != nil {
+			return err
+		}
+
+		a, err = tx.getLoginAttempts(ctx, key, true)
+		if err != nil {
+			return err
+		}
+
+		if a.LastFailureAt != nil && now.Sub(*a.LastFailureAt) > window {
+			a.Failures = 0
+		}
+		a.Failures++
+		a.LastFailureAt = &now
+
+		query = `
+			UPDATE login_attempts
+			SET failures = ?, last_failure_at = ?, updated_at = ?
+			WHERE attempt_key = ?
+		`
+		_, err = tx.conn().ExecContext(ctx, query, a.Failures, now, now, key)
+		return err
+	})
+
+	return a, err
+}
+
+// LockLogin locks a key out until until. Accounts locked out are picked up by
+// GetUnnotifiedLockouts so their owner can be told.
+func (m *DBModel) LockLogin(key string, until time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE login_attempts
+		SET locked_until = ?, notified_at = NULL, updated_at = ?
+		WHERE attempt_key = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, until, time.Now(), key)
+	return err
+}
+
+// ResetLoginAttempts forgets the failed logins of a key, unlocking it
+func (m *DBModel) ResetLoginAttempts(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `DELETE FROM login_attempts WHERE attempt_key = ?`, key)
+	return err
+}
+
+// GetUnnotifiedLockouts returns the accounts locked out whose owner has not been told yet
+func (m *DBModel) GetUnnotifiedLockouts() ([]LoginAttempts, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var lockouts []LoginAttempts
+
+	query := `
+		SELECT
+			` + loginAttemptsColumns + `
+		FROM
+			login_attempts
+		WHERE
+			email <> '' AND locked_until > ? AND notified_at IS NULL
+		ORDER BY locked_until
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		a, err := scanLoginAttempts(rows)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockouts, nil
+}
+
+// MarkLockoutNotified records that the owner of a locked out account has been told
+func (m *DBModel) MarkLockoutNotified(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE login_attempts
+		SET notified_at = ?, updated_at = ?
+		WHERE attempt_key = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, time.Now(), time.Now(), key)
+	return err
+}
+
+// DeleteStaleLoginAttempts forgets the keys that have not failed since before and are not
+// locked out, and returns how many were deleted
+func (m *DBModel) DeleteStaleLoginAttempts(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		DELETE FROM login_attempts
+		WHERE (last_failure_at IS NULL OR last_failure_at < ?)
+			AND (locked_until IS NULL OR locked_until < ?)
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, before, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
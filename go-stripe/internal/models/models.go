@@ -13,7 +13,9 @@ import (
 
 // DBModel is the type for database connection values
 type DBModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Dialect Dialect
+	tx      *sql.Tx
 }
 
 // Models is the wrapper for all models
@@ -38,24 +40,42 @@ type Widget struct {
 	Image          string    `json:"image"`
 	IsRecurring    bool      `json:"is_recurring"`
 	PlanID         string    `json:"plan_id"`
+	Slug           string    `json:"slug"`
 	CreatedAt      time.Time `json:"-"`
 	UpdatedAt      time.Time `json:"-"`
 }
 
 // Order is the type for all orders
 type Order struct {
-	ID            int         `json:"id"`
-	WidgetID      int         `json:"widget_id"`
-	TransactionID int         `json:"transaction_id"`
-	CustomerID    int         `json:"customer_id"`
-	StatusID      int         `json:"status_id"`
-	Quantity      int         `json:"quantity"`
-	Amount        int         `json:"amount"`
-	CreatedAt     time.Time   `json:"-"`
-	UpdatedAt     time.Time   `json:"-"`
-	Widget        Widget      `json:"widget"`
-	Transaction   Transaction `json:"transaction"`
-	Customer      Customer    `json:"customer"`
+	ID            int                  `json:"id"`
+	WidgetID      int                  `json:"widget_id"`
+	TransactionID int                  `json:"transaction_id"`
+	CustomerID    int                  `json:"customer_id"`
+	StatusID      int                  `json:"status_id"`
+	Quantity      int                  `json:"quantity"`
+	Amount        int                  `json:"amount"`
+	CreatedAt     time.Time            `json:"-"`
+	UpdatedAt     time.Time            `json:"-"`
+	Widget        Widget               `json:"widget"`
+	Transaction   Transaction          `json:"transaction"`
+	Customer      Customer             `json:"customer"`
+	Items         []OrderItem          `json:"items"`
+	History       []OrderStatusHistory `json:"history"`
+	// Refunds of the order's transaction, and what is left to refund of it
+	Refunds          []Refund `json:"refunds"`
+	RefundableAmount int      `json:"refundable_amount"`
+}
+
+// OrderItem is the type for one line of an order
+type OrderItem struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	WidgetID  int       `json:"widget_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Widget    Widget    `json:"widget"`
 }
 
 // Status is the type for all order statuses
@@ -86,19 +106,39 @@ type Transaction struct {
 	PaymentMethod       string    `json:"payment_method"`
 	BankReturnCode      string    `json:"bank_return_code"`
 	TransactionStatusID int       `json:"transaction_status_id"`
+	StripePaymentID     string    `json:"stripe_payment_id"`
 	CreatedAt           time.Time `json:"-"`
 	UpdatedAt           time.Time `json:"-"`
 }
 
 // User is the type for all users
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID          int        `json:"id"`
+	FirstName   string     `json:"first_name"`
+	LastName    string     `json:"last_name"`
+	Email       string     `json:"email"`
+	Password    string     `json:"password"`
+	RoleID      int        `json:"role_id"`
+	Role        string     `json:"role"`
+	Permissions []string   `json:"permissions,omitempty"`
+	TwoFactor   bool       `json:"two_factor"`
+	DisabledAt  *time.Time `json:"disabled_at"`
+	CreatedAt   time.Time  `json:"-"`
+	UpdatedAt   time.Time  `json:"-"`
+}
+
+// ErrUserDisabled is returned when a disabled user logs in
+var ErrUserDisabled = errors.New("this account has been disabled")
+
+// ErrPaymentRecorded is returned when recording a payment that already has a transaction.
+// A transaction's StripePaymentID is the payment it records, the payment intent of a
+// one-time payment or the invoice of a subscription payment, and is unique; it is empty
+// for transactions that record no payment, such as declines.
+var ErrPaymentRecorded = errors.New("this payment has already been recorded")
+
+// Disabled reports whether the user has been disabled, and so may not log in
+func (u *User) Disabled() bool {
+	return u.DisabledAt != nil
 }
 
 // Customer is the type for all Customers
@@ -119,11 +159,44 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 
 	query := `SELECT 
 				id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
-				created_at, updated_at
+				slug, created_at, updated_at
 			  FROM widgets
 			  WHERE id = ?`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
+	err := row.Scan(
+		&widget.ID,
+		&widget.Name,
+		&widget.Description,
+		&widget.InventoryLevel,
+		&widget.Price,
+		&widget.Image,
+		&widget.IsRecurring,
+		&widget.PlanID,
+		&widget.Slug,
+		&widget.CreatedAt,
+		&widget.UpdatedAt)
+	if err != nil {
+		return widget, err
+	}
+
+	return widget, nil
+}
+
+// GetWidgetByPlanID returns the recurring widget for a Stripe plan ID
+func (m *DBModel) GetWidgetByPlanID(planID string) (Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widget Widget
+
+	query := `SELECT 
+				id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+				slug, created_at, updated_at
+			  FROM widgets
+			  WHERE plan_id = ?`
+
+	row := m.conn().QueryRowContext(ctx, query, planID)
 	err := row.Scan(
 		&widget.ID,
 		&widget.Name,
@@ -133,6 +206,7 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 		&widget.Image,
 		&widget.IsRecurring,
 		&widget.PlanID,
+		&widget.Slug,
 		&widget.CreatedAt,
 		&widget.UpdatedAt)
 	if err != nil {
@@ -142,16 +216,98 @@ func (m *DBModel) GetWidget(id int) (Widget, error) {
 	return widget, nil
 }
 
-// InsertTransaction inserts a transaction into the database and returns the newly created ID
+// GetWidgetBySlug returns the widget with the given URL slug
+func (m *DBModel) GetWidgetBySlug(slug string) (Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widget Widget
+
+	query := `SELECT 
+				id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+				slug, created_at, updated_at
+			  FROM widgets
+			  WHERE slug = ?`
+
+	row := m.conn().QueryRowContext(ctx, query, slug)
+	err := row.Scan(
+		&widget.ID,
+		&widget.Name,
+		&widget.Description,
+		&widget.InventoryLevel,
+		&widget.Price,
+		&widget.Image,
+		&widget.IsRecurring,
+		&widget.PlanID,
+		&widget.Slug,
+		&widget.CreatedAt,
+		&widget.UpdatedAt)
+	if err != nil {
+		return widget, err
+	}
+
+	return widget, nil
+}
+
+// GetRecurringWidgets returns every widget sold as a subscription plan, cheapest first
+func (m *DBModel) GetRecurringWidgets() ([]Widget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var widgets []Widget
+
+	query := `SELECT 
+				id, name, description, inventory_level, price, coalesce(image, ''), is_recurring, plan_id,
+				slug, created_at, updated_at
+			  FROM widgets
+			  WHERE is_recurring = 1
+			  ORDER BY price, name`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var widget Widget
+		err := rows.Scan(
+			&widget.ID,
+			&widget.Name,
+			&widget.Description,
+			&widget.InventoryLevel,
+			&widget.Price,
+			&widget.Image,
+			&widget.IsRecurring,
+			&widget.PlanID,
+			&widget.Slug,
+			&widget.CreatedAt,
+			&widget.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		widgets = append(widgets, widget)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return widgets, nil
+}
+
+// InsertTransaction inserts a transaction into the database and returns the newly created ID.
+// It returns ErrPaymentRecorded if the transaction's payment already has one.
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	query := `INSERT INTO transactions 
-				(amount, currency, last_four, bank_return_code, expiry_month, expiry_year, payment_intent, payment_method, transaction_status_id, created_at, updated_at)
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+				(amount, currency, last_four, bank_return_code, expiry_month, expiry_year, payment_intent, payment_method,
+				 transaction_status_id, stripe_payment_id, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, query,
+	result, err := m.conn().ExecContext(ctx, query,
 		txn.Amount,
 		txn.Currency,
 		txn.LastFour,
@@ -161,9 +317,13 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		txn.PaymentIntent,
 		txn.PaymentMethod,
 		txn.TransactionStatusID,
+		txn.StripePaymentID,
 		time.Now(),
 		time.Now(),
 	)
+	if isDuplicateKey(err) {
+		return 0, ErrPaymentRecorded
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -176,6 +336,60 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	return int(id), nil
 }
 
+// GetTransactionByPaymentIntent returns the most recent transaction for a payment intent (or subscription) ID
+func (m *DBModel) GetTransactionByPaymentIntent(pi string) (*Transaction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t Transaction
+
+	query := `SELECT 
+				id, amount, currency, last_four, expiry_month, expiry_year, payment_intent, payment_method,
+				bank_return_code, transaction_status_id, created_at, updated_at
+			  FROM transactions
+			  WHERE payment_intent = ?
+			  ORDER BY id DESC
+			  LIMIT 1`
+
+	row := m.conn().QueryRowContext(ctx, query, pi)
+	err := row.Scan(
+		&t.ID,
+		&t.Amount,
+		&t.Currency,
+		&t.LastFour,
+		&t.ExpiryMonth,
+		&t.ExpiryYear,
+		&t.PaymentIntent,
+		&t.PaymentMethod,
+		&t.BankReturnCode,
+		&t.TransactionStatusID,
+		&t.CreatedAt,
+		&t.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// UpdateTransactionStatus updates the status of a transaction
+func (m *DBModel) UpdateTransactionStatus(id, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE transactions SET transaction_status_id = ?, updated_at = UTC_TIMESTAMP() WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), statusID, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // InsertOrder inserts an order into the database and returns the newly created ID
 func (m *DBModel) InsertOrder(order Order) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -185,7 +399,7 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 				(widget_id, transaction_id, status_id, quantity, customer_id, amount, created_at, updated_at)
 			  VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, query,
+	result, err := m.conn().ExecContext(ctx, query,
 		order.WidgetID,
 		order.TransactionID,
 		order.StatusID,
@@ -216,7 +430,7 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 				(first_name, last_name, email, created_at, updated_at)
 			  VALUES (?, ?, ?, ?, ?)`
 
-	result, err := m.DB.ExecContext(ctx, query,
+	result, err := m.conn().ExecContext(ctx, query,
 		customer.FirstName,
 		customer.LastName,
 		customer.Email,
@@ -235,16 +449,24 @@ func (m *DBModel) InsertCustomer(customer Customer) (int, error) {
 	return int(id), nil
 }
 
+// NormalizeEmail returns an email address in lower case and without surrounding space, so
+// the ways one address can be typed count as the same address
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 // GetUserByEmail returns a user based on the email address
 func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	email = strings.ToLower(email)
+	email = NormalizeEmail(email)
 	var u User
 
-	query := `SELECT id, first_name, last_name, email, password, created_at, updated_at FROM users WHERE email = ?`
-	row := m.DB.QueryRowContext(ctx, query, email)
+	var disabledAt sql.NullTime
+
+	query := `SELECT id, first_name, last_name, email, password, totp_enabled_at IS NOT NULL, disabled_at, created_at, updated_at FROM users WHERE email = ?`
+	row := m.conn().QueryRowContext(ctx, query, email)
 
 	err := row.Scan(
 		&u.ID,
@@ -252,6 +474,8 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.TwoFactor,
+		&disabledAt,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -259,6 +483,7 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	if err != nil {
 		return u, err
 	}
+	u.DisabledAt = timeOrNil(disabledAt)
 
 	return u, nil
 }
@@ -268,14 +493,16 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	email = strings.ToLower(email)
+	email = NormalizeEmail(email)
 	var id int
 	var hashedPassword string
 
-	query := `SELECT id, password FROM users WHERE email = ?`
-	row := m.DB.QueryRowContext(ctx, query, email)
+	var disabledAt sql.NullTime
 
-	err := row.Scan(&id, &hashedPassword)
+	query := `SELECT id, password, disabled_at FROM users WHERE email = ?`
+	row := m.conn().QueryRowContext(ctx, query, email)
+
+	err := row.Scan(&id, &hashedPassword, &disabledAt)
 	if err != nil {
 		return 0, err
 	}
@@ -288,6 +515,11 @@ func (m *DBModel) Authenticate(email, password string) (int, error) {
 		return 0, err
 	}
 
+	// Only say the account is disabled to someone who knows its password
+	if disabledAt.Valid {
+		return 0, ErrUserDisabled
+	}
+
 	return id, nil
 }
 
@@ -298,12 +530,13 @@ func (m *DBModel) UpdatePasswordForUser(user User, hashed_password string) error
 
 	query := `UPDATE users SET password = ? WHERE id = ?`
 
-	_, err := m.DB.ExecContext(ctx, query, hashed_password, user.ID)
+	_, err := m.conn().ExecContext(ctx, query, hashed_password, user.ID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// Links to reset the old password must not work any more, whichever way it changed
+	return m.InvalidatePasswordResets(user.ID)
 }
 
 // GetAllOrders returns all orders
@@ -332,7 +565,7 @@ func (m *DBModel) GetAllOrders() ([]*Order, error) {
 		ORDER BY o.created_at DESC 
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -377,6 +610,11 @@ func (m *DBModel) GetAllOrders() ([]*Order, error) {
 		return nil, err
 	}
 
+	err = m.loadOrderItems(ctx, orders)
+	if err != nil {
+		return nil, err
+	}
+
 	return orders, nil
 }
 
@@ -409,7 +647,7 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 		LIMIT ? OFFSET ?
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query, pageSize, offset)
+	rows, err := m.conn().QueryContext(ctx, query, pageSize, offset)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -454,6 +692,11 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 		return nil, 0, 0, err
 	}
 
+	err = m.loadOrderItems(ctx, orders)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
 	query = `
 		SELECT COUNT(o.id) 
 		FROM 
@@ -464,7 +707,7 @@ func (m *DBModel) GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int,
 	`
 
 	var numRecords int
-	err = m.DB.QueryRowContext(ctx, query).Scan(&numRecords)
+	err = m.conn().QueryRowContext(ctx, query).Scan(&numRecords)
 	if err != nil {
 		return nil, 0, 0, err
 	}
@@ -496,11 +739,15 @@ func (m *DBModel) GetAllSubscriptions() ([]*Order, error) {
 			
 		WHERE
 			w.is_recurring = 1
+			and o.id = (
+				select max(o2.id) from orders o2 left join transactions t2 on (o2.transaction_id = t2.id)
+				where t2.payment_intent = t.payment_intent
+			)
 			
 		ORDER BY o.created_at DESC 
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -545,6 +792,11 @@ func (m *DBModel) GetAllSubscriptions() ([]*Order, error) {
 		return nil, err
 	}
 
+	err = m.loadOrderItems(ctx, orders)
+	if err != nil {
+		return nil, err
+	}
+
 	return orders, nil
 }
 
@@ -572,7 +824,7 @@ func (m *DBModel) GetOrderById(id int) (*Order, error) {
 			o.id = ?
 	`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&o.ID,
@@ -604,24 +856,113 @@ func (m *DBModel) GetOrderById(id int) (*Order, error) {
 		return nil, err
 	}
 
+	err = m.loadOrderItems(ctx, []*Order{&o})
+	if err != nil {
+		return nil, err
+	}
+
+	o.History, err = m.GetOrderStatusHistory(o.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	o.Refunds, err = m.GetRefundsForTransaction(o.TransactionID)
+	if err != nil {
+		return nil, err
+	}
+	o.RefundableAmount = o.Transaction.Amount
+	for _, refund := range o.Refunds {
+		o.RefundableAmount -= refund.Amount
+	}
+
 	return &o, nil
 }
 
-// UpdateOrderStatus updates the status of an order
-func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
+// GetOrderByPaymentIntent returns the most recent order paid with a payment intent (or subscription) ID
+func (m *DBModel) GetOrderByPaymentIntent(pi string) (*Order, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	var o Order
+
 	query := `
-		UPDATE orders SET status_id = ?, updated_at = UTC_TIMESTAMP() WHERE id = ?
+		SELECT 
+			o.id, o.widget_id, o.transaction_id, o.customer_id, o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+			w.id, w.name,
+			t.id, t.amount, t.currency, t.last_four, t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
+			c.id, c.first_name, c.last_name, c.email
+			
+		FROM
+			orders o 
+			LEFT JOIN widgets w on (o.widget_id = w.id)
+			LEFT JOIN transactions t on (o.transaction_id = t.id)
+			LEFT JOIN customers c on (o.customer_id = c.id)
+			
+		WHERE
+			t.payment_intent = ?
+
+		ORDER BY o.id DESC
+		LIMIT 1
 	`
 
-	_, err := m.DB.ExecContext(ctx, query, statusID, id)
+	row := m.conn().QueryRowContext(ctx, query, pi)
+
+	err := row.Scan(
+		&o.ID,
+		&o.WidgetID,
+		&o.TransactionID,
+		&o.CustomerID,
+		&o.StatusID,
+		&o.Quantity,
+		&o.Amount,
+		&o.CreatedAt,
+		&o.UpdatedAt,
+		&o.Widget.ID,
+		&o.Widget.Name,
+		&o.Transaction.ID,
+		&o.Transaction.Amount,
+		&o.Transaction.Currency,
+		&o.Transaction.LastFour,
+		&o.Transaction.ExpiryMonth,
+		&o.Transaction.ExpiryYear,
+		&o.Transaction.PaymentIntent,
+		&o.Transaction.BankReturnCode,
+		&o.Customer.ID,
+		&o.Customer.FirstName,
+		&o.Customer.LastName,
+		&o.Customer.Email,
+	)
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	err = m.loadOrderItems(ctx, []*Order{&o})
+	if err != nil {
+		return nil, err
+	}
+
+	return &o, nil
+}
+
+// UpdateOrderStatus updates the status of an order and records the change in its history
+func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE orders SET status_id = ?, updated_at = UTC_TIMESTAMP() WHERE id = ?
+	`
+
+	return m.withTx(ctx, func(tx *DBModel) error {
+		_, err := tx.conn().ExecContext(ctx, tx.rebind(query), statusID, id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.InsertOrderStatusHistory(id, statusID, "")
+		return err
+	})
 }
 
 // GetAllUsers returns all users
@@ -633,15 +974,17 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 
 	query := `
 		SELECT 
-			id, last_name, first_name, email, created_at, updated_at
+			u.id, u.last_name, u.first_name, u.email, u.role_id, coalesce(r.name, ''),
+			u.totp_enabled_at IS NOT NULL, u.disabled_at, u.created_at, u.updated_at
 			
 		FROM
-			users
+			users u
+			LEFT JOIN roles r on (u.role_id = r.id)
 			
-		ORDER BY last_name, first_name 
+		ORDER BY u.last_name, u.first_name 
 	`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -649,18 +992,26 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 
 	for rows.Next() {
 		var u User
+		var roleID sql.NullInt64
+		var disabledAt sql.NullTime
 
 		err := rows.Scan(
 			&u.ID,
 			&u.LastName,
 			&u.FirstName,
 			&u.Email,
+			&roleID,
+			&u.Role,
+			&u.TwoFactor,
+			&disabledAt,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
+		u.RoleID = int(roleID.Int64)
+		u.DisabledAt = timeOrNil(disabledAt)
 
 		users = append(users, &u)
 	}
@@ -678,25 +1029,33 @@ func (m *DBModel) GetOneUser(id int) (*User, error) {
 	defer cancel()
 
 	var u User
+	var roleID sql.NullInt64
+	var disabledAt sql.NullTime
 
 	query := `
 		SELECT 
-			id, last_name, first_name, email, created_at, updated_at
+			u.id, u.last_name, u.first_name, u.email, u.role_id, coalesce(r.name, ''),
+			u.totp_enabled_at IS NOT NULL, u.disabled_at, u.created_at, u.updated_at
 			
 		FROM
-			users
+			users u
+			LEFT JOIN roles r on (u.role_id = r.id)
 			
 		WHERE
-			id = ?
+			u.id = ?
 	`
 
-	row := m.DB.QueryRowContext(ctx, query, id)
+	row := m.conn().QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&u.ID,
 		&u.LastName,
 		&u.FirstName,
 		&u.Email,
+		&roleID,
+		&u.Role,
+		&u.TwoFactor,
+		&disabledAt,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -704,6 +1063,8 @@ func (m *DBModel) GetOneUser(id int) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	u.RoleID = int(roleID.Int64)
+	u.DisabledAt = timeOrNil(disabledAt)
 
 	return &u, nil
 }
@@ -718,11 +1079,12 @@ func (m *DBModel) EditUser(u User) error {
 			last_name = ?, 
 			first_name = ?, 
 			email = ?, 
+			role_id = ?, 
 			updated_at = UTC_TIMESTAMP() 
 		WHERE id = ?
 	`
 
-	_, err := m.DB.ExecContext(ctx, query, u.LastName, u.FirstName, u.Email, u.ID)
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), u.LastName, u.FirstName, u.Email, roleOrNil(u.RoleID), u.ID)
 	if err != nil {
 		return err
 	}
@@ -730,22 +1092,64 @@ func (m *DBModel) EditUser(u User) error {
 	return nil
 }
 
-// AddUser
-func (m *DBModel) AddUser(u User, hash string) error {
+// DisableUser stops a user from logging in. It does not end the sessions or revoke the
+// tokens the user already has.
+func (m *DBModel) DisableUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	query := `
-		INSERT INTO users (last_name, first_name, email, password, created_at, updated_at)
-		VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+		UPDATE users SET 
+			disabled_at = UTC_TIMESTAMP(), 
+			updated_at = UTC_TIMESTAMP() 
+		WHERE id = ? AND disabled_at IS NULL
 	`
 
-	_, err := m.DB.ExecContext(ctx, query, u.LastName, u.FirstName, u.Email, hash)
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), id)
+	return err
+}
+
+// EnableUser lets a disabled user log in again
+func (m *DBModel) EnableUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE users SET 
+			disabled_at = NULL, 
+			updated_at = UTC_TIMESTAMP() 
+		WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, m.rebind(query), id)
+	return err
+}
+
+// AddUser adds a user and returns its ID. Users added without a role are read-only.
+func (m *DBModel) AddUser(u User, hash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		INSERT INTO users (last_name, first_name, email, password, role_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())
+	`
+
+	if u.RoleID == 0 {
+		u.RoleID = RoleReadOnly
+	}
+
+	result, err := m.conn().ExecContext(ctx, m.rebind(query), u.LastName, u.FirstName, u.Email, hash, u.RoleID)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
 }
 
 // DeleteUser deletes a user
@@ -753,12 +1157,18 @@ func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	// Log the user out of the web server, while their sessions can still be found
+	_, err := m.DeleteSessionsForUser(id)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		DELETE FROM users 
 		WHERE id = ?
 	`
 
-	_, err := m.DB.ExecContext(ctx, query, id)
+	_, err = m.conn().ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -768,7 +1178,37 @@ func (m *DBModel) DeleteUser(id int) error {
 		DELETE FROM tokens
 		WHERE user_id = ?
 	`
-	_, err = m.DB.ExecContext(ctx, query, id)
+	_, err = m.conn().ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	// Delete recovery codes
+	query = `
+		DELETE FROM recovery_codes
+		WHERE user_id = ?
+	`
+	_, err = m.conn().ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	// Delete password history
+	query = `
+		DELETE FROM password_history
+		WHERE user_id = ?
+	`
+	_, err = m.conn().ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	// Delete password resets
+	query = `
+		DELETE FROM password_resets
+		WHERE user_id = ?
+	`
+	_, err = m.conn().ExecContext(ctx, query, id)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// InsertOrderItem inserts one line of an order and returns the newly created ID
+func (m *DBModel) InsertOrderItem(item OrderItem) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO order_items
+				(order_id, widget_id, quantity, unit_price, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?, ?)`
+
+	result, err := m.conn().ExecContext(ctx, query,
+		item.OrderID,
+		item.WidgetID,
+		item.Quantity,
+		item.UnitPrice,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// loadOrderItems fills in the Items of every order with a single query
+func (m *DBModel) loadOrderItems(ctx context.Context, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+
+	byID := make(map[int]*Order, len(orders))
+	args := make([]interface{}, 0, len(orders))
+	for _, o := range orders {
+		byID[o.ID] = o
+		args = append(args, o.ID)
+	}
+
+	query := `
+		SELECT
+			oi.id, oi.order_id, oi.widget_id, oi.quantity, oi.unit_price, oi.created_at, oi.updated_at,
+			w.id, w.name, w.price
+		FROM
+			order_items oi
+			LEFT JOIN widgets w on (oi.widget_id = w.id)
+		WHERE
+			oi.order_id IN (?` + strings.Repeat(", ?", len(orders)-1) + `)
+		ORDER BY oi.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item OrderItem
+
+		err := rows.Scan(
+			&item.ID,
+			&item.OrderID,
+			&item.WidgetID,
+			&item.Quantity,
+			&item.UnitPrice,
+			&item.CreatedAt,
+			&item.UpdatedAt,
+			&item.Widget.ID,
+			&item.Widget.Name,
+			&item.Widget.Price,
+		)
+		if err != nil {
+			return err
+		}
+
+		if o, ok := byID[item.OrderID]; ok {
+			o.Items = append(o.Items, item)
+		}
+	}
+
+	return rows.Err()
+}
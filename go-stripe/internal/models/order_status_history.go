@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// OrderStatusHistory is the type for one change of an order's status. Note says why the
+// status changed, when that is not obvious from the status alone.
+type OrderStatusHistory struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	StatusID  int       `json:"status_id"`
+	Status    string    `json:"status"`
+	Note      string    `json:"note"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// InsertOrderStatusHistory records that an order is now in statusID
+func (m *DBModel) InsertOrderStatusHistory(orderID, statusID int, note string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `INSERT INTO order_status_history
+				(order_id, status_id, note, created_at, updated_at)
+			  VALUES (?, ?, ?, ?, ?)`
+
+	result, err := m.conn().ExecContext(ctx, query,
+		orderID,
+		statusID,
+		note,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// GetOrderStatusHistory returns the status changes of an order, oldest first
+func (m *DBModel) GetOrderStatusHistory(orderID int) ([]OrderStatusHistory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var history []OrderStatusHistory
+
+	query := `
+		SELECT
+			h.id, h.order_id, h.status_id, coalesce(s.name, ''), h.note, h.created_at, h.updated_at
+		FROM
+			order_status_history h
+			LEFT JOIN statuses s on (h.status_id = s.id)
+		WHERE
+			h.order_id = ?
+		ORDER BY h.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h OrderStatusHistory
+
+		err := rows.Scan(
+			&h.ID,
+			&h.OrderID,
+			&h.StatusID,
+			&h.Status,
+			&h.Note,
+			&h.CreatedAt,
+			&h.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
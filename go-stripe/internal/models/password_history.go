@@ -0,0 +1,84 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// GetPasswordHistory returns the bcrypt hash of the current password of a user followed by
+// the other hashes among the last n in their password history, newest first
+func (m *DBModel) GetPasswordHistory(userID, n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var current string
+	err := m.conn().QueryRowContext(ctx, `SELECT password FROM users WHERE id = ?`, userID).Scan(&current)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{current}
+
+	if n <= 0 {
+		return hashes, nil
+	}
+
+	query := `
+		SELECT password_hash
+		FROM password_history
+		WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		// The newest entry is usually the current password
+		if hash != current {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, rows.Err()
+}
+
+// AddPasswordHistory records a password hash set for a user, keeping only their keep most
+// recent hashes
+func (m *DBModel) AddPasswordHistory(userID int, hash string, keep int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		INSERT INTO password_history (user_id, password_hash, created_at, updated_at)
+		VALUES (?, ?, ?, ?)
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, userID, hash, now, now)
+	if err != nil {
+		return err
+	}
+
+	// MySQL does not allow LIMIT in an IN subquery, or selecting from the table being
+	// deleted from, but does allow both through a derived table
+	query = `
+		DELETE FROM password_history
+		WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM (
+				SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?
+			) AS kept
+		)
+	`
+
+	_, err = m.conn().ExecContext(ctx, query, userID, userID, keep)
+	return err
+}
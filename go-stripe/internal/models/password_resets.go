@@ -0,0 +1,158 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// PasswordResetTTL is how long password reset links work for
+const PasswordResetTTL = time.Hour
+
+// ErrPasswordResetInvalid is returned for a password reset that does not exist, has
+// expired or has already been used
+var ErrPasswordResetInvalid = errors.New("this password reset link has expired or has already been used")
+
+// PasswordReset is the type for a password reset link emailed to a user. Only the SHA-256
+// hash of the nonce in the link is stored.
+type PasswordReset struct {
+	ID         int
+	UserID     int
+	ExpiresAt  time.Time
+	ConsumedAt *time.Time
+	CreatedAt  time.Time
+}
+
+// Usable reports whether the link can still be used to reset a password
+func (p PasswordReset) Usable(now time.Time) bool {
+	return p.ConsumedAt == nil && now.Before(p.ExpiresAt)
+}
+
+// InsertPasswordReset records a password reset link for a user, usable for
+// PasswordResetTTL, and returns the nonce to put in the link
+func (m *DBModel) InsertPasswordReset(userID int) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(randomBytes)
+	nonceHash := sha256.Sum256([]byte(nonce))
+	now := time.Now()
+
+	query := `
+		INSERT INTO password_resets (user_id, nonce_hash, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err = m.conn().ExecContext(ctx, query, userID, nonceHash[:], now.Add(PasswordResetTTL), now, now)
+	if err != nil {
+		return "", err
+	}
+
+	return nonce, nil
+}
+
+// GetPasswordReset returns the password reset link with a nonce
+func (m *DBModel) GetPasswordReset(nonce string) (PasswordReset, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	nonceHash := sha256.Sum256([]byte(nonce))
+
+	var p PasswordReset
+	var consumedAt sql.NullTime
+
+	query := `
+		SELECT id, user_id, expires_at, consumed_at, created_at
+		FROM password_resets
+		WHERE nonce_hash = ?
+	`
+
+	err := m.conn().QueryRowContext(ctx, query, nonceHash[:]).Scan(
+		&p.ID,
+		&p.UserID,
+		&p.ExpiresAt,
+		&consumedAt,
+		&p.CreatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, ErrPasswordResetInvalid
+	}
+	if err != nil {
+		return p, err
+	}
+	p.ConsumedAt = timeOrNil(consumedAt)
+
+	return p, nil
+}
+
+// ConsumePasswordReset uses up the password reset link of a user with a nonce. It returns
+// ErrPasswordResetInvalid unless the link is usable, so a link only works once.
+func (m *DBModel) ConsumePasswordReset(userID int, nonce string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	nonceHash := sha256.Sum256([]byte(nonce))
+	now := time.Now()
+
+	query := `
+		UPDATE password_resets
+		SET consumed_at = ?, updated_at = ?
+		WHERE nonce_hash = ? AND user_id = ? AND consumed_at IS NULL AND expires_at > ?
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, now, now, nonceHash[:], userID, now)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrPasswordResetInvalid
+	}
+
+	return nil
+}
+
+// InvalidatePasswordResets uses up every password reset link of a user that has not been
+// used, once their password has changed
+func (m *DBModel) InvalidatePasswordResets(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	query := `
+		UPDATE password_resets
+		SET consumed_at = ?, updated_at = ?
+		WHERE user_id = ? AND consumed_at IS NULL
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, now, now, userID)
+	return err
+}
+
+// DeletePasswordResetsBefore deletes the password reset links that expired before before,
+// and returns how many were deleted
+func (m *DBModel) DeletePasswordResetsBefore(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.conn().ExecContext(ctx, `DELETE FROM password_resets WHERE expires_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
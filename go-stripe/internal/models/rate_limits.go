@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// RateLimitBucket is the type for a token bucket: it holds up to a number of tokens, gains
+// one back every interval, and every request takes one
+type RateLimitBucket struct {
+	Key        string
+	Tokens     float64
+	RefilledAt time.Time
+}
+
+// Take refills the bucket up to capacity for the time since it was last refilled, then
+// takes a token. When there is none left it reports how long until there will be.
+func (b *RateLimitBucket) Take(capacity int, interval time.Duration, now time.Time) (bool, time.Duration) {
+	if b.RefilledAt.IsZero() {
+		b.Tokens = float64(capacity)
+	} else if elapsed := now.Sub(b.RefilledAt); elapsed > 0 {
+		b.Tokens = math.Min(float64(capacity), b.Tokens+float64(elapsed)/float64(interval))
+	}
+	b.RefilledAt = now
+
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.Tokens) * float64(interval))
+}
+
+// TakeRateLimitToken takes a token from the bucket of key, which holds up to capacity
+// tokens and gains one every interval. It reports whether there was one and, if not, how
+// long until there will be.
+func (m *DBModel) TakeRateLimitToken(key string, capacity int, interval time.Duration) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var allowed bool
+	var retryAfter time.Duration
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		now := time.Now()
+
+		// Make sure the row exists, so that concurrent requests all lock the same row
+		query := `
+			INSERT IGNORE INTO rate_limit_buckets (bucket_key, tokens, refilled_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?)
+		`
+		_, err := tx.conn().ExecContext(ctx, tx.rebind(query), key, capacity, now, now, now)
+		if err != nil {
+			return err
+		}
+
+		b := RateLimitBucket{Key: key}
+
+		query = `SELECT tokens, refilled_at FROM rate_limit_buckets WHERE bucket_key = ? FOR UPDATE`
+		err = tx.conn().QueryRowContext(ctx, tx.rebind(query), key).Scan(&b.Tokens, &b.RefilledAt)
+		if err != nil {
+			return err
+		}
+
+		allowed, retryAfter = b.Take(capacity, interval, now)
+
+		query = `
+			UPDATE rate_limit_buckets
+			SET tokens = ?, refilled_at = ?, updated_at = ?
+			WHERE bucket_key = ?
+		`
+		_, err = tx.conn().ExecContext(ctx, query, b.Tokens, b.RefilledAt, now, key)
+		return err
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	return allowed, retryAfter, nil
+}
+
+// DeleteIdleRateLimitBuckets forgets the buckets not used since before, and returns how
+// many were deleted. Buckets idle for longer than it takes them to refill are full, and
+// the same as no bucket at all.
+func (m *DBModel) DeleteIdleRateLimitBuckets(before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.conn().ExecContext(ctx, `DELETE FROM rate_limit_buckets WHERE refilled_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRefundTooLarge is returned when a refund is for more than what is left to refund
+var ErrRefundTooLarge = errors.New("refund is more than what is left to refund")
+
+// Refund is the type for a refund of part or all of a transaction. UserID is the admin
+// user who made the refund, or 0 for refunds made outside this application.
+type Refund struct {
+	ID             int       `json:"id"`
+	TransactionID  int       `json:"transaction_id"`
+	StripeRefundID string    `json:"stripe_refund_id"`
+	Amount         int       `json:"amount"`
+	Reason         string    `json:"reason"`
+	UserID         int       `json:"user_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"-"`
+	User           User      `json:"user"`
+}
+
+// RecordRefund records a refund of a transaction and returns what is left to refund. The
+// transaction and its orders become refunded once nothing is left, and partially refunded
+// before that; each refund is noted in the orders' status history. A refund with the same
+// Stripe refund ID as one already recorded is ignored, so refunds made in the Stripe
+// dashboard can be recorded from webhooks without counting twice.
+func (m *DBModel) RecordRefund(ctx context.Context, refund Refund) (int, error) {
+	var remaining int
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		var amount, refunded int
+
+		// Locking the transaction makes concurrent refunds of it wait for each other
+		query := `SELECT amount FROM transactions WHERE id = ? FOR UPDATE`
+		err := tx.conn().QueryRowContext(ctx, tx.rebind(query), refund.TransactionID).Scan(&amount)
+		if err != nil {
+			return err
+		}
+
+		query = `SELECT coalesce(sum(amount), 0) FROM refunds WHERE transaction_id = ?`
+		err = tx.conn().QueryRowContext(ctx, query, refund.TransactionID).Scan(&refunded)
+		if err != nil {
+			return err
+		}
+		remaining = amount - refunded
+
+		if refund.StripeRefundID != "" {
+			var count int
+			query = `SELECT count(id) FROM refunds WHERE stripe_refund_id = ?`
+			err = tx.conn().QueryRowContext(ctx, query, refund.StripeRefundID).Scan(&count)
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+		}
+
+		if refund.Amount <= 0 || refund.Amount > remaining {
+			return fmt.Errorf("%w: %d left, got %d", ErrRefundTooLarge, remaining, refund.Amount)
+		}
+
+		query = `INSERT INTO refunds
+					(transaction_id, stripe_refund_id, amount, reason, user_id, created_at, updated_at)
+				  VALUES (?, ?, ?, ?, ?, ?, ?)`
+		_, err = tx.conn().ExecContext(ctx, query,
+			refund.TransactionID,
+			refund.StripeRefundID,
+			refund.Amount,
+			refund.Reason,
+			sql.NullInt64{Int64: int64(refund.UserID), Valid: refund.UserID != 0},
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+		remaining -= refund.Amount
+
+		// Partially refunded, unless this refund used up the rest
+		txnStatusID, orderStatusID := 5, 4
+		if remaining == 0 {
+			txnStatusID, orderStatusID = 4, 2
+		}
+
+		err = tx.UpdateTransactionStatus(refund.TransactionID, txnStatusID)
+		if err != nil {
+			return err
+		}
+
+		var orderIDs []int
+		query = `SELECT id FROM orders WHERE transaction_id = ?`
+		rows, err := tx.conn().QueryContext(ctx, query, refund.TransactionID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			orderIDs = append(orderIDs, id)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range orderIDs {
+			query = `UPDATE orders SET status_id = ?, updated_at = UTC_TIMESTAMP() WHERE id = ?`
+			_, err = tx.conn().ExecContext(ctx, tx.rebind(query), orderStatusID, id)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.InsertOrderStatusHistory(id, orderStatusID, refund.Reason)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return remaining, nil
+}
+
+// LockTransaction locks a transaction until the end of the database transaction it is
+// called in, so that refunds of it made at the same time wait for each other. It only
+// makes sense inside WithTx.
+func (m *DBModel) LockTransaction(ctx context.Context, transactionID int) error {
+	var id int
+	query := `SELECT id FROM transactions WHERE id = ? FOR UPDATE`
+	return m.conn().QueryRowContext(ctx, m.rebind(query), transactionID).Scan(&id)
+}
+
+// GetRefundsForTransaction returns the refunds of a transaction, oldest first, with the
+// user who made each of them
+func (m *DBModel) GetRefundsForTransaction(transactionID int) ([]Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refunds []Refund
+
+	query := `
+		SELECT
+			r.id, r.transaction_id, r.stripe_refund_id, r.amount, r.reason, r.user_id, r.created_at, r.updated_at,
+			coalesce(u.first_name, ''), coalesce(u.last_name, '')
+		FROM
+			refunds r
+			LEFT JOIN users u on (r.user_id = u.id)
+		WHERE
+			r.transaction_id = ?
+		ORDER BY r.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		var userID sql.NullInt64
+
+		err := rows.Scan(
+			&r.ID,
+			&r.TransactionID,
+			&r.StripeRefundID,
+			&r.Amount,
+			&r.Reason,
+			&userID,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+			&r.User.FirstName,
+			&r.User.LastName,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		r.UserID = int(userID.Int64)
+		r.User.ID = r.UserID
+		refunds = append(refunds, r)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return refunds, nil
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"myapp/internal/cart"
+	"time"
+)
+
+// WidgetRepository is the interface for reading widgets
+type WidgetRepository interface {
+	GetWidget(id int) (Widget, error)
+	GetWidgetByPlanID(planID string) (Widget, error)
+	GetWidgetBySlug(slug string) (Widget, error)
+	GetRecurringWidgets() ([]Widget, error)
+}
+
+// InventoryRepository is the interface for reserving and adjusting widget stock
+type InventoryRepository interface {
+	ReserveWidget(widgetID, quantity int, client string, ttl time.Duration) (int, error)
+	ReservedBy(client string) (int, error)
+	AttachReservation(id int, paymentIntent string) error
+	ReleaseReservation(id int) error
+	ReleaseExpiredReservations() (int, error)
+	DecrementInventory(widgetID, quantity int, paymentIntent string) error
+	RestockWidget(widgetID, quantity int) error
+}
+
+// TransactionRepository is the interface for storing transactions
+type TransactionRepository interface {
+	InsertTransaction(txn Transaction) (int, error)
+	GetTransactionByPaymentIntent(pi string) (*Transaction, error)
+	UpdateTransactionStatus(id, statusID int) error
+}
+
+// OrderRepository is the interface for storing and listing orders (sales and subscriptions)
+type OrderRepository interface {
+	InsertOrder(order Order) (int, error)
+	InsertOrderItem(item OrderItem) (int, error)
+	GetAllOrders() ([]*Order, error)
+	GetAllOrdersPaginated(pageSize, page int) ([]*Order, int, int, error)
+	GetAllSubscriptions() ([]*Order, error)
+	GetOrderById(id int) (*Order, error)
+	GetOrderByPaymentIntent(pi string) (*Order, error)
+	UpdateOrderStatus(id, statusID int) error
+	InsertOrderStatusHistory(orderID, statusID int, note string) (int, error)
+	GetOrderStatusHistory(orderID int) ([]OrderStatusHistory, error)
+}
+
+// RefundRepository is the interface for the ledger of refunds
+type RefundRepository interface {
+	RecordRefund(ctx context.Context, refund Refund) (int, error)
+	LockTransaction(ctx context.Context, transactionID int) error
+	GetRefundsForTransaction(transactionID int) ([]Refund, error)
+}
+
+// CartRepository is the interface for storing shopping carts
+type CartRepository interface {
+	CreateCart() (*Cart, error)
+	GetCartByToken(token string) (*Cart, error)
+	SetCartItems(cartID int, items []cart.Item) error
+	ClearCart(token string) error
+}
+
+// SubscriptionRepository is the interface for tracking the state of Stripe subscriptions
+type SubscriptionRepository interface {
+	SaveSubscription(s Subscription) (int, error)
+	GetSubscriptionByStripeID(stripeSubscriptionID string) (*Subscription, error)
+	GetSubscriptionsByEmail(email string) ([]*Subscription, error)
+	ChangeSubscriptionPlan(ctx context.Context, s Subscription, txn Transaction, order Order, note string) (Checkout, error)
+}
+
+// CheckoutRepository is the interface for recording a sale atomically
+type CheckoutRepository interface {
+	CreateCheckout(ctx context.Context, customer Customer, txn Transaction, order Order) (Checkout, error)
+}
+
+// CustomerRepository is the interface for storing customers
+type CustomerRepository interface {
+	InsertCustomer(customer Customer) (int, error)
+}
+
+// UserRepository is the interface for managing admin users
+type UserRepository interface {
+	GetUserByEmail(email string) (User, error)
+	Authenticate(email, password string) (int, error)
+	UpdatePasswordForUser(user User, hashed_password string) error
+	GetAllUsers() ([]*User, error)
+	GetOneUser(id int) (*User, error)
+	EditUser(u User) error
+	AddUser(u User, hash string) (int, error)
+	DeleteUser(id int) error
+	DisableUser(id int) error
+	EnableUser(id int) error
+}
+
+// RoleRepository is the interface for the roles and permissions of admin users
+type RoleRepository interface {
+	GetRoles() ([]Role, error)
+	GetUserPermissions(userID int) ([]string, error)
+}
+
+// AuditRepository is the interface for recording and browsing administrative actions
+type AuditRepository interface {
+	InsertAuditEvent(event AuditEvent) (int, error)
+	GetAuditEventsPaginated(filter AuditFilter, pageSize, page int) ([]*AuditEvent, int, int, error)
+}
+
+// TokenRepository is the interface for storing authentication tokens
+type TokenRepository interface {
+	InsertToken(token *Token, u User) error
+	InsertTokenPair(access, refresh *Token, u User) error
+	RefreshTokens(ctx context.Context, refreshToken string, accessTTL, refreshTTL time.Duration) (*User, *Token, *Token, error)
+	GetUserForToken(token, scope string) (*User, error)
+	GetTokensForUser(userID int) ([]Token, error)
+	DeleteTokenForUser(tokenID, userID int) (bool, error)
+	DeleteToken(token string) error
+	DeleteTokensForUser(userID int) (int64, error)
+	DeleteExpiredTokens() (int64, error)
+}
+
+// TwoFactorRepository is the interface for the TOTP secrets and recovery codes of admin users
+type TwoFactorRepository interface {
+	GetTwoFactor(userID int) (TwoFactor, error)
+	SetTOTPSecret(userID int, secret string) error
+	EnableTwoFactor(ctx context.Context, userID int, step int64, recoveryCodeHashes [][]byte) error
+	DisableTwoFactor(ctx context.Context, userID int) error
+	UseTOTPStep(userID int, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID int, hashes [][]byte) error
+	UseRecoveryCode(userID int, hash []byte) (bool, error)
+}
+
+// LoginAttemptRepository is the interface for counting failed logins. The database keeps
+// the counts of every api and web server; lockout.MemoryStore keeps those of one process.
+type LoginAttemptRepository interface {
+	GetLoginAttempts(key string) (LoginAttempts, error)
+	RecordLoginFailure(key, email string, window time.Duration) (LoginAttempts, error)
+	LockLogin(key string, until time.Time) error
+	ResetLoginAttempts(key string) error
+	GetUnnotifiedLockouts() ([]LoginAttempts, error)
+	MarkLockoutNotified(key string) error
+	DeleteStaleLoginAttempts(before time.Time) (int64, error)
+}
+
+// RateLimitRepository is the interface for the token buckets of rate limited routes. The
+// database shares them between servers; ratelimit.MemoryStore keeps those of one process.
+type RateLimitRepository interface {
+	TakeRateLimitToken(key string, capacity int, interval time.Duration) (bool, time.Duration, error)
+	DeleteIdleRateLimitBuckets(before time.Time) (int64, error)
+}
+
+// PasswordHistoryRepository is the interface for the passwords users have had, so that
+// they cannot be used again
+type PasswordHistoryRepository interface {
+	GetPasswordHistory(userID, n int) ([]string, error)
+	AddPasswordHistory(userID int, hash string, keep int) error
+}
+
+// PasswordResetRepository is the interface for the password reset links emailed to users
+type PasswordResetRepository interface {
+	InsertPasswordReset(userID int) (string, error)
+	GetPasswordReset(nonce string) (PasswordReset, error)
+	ConsumePasswordReset(userID int, nonce string) error
+	InvalidatePasswordResets(userID int) error
+	DeletePasswordResetsBefore(before time.Time) (int64, error)
+}
+
+// StripeEventRepository is the interface for recording handled Stripe webhook events
+type StripeEventRepository interface {
+	ClaimStripeEvent(event StripeEvent) (bool, error)
+}
+
+// BusMessageRepository is the interface for the messages of the event bus shared by the
+// web servers
+type BusMessageRepository interface {
+	InsertBusMessage(topic string, payload []byte) (int, error)
+	GetLastBusMessageID() (int, error)
+	GetBusMessagesAfter(id, limit int) ([]BusMessage, error)
+	DeleteBusMessagesBefore(before time.Time) (int64, error)
+}
+
+// UserSessionRepository is the interface for knowing which web server sessions belong to
+// which user, so that they can be ended from any server
+type UserSessionRepository interface {
+	AddUserSession(userID int, token string, expiresAt time.Time) error
+	DeleteUserSession(token string) error
+	DeleteSessionsForUser(userID int) (int64, error)
+	DeleteExpiredUserSessions() (int64, error)
+}
+
+// InvoiceJobRepository is the interface for the invoices waiting to be sent to the invoice
+// microservice
+type InvoiceJobRepository interface {
+	InsertInvoiceJob(orderID int, payload []byte) (int, error)
+	ClaimInvoiceJobs(limit int, lease time.Duration) ([]InvoiceJob, error)
+	MarkInvoiceJobDelivered(id int) error
+	RescheduleInvoiceJob(id int, next time.Time, lastError string) error
+	FailInvoiceJob(id int, lastError string) error
+	RetryInvoiceJob(id int) (bool, error)
+	GetInvoiceJob(id int) (InvoiceJob, error)
+	GetInvoiceJobsPaginated(status string, pageSize, page int) ([]*InvoiceJob, int, int, error)
+}
+
+// Repository is every repository the application uses, and the transactions to use them
+// in
+type Repository interface {
+	WithTx(ctx context.Context, fn func(tx Repository) error) error
+
+	WidgetRepository
+	InventoryRepository
+	TransactionRepository
+	OrderRepository
+	RefundRepository
+	CartRepository
+	SubscriptionRepository
+	CheckoutRepository
+	CustomerRepository
+	UserRepository
+	RoleRepository
+	AuditRepository
+	TokenRepository
+	TwoFactorRepository
+	LoginAttemptRepository
+	RateLimitRepository
+	PasswordHistoryRepository
+	PasswordResetRepository
+	StripeEventRepository
+	BusMessageRepository
+	UserSessionRepository
+	InvoiceJobRepository
+}
+
+// DBModel implements every repository, for both MySQL and SQLite
+var _ Repository = (*DBModel)(nil)
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Roles, by ID. A user without a role can sign in but has no permissions.
+const (
+	RoleOwner    = 1
+	RoleAdmin    = 2
+	RoleSupport  = 3
+	RoleReadOnly = 4
+)
+
+// Permissions checked by the api and web servers. Which roles have them is stored in the
+// role_permissions table.
+const (
+	PermissionViewSales           = "view-sales"
+	PermissionRefund              = "refund"
+	PermissionViewSubscriptions   = "view-subscriptions"
+	PermissionManageSubscriptions = "manage-subscriptions"
+	PermissionVirtualTerminal     = "virtual-terminal"
+	PermissionViewUsers           = "view-users"
+	PermissionManageUsers         = "manage-users"
+	PermissionViewAuditLog        = "view-audit-log"
+	PermissionManageInvoices      = "manage-invoices"
+)
+
+// Role is the type for a role, with the names of its permissions
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"-"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// Can reports whether u has permission. Permissions must have been loaded with
+// GetUserPermissions.
+func (u *User) Can(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRoles returns every role with its permissions
+func (m *DBModel) GetRoles() ([]Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var roles []Role
+
+	query := `
+		SELECT
+			r.id, r.name, r.description, coalesce(p.name, ''), r.created_at, r.updated_at
+		FROM
+			roles r
+			LEFT JOIN role_permissions rp on (rp.role_id = r.id)
+			LEFT JOIN permissions p on (rp.permission_id = p.id)
+		ORDER BY r.id, p.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Role
+		var permission string
+
+		err := rows.Scan(
+			&r.ID,
+			&r.Name,
+			&r.Description,
+			&permission,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// One row per permission, so rows of the same role follow each other
+		if len(roles) == 0 || roles[len(roles)-1].ID != r.ID {
+			roles = append(roles, r)
+		}
+		if permission != "" {
+			last := &roles[len(roles)-1]
+			last.Permissions = append(last.Permissions, permission)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// GetUserPermissions returns the names of the permissions of a user's role
+func (m *DBModel) GetUserPermissions(userID int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var permissions []string
+
+	query := `
+		SELECT
+			p.name
+		FROM
+			users u
+			INNER JOIN role_permissions rp on (rp.role_id = u.role_id)
+			INNER JOIN permissions p on (rp.permission_id = p.id)
+		WHERE
+			u.id = ?
+		ORDER BY p.id
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// roleOrNil stores a role ID of 0 as NULL, since users.role_id is a foreign key
+func roleOrNil(roleID int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(roleID), Valid: roleID != 0}
+}
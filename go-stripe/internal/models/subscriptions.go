@@ -0,0 +1,268 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Subscription statuses. They are Stripe's subscription statuses, plus SubscriptionPaused
+// for a subscription whose payment collection has been paused.
+const (
+	SubscriptionActive     = "active"
+	SubscriptionTrialing   = "trialing"
+	SubscriptionPastDue    = "past_due"
+	SubscriptionPaused     = "paused"
+	SubscriptionCanceled   = "canceled"
+	SubscriptionUnpaid     = "unpaid"
+	SubscriptionIncomplete = "incomplete"
+)
+
+// Subscription is the type for the state of a Stripe subscription. Times that Stripe has
+// not set (no trial, no cancellation scheduled) are nil.
+type Subscription struct {
+	ID                   int        `json:"id"`
+	StripeSubscriptionID string     `json:"stripe_subscription_id"`
+	WidgetID             int        `json:"widget_id"`
+	CustomerID           int        `json:"customer_id"`
+	PlanID               string     `json:"plan_id"`
+	Status               string     `json:"status"`
+	CurrentPeriodStart   *time.Time `json:"current_period_start"`
+	CurrentPeriodEnd     *time.Time `json:"current_period_end"`
+	TrialEnd             *time.Time `json:"trial_end"`
+	CancelAt             *time.Time `json:"cancel_at"`
+	CancelAtPeriodEnd    bool       `json:"cancel_at_period_end"`
+	CanceledAt           *time.Time `json:"canceled_at"`
+	CreatedAt            time.Time  `json:"-"`
+	UpdatedAt            time.Time  `json:"-"`
+	Widget               Widget     `json:"widget"`
+	Customer             Customer   `json:"customer"`
+}
+
+// SaveSubscription inserts a subscription, or updates the one with the same Stripe
+// subscription ID, and returns its ID. The customer of an existing subscription never
+// changes; its widget changes along with its plan.
+func (m *DBModel) SaveSubscription(s Subscription) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		query := `SELECT id FROM subscriptions WHERE stripe_subscription_id = ? FOR UPDATE`
+		err := tx.conn().QueryRowContext(ctx, tx.rebind(query), s.StripeSubscriptionID).Scan(&id)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if err == nil {
+			query = `UPDATE subscriptions SET
+						widget_id = ?, plan_id = ?, status = ?, current_period_start = ?, current_period_end = ?,
+						trial_end = ?, cancel_at = ?, cancel_at_period_end = ?, canceled_at = ?,
+						updated_at = ?
+					  WHERE id = ?`
+			_, err = tx.conn().ExecContext(ctx, query,
+				s.WidgetID,
+				s.PlanID,
+				s.Status,
+				s.CurrentPeriodStart,
+				s.CurrentPeriodEnd,
+				s.TrialEnd,
+				s.CancelAt,
+				s.CancelAtPeriodEnd,
+				s.CanceledAt,
+				time.Now(),
+				id,
+			)
+			return err
+		}
+
+		query = `INSERT INTO subscriptions
+					(stripe_subscription_id, widget_id, customer_id, plan_id, status, current_period_start,
+					current_period_end, trial_end, cancel_at, cancel_at_period_end, canceled_at, created_at, updated_at)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		result, err := tx.conn().ExecContext(ctx, query,
+			s.StripeSubscriptionID,
+			s.WidgetID,
+			s.CustomerID,
+			s.PlanID,
+			s.Status,
+			s.CurrentPeriodStart,
+			s.CurrentPeriodEnd,
+			s.TrialEnd,
+			s.CancelAt,
+			s.CancelAtPeriodEnd,
+			s.CanceledAt,
+			time.Now(),
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		id = int(lastID)
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ChangeSubscriptionPlan records that a subscription has moved to another plan: txn is the
+// payment for the prorated difference, and order is a new order for the widget of the new
+// plan, made by the subscription's customer. The previous order of the subscription gets a
+// status history entry pointing to the new one, and s is saved with the new widget. It all
+// happens in one database transaction.
+func (m *DBModel) ChangeSubscriptionPlan(ctx context.Context, s Subscription, txn Transaction, order Order, note string) (Checkout, error) {
+	var checkout Checkout
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		previous, err := tx.GetOrderByPaymentIntent(s.StripeSubscriptionID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		txn.PaymentIntent = s.StripeSubscriptionID
+		order.WidgetID = s.WidgetID
+		checkout, err = tx.createCheckout(Customer{ID: s.CustomerID}, txn, order, note)
+		if err != nil {
+			return err
+		}
+
+		if previous != nil {
+			_, err = tx.InsertOrderStatusHistory(previous.ID, previous.StatusID, fmt.Sprintf("Plan changed, replaced by order %d", checkout.OrderID))
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.SaveSubscription(s)
+		return err
+	})
+	if err != nil {
+		return Checkout{}, err
+	}
+
+	return checkout, nil
+}
+
+// subscriptionQuery selects a subscription with its widget and customer, for scanSubscription
+const subscriptionQuery = `
+		SELECT
+			s.id, s.stripe_subscription_id, s.widget_id, s.customer_id, s.plan_id, s.status,
+			s.current_period_start, s.current_period_end, s.trial_end, s.cancel_at,
+			s.cancel_at_period_end, s.canceled_at, s.created_at, s.updated_at,
+			w.id, w.name, w.price, w.slug,
+			c.id, c.first_name, c.last_name, c.email
+		FROM
+			subscriptions s
+			LEFT JOIN widgets w on (s.widget_id = w.id)
+			LEFT JOIN customers c on (s.customer_id = c.id)
+`
+
+// GetSubscriptionByStripeID returns a subscription with its widget and customer
+func (m *DBModel) GetSubscriptionByStripeID(stripeSubscriptionID string) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := subscriptionQuery + `
+		WHERE
+			s.stripe_subscription_id = ?
+	`
+
+	return scanSubscription(m.conn().QueryRowContext(ctx, query, stripeSubscriptionID))
+}
+
+// GetSubscriptionsByEmail returns the subscriptions of the customers with an email
+// address, newest first, including cancelled ones
+func (m *DBModel) GetSubscriptionsByEmail(email string) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var subscriptions []*Subscription
+
+	query := subscriptionQuery + `
+		WHERE
+			c.email = ?
+		ORDER BY s.id DESC
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		s, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+// scanSubscription scans a row selected with subscriptionQuery
+func scanSubscription(row interface{ Scan(...interface{}) error }) (*Subscription, error) {
+	var s Subscription
+	var periodStart, periodEnd, trialEnd, cancelAt, canceledAt sql.NullTime
+
+	err := row.Scan(
+		&s.ID,
+		&s.StripeSubscriptionID,
+		&s.WidgetID,
+		&s.CustomerID,
+		&s.PlanID,
+		&s.Status,
+		&periodStart,
+		&periodEnd,
+		&trialEnd,
+		&cancelAt,
+		&s.CancelAtPeriodEnd,
+		&canceledAt,
+		&s.CreatedAt,
+		&s.UpdatedAt,
+		&s.Widget.ID,
+		&s.Widget.Name,
+		&s.Widget.Price,
+		&s.Widget.Slug,
+		&s.Customer.ID,
+		&s.Customer.FirstName,
+		&s.Customer.LastName,
+		&s.Customer.Email,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.CurrentPeriodStart = timeOrNil(periodStart)
+	s.CurrentPeriodEnd = timeOrNil(periodEnd)
+	s.TrialEnd = timeOrNil(trialEnd)
+	s.CancelAt = timeOrNil(cancelAt)
+	s.CanceledAt = timeOrNil(canceledAt)
+
+	return &s, nil
+}
+
+// timeOrNil returns a pointer to the time in t, or nil when t is NULL
+func timeOrNil(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -4,21 +4,45 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
+	"encoding/hex"
+	"errors"
 	"time"
 )
 
 const (
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
 )
 
-// Token represents an authentication token.
+var (
+	// ErrInvalidToken is returned for a refresh token that does not exist or has expired
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrTokenReused is returned for a refresh token that was already exchanged. Its whole
+	// family has been revoked by then, since someone other than the device may have it.
+	ErrTokenReused = errors.New("refresh token has already been used")
+)
+
+// lastUsedResolution is how stale last_used_at may get, so that every request does not
+// write to the tokens table
+const lastUsedResolution = time.Minute
+
+// Token represents an authentication token. A user has one token per device they are
+// logged in on; DeviceName tells them apart. Logging in issues an authentication token and
+// a refresh token in a new family; every refresh replaces both with new tokens of the same
+// family, and marks the refresh token used.
 type Token struct {
-	PlainText string    `json:"token"`
-	UserID    int64     `json:"-"`
-	Hash      []byte    `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID         int        `json:"id"`
+	PlainText  string     `json:"token,omitempty"`
+	UserID     int64      `json:"-"`
+	Hash       []byte     `json:"-"`
+	Expiry     time.Time  `json:"expiry"`
+	Scope      string     `json:"scope"`
+	DeviceName string     `json:"device_name"`
+	FamilyID   string     `json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
 }
 
 // GenerateToken generates a new token for the given user ID, expiry time and scope.
@@ -43,53 +67,366 @@ func GenerateToken(userID int64, ttl time.Duration, scope string) (*Token, error
 	return token, nil
 }
 
-// InsertToken inserts a token into the database.
+// GenerateTokenPair generates an authentication token and a refresh token for a device,
+// in a new family
+func GenerateTokenPair(userID int64, deviceName string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return generateTokenPair(userID, deviceName, hex.EncodeToString(randomBytes), accessTTL, refreshTTL)
+}
+
+// generateTokenPair generates an authentication token and a refresh token in familyID
+func generateTokenPair(userID int64, deviceName, familyID string, accessTTL, refreshTTL time.Duration) (*Token, *Token, error) {
+	access, err := GenerateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := GenerateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, t := range []*Token{access, refresh} {
+		t.DeviceName = deviceName
+		t.FamilyID = familyID
+	}
+
+	return access, refresh, nil
+}
+
+// InsertTokenPair inserts an authentication token and its refresh token
+func (m *DBModel) InsertTokenPair(access, refresh *Token, u User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// The refresh token goes first, so the newest token of a family is the one in use
+	return m.withTx(ctx, func(tx *DBModel) error {
+		err := tx.InsertToken(refresh, u)
+		if err != nil {
+			return err
+		}
+		return tx.InsertToken(access, u)
+	})
+}
+
+// RefreshTokens exchanges a refresh token for a new authentication token and refresh
+// token of the same family, with fresh expiries. The refresh token is marked used and the
+// family's earlier authentication token is deleted, so a stolen one stops working once
+// its device refreshes. A refresh token presented a second time revokes the whole family
+// and returns ErrTokenReused.
+func (m *DBModel) RefreshTokens(ctx context.Context, refreshToken string, accessTTL, refreshTTL time.Duration) (*User, *Token, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(refreshToken))
+
+	var user *User
+	var access, refresh *Token
+	var reused bool
+
+	err := m.withTx(ctx, func(tx *DBModel) error {
+		var id int
+		var userID int64
+		var familyID, deviceName string
+		var expiry time.Time
+		var usedAt sql.NullTime
+
+		// Locking the token makes a concurrent refresh with it wait, and then see it used
+		query := `SELECT id, user_id, family_id, device_name, expiry, used_at
+				  FROM tokens WHERE token_hash = ? AND scope = ? FOR UPDATE`
+		err := tx.conn().QueryRowContext(ctx, tx.rebind(query), tokenHash[:], ScopeRefresh).Scan(
+			&id,
+			&userID,
+			&familyID,
+			&deviceName,
+			&expiry,
+			&usedAt,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if usedAt.Valid {
+			reused = true
+			query = `DELETE FROM tokens WHERE family_id = ?`
+			_, err = tx.conn().ExecContext(ctx, query, familyID)
+			return err
+		}
+
+		if !expiry.After(time.Now()) {
+			return ErrInvalidToken
+		}
+
+		user, err = tx.GetOneUser(int(userID))
+		if err != nil {
+			return err
+		}
+		if user.Disabled() {
+			return ErrInvalidToken
+		}
+
+		query = `UPDATE tokens SET used_at = ? WHERE id = ?`
+		_, err = tx.conn().ExecContext(ctx, query, time.Now(), id)
+		if err != nil {
+			return err
+		}
+
+		query = `DELETE FROM tokens WHERE family_id = ? AND scope = ?`
+		_, err = tx.conn().ExecContext(ctx, query, familyID, ScopeAuthentication)
+		if err != nil {
+			return err
+		}
+
+		access, refresh, err = generateTokenPair(userID, deviceName, familyID, accessTTL, refreshTTL)
+		if err != nil {
+			return err
+		}
+
+		return tx.InsertTokenPair(access, refresh, *user)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if reused {
+		return nil, nil, nil, ErrTokenReused
+	}
+
+	return user, access, refresh, nil
+}
+
+// InsertToken inserts a token into the database and sets its ID. The user's other tokens
+// are kept, so logging in on one device does not log out the others.
 func (m *DBModel) InsertToken(token *Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// Delete any existing tokens for the user
-	query := `DELETE FROM tokens WHERE user_id = ?`
-	_, err := m.DB.ExecContext(ctx, query, token.UserID)
+	token.CreatedAt = time.Now()
+
+	query := `INSERT INTO tokens
+				(user_id, name, email, token_hash, expiry, scope, device_name, family_id, created_at, updated_at)
+			  values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := m.conn().ExecContext(ctx, query,
+		token.UserID,
+		u.LastName,
+		u.Email,
+		token.Hash,
+		token.Expiry,
+		token.Scope,
+		token.DeviceName,
+		token.FamilyID,
+		token.CreatedAt,
+		token.CreatedAt,
+	)
 	if err != nil {
 		return err
 	}
 
-	// Insert new token
-	query = `INSERT INTO tokens (user_id, name, email, token_hash, expiry, created_at, updated_at) values (?, ?, ?, ?, ?, ?, ?)`
-	_, err = m.DB.ExecContext(ctx, query, token.UserID, u.LastName, u.Email, token.Hash, token.Expiry, time.Now(), time.Now())
+	id, err := result.LastInsertId()
 	if err != nil {
 		return err
 	}
+	token.ID = int(id)
 
 	return nil
 }
 
-// GetUserForToken returns the user for the given token string.
-func (m *DBModel) GetUserForToken(token string) (*User, error) {
+// GetUserForToken returns the user for the given token string, if the token has not
+// expired and is for scope and the user is not disabled. The token is marked as used.
+func (m *DBModel) GetUserForToken(token, scope string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 	var user User
+	var roleID sql.NullInt64
+	var tokenID int
 
 	query := `SELECT
-				u.id, u.first_name, u.last_name, u.email
+				u.id, u.first_name, u.last_name, u.email, u.role_id, coalesce(r.name, ''), t.id
 			  FROM
 			    users u
 			  INNER JOIN tokens t ON t.user_id = u.id
+			  LEFT JOIN roles r ON r.id = u.role_id
 			  WHERE
-			    t.token_hash = ? AND t.expiry > ?
+			    t.token_hash = ? AND t.scope = ? AND t.expiry > ? AND u.disabled_at IS NULL
 	`
-	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
+	err := m.conn().QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(
 		&user.ID,
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&roleID,
+		&user.Role,
+		&tokenID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	user.RoleID = int(roleID.Int64)
+
+	now := time.Now()
+	query = `UPDATE tokens SET last_used_at = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ?)`
+	_, err = m.conn().ExecContext(ctx, query, now, tokenID, now.Add(-lastUsedResolution))
+	if err != nil {
+		return nil, err
+	}
 
 	return &user, nil
 }
+
+// GetTokensForUser returns the devices a user is logged in on, most recent first. Each
+// family of tokens is one device, shown as its newest unused token, which expires when the
+// last token of the family does. The plain text of the tokens is not stored, so only their
+// hashes are returned.
+func (m *DBModel) GetTokensForUser(userID int) ([]Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens []Token
+	families := make(map[string]int)
+
+	query := `
+		SELECT
+			id, user_id, token_hash, expiry, scope, device_name, family_id, last_used_at, created_at
+		FROM
+			tokens
+		WHERE
+			user_id = ? AND expiry > ? AND used_at IS NULL
+		ORDER BY id DESC
+	`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Token
+		var lastUsedAt sql.NullTime
+
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Hash,
+			&t.Expiry,
+			&t.Scope,
+			&t.DeviceName,
+			&t.FamilyID,
+			&lastUsedAt,
+			&t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.LastUsedAt = timeOrNil(lastUsedAt)
+
+		i, seen := families[t.FamilyID]
+		if !seen || t.FamilyID == "" {
+			families[t.FamilyID] = len(tokens)
+			tokens = append(tokens, t)
+			continue
+		}
+
+		device := &tokens[i]
+		if t.Expiry.After(device.Expiry) {
+			device.Expiry = t.Expiry
+		}
+		if t.LastUsedAt != nil && (device.LastUsedAt == nil || t.LastUsedAt.After(*device.LastUsedAt)) {
+			device.LastUsedAt = t.LastUsedAt
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// DeleteTokenForUser revokes one of a user's tokens, with the rest of its family. It
+// returns false when the user has no token with that ID.
+func (m *DBModel) DeleteTokenForUser(tokenID, userID int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var familyID string
+	query := `SELECT family_id FROM tokens WHERE id = ? AND user_id = ?`
+	err := m.conn().QueryRowContext(ctx, query, tokenID, userID).Scan(&familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, m.deleteTokenFamily(ctx, tokenID, familyID)
+}
+
+// DeleteToken revokes the token with the given plain text, with the rest of its family
+func (m *DBModel) DeleteToken(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tokenHash := sha256.Sum256([]byte(token))
+
+	var id int
+	var familyID string
+	query := `SELECT id, family_id FROM tokens WHERE token_hash = ?`
+	err := m.conn().QueryRowContext(ctx, query, tokenHash[:]).Scan(&id, &familyID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return m.deleteTokenFamily(ctx, id, familyID)
+}
+
+// deleteTokenFamily deletes a token and the other tokens of its family. Tokens issued
+// before refresh tokens have no family.
+func (m *DBModel) deleteTokenFamily(ctx context.Context, tokenID int, familyID string) error {
+	query := `DELETE FROM tokens WHERE id = ?`
+	args := []interface{}{tokenID}
+	if familyID != "" {
+		query = `DELETE FROM tokens WHERE id = ? OR family_id = ?`
+		args = append(args, familyID)
+	}
+
+	_, err := m.conn().ExecContext(ctx, query, args...)
+	return err
+}
+
+// DeleteTokensForUser revokes every token of a user and returns how many there were
+func (m *DBModel) DeleteTokensForUser(userID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM tokens WHERE user_id = ?`
+	result, err := m.conn().ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpiredTokens deletes the tokens that have expired and returns how many there were
+func (m *DBModel) DeleteExpiredTokens() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `DELETE FROM tokens WHERE expiry <= ?`
+	result, err := m.conn().ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
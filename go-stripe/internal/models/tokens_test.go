@@ -0,0 +1,131 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"myapp/internal/models"
+	"testing"
+	"time"
+)
+
+// logIn adds a user and logs them in on a device, returning the user and the device's
+// authentication and refresh tokens
+func logIn(t *testing.T, m *models.DBModel) (models.User, *models.Token, *models.Token) {
+	t.Helper()
+
+	result, err := m.DB.Exec(`INSERT INTO users (first_name, last_name, email, password) VALUES ('Pat', 'Admin', 'pat@example.com', 'x')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+	user := models.User{ID: int(id), Email: "pat@example.com"}
+
+	access, refresh, err := models.GenerateTokenPair(id, "laptop", time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.InsertTokenPair(access, refresh, user); err != nil {
+		t.Fatal(err)
+	}
+
+	return user, access, refresh
+}
+
+// refreshTokens refreshes with a token for an hour long authentication token and a day
+// long refresh token
+func refreshTokens(m *models.DBModel, refreshToken string) (*models.User, *models.Token, *models.Token, error) {
+	return m.RefreshTokens(context.Background(), refreshToken, time.Hour, 24*time.Hour)
+}
+
+// valid tells whether a token authenticates a user for scope
+func valid(m *models.DBModel, token, scope string) bool {
+	_, err := m.GetUserForToken(token, scope)
+	return err == nil
+}
+
+func TestRefreshTokens(t *testing.T) {
+	m, _ := newTestModel(t)
+	user, access, refresh := logIn(t, m)
+
+	got, newAccess, newRefresh, err := refreshTokens(m, refresh.PlainText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != user.ID {
+		t.Errorf("refreshed tokens of user %d, want %d", got.ID, user.ID)
+	}
+	if newAccess.DeviceName != "laptop" || newRefresh.DeviceName != "laptop" {
+		t.Errorf("new tokens are for %q and %q, want laptop", newAccess.DeviceName, newRefresh.DeviceName)
+	}
+
+	if valid(m, access.PlainText, models.ScopeAuthentication) {
+		t.Error("authentication token still works after refreshing")
+	}
+	if !valid(m, newAccess.PlainText, models.ScopeAuthentication) {
+		t.Error("new authentication token does not work")
+	}
+
+	// A refresh token is not an authentication token, nor the other way round
+	if valid(m, newRefresh.PlainText, models.ScopeAuthentication) {
+		t.Error("refresh token works as an authentication token")
+	}
+	if _, _, _, err := refreshTokens(m, newAccess.PlainText); !errors.Is(err, models.ErrInvalidToken) {
+		t.Errorf("refreshing with an authentication token got %v, want %v", err, models.ErrInvalidToken)
+	}
+
+	tokens, err := m.GetTokensForUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Errorf("user is logged in on %d devices, want 1", len(tokens))
+	}
+}
+
+func TestRefreshTokensReused(t *testing.T) {
+	m, _ := newTestModel(t)
+	_, _, refresh := logIn(t, m)
+
+	_, newAccess, newRefresh, err := refreshTokens(m, refresh.PlainText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else has the old refresh token, so the whole family is revoked
+	if _, _, _, err := refreshTokens(m, refresh.PlainText); !errors.Is(err, models.ErrTokenReused) {
+		t.Fatalf("reusing a refresh token got %v, want %v", err, models.ErrTokenReused)
+	}
+
+	if valid(m, newAccess.PlainText, models.ScopeAuthentication) {
+		t.Error("authentication token of a revoked family still works")
+	}
+	if _, _, _, err := refreshTokens(m, newRefresh.PlainText); !errors.Is(err, models.ErrInvalidToken) {
+		t.Errorf("refreshing with a revoked family got %v, want %v", err, models.ErrInvalidToken)
+	}
+}
+
+func TestRefreshTokensInvalid(t *testing.T) {
+	m, db := newTestModel(t)
+	user, _, refresh := logIn(t, m)
+
+	if _, _, _, err := refreshTokens(m, "not a token"); !errors.Is(err, models.ErrInvalidToken) {
+		t.Errorf("refreshing with an unknown token got %v, want %v", err, models.ErrInvalidToken)
+	}
+
+	if _, err := db.Exec(`UPDATE users SET disabled_at = ? WHERE id = ?`, time.Now(), user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := refreshTokens(m, refresh.PlainText); !errors.Is(err, models.ErrInvalidToken) {
+		t.Errorf("refreshing for a disabled user got %v, want %v", err, models.ErrInvalidToken)
+	}
+
+	if _, err := db.Exec(`UPDATE users SET disabled_at = NULL`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE tokens SET expiry = ? WHERE scope = ?`, time.Now().Add(-time.Minute), models.ScopeRefresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := refreshTokens(m, refresh.PlainText); !errors.Is(err, models.ErrInvalidToken) {
+		t.Errorf("refreshing with an expired token got %v, want %v", err, models.ErrInvalidToken)
+	}
+}
@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrTwoFactorNotEnrolled is returned when enabling two-factor authentication for a user
+// who has not been given a secret
+var ErrTwoFactorNotEnrolled = errors.New("two-factor authentication has not been set up")
+
+// TwoFactor is the two-factor authentication state of a user. Secret is their TOTP
+// secret, encrypted; it is set when they start enrolling and EnabledAt once they have
+// confirmed it with a code. LastStep is the time step of the last code accepted, so that no
+// code is accepted twice.
+type TwoFactor struct {
+	UserID            int
+	Secret            string
+	EnabledAt         *time.Time
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+// Enabled reports whether the user has to give a code to log in
+func (t TwoFactor) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+// GetTwoFactor returns the two-factor authentication state of a user
+func (m *DBModel) GetTwoFactor(userID int) (TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var t TwoFactor
+	var enabledAt sql.NullTime
+
+	query := `
+		SELECT
+			u.id, u.totp_secret, u.totp_enabled_at, u.totp_last_step,
+			(SELECT COUNT(rc.id) FROM recovery_codes rc WHERE rc.user_id = u.id AND rc.used_at IS NULL)
+		FROM
+			users u
+		WHERE
+			u.id = ?
+	`
+
+	err := m.conn().QueryRowContext(ctx, query, userID).Scan(
+		&t.UserID,
+		&t.Secret,
+		&enabledAt,
+		&t.LastStep,
+		&t.RecoveryCodesLeft,
+	)
+	if err != nil {
+		return t, err
+	}
+	t.EnabledAt = timeOrNil(enabledAt)
+
+	return t, nil
+}
+
+// SetTOTPSecret starts enrolling a user in two-factor authentication with an encrypted
+// secret. Two-factor authentication stays off until EnableTwoFactor is called.
+func (m *DBModel) SetTOTPSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET totp_secret = ?, totp_enabled_at = NULL, totp_last_step = 0, updated_at = ?
+		WHERE id = ?
+	`
+
+	_, err := m.conn().ExecContext(ctx, query, secret, time.Now(), userID)
+	return err
+}
+
+// EnableTwoFactor turns on two-factor authentication for a user who has a secret, once
+// they have given the code of time step step, and gives them new recovery codes
+func (m *DBModel) EnableTwoFactor(ctx context.Context, userID int, step int64, recoveryCodeHashes [][]byte) error {
+	return m.withTx(ctx, func(tx *DBModel) error {
+		query := `
+			UPDATE users
+			SET totp_enabled_at = ?, totp_last_step = ?, updated_at = ?
+			WHERE id = ? AND totp_secret <> ''
+		`
+
+		result, err := tx.conn().ExecContext(ctx, query, time.Now(), step, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrTwoFactorNotEnrolled
+		}
+
+		return tx.ReplaceRecoveryCodes(ctx, userID, recoveryCodeHashes)
+	})
+}
+
+// DisableTwoFactor turns off two-factor authentication for a user and forgets their
+// secret and recovery codes
+func (m *DBModel) DisableTwoFactor(ctx context.Context, userID int) error {
+	return m.withTx(ctx, func(tx *DBModel) error {
+		query := `
+			UPDATE users
+			SET totp_secret = '', totp_enabled_at = NULL, totp_last_step = 0, updated_at = ?
+			WHERE id = ?
+		`
+
+		_, err := tx.conn().ExecContext(ctx, query, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+
+		return tx.ReplaceRecoveryCodes(ctx, userID, nil)
+	})
+}
+
+// UseTOTPStep records that a user gave the code of time step step, and reports whether no
+// code of that step or a later one had been accepted before
+func (m *DBModel) UseTOTPStep(userID int, step int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET totp_last_step = ?
+		WHERE id = ? AND totp_last_step < ?
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// ReplaceRecoveryCodes replaces every recovery code of a user with the codes hashed in
+// hashes
+func (m *DBModel) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes [][]byte) error {
+	return m.withTx(ctx, func(tx *DBModel) error {
+		_, err := tx.conn().ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID)
+		if err != nil {
+			return err
+		}
+
+		query := `
+			INSERT INTO recovery_codes (user_id, code_hash, created_at, updated_at)
+			VALUES (?, ?, ?, ?)
+		`
+
+		for _, hash := range hashes {
+			_, err = tx.conn().ExecContext(ctx, query, userID, hash, time.Now(), time.Now())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// UseRecoveryCode marks the unused recovery code of a user hashed in hash as used, and
+// reports whether there was one
+func (m *DBModel) UseRecoveryCode(userID int, hash []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		UPDATE recovery_codes
+		SET used_at = ?, updated_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+
+	result, err := m.conn().ExecContext(ctx, query, time.Now(), time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+)
+
+// querier is the part of *sql.DB and *sql.Tx the models use
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// conn returns the transaction the model is running in, or the connection pool
+func (m *DBModel) conn() querier {
+	if m.tx != nil {
+		return m.tx
+	}
+
+	return m.DB
+}
+
+// WithTx runs fn inside a database transaction. Every query made through the repository
+// passed to fn is part of the transaction, which is committed when fn returns nil and
+// rolled back otherwise. Calling WithTx on a model already in a transaction reuses it.
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx Repository) error) error {
+	return m.withTx(ctx, func(tx *DBModel) error {
+		return fn(tx)
+	})
+}
+
+// withTx is WithTx for the models, which work with the DBModel of the transaction
+func (m *DBModel) withTx(ctx context.Context, fn func(tx *DBModel) error) (err error) {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	err = fn(&DBModel{DB: m.DB, Dialect: m.Dialect, tx: tx})
+	return err
+}
@@ -0,0 +1,138 @@
+package models_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/testdb"
+	"path/filepath"
+	"testing"
+)
+
+// The tests are in package models_test, as testdb imports models
+
+// newTestModel returns a model on a new SQLite database, and the database itself for
+// checking what was written
+func newTestModel(t *testing.T) (*models.DBModel, *sql.DB) {
+	t.Helper()
+
+	db, err := testdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	m := testdb.NewModel(db)
+	return &m, db
+}
+
+// count returns the number of rows in a table
+func count(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// insertCustomer inserts a customer through a repository
+func insertCustomer(t *testing.T, r models.Repository, email string) {
+	t.Helper()
+
+	if _, err := r.InsertCustomer(models.Customer{FirstName: "Pat", LastName: "Buyer", Email: email}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	m, db := newTestModel(t)
+	errFailed := errors.New("failed")
+
+	err := m.WithTx(context.Background(), func(tx models.Repository) error {
+		insertCustomer(t, tx, "committed@example.com")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, db, "customers"); n != 1 {
+		t.Fatalf("%d customers after committing, want 1", n)
+	}
+
+	err = m.WithTx(context.Background(), func(tx models.Repository) error {
+		insertCustomer(t, tx, "rolled-back@example.com")
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("rolled back transaction returned %v, want %v", err, errFailed)
+	}
+	if n := count(t, db, "customers"); n != 1 {
+		t.Errorf("%d customers after rolling back, want 1", n)
+	}
+}
+
+func TestWithTxPanic(t *testing.T) {
+	m, db := newTestModel(t)
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was not passed on")
+			}
+		}()
+		_ = m.WithTx(context.Background(), func(tx models.Repository) error {
+			insertCustomer(t, tx, "panicked@example.com")
+			panic("failed")
+		})
+	}()
+
+	if n := count(t, db, "customers"); n != 0 {
+		t.Errorf("%d customers after panicking, want 0", n)
+	}
+}
+
+func TestWithTxNested(t *testing.T) {
+	m, db := newTestModel(t)
+	errFailed := errors.New("failed")
+
+	// The nested call is part of the outer transaction, so it is rolled back with it even
+	// though it succeeded
+	err := m.WithTx(context.Background(), func(tx models.Repository) error {
+		insertCustomer(t, tx, "outer@example.com")
+
+		err := tx.WithTx(context.Background(), func(nested models.Repository) error {
+			insertCustomer(t, nested, "nested@example.com")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("outer transaction returned %v, want %v", err, errFailed)
+	}
+	if n := count(t, db, "customers"); n != 0 {
+		t.Errorf("%d customers after rolling back the outer transaction, want 0", n)
+	}
+
+	// A nested failure fails the outer transaction when it is passed on
+	err = m.WithTx(context.Background(), func(tx models.Repository) error {
+		insertCustomer(t, tx, "outer@example.com")
+
+		return tx.WithTx(context.Background(), func(nested models.Repository) error {
+			insertCustomer(t, nested, "nested@example.com")
+			return errFailed
+		})
+	})
+	if !errors.Is(err, errFailed) {
+		t.Errorf("outer transaction returned %v, want %v", err, errFailed)
+	}
+	if n := count(t, db, "customers"); n != 0 {
+		t.Errorf("%d customers after a nested failure, want 0", n)
+	}
+}
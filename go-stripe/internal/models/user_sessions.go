@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// AddUserSession records that the web server session with the given token belongs to a
+// user, so that it can be ended when the user is disabled or deleted
+func (m *DBModel) AddUserSession(userID int, token string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+
+	// A session token stays the same when it is renewed, so keep the row up to date
+	_, err := m.conn().ExecContext(ctx, `DELETE FROM user_sessions WHERE token = ?`, token)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO user_sessions (user_id, token, expires_at, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`
+
+	_, err = m.conn().ExecContext(ctx, query, userID, token, expiresAt, now, now)
+	return err
+}
+
+// DeleteUserSession forgets the session with the given token, when the user logs out
+func (m *DBModel) DeleteUserSession(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `DELETE FROM user_sessions WHERE token = ?`, token)
+	return err
+}
+
+// DeleteSessionsForUser ends every web server session of a user, by deleting them from
+// the session store, and returns how many there were
+func (m *DBModel) DeleteSessionsForUser(userID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `
+		DELETE FROM sessions
+		WHERE token IN (SELECT token FROM user_sessions WHERE user_id = ?)
+	`
+	result, err := m.conn().ExecContext(ctx, query, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = m.conn().ExecContext(ctx, `DELETE FROM user_sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// DeleteExpiredUserSessions forgets the sessions that have expired and returns how many
+// there were
+func (m *DBModel) DeleteExpiredUserSessions() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.conn().ExecContext(ctx, `DELETE FROM user_sessions WHERE expires_at <= ?`, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// StripeEvent is the type for webhook events received from Stripe
+type StripeEvent struct {
+	ID            int       `json:"id"`
+	StripeEventID string    `json:"stripe_event_id"`
+	EventType     string    `json:"event_type"`
+	CreatedAt     time.Time `json:"-"`
+	UpdatedAt     time.Time `json:"-"`
+}
+
+// ClaimStripeEvent records a Stripe event as handled, and reports false if it already
+// was. Call it in the transaction that handles the event: a delivery of the same event
+// running at the same time waits for the transaction on the unique stripe_event_id, and
+// claims the event only if the transaction is rolled back.
+func (m *DBModel) ClaimStripeEvent(event StripeEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	query := `INSERT IGNORE INTO stripe_events
+				(stripe_event_id, event_type, created_at, updated_at)
+			  VALUES (?, ?, ?, ?)`
+
+	result, err := m.conn().ExecContext(ctx, m.rebind(query),
+		event.StripeEventID,
+		event.EventType,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
@@ -0,0 +1,108 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// prefixLength is how many hex digits of a SHA-1 hash pick its range, as in the k-anonymity
+// API of Have I Been Pwned
+const prefixLength = 5
+
+// BreachList holds the SHA-1 hashes of leaked passwords, grouped into ranges by the first
+// five hex digits of the hash the way Have I Been Pwned serves them. Looking a password up
+// only needs its range, so the list works offline from a download of some or all of the
+// ranges.
+type BreachList struct {
+	ranges map[string]map[string]bool
+}
+
+// LoadBreachList reads a file of leaked password hashes. Each line is either a whole
+// upper or lower case SHA-1 hash, or a range: a "PREFIX:" line followed by the lines of
+// the range response for that prefix, each the rest of a hash. Anything after a colon on
+// a hash line, such as the number of times it was seen, is ignored.
+func LoadBreachList(path string) (*BreachList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &BreachList{ranges: make(map[string]map[string]bool)}
+
+	var prefix string
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.ToUpper(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// A range starts
+		if len(line) == prefixLength+1 && strings.HasSuffix(line, ":") {
+			prefix = line[:prefixLength]
+			if !isHex(prefix) {
+				return nil, fmt.Errorf("%s:%d: bad range prefix %q", path, n, prefix)
+			}
+			continue
+		}
+
+		hash, _, _ := strings.Cut(line, ":")
+		switch {
+		case len(hash) == sha1.Size*2:
+		case len(hash) == sha1.Size*2-prefixLength && prefix != "":
+			hash = prefix + hash
+		default:
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash or the rest of one", path, n)
+		}
+		if !isHex(hash) {
+			return nil, fmt.Errorf("%s:%d: not a SHA-1 hash or the rest of one", path, n)
+		}
+
+		l.add(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// add adds an upper case SHA-1 hash to the list
+func (l *BreachList) add(hash string) {
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+	if l.ranges[prefix] == nil {
+		l.ranges[prefix] = make(map[string]bool)
+	}
+	l.ranges[prefix][suffix] = true
+}
+
+// Len returns how many hashes are in the list
+func (l *BreachList) Len() int {
+	n := 0
+	for _, r := range l.ranges {
+		n += len(r)
+	}
+	return n
+}
+
+// Contains reports whether password is in the list
+func (l *BreachList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	return l.ranges[hash[:prefixLength]][hash[prefixLength:]]
+}
+
+// isHex reports whether s only has upper case hex digits
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
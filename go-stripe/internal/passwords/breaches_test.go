@@ -0,0 +1,104 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"myapp/internal/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sha1Hex returns the upper case SHA-1 hash of a password
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// writeList writes a breach list to a file and returns its path
+func writeList(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breaches.txt")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadBreachList(t *testing.T) {
+	whole := sha1Hex("whole hash")
+	ranged := sha1Hex("ranged hash")
+	lower := sha1Hex("lower case hash")
+
+	// A whole hash, a range as Have I Been Pwned serves it, with counts, and a lower
+	// case hash after the range
+	path := writeList(t, strings.Join([]string{
+		"# leaked passwords",
+		whole,
+		"",
+		ranged[:5] + ":",
+		ranged[5:] + ":42",
+		strings.Repeat("0", 35) + ":1",
+		strings.ToLower(lower),
+	}, "\n"))
+
+	l, err := LoadBreachList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Len() != 4 {
+		t.Errorf("loaded %d hashes, want 4", l.Len())
+	}
+	for _, password := range []string{"whole hash", "ranged hash", "lower case hash"} {
+		if !l.Contains(password) {
+			t.Errorf("%q is not in the list", password)
+		}
+	}
+	if l.Contains("never leaked") {
+		t.Error("a password not in the list was found")
+	}
+}
+
+func TestLoadBreachListErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"bad prefix", "XYZ12:\n"},
+		{"suffix outside a range", strings.Repeat("A", 35) + "\n"},
+		{"short hash", "ABCDEF\n"},
+		{"not hex", strings.Repeat("G", 40) + "\n"},
+	}
+
+	for _, tt := range tests {
+		if _, err := LoadBreachList(writeList(t, tt.content)); err == nil {
+			t.Errorf("%s: loaded without an error", tt.name)
+		}
+	}
+
+	if _, err := LoadBreachList(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("missing file loaded without an error")
+	}
+}
+
+func TestCheckBreaches(t *testing.T) {
+	l, err := LoadBreachList(writeList(t, sha1Hex("leaked password")+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := DefaultPolicy
+	policy.Breaches = l
+	c := New(history{}, policy)
+
+	err = c.Check(models.User{}, "leaked password")
+	if err == nil || !strings.Contains(err.Error(), "data breach") {
+		t.Errorf("leaked password got %v", err)
+	}
+	if err := c.Check(models.User{}, "never leaked password"); err != nil {
+		t.Errorf("password not in the list refused: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Package passwords decides which passwords users may set, and hashes them. A password must
+// be long enough, not be on the list of banned passwords or, when one is loaded, of
+// breached passwords, and not be one of the last few the user has had.
+package passwords
+
+import (
+	"bufio"
+	"fmt"
+	"myapp/internal/models"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cost is the bcrypt cost passwords are hashed with
+const Cost = 12
+
+// maxLength is the most bytes of a password bcrypt uses
+const maxLength = 72
+
+// FieldErrors maps fields of a form to what is wrong with them, for pages to show next to
+// the fields
+type FieldErrors map[string][]string
+
+// Add records what is wrong with a field
+func (e FieldErrors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Error lists every problem, field by field
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var problems []string
+	for _, field := range fields {
+		for _, message := range e[field] {
+			problems = append(problems, field+" "+message)
+		}
+	}
+
+	return strings.Join(problems, "; ")
+}
+
+// Policy is the rules passwords must follow
+type Policy struct {
+	// MinLength is the fewest characters a password may have
+	MinLength int
+	// History is how many of their previous passwords users may not use again, as well as
+	// their current one
+	History int
+	// Banned holds passwords no one may use, in lower case
+	Banned map[string]bool
+	// Breaches, if set, holds passwords that have been leaked
+	Breaches *BreachList
+}
+
+// commonPasswords are banned whatever list is loaded
+var commonPasswords = []string{
+	"password", "password1", "password123", "passw0rd", "123456789", "1234567890",
+	"12345678", "qwertyuiop", "qwerty123", "iloveyou", "letmein123", "welcome123",
+	"administrator", "changeme", "trustno1", "football", "baseball", "sunshine",
+	"princess", "superman", "1q2w3e4r", "abc12345", "gowidgets", "widgets",
+}
+
+// DefaultPolicy is the policy used unless configured otherwise
+var DefaultPolicy = Policy{
+	MinLength: 10,
+	History:   5,
+	Banned:    BannedList(commonPasswords),
+}
+
+// BannedList returns a set of banned passwords for a Policy
+func BannedList(passwords []string) map[string]bool {
+	banned := make(map[string]bool, len(passwords))
+	for _, p := range passwords {
+		if p = strings.TrimSpace(p); p != "" {
+			banned[strings.ToLower(p)] = true
+		}
+	}
+	return banned
+}
+
+// LoadBannedList reads banned passwords from a file, one per line, on top of the common
+// passwords DefaultPolicy bans
+func LoadBannedList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	passwords := append([]string{}, commonPasswords...)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		passwords = append(passwords, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return BannedList(passwords), nil
+}
+
+// Checker checks passwords against a policy and the passwords users have had before
+type Checker struct {
+	store  models.PasswordHistoryRepository
+	policy Policy
+}
+
+// New returns a Checker for policy, looking up previous passwords in store
+func New(store models.PasswordHistoryRepository, policy Policy) *Checker {
+	return &Checker{
+		store:  store,
+		policy: policy,
+	}
+}
+
+// Keep returns how many password hashes of each user to keep in their history: their
+// current one, and the History before it
+func (c *Checker) Keep() int {
+	return c.policy.History + 1
+}
+
+// Check returns FieldErrors for the password field when user may not set password. Users
+// without an ID yet have no previous passwords.
+func (c *Checker) Check(user models.User, password string) error {
+	problems := make(FieldErrors)
+
+	if utf8.RuneCountInString(password) < c.policy.MinLength {
+		problems.Add("password", fmt.Sprintf("must be at least %d characters long", c.policy.MinLength))
+	}
+	if len(password) > maxLength {
+		problems.Add("password", fmt.Sprintf("must be at most %d bytes long", maxLength))
+	}
+
+	lower := strings.ToLower(password)
+	if c.policy.Banned[lower] || (user.Email != "" && lower == strings.ToLower(user.Email)) {
+		problems.Add("password", "is too easy to guess")
+	} else if c.policy.Breaches != nil && c.policy.Breaches.Contains(password) {
+		problems.Add("password", "has appeared in a data breach, so choose another one")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	if user.ID > 0 {
+		hashes, err := c.store.GetPasswordHistory(user.ID, c.Keep())
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+				continue
+			}
+			if c.policy.History > 0 {
+				problems.Add("password", fmt.Sprintf("must not be your current password or one of your last %d", c.policy.History))
+			} else {
+				problems.Add("password", "must not be your current password")
+			}
+			return problems
+		}
+	}
+
+	return nil
+}
+
+// Hash returns the bcrypt hash of password
+func (c *Checker) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,151 @@
+package passwords
+
+import (
+	"errors"
+	"myapp/internal/models"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// history is a password history in memory, newest first
+type history map[int][]string
+
+func (h history) GetPasswordHistory(userID, n int) ([]string, error) {
+	hashes := h[userID]
+	if len(hashes) > n {
+		hashes = hashes[:n]
+	}
+	return hashes, nil
+}
+
+func (h history) AddPasswordHistory(userID int, hash string, keep int) error {
+	h[userID] = append([]string{hash}, h[userID]...)
+	return nil
+}
+
+// brokenHistory is a password history that cannot be read
+type brokenHistory struct{ history }
+
+func (brokenHistory) GetPasswordHistory(userID, n int) ([]string, error) {
+	return nil, errors.New("history is down")
+}
+
+// hash hashes a password quickly, for filling histories
+func hash(t *testing.T, password string) string {
+	t.Helper()
+
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestCheck(t *testing.T) {
+	c := New(history{}, DefaultPolicy)
+	user := models.User{Email: "pat@example.com"}
+
+	tests := []struct {
+		password string
+		problem  string
+	}{
+		{"correct horse battery staple", ""},
+		{"ten chars!", ""},
+		{"nine char", "at least 10 characters"},
+		{"ünïcödé pw", ""},
+		{strings.Repeat("x", 73), "at most 72 bytes"},
+		{"Password123", "too easy to guess"},
+		{"ADMINISTRATOR", "too easy to guess"},
+		{"Pat@Example.com", "too easy to guess"},
+	}
+
+	for _, tt := range tests {
+		err := c.Check(user, tt.password)
+		if tt.problem == "" {
+			if err != nil {
+				t.Errorf("%q refused: %s", tt.password, err)
+			}
+			continue
+		}
+
+		var problems FieldErrors
+		if !errors.As(err, &problems) || len(problems["password"]) == 0 {
+			t.Errorf("%q got %v, want a problem with the password field", tt.password, err)
+			continue
+		}
+		if !strings.Contains(problems["password"][0], tt.problem) {
+			t.Errorf("%q got %q, want %q", tt.password, problems["password"][0], tt.problem)
+		}
+	}
+}
+
+func TestCheckBannedList(t *testing.T) {
+	policy := DefaultPolicy
+	policy.Banned = BannedList([]string{" Hunter2Hunter2 ", ""})
+	c := New(history{}, policy)
+
+	if err := c.Check(models.User{}, "hunter2hunter2"); err == nil {
+		t.Error("banned password was allowed")
+	}
+	if err := c.Check(models.User{}, "correct horse battery staple"); err != nil {
+		t.Errorf("password not on the list refused: %s", err)
+	}
+}
+
+func TestCheckHistory(t *testing.T) {
+	policy := DefaultPolicy
+	policy.History = 2
+
+	// The current password, then the two before it, then one old enough to use again
+	h := history{1: {
+		hash(t, "current password"),
+		hash(t, "previous password"),
+		hash(t, "earlier password"),
+		hash(t, "forgotten password"),
+	}}
+	c := New(h, policy)
+	user := models.User{ID: 1, Email: "pat@example.com"}
+
+	for _, password := range []string{"current password", "previous password", "earlier password"} {
+		err := c.Check(user, password)
+		if err == nil || !strings.Contains(err.Error(), "one of your last 2") {
+			t.Errorf("reusing %q got %v", password, err)
+		}
+	}
+
+	if err := c.Check(user, "forgotten password"); err != nil {
+		t.Errorf("password older than the history refused: %s", err)
+	}
+
+	// New users have no history to look up
+	if err := New(brokenHistory{}, policy).Check(models.User{}, "current password"); err != nil {
+		t.Errorf("new user's password refused: %s", err)
+	}
+
+	// Without a history to check against, the password is not allowed
+	err := New(brokenHistory{}, policy).Check(user, "brand new password")
+	var problems FieldErrors
+	if err == nil || errors.As(err, &problems) {
+		t.Errorf("unreadable history got %v, want its error", err)
+	}
+}
+
+func TestKeep(t *testing.T) {
+	if got := New(history{}, Policy{History: 5}).Keep(); got != 6 {
+		t.Errorf("keeping %d hashes, want the current one and 5 more", got)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	problems := make(FieldErrors)
+	problems.Add("password", "is too short")
+	problems.Add("email", "is taken")
+	problems.Add("password", "is too easy to guess")
+
+	want := "email is taken; password is too short; password is too easy to guess"
+	if got := problems.Error(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
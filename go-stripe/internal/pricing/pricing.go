@@ -0,0 +1,136 @@
+// Package pricing works out what a customer is charged for a widget. The api and web
+// servers both use it, so the amount is always computed from the widget price on the
+// server and never taken from the browser.
+package pricing
+
+import (
+	"errors"
+	"fmt"
+	"myapp/internal/cart"
+	"myapp/internal/models"
+	"strings"
+)
+
+// DefaultCurrency is the currency every widget is priced in
+const DefaultCurrency = "cad"
+
+// MaxQuantity is the largest number of one widget that can be bought at once
+const MaxQuantity = cart.MaxQuantity
+
+var (
+	// ErrInvalidQuantity is returned for a quantity below 1 or above MaxQuantity
+	ErrInvalidQuantity = fmt.Errorf("quantity must be between 1 and %d", MaxQuantity)
+	// ErrAmountMismatch is returned when an amount is not the price of the order
+	ErrAmountMismatch = errors.New("amount does not match the price of the order")
+	// ErrCurrencyMismatch is returned when a currency is not the currency of the order
+	ErrCurrencyMismatch = errors.New("currency does not match the currency of the order")
+	// ErrEmptyOrder is returned when pricing an order with no items
+	ErrEmptyOrder = errors.New("order has no items")
+	// ErrRecurring is returned when pricing a recurring widget with QuoteItems
+	ErrRecurring = errors.New("this widget is sold as a subscription")
+)
+
+// Service prices orders from the widgets table
+type Service struct {
+	widgets  models.WidgetRepository
+	currency string
+}
+
+// New returns a Service that reads prices from widgets
+func New(widgets models.WidgetRepository) *Service {
+	return &Service{
+		widgets:  widgets,
+		currency: DefaultCurrency,
+	}
+}
+
+// Quote is the price of quantity of a widget
+type Quote struct {
+	Widget   models.Widget
+	Quantity int
+	Amount   int
+	Currency string
+}
+
+// Quote returns the price of quantity of the widget with the given ID
+func (s *Service) Quote(widgetID, quantity int) (Quote, error) {
+	if quantity < 1 || quantity > MaxQuantity {
+		return Quote{}, ErrInvalidQuantity
+	}
+
+	widget, err := s.widgets.GetWidget(widgetID)
+	if err != nil {
+		return Quote{}, err
+	}
+
+	return Quote{
+		Widget:   widget,
+		Quantity: quantity,
+		Amount:   widget.Price * quantity,
+		Currency: s.currency,
+	}, nil
+}
+
+// Check returns an error unless amount and currency are exactly the quoted price. It is
+// used both for amounts sent by the browser and for payment intents read back from the
+// payment gateway before an order is recorded.
+func (q Quote) Check(amount int, currency string) error {
+	if amount != q.Amount {
+		return fmt.Errorf("%w: got %d, want %d", ErrAmountMismatch, amount, q.Amount)
+	}
+
+	if !strings.EqualFold(currency, q.Currency) {
+		return fmt.Errorf("%w: got %q, want %q", ErrCurrencyMismatch, currency, q.Currency)
+	}
+
+	return nil
+}
+
+// CartQuote is the price of an order of several widgets
+type CartQuote struct {
+	Lines    []Quote
+	Amount   int
+	Currency string
+}
+
+// QuoteItems returns the price of an order of items. Recurring widgets are sold on their
+// own as subscriptions, so they cannot be part of an order of items.
+func (s *Service) QuoteItems(items []cart.Item) (CartQuote, error) {
+	if len(items) == 0 {
+		return CartQuote{}, ErrEmptyOrder
+	}
+
+	cq := CartQuote{Currency: s.currency}
+	for _, item := range items {
+		q, err := s.Quote(item.WidgetID, item.Quantity)
+		if err != nil {
+			return CartQuote{}, err
+		}
+		if q.Widget.IsRecurring {
+			return CartQuote{}, fmt.Errorf("%w: %s", ErrRecurring, q.Widget.Name)
+		}
+
+		cq.Lines = append(cq.Lines, q)
+		cq.Amount += q.Amount
+	}
+
+	return cq, nil
+}
+
+// Check returns an error unless amount and currency are exactly the quoted price
+func (q CartQuote) Check(amount int, currency string) error {
+	return Quote{Amount: q.Amount, Currency: q.Currency}.Check(amount, currency)
+}
+
+// OrderItems returns the lines of the quote as order items, for CreateCheckout
+func (q CartQuote) OrderItems() []models.OrderItem {
+	items := make([]models.OrderItem, 0, len(q.Lines))
+	for _, line := range q.Lines {
+		items = append(items, models.OrderItem{
+			WidgetID:  line.Widget.ID,
+			Quantity:  line.Quantity,
+			UnitPrice: line.Widget.Price,
+		})
+	}
+	return items
+}
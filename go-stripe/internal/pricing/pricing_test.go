@@ -0,0 +1,136 @@
+package pricing
+
+import (
+	"database/sql"
+	"errors"
+	"myapp/internal/cart"
+	"myapp/internal/models"
+	"testing"
+)
+
+// catalogue is a widgets table in memory
+type catalogue map[int]models.Widget
+
+func (c catalogue) GetWidget(id int) (models.Widget, error) {
+	w, ok := c[id]
+	if !ok {
+		return models.Widget{}, sql.ErrNoRows
+	}
+	return w, nil
+}
+
+func (c catalogue) GetWidgetByPlanID(planID string) (models.Widget, error) {
+	for _, w := range c {
+		if w.PlanID == planID {
+			return w, nil
+		}
+	}
+	return models.Widget{}, sql.ErrNoRows
+}
+
+func (c catalogue) GetWidgetBySlug(slug string) (models.Widget, error) {
+	for _, w := range c {
+		if w.Slug == slug {
+			return w, nil
+		}
+	}
+	return models.Widget{}, sql.ErrNoRows
+}
+
+func (c catalogue) GetRecurringWidgets() ([]models.Widget, error) {
+	var widgets []models.Widget
+	for _, w := range c {
+		if w.IsRecurring {
+			widgets = append(widgets, w)
+		}
+	}
+	return widgets, nil
+}
+
+var widgets = catalogue{
+	1: {ID: 1, Name: "Widget", Price: 1000},
+	2: {ID: 2, Name: "Gadget", Price: 2500},
+	3: {ID: 3, Name: "Plan", Price: 2000, IsRecurring: true, PlanID: "price_1"},
+}
+
+func TestQuote(t *testing.T) {
+	s := New(widgets)
+
+	q, err := s.Quote(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Amount != 7500 || q.Currency != DefaultCurrency || q.Widget.Name != "Gadget" {
+		t.Errorf("got %d %s for %s, want 7500 %s for Gadget", q.Amount, q.Currency, q.Widget.Name, DefaultCurrency)
+	}
+
+	for _, quantity := range []int{0, -1, MaxQuantity + 1} {
+		if _, err := s.Quote(1, quantity); !errors.Is(err, ErrInvalidQuantity) {
+			t.Errorf("quantity %d got %v, want ErrInvalidQuantity", quantity, err)
+		}
+	}
+
+	if _, err := s.Quote(99, 1); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("unknown widget got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestQuoteItems(t *testing.T) {
+	s := New(widgets)
+
+	q, err := s.QuoteItems([]cart.Item{{WidgetID: 1, Quantity: 2}, {WidgetID: 2, Quantity: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Amount != 4500 || q.Currency != DefaultCurrency || len(q.Lines) != 2 {
+		t.Errorf("got %d %s in %d lines, want 4500 %s in 2", q.Amount, q.Currency, len(q.Lines), DefaultCurrency)
+	}
+
+	items := q.OrderItems()
+	if len(items) != 2 || items[0] != (models.OrderItem{WidgetID: 1, Quantity: 2, UnitPrice: 1000}) {
+		t.Errorf("got order items %+v", items)
+	}
+
+	tests := []struct {
+		name  string
+		items []cart.Item
+		err   error
+	}{
+		{"no items", nil, ErrEmptyOrder},
+		{"unknown widget", []cart.Item{{WidgetID: 1, Quantity: 1}, {WidgetID: 99, Quantity: 1}}, sql.ErrNoRows},
+		{"recurring widget", []cart.Item{{WidgetID: 1, Quantity: 1}, {WidgetID: 3, Quantity: 1}}, ErrRecurring},
+		{"bad quantity", []cart.Item{{WidgetID: 1, Quantity: 0}}, ErrInvalidQuantity},
+	}
+
+	for _, tt := range tests {
+		if _, err := s.QuoteItems(tt.items); !errors.Is(err, tt.err) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	q, err := New(widgets).QuoteItems([]cart.Item{{WidgetID: 1, Quantity: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		amount   int
+		currency string
+		err      error
+	}{
+		{2000, "cad", nil},
+		{2000, "CAD", nil},
+		{1999, "cad", ErrAmountMismatch},
+		{2001, "cad", ErrAmountMismatch},
+		{2000, "usd", ErrCurrencyMismatch},
+		{2000, "", ErrCurrencyMismatch},
+	}
+
+	for _, tt := range tests {
+		if err := q.Check(tt.amount, tt.currency); !errors.Is(err, tt.err) {
+			t.Errorf("%d %q got %v, want %v", tt.amount, tt.currency, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"myapp/internal/models"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps token buckets in memory. They are lost on restart and not shared
+// between servers, so it is only meant for development and a single server.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*models.RateLimitBucket
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*models.RateLimitBucket)}
+}
+
+var _ models.RateLimitRepository = (*MemoryStore)(nil)
+
+// TakeRateLimitToken takes a token from the bucket of key, which holds up to capacity
+// tokens and gains one every interval
+func (s *MemoryStore) TakeRateLimitToken(key string, capacity int, interval time.Duration) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &models.RateLimitBucket{Key: key}
+		s.buckets[key] = b
+	}
+
+	allowed, retryAfter := b.Take(capacity, interval, time.Now())
+	return allowed, retryAfter, nil
+}
+
+// DeleteIdleRateLimitBuckets forgets the buckets not used since before
+func (s *MemoryStore) DeleteIdleRateLimitBuckets(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for key, b := range s.buckets {
+		if b.RefilledAt.Before(before) {
+			delete(s.buckets, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,169 @@
+// Package ratelimit throttles requests to chi routes with token buckets. Each route gets
+// policies saying how many requests a client may burst and how quickly it earns more, and
+// who the client is: an IP address, an email address or a token. The api and web servers
+// share buckets when they both use the database store.
+package ratelimit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"myapp/internal/clientip"
+	"myapp/internal/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyFunc returns who a request counts against. Requests it returns "" for are not
+// limited by the policy.
+type KeyFunc func(r *http.Request) string
+
+// Policy is how many requests a client may make to a route
+type Policy struct {
+	// Name tells the buckets of policies apart; routes sharing a name share their buckets
+	Name string
+	// Burst is how many requests a client may make at once
+	Burst int
+	// Every is how long it takes a client to earn another request
+	Every time.Duration
+	// Key returns the client of a request
+	Key KeyFunc
+}
+
+// Limiter takes tokens from the buckets of a store
+type Limiter struct {
+	store    models.RateLimitRepository
+	errorLog *log.Logger
+	// Denied writes the response to a request over its limit. It defaults to a JSON error.
+	Denied func(w http.ResponseWriter, r *http.Request, retryAfter time.Duration)
+}
+
+// New returns a Limiter keeping buckets in store. Requests are let through when the store
+// fails, and the error is logged to errorLog, so an outage of the store is not an outage of
+// the site.
+func New(store models.RateLimitRepository, errorLog *log.Logger) *Limiter {
+	return &Limiter{
+		store:    store,
+		errorLog: errorLog,
+		Denied:   DeniedJSON,
+	}
+}
+
+// Limit returns middleware that lets requests through while they are within every policy,
+// and otherwise sends 429 Too Many Requests with a Retry-After header
+func (l *Limiter) Limit(policies ...Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, p := range policies {
+				client := p.Key(r)
+				if client == "" {
+					continue
+				}
+
+				allowed, retryAfter, err := l.store.TakeRateLimitToken(bucketKey(p.Name, client), p.Burst, p.Every)
+				if err != nil {
+					l.errorLog.Println("rate limiting:", err)
+					continue
+				}
+				if !allowed {
+					w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+					l.Denied(w, r, retryAfter)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bucketKey returns the key of the bucket of a client under a policy. Clients are hashed,
+// so email addresses and tokens are not stored.
+func bucketKey(policy, client string) string {
+	hash := sha256.Sum256([]byte(client))
+	return policy + ":" + hex.EncodeToString(hash[:16])
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, as Retry-After is written in
+func retryAfterSeconds(d time.Duration) int {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// DeniedJSON sends the JSON error of the api
+func DeniedJSON(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "Too many requests. Please try again in " + strconv.Itoa(retryAfterSeconds(retryAfter)) + " seconds."
+
+	out, _ := json.MarshalIndent(payload, "", "\t")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(out)
+}
+
+// DeniedText sends a plain text error, for pages
+func DeniedText(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	http.Error(w, "Too many requests. Please try again later.", http.StatusTooManyRequests)
+}
+
+// ByIP keys requests by the IP address they came from
+func ByIP(r *http.Request) string {
+	return clientip.FromRequest(r)
+}
+
+// maxBodyBytes is the most of a body ByEmail reads, as readJSON allows
+const maxBodyBytes = 1048576
+
+// ByEmail keys requests by the email field of their JSON body or form. The body is put
+// back for the handler to read.
+func ByEmail(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		return models.NormalizeEmail(r.FormValue("email"))
+	}
+
+	if r.Body == nil {
+		return ""
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var payload struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return ""
+	}
+
+	return models.NormalizeEmail(payload.Email)
+}
+
+// ByToken keys requests by the bearer token in their Authorization header
+func ByToken(r *http.Request) string {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return ""
+	}
+	return headerParts[1]
+}
@@ -0,0 +1,158 @@
+package ratelimit
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStore is a store that cannot be reached
+type failingStore struct{}
+
+func (failingStore) TakeRateLimitToken(key string, capacity int, interval time.Duration) (bool, time.Duration, error) {
+	return false, 0, errors.New("store is down")
+}
+
+func (failingStore) DeleteIdleRateLimitBuckets(before time.Time) (int64, error) {
+	return 0, errors.New("store is down")
+}
+
+// ok is the handler behind the limits
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+// send sends a POST request from addr through handler
+func send(handler http.Handler, addr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = addr
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestLimitBurstAndRefill(t *testing.T) {
+	l := New(NewMemoryStore(), log.New(io.Discard, "", 0))
+	handler := l.Limit(Policy{Name: "test", Burst: 2, Every: 50 * time.Millisecond, Key: ByIP})(ok)
+
+	for i := 0; i < 2; i++ {
+		if w := send(handler, "192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d of the burst got %d", i+1, w.Code)
+		}
+	}
+
+	w := send(handler, "192.0.2.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request after the burst got %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	// Waits shorter than a second are rounded up, as Retry-After is in whole seconds
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("got Retry-After %q, want 1", got)
+	}
+
+	// Other clients have buckets of their own
+	if w := send(handler, "198.51.100.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("request from another client got %d", w.Code)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if w := send(handler, "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("request after a refill got %d", w.Code)
+	}
+	if w := send(handler, "192.0.2.1:1234"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("second request after refilling one token got %d", w.Code)
+	}
+}
+
+func TestLimitRetryAfter(t *testing.T) {
+	l := New(NewMemoryStore(), log.New(io.Discard, "", 0))
+	handler := l.Limit(Policy{Name: "test", Burst: 1, Every: 90 * time.Second, Key: ByIP})(ok)
+
+	send(handler, "192.0.2.1:1234")
+	w := send(handler, "192.0.2.1:1234")
+
+	seconds, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || seconds < 89 || seconds > 90 {
+		t.Errorf("got Retry-After %q, want 90", w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), `"error": true`) {
+		t.Errorf("got body %s, want a JSON error", w.Body)
+	}
+}
+
+func TestLimitSkipsEmptyKeys(t *testing.T) {
+	l := New(NewMemoryStore(), log.New(io.Discard, "", 0))
+	none := func(r *http.Request) string { return "" }
+	handler := l.Limit(Policy{Name: "test", Burst: 0, Every: time.Hour, Key: none})(ok)
+
+	if w := send(handler, "192.0.2.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("request without a key got %d", w.Code)
+	}
+}
+
+func TestLimitStoreError(t *testing.T) {
+	var logged strings.Builder
+	l := New(failingStore{}, log.New(&logged, "", 0))
+	handler := l.Limit(Policy{Name: "test", Burst: 1, Every: time.Hour, Key: ByIP})(ok)
+
+	// The site stays up while the store is down
+	for i := 0; i < 3; i++ {
+		if w := send(handler, "192.0.2.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("request %d got %d while the store was down", i+1, w.Code)
+		}
+	}
+	if !strings.Contains(logged.String(), "store is down") {
+		t.Errorf("store error was not logged, got %q", logged.String())
+	}
+}
+
+func TestByEmail(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"json", "application/json", `{"email": " Pat@Example.com ", "password": "secret"}`, "pat@example.com"},
+		{"form", "application/x-www-form-urlencoded", url.Values{"email": {"Pat@Example.com"}, "password": {"secret"}}.Encode(), "pat@example.com"},
+		{"json without email", "application/json", `{"password": "secret"}`, ""},
+		{"not json", "application/json", `email=pat@example.com`, ""},
+	}
+
+	for _, tt := range tests {
+		l := New(NewMemoryStore(), log.New(io.Discard, "", 0))
+
+		var key, body string
+		handler := l.Limit(Policy{Name: "test", Burst: 1, Every: time.Hour, Key: func(r *http.Request) string {
+			key = ByEmail(r)
+			return key
+		}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType == "application/json" {
+				b, _ := io.ReadAll(r.Body)
+				body = string(b)
+			} else {
+				body = r.PostForm.Encode()
+			}
+		}))
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", tt.contentType)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if key != tt.want {
+			t.Errorf("%s: got key %q, want %q", tt.name, key, tt.want)
+		}
+
+		// The handler still gets the whole body
+		if body != tt.body {
+			t.Errorf("%s: handler read %q, want %q", tt.name, body, tt.body)
+		}
+	}
+}
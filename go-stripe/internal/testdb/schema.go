@@ -0,0 +1,166 @@
+package testdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	createTableRe = regexp.MustCompile("(?is)CREATE TABLE `?(\\w+)`? \\((.*?)\\n\\)[^;]*;")
+	columnTypeRe  = regexp.MustCompile(`(?i)^(\w+)\s+(\w+)(\([^)]*\))?(\s+unsigned)?(.*)$`)
+	keyRe         = regexp.MustCompile(`(?i)^(UNIQUE\s+)?KEY\s+(\w+)\s+\((.+)\)$`)
+	primaryKeyRe  = regexp.MustCompile(`(?i)^PRIMARY KEY\s+\((.+)\)$`)
+	currentTimeRe = regexp.MustCompile(`(?i)current_timestamp(\(\d*\))?`)
+	onUpdateRe    = regexp.MustCompile(`(?i)\s+ON UPDATE CURRENT_TIMESTAMP`)
+	charsetRe     = regexp.MustCompile(`(?i)\s+(CHARACTER SET|COLLATE)\s+\w+`)
+	autoIncRe     = regexp.MustCompile(`(?i)\s*AUTO_INCREMENT`)
+)
+
+// TranslateSchema turns the CREATE TABLE statements of a MySQL dump (such as
+// migrations/schema.sql) into SQLite DDL. Indexes become CREATE INDEX statements
+// and an auto increment primary key becomes INTEGER PRIMARY KEY AUTOINCREMENT.
+// Everything else in the dump is ignored.
+func TranslateSchema(dump string) (string, error) {
+	var out strings.Builder
+
+	tables := createTableRe.FindAllStringSubmatch(dump, -1)
+	if len(tables) == 0 {
+		return "", fmt.Errorf("no CREATE TABLE statements found")
+	}
+
+	for _, table := range tables {
+		name := table[1]
+		body := strings.ReplaceAll(table[2], "`", "")
+
+		var columns, indexes []string
+		var primaryKey []string
+		autoIncrement := ""
+
+		for _, line := range strings.Split(body, "\n") {
+			line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+			if line == "" {
+				continue
+			}
+
+			if m := primaryKeyRe.FindStringSubmatch(line); m != nil {
+				primaryKey = splitColumns(m[1])
+				continue
+			}
+
+			if m := keyRe.FindStringSubmatch(line); m != nil {
+				unique := ""
+				if m[1] != "" {
+					unique = "UNIQUE "
+				}
+				indexes = append(indexes, fmt.Sprintf("CREATE %sINDEX %s ON %s (%s);", unique, m[2], name, m[3]))
+				continue
+			}
+
+			if strings.HasPrefix(strings.ToUpper(line), "CONSTRAINT") {
+				columns = append(columns, line)
+				continue
+			}
+
+			column, autoInc, err := translateColumn(line)
+			if err != nil {
+				return "", fmt.Errorf("table %s: %w", name, err)
+			}
+			if autoInc != "" {
+				autoIncrement = autoInc
+			}
+			columns = append(columns, column)
+		}
+
+		// SQLite only auto increments a column declared INTEGER PRIMARY KEY
+		if autoIncrement != "" {
+			if len(primaryKey) != 1 || primaryKey[0] != autoIncrement {
+				return "", fmt.Errorf("table %s: auto increment column %s is not the primary key", name, autoIncrement)
+			}
+			for i, column := range columns {
+				if strings.HasPrefix(column, autoIncrement+" ") {
+					columns[i] = autoIncrement + " INTEGER PRIMARY KEY AUTOINCREMENT"
+				}
+			}
+		} else if len(primaryKey) > 0 {
+			columns = append(columns, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(primaryKey, ", ")))
+		}
+
+		// Constraints must come after every column
+		sortConstraintsLast(columns)
+
+		fmt.Fprintf(&out, "CREATE TABLE %s (\n  %s\n);\n", name, strings.Join(columns, ",\n  "))
+		for _, index := range indexes {
+			out.WriteString(index + "\n")
+		}
+		out.WriteString("\n")
+	}
+
+	return out.String(), nil
+}
+
+// translateColumn translates a single MySQL column definition. If the column
+// auto increments, its name is returned as well.
+func translateColumn(line string) (string, string, error) {
+	m := columnTypeRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", fmt.Errorf("cannot translate column %q", line)
+	}
+
+	name, mysqlType, rest := m[1], strings.ToLower(m[2]), m[5]
+
+	var sqliteType string
+	switch mysqlType {
+	case "int", "integer", "tinyint", "smallint", "mediumint", "bigint":
+		sqliteType = "INTEGER"
+	case "decimal", "numeric", "float", "double":
+		sqliteType = "REAL"
+	case "char", "varchar", "text", "tinytext", "mediumtext", "longtext", "enum":
+		sqliteType = "TEXT"
+	case "binary", "varbinary", "blob", "tinyblob", "mediumblob", "longblob":
+		sqliteType = "BLOB"
+	case "datetime":
+		sqliteType = "DATETIME"
+	case "timestamp":
+		sqliteType = "TIMESTAMP"
+	case "date":
+		sqliteType = "DATE"
+	default:
+		return "", "", fmt.Errorf("unknown type %s for column %s", mysqlType, name)
+	}
+
+	autoIncrement := ""
+	if autoIncRe.MatchString(rest) {
+		autoIncrement = name
+		rest = autoIncRe.ReplaceAllString(rest, "")
+	}
+
+	rest = currentTimeRe.ReplaceAllString(rest, "CURRENT_TIMESTAMP")
+	rest = onUpdateRe.ReplaceAllString(rest, "")
+	rest = charsetRe.ReplaceAllString(rest, "")
+
+	return strings.TrimSpace(name + " " + sqliteType + rest), autoIncrement, nil
+}
+
+// splitColumns splits a comma separated column list
+func splitColumns(list string) []string {
+	var columns []string
+	for _, column := range strings.Split(list, ",") {
+		columns = append(columns, strings.TrimSpace(column))
+	}
+	return columns
+}
+
+// sortConstraintsLast moves table constraints after the column definitions, keeping their order
+func sortConstraintsLast(columns []string) {
+	var defs, constraints []string
+	for _, column := range columns {
+		upper := strings.ToUpper(column)
+		if strings.HasPrefix(upper, "CONSTRAINT") || strings.HasPrefix(upper, "PRIMARY KEY") {
+			constraints = append(constraints, column)
+		} else {
+			defs = append(defs, column)
+		}
+	}
+	copy(columns, append(defs, constraints...))
+}
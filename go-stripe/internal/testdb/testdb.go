@@ -0,0 +1,51 @@
+// Package testdb creates SQLite databases with the application schema, so the
+// models can be exercised in tests without a MySQL server.
+package testdb
+
+import (
+	"database/sql"
+	"fmt"
+	"myapp/internal/models"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SchemaPath returns the path to migrations/schema.sql in this repository
+func SchemaPath() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "migrations", "schema.sql")
+}
+
+// Open creates a SQLite database in the file at path, with the tables from
+// migrations/schema.sql. Tests usually pass a file in t.TempDir().
+func Open(path string) (*sql.DB, error) {
+	dump, err := os.ReadFile(SchemaPath())
+	if err != nil {
+		return nil, err
+	}
+
+	schema, err := TranslateSchema(string(dump))
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewModel returns a DBModel for a database created by Open
+func NewModel(db *sql.DB) models.DBModel {
+	return models.DBModel{DB: db, Dialect: models.SQLite}
+}
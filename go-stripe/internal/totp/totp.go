@@ -0,0 +1,176 @@
+// Package totp generates and checks the time-based one-time passwords of RFC 6238, as
+// shown by authenticator apps. It knows nothing about users or storage: callers keep the
+// secret and the last time step accepted for each user, so a code is never accepted twice.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Algorithm is the HMAC hash function codes are computed with
+type Algorithm string
+
+// Algorithms of RFC 6238. Most authenticator apps only support SHA1.
+const (
+	SHA1   Algorithm = "SHA1"
+	SHA256 Algorithm = "SHA256"
+	SHA512 Algorithm = "SHA512"
+)
+
+// ErrInvalidSecret is returned for a secret that is not base32
+var ErrInvalidSecret = errors.New("totp secret is not valid base32")
+
+// Options are how codes are computed. They must match what the authenticator app was
+// given in the provisioning URI.
+type Options struct {
+	Algorithm Algorithm
+	Digits    int
+	Period    time.Duration
+	// Skew is how many periods either side of the current one are still accepted, to allow
+	// for clock drift and slow typing
+	Skew int
+}
+
+// DefaultOptions are the options every authenticator app understands
+var DefaultOptions = Options{
+	Algorithm: SHA1,
+	Digits:    6,
+	Period:    30 * time.Second,
+	Skew:      1,
+}
+
+// secretSize is the length in bytes of generated secrets, as recommended by RFC 4226
+const secretSize = 20
+
+// encoding is the base32 encoding of secrets, without padding as authenticator apps expect
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// decodeSecret decodes a base32 secret, ignoring case, spaces and padding as people type
+// them
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	secret = strings.TrimRight(secret, "=")
+
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// Step returns the time step t falls in
+func (o Options) Step(t time.Time) int64 {
+	return t.Unix() / int64(o.Period/time.Second)
+}
+
+// Code returns the code for the time step t falls in
+func (o Options) Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return o.code(key, o.Step(t))
+}
+
+// code returns the HOTP value of RFC 4226 for counter, with the options' hash and digits
+func (o Options) code(key []byte, counter int64) (string, error) {
+	var h func() hash.Hash
+	switch o.Algorithm {
+	case SHA1, "":
+		h = sha1.New
+	case SHA256:
+		h = sha256.New
+	case SHA512:
+		h = sha512.New
+	default:
+		return "", fmt.Errorf("unknown totp algorithm %q", o.Algorithm)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(h, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation: the low nibble of the last byte picks four bytes of the sum
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < o.Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", o.Digits, value%mod), nil
+}
+
+// Validate checks code against the time steps around t and returns the step it matched.
+// Callers should only accept a code whose step is later than the last one accepted for the
+// secret, so that a code seen over someone's shoulder cannot be used again.
+func (o Options) Validate(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != o.Digits {
+		return 0, false
+	}
+
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	step := o.Step(t)
+	for i := -o.Skew; i <= o.Skew; i++ {
+		expected, err := o.code(key, step+int64(i))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step + int64(i), true
+		}
+	}
+
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth:// URI authenticator apps read from a QR code. The
+// issuer is shown as the name of the account, with the account (usually an email address).
+func (o Options) ProvisioningURI(issuer, account, secret string) string {
+	algorithm := o.Algorithm
+	if algorithm == "" {
+		algorithm = SHA1
+	}
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", string(algorithm))
+	v.Set("digits", fmt.Sprint(o.Digits))
+	v.Set("period", fmt.Sprint(int64(o.Period/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
@@ -0,0 +1,130 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// rfcSecret returns the base32 encoding of one of the ASCII seeds of RFC 6238
+func rfcSecret(seed string) string {
+	return base32.StdEncoding.EncodeToString([]byte(seed))
+}
+
+// The test vectors of RFC 6238, appendix B
+func TestCodeRFC6238(t *testing.T) {
+	secrets := map[Algorithm]string{
+		SHA1:   rfcSecret("12345678901234567890"),
+		SHA256: rfcSecret("12345678901234567890123456789012"),
+		SHA512: rfcSecret("1234567890123456789012345678901234567890123456789012345678901234"),
+	}
+
+	tests := []struct {
+		unix      int64
+		algorithm Algorithm
+		code      string
+	}{
+		{59, SHA1, "94287082"},
+		{59, SHA256, "46119246"},
+		{59, SHA512, "90693936"},
+		{1111111109, SHA1, "07081804"},
+		{1111111109, SHA256, "68084774"},
+		{1111111109, SHA512, "25091201"},
+		{1111111111, SHA1, "14050471"},
+		{1111111111, SHA256, "67062674"},
+		{1111111111, SHA512, "99943326"},
+		{1234567890, SHA1, "89005924"},
+		{1234567890, SHA256, "91819424"},
+		{1234567890, SHA512, "93441116"},
+		{2000000000, SHA1, "69279037"},
+		{2000000000, SHA256, "90698825"},
+		{2000000000, SHA512, "38618901"},
+	}
+
+	for _, tt := range tests {
+		o := Options{Algorithm: tt.algorithm, Digits: 8, Period: 30 * time.Second}
+
+		code, err := o.Code(secrets[tt.algorithm], time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatalf("%s at %d: %s", tt.algorithm, tt.unix, err)
+		}
+		if code != tt.code {
+			t.Errorf("%s at %d: got %s, want %s", tt.algorithm, tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	secret := rfcSecret("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+
+	o := DefaultOptions
+	step := o.Step(now)
+
+	tests := []struct {
+		offset int64
+		skew   int
+		ok     bool
+	}{
+		{0, 0, true},
+		{-1, 0, false},
+		{1, 0, false},
+		{-1, 1, true},
+		{1, 1, true},
+		{-2, 1, false},
+		{2, 1, false},
+		{-2, 2, true},
+		{2, 2, true},
+	}
+
+	for _, tt := range tests {
+		code, err := o.code(mustDecode(t, secret), step+tt.offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o.Skew = tt.skew
+		matched, ok := o.Validate(secret, code, now)
+		if ok != tt.ok {
+			t.Errorf("code %d steps away with skew %d: got %v, want %v", tt.offset, tt.skew, ok, tt.ok)
+			continue
+		}
+		if ok && matched != step+tt.offset {
+			t.Errorf("code %d steps away with skew %d: matched step %d, want %d", tt.offset, tt.skew, matched, step+tt.offset)
+		}
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	code, err := DefaultOptions.Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := DefaultOptions.Validate(secret, code[:3]+" "+code[3:], now); !ok {
+		t.Error("code with a space was not accepted")
+	}
+	if _, ok := DefaultOptions.Validate(secret, code[:5], now); ok {
+		t.Error("code with too few digits was accepted")
+	}
+	if _, ok := DefaultOptions.Validate("not base32!", code, now); ok {
+		t.Error("code for an invalid secret was accepted")
+	}
+}
+
+// mustDecode decodes a base32 secret
+func mustDecode(t *testing.T, secret string) []byte {
+	t.Helper()
+
+	key, err := decodeSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
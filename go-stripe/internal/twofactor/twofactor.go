@@ -0,0 +1,241 @@
+// Package twofactor enrolls admin users in two-factor authentication and checks the codes
+// they log in with. The api and web servers both use it. TOTP secrets are stored
+// encrypted with the application's secret key, and recovery codes only as hashes.
+package twofactor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"myapp/internal/encryption"
+	"myapp/internal/models"
+	"myapp/internal/totp"
+	"strings"
+	"time"
+)
+
+// DefaultIssuer is the name authenticator apps show for the account
+const DefaultIssuer = "Widgets"
+
+// RecoveryCodeCount is how many recovery codes a user is given at a time
+const RecoveryCodeCount = 10
+
+var (
+	// ErrAlreadyEnabled is returned when enrolling a user who already has two-factor
+	// authentication
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrNotEnabled is returned when checking a code for a user without two-factor
+	// authentication
+	ErrNotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrInvalidCode is returned for a wrong, expired or already used code
+	ErrInvalidCode = errors.New("invalid two-factor authentication code")
+)
+
+// Service enrolls users and checks their codes
+type Service struct {
+	store     models.TwoFactorRepository
+	encryptor encryption.Encryption
+	options   totp.Options
+	issuer    string
+}
+
+// New returns a Service that keeps secrets in store, encrypted with key
+func New(store models.TwoFactorRepository, key []byte) *Service {
+	return &Service{
+		store:     store,
+		encryptor: encryption.Encryption{Key: key},
+		options:   totp.DefaultOptions,
+		issuer:    DefaultIssuer,
+	}
+}
+
+// Enrollment is what a user adds to their authenticator app, either by scanning URI as a
+// QR code or by typing Secret
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// Enroll gives a user a new TOTP secret. Two-factor authentication is not required of
+// them until they confirm it with Confirm.
+func (s *Service) Enroll(user models.User) (Enrollment, error) {
+	state, err := s.store.GetTwoFactor(user.ID)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if state.Enabled() {
+		return Enrollment{}, ErrAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	encrypted, err := s.encryptor.Encrypt(secret)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	err = s.store.SetTOTPSecret(user.ID, encrypted)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	return Enrollment{
+		Secret: secret,
+		URI:    s.options.ProvisioningURI(s.issuer, user.Email, secret),
+	}, nil
+}
+
+// Confirm turns on two-factor authentication for a user once they give a code from their
+// authenticator app, and returns their recovery codes. They are only ever shown now.
+func (s *Service) Confirm(ctx context.Context, userID int, code string) ([]string, error) {
+	state, err := s.store.GetTwoFactor(userID)
+	if err != nil {
+		return nil, err
+	}
+	if state.Enabled() {
+		return nil, ErrAlreadyEnabled
+	}
+	if state.Secret == "" {
+		return nil, models.ErrTwoFactorNotEnrolled
+	}
+
+	step, ok, err := s.validate(state, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.EnableTwoFactor(ctx, userID, step, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Verify checks a code a user logs in with: a code from their authenticator app, or one
+// of their recovery codes. Each code is only accepted once.
+func (s *Service) Verify(userID int, code string) (bool, error) {
+	state, err := s.store.GetTwoFactor(userID)
+	if err != nil {
+		return false, err
+	}
+	if !state.Enabled() {
+		return false, ErrNotEnabled
+	}
+
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	step, ok, err := s.validate(state, code)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		// A code that was already used, or is older than one that was, is refused
+		return s.store.UseTOTPStep(userID, step)
+	}
+
+	return s.store.UseRecoveryCode(userID, hashRecoveryCode(code))
+}
+
+// Disable turns off two-factor authentication for a user, who must give a code to show
+// it is them
+func (s *Service) Disable(ctx context.Context, userID int, code string) error {
+	ok, err := s.Verify(userID, code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidCode
+	}
+
+	return s.store.DisableTwoFactor(ctx, userID)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user, who must give a code to
+// show it is them, and returns the new ones
+func (s *Service) RegenerateRecoveryCodes(ctx context.Context, userID int, code string) ([]string, error) {
+	ok, err := s.Verify(userID, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.store.ReplaceRecoveryCodes(ctx, userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// validate checks a TOTP code against the secret of a user and returns its time step
+func (s *Service) validate(state models.TwoFactor, code string) (int64, bool, error) {
+	secret, err := s.encryptor.Decrypt(state.Secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	step, ok := s.options.Validate(secret, code, time.Now())
+	if !ok || step <= state.LastStep {
+		return 0, false, nil
+	}
+
+	return step, true, nil
+}
+
+// recoveryCodeEncoding writes recovery codes in letters and digits that are easy to copy
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijkmnpqrstuvwxyz23456789").WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns RecoveryCodeCount new recovery codes, like
+// "abcde-fghij", and their hashes
+func generateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([][]byte, 0, RecoveryCodeCount)
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := recoveryCodeEncoding.EncodeToString(randomBytes)[:10]
+		code = code[:5] + "-" + code[5:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as. The dash and case do not
+// matter, since people retype the codes from paper.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -0,0 +1,173 @@
+package twofactor
+
+import (
+	"context"
+	"errors"
+	"myapp/internal/models"
+	"myapp/internal/testdb"
+	"myapp/internal/totp"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestService returns a Service on a new SQLite database with one user, and the user
+func newTestService(t *testing.T) (*Service, models.User) {
+	t.Helper()
+
+	db, err := testdb.Open(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	result, err := db.Exec(`INSERT INTO users (first_name, last_name, email, password) VALUES ('Pat', 'Admin', 'pat@example.com', 'x')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := result.LastInsertId()
+
+	m := testdb.NewModel(db)
+	return New(&m, []byte("x6Z2c9H5F1B8g7L9A3p7D1W8k2E6h3R9")), models.User{ID: int(id), Email: "pat@example.com"}
+}
+
+// code returns the code an authenticator app shows for a secret at t
+func code(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+
+	c, err := totp.DefaultOptions.Code(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// enable enrolls a user and confirms it with the code of the previous time step, so that
+// the current step is still free to log in with. It returns the secret and recovery codes.
+func enable(t *testing.T, s *Service, user models.User) (string, []string) {
+	t.Helper()
+
+	enrollment, err := s.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Errorf("provisioning URI %q does not have the secret", enrollment.URI)
+	}
+
+	previous := time.Now().Add(-totp.DefaultOptions.Period)
+	codes, err := s.Confirm(context.Background(), user.ID, code(t, enrollment.Secret, previous))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return enrollment.Secret, codes
+}
+
+func TestConfirm(t *testing.T) {
+	s, user := newTestService(t)
+
+	// Nothing to confirm before enrolling
+	if _, err := s.Confirm(context.Background(), user.ID, "123456"); !errors.Is(err, models.ErrTwoFactorNotEnrolled) {
+		t.Errorf("confirming before enrolling got %v", err)
+	}
+
+	enrollment, err := s.Enroll(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Confirm(context.Background(), user.ID, "000000"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("confirming with a wrong code got %v", err)
+	}
+
+	codes, err := s.Confirm(context.Background(), user.ID, code(t, enrollment.Secret, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Errorf("got %d recovery codes, want %d", len(codes), RecoveryCodeCount)
+	}
+
+	if _, err := s.Enroll(user); !errors.Is(err, ErrAlreadyEnabled) {
+		t.Errorf("enrolling again got %v", err)
+	}
+}
+
+func TestVerifyStepReplay(t *testing.T) {
+	s, user := newTestService(t)
+	secret, _ := enable(t, s, user)
+
+	now := code(t, secret, time.Now())
+	if ok, err := s.Verify(user.ID, now); err != nil || !ok {
+		t.Fatalf("current code got %v, %v", ok, err)
+	}
+
+	// The same code cannot be used twice, nor can one from before it
+	if ok, err := s.Verify(user.ID, now); err != nil || ok {
+		t.Errorf("replayed code got %v, %v", ok, err)
+	}
+	previous := code(t, secret, time.Now().Add(-totp.DefaultOptions.Period))
+	if ok, err := s.Verify(user.ID, previous); err != nil || ok {
+		t.Errorf("code older than a used one got %v, %v", ok, err)
+	}
+
+	if ok, err := s.Verify(user.ID, ""); err != nil || ok {
+		t.Errorf("empty code got %v, %v", ok, err)
+	}
+}
+
+func TestVerifyRecoveryCodes(t *testing.T) {
+	s, user := newTestService(t)
+	_, codes := enable(t, s, user)
+
+	seen := make(map[string]bool)
+	for _, c := range codes {
+		if len(c) != 11 || c[5] != '-' || seen[c] {
+			t.Errorf("recovery code %q is not a new code like abcde-fghij", c)
+		}
+		seen[c] = true
+	}
+
+	// Codes are retyped from paper, so case, dashes and spaces do not matter
+	typed := " " + strings.ToUpper(strings.Replace(codes[0], "-", " ", 1)) + " "
+	if ok, err := s.Verify(user.ID, typed); err != nil || !ok {
+		t.Fatalf("recovery code typed as %q got %v, %v", typed, ok, err)
+	}
+
+	// Each code works once
+	if ok, err := s.Verify(user.ID, codes[0]); err != nil || ok {
+		t.Errorf("used recovery code got %v, %v", ok, err)
+	}
+	if ok, err := s.Verify(user.ID, "abcde-fghij"); err != nil || ok {
+		t.Errorf("made up recovery code got %v, %v", ok, err)
+	}
+
+	// New codes replace the old ones
+	fresh, err := s.RegenerateRecoveryCodes(context.Background(), user.ID, codes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Verify(user.ID, codes[2]); err != nil || ok {
+		t.Errorf("replaced recovery code got %v, %v", ok, err)
+	}
+	if ok, err := s.Verify(user.ID, fresh[0]); err != nil || !ok {
+		t.Errorf("new recovery code got %v, %v", ok, err)
+	}
+}
+
+func TestDisable(t *testing.T) {
+	s, user := newTestService(t)
+	_, codes := enable(t, s, user)
+
+	if err := s.Disable(context.Background(), user.ID, "abcde-fghij"); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("disabling with a wrong code got %v", err)
+	}
+	if err := s.Disable(context.Background(), user.ID, codes[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Verify(user.ID, codes[1]); !errors.Is(err, ErrNotEnabled) {
+		t.Errorf("verifying after disabling got %v", err)
+	}
+}
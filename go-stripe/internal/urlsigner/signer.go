@@ -1,40 +1,71 @@
 package urlsigner
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
 	goalone "github.com/bwmarrin/go-alone"
 )
 
+// Purposes of signed URLs
+const (
+	PurposePasswordReset = "password-reset"
+	PurposeChangePlan    = "change-plan"
+)
+
+// ChangePlanTTL is how long a link to change the plan of a subscription works for
+const ChangePlanTTL = 24 * time.Hour
+
+// ErrWrongPurpose is returned by VerifyToken for URLs signed for another purpose
+var ErrWrongPurpose = errors.New("wrong purpose for signed URL")
+
+// Signer signs URLs. Signers with a Purpose add it to the URLs they sign as the purpose
+// query parameter, and only verify URLs signed for the same purpose, so a URL signed for
+// one thing cannot be used for another.
 type Signer struct {
-	Secret []byte
+	Secret  []byte
+	Purpose string
 }
 
 func (s *Signer) GenerateTokenFromString(data string) string {
-	var urlToSign string
+	if s.Purpose != "" {
+		data = addQuery(data, "purpose="+url.QueryEscape(s.Purpose))
+	}
 
 	crypt := goalone.New(s.Secret, goalone.Timestamp)
-	if strings.Contains(data, "?") {
-		urlToSign = fmt.Sprintf("%s&hash=", data)
-	} else {
-		urlToSign = fmt.Sprintf("%s?hash=", data)
-	}
+	urlToSign := addQuery(data, "hash=")
 
 	tokenBytes := crypt.Sign([]byte(urlToSign))
 	token := string(tokenBytes)
 	return token
 }
 
-func (s *Signer) VerifyToken(token string) bool {
+// addQuery adds a parameter to the query of a URL
+func addQuery(data, param string) string {
+	if strings.Contains(data, "?") {
+		return fmt.Sprintf("%s&%s", data, param)
+	}
+	return fmt.Sprintf("%s?%s", data, param)
+}
+
+// VerifyToken returns an error unless token is a URL signed with the secret for the
+// signer's purpose
+func (s *Signer) VerifyToken(token string) error {
 	crypt := goalone.New(s.Secret, goalone.Timestamp)
 	_, err := crypt.Unsign([]byte(token))
 	if err != nil {
-		fmt.Println(err)
-		return false
+		return err
 	}
-	return true
+
+	u, err := url.Parse(token)
+	if err != nil || u.Query().Get("purpose") != s.Purpose {
+		return ErrWrongPurpose
+	}
+
+	return nil
 }
 
 func (s *Signer) Expired(token string, minutesUntilExpire int) bool {
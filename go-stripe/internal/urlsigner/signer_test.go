@@ -0,0 +1,32 @@
+package urlsigner
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerifyToken(t *testing.T) {
+	secret := []byte("x6Z2c9H5F1B8g7L9A3p7D1W8k2E6h3R9")
+	reset := Signer{Secret: secret, Purpose: PurposePasswordReset}
+
+	token := reset.GenerateTokenFromString("http://localhost:4000/reset-password?email=admin@example.com")
+	if err := reset.VerifyToken(token); err != nil {
+		t.Errorf("signed URL was not verified: %s", err)
+	}
+
+	tampered := strings.Replace(token, "admin@example.com", "other@example.com", 1)
+	if err := reset.VerifyToken(tampered); err == nil {
+		t.Error("tampered URL was verified")
+	}
+
+	changePlan := Signer{Secret: secret, Purpose: PurposeChangePlan}
+	if err := changePlan.VerifyToken(token); !errors.Is(err, ErrWrongPurpose) {
+		t.Errorf("URL signed for another purpose returned %v, want ErrWrongPurpose", err)
+	}
+
+	other := Signer{Secret: []byte("another secret"), Purpose: PurposePasswordReset}
+	if err := other.VerifyToken(token); err == nil {
+		t.Error("URL signed with another secret was verified")
+	}
+}